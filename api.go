@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/docker/distribution/reference"
+	"github.com/genuinetools/img/client"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/identity"
+	"github.com/sirupsen/logrus"
+)
+
+// Build states reported by the HTTP API.
+const (
+	apiBuildQueued    = "queued"
+	apiBuildRunning   = "running"
+	apiBuildSuccess   = "success"
+	apiBuildFailure   = "failure"
+	apiBuildCancelled = "cancelled"
+)
+
+const (
+	// maxAPIContextSize is the largest build context that can be uploaded
+	// to the HTTP and Docker Engine APIs, compressed or unpacked.
+	maxAPIContextSize = 512 << 20
+	// apiBuildRetention is how long finished builds are kept to get their
+	// status and logs, at most maxFinishedAPIBuilds of them.
+	apiBuildRetention    = 24 * time.Hour
+	maxFinishedAPIBuilds = 100
+)
+
+// apiServer serves the HTTP API for submitting builds and following their
+// progress.
+type apiServer struct {
+	ctx    context.Context
+	client *client.Client
+	// users maps the tokens to the users they authenticate.
+	users map[string]string
+	queue *buildQueue
+	// webhooks receive the lifecycle events of the builds.
+	webhooks *webhooks
+	// maxContextSize is the largest build context that can be uploaded.
+	maxContextSize int64
+
+	mu     sync.Mutex
+	builds map[string]*apiBuild
+}
+
+// apiBuildStatus is the state of a build returned by the HTTP API.
+type apiBuildStatus struct {
+	ID       string `json:"id"`
+	Tag      string `json:"tag"`
+	User     string `json:"user"`
+	Priority int    `json:"priority"`
+	Status   string `json:"status"`
+	// Position is the number of builds queued before a queued build.
+	Position *int       `json:"position,omitempty"`
+	Digest   string     `json:"digest,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// apiBuild is a build submitted through the HTTP API.
+type apiBuild struct {
+	id       string
+	user     string
+	priority int
+	opt      client.BuildOpt
+
+	mu     sync.Mutex
+	status apiBuildStatus
+	// logs holds the progress events of the build as JSON lines.
+	logs spillBuffer
+	// cancel cancels the build once it is running.
+	cancel context.CancelFunc
+}
+
+func (b *apiBuild) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.logs.Write(p)
+}
+
+// snapshot returns a copy of the build state.
+func (b *apiBuild) snapshot() apiBuildStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.status
+}
+
+// readLogs returns the logs written after offset and whether the build is
+// done.
+func (b *apiBuild) readLogs(offset int) ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	size := b.logs.Len()
+	if int64(offset) > size {
+		offset = int(size)
+	}
+	logs := make([]byte, size-int64(offset))
+	b.logs.ReadAt(logs, int64(offset))
+	return logs, b.status.Status != apiBuildQueued && b.status.Status != apiBuildRunning
+}
+
+// finish records the result of the build.
+func (b *apiBuild) finish(status, digest string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	finished := time.Now().UTC()
+	b.status.Finished = &finished
+	b.status.Status = status
+	b.status.Digest = digest
+	if err != nil {
+		b.status.Error = err.Error()
+	}
+}
+
+// release frees the logs of the build once it is evicted.
+func (b *apiBuild) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.logs.Close()
+	b.logs = spillBuffer{}
+}
+
+// newAPIServer returns the HTTP API server. users maps the tokens clients
+// authenticate with to their user names. At most maxBuilds builds run at
+// once, at most maxPerUser per user if it is positive.
+func newAPIServer(ctx context.Context, c *client.Client, users map[string]string, maxBuilds, maxPerUser int) *apiServer {
+	s := &apiServer{
+		ctx:            ctx,
+		client:         c,
+		users:          users,
+		maxContextSize: maxAPIContextSize,
+		builds:         map[string]*apiBuild{},
+	}
+	s.queue = newBuildQueue(maxBuilds, maxPerUser, s.run)
+	return s
+}
+
+// Handler returns the http handler for the API.
+func (s *apiServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/builds", s.handleBuilds)
+	mux.HandleFunc("/v1/builds/", s.handleBuild)
+	return s.authenticate(mux)
+}
+
+type apiUserKey struct{}
+
+// authenticate requires requests to pass the token of a user as a bearer
+// token, the user is added to the request context.
+func (s *apiServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		user := ""
+		for t, u := range s.users {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				user = u
+			}
+		}
+		if user == "" {
+			apiError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiUserKey{}, user)))
+	})
+}
+
+// apiUser returns the user that made the request.
+func apiUser(r *http.Request) string {
+	user, _ := r.Context().Value(apiUserKey{}).(string)
+	return user
+}
+
+// handleBuilds lists the builds or submits a new one.
+func (s *apiServer) handleBuilds(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		status := r.URL.Query().Get("status")
+		user := apiUser(r)
+		s.mu.Lock()
+		builds := make([]apiBuildStatus, 0, len(s.builds))
+		for _, b := range s.builds {
+			if b.user != user {
+				continue
+			}
+			if st := s.status(b); status == "" || st.Status == status {
+				builds = append(builds, st)
+			}
+		}
+		s.mu.Unlock()
+		sort.Slice(builds, func(i, j int) bool { return builds[i].Created.Before(builds[j].Created) })
+		apiJSON(w, http.StatusOK, builds)
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxContextSize)
+		b, err := s.submit(r)
+		if err != nil {
+			apiError(w, requestErrorCode(err), err.Error())
+			return
+		}
+		apiJSON(w, http.StatusAccepted, s.status(b))
+	default:
+		apiError(w, http.StatusMethodNotAllowed, r.Method+" is not allowed")
+	}
+}
+
+// handleBuild returns the state of a build, follows its logs or cancels it.
+// Users can only see and cancel their own builds.
+func (s *apiServer) handleBuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		apiError(w, http.StatusMethodNotAllowed, r.Method+" is not allowed")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/builds/"), "/")
+	s.mu.Lock()
+	b, ok := s.builds[parts[0]]
+	s.mu.Unlock()
+	if !ok {
+		apiError(w, http.StatusNotFound, "no such build "+parts[0])
+		return
+	}
+	if b.user != apiUser(r) {
+		apiError(w, http.StatusForbidden, "build "+b.id+" was submitted by another user")
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		s.cancel(b)
+		apiJSON(w, http.StatusOK, s.status(b))
+	case len(parts) == 1:
+		apiJSON(w, http.StatusOK, s.status(b))
+	case len(parts) == 2 && parts[1] == "logs":
+		s.followLogs(w, r, b)
+	default:
+		apiError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// followLogs streams the progress events of the build until it is done. With
+// follow=0 only the events so far are returned.
+func (s *apiServer) followLogs(w http.ResponseWriter, r *http.Request, b *apiBuild) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	follow := r.URL.Query().Get("follow") != "0"
+	flusher, _ := w.(http.Flusher)
+
+	offset := 0
+	for {
+		logs, done := b.readLogs(offset)
+		offset += len(logs)
+		if _, err := w.Write(logs); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if done || !follow {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// status returns the state of a build with its position in the queue.
+func (s *apiServer) status(b *apiBuild) apiBuildStatus {
+	st := b.snapshot()
+	if st.Status == apiBuildQueued {
+		if pos := s.queue.position(b.id); pos >= 0 {
+			st.Position = &pos
+		}
+	}
+	return st
+}
+
+// cancel takes a queued build out of the queue or cancels a running one.
+func (s *apiServer) cancel(b *apiBuild) {
+	if s.queue.remove(b.id) {
+		b.finish(apiBuildCancelled, "", nil)
+		if b.opt.ContextDir != "" {
+			os.RemoveAll(b.opt.ContextDir)
+		}
+		return
+	}
+
+	b.mu.Lock()
+	cancel := b.cancel
+	b.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// submit queues a build from the request. The build context is either a
+// tar archive in the request body or the git repository
+// passed with the git parameter.
+func (s *apiServer) submit(r *http.Request) (*apiBuild, error) {
+	q := r.URL.Query()
+
+	named, err := reference.ParseNormalizedNamed(q.Get("tag"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing image name %q failed: %v", q.Get("tag"), err)
+	}
+	tag := reference.TagNameOnly(named).String()
+
+	push := false
+	if p := q.Get("push"); p != "" {
+		if push, err = strconv.ParseBool(p); err != nil {
+			return nil, fmt.Errorf("parsing push %q failed: %v", p, err)
+		}
+	}
+
+	priority := 0
+	if p := q.Get("priority"); p != "" {
+		if priority, err = strconv.Atoi(p); err != nil {
+			return nil, fmt.Errorf("parsing priority %q failed: %v", p, err)
+		}
+	}
+
+	opt := client.BuildOpt{
+		Tag:        tag,
+		Dockerfile: q.Get("dockerfile"),
+		Target:     q.Get("target"),
+		BuildArgs:  map[string]string{},
+		Ref:        identity.NewID(),
+		Push:       push,
+	}
+	for _, buildArg := range q["build-arg"] {
+		kv := strings.SplitN(buildArg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid build-arg value %s", buildArg)
+		}
+		opt.BuildArgs[kv[0]] = kv[1]
+	}
+
+	// Unpack the uploaded context unless building from git.
+	if git := q.Get("git"); git != "" {
+		opt.FrontendAttrs = map[string]string{"context": git}
+	} else {
+		opt.ContextDir, err = ioutil.TempDir("", "img-api-context-")
+		if err != nil {
+			return nil, fmt.Errorf("creating context directory failed: %v", err)
+		}
+		if err := untar(opt.ContextDir, r.Body, s.maxContextSize); err != nil {
+			os.RemoveAll(opt.ContextDir)
+			return nil, fmt.Errorf("unpacking context failed, it must be a tar archive: %v", err)
+		}
+	}
+
+	b := &apiBuild{
+		id:       opt.Ref,
+		user:     apiUser(r),
+		priority: priority,
+		opt:      opt,
+		status: apiBuildStatus{
+			ID:       opt.Ref,
+			Tag:      tag,
+			User:     apiUser(r),
+			Priority: priority,
+			Status:   apiBuildQueued,
+			Created:  time.Now().UTC(),
+		},
+	}
+	s.evict(time.Now())
+	s.mu.Lock()
+	s.builds[b.id] = b
+	s.mu.Unlock()
+	s.queue.push(b)
+
+	return b, nil
+}
+
+// evict forgets the builds that finished more than apiBuildRetention ago,
+// and the oldest finished builds past maxFinishedAPIBuilds.
+func (s *apiServer) evict(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type finishedBuild struct {
+		b        *apiBuild
+		finished time.Time
+	}
+	var finished []finishedBuild
+	for _, b := range s.builds {
+		if st := b.snapshot(); st.Finished != nil {
+			finished = append(finished, finishedBuild{b, *st.Finished})
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].finished.After(finished[j].finished) })
+
+	for i, f := range finished {
+		if i < maxFinishedAPIBuilds && now.Sub(f.finished) < apiBuildRetention {
+			continue
+		}
+		delete(s.builds, f.b.id)
+		f.b.release()
+	}
+}
+
+// run runs a build taken from the queue.
+func (s *apiServer) run(b *apiBuild) {
+	if b.opt.ContextDir != "" {
+		defer os.RemoveAll(b.opt.ContextDir)
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	b.mu.Lock()
+	started := time.Now().UTC()
+	b.status.Started = &started
+	b.status.Status = apiBuildRunning
+	b.cancel = cancel
+	b.mu.Unlock()
+
+	done := s.webhooks.build("http", b.id, b.status.Tag, b.opt.Push)
+	resp, err := s.build(ctx, b.opt, b)
+	var digest string
+	if resp != nil {
+		digest = resp.ExporterResponse["containerimage.digest"]
+	}
+	done(digest, err)
+	switch {
+	case err != nil && ctx.Err() == context.Canceled && s.ctx.Err() == nil:
+		b.finish(apiBuildCancelled, "", nil)
+	case err != nil:
+		logrus.WithField("build", b.id).Warnf("build of %s failed: %v", b.status.Tag, err)
+		b.finish(apiBuildFailure, "", err)
+	default:
+		b.finish(apiBuildSuccess, digest, nil)
+	}
+	s.evict(time.Now())
+}
+
+// build runs a build, writing the progress events to logs.
+func (s *apiServer) build(ctx context.Context, opt client.BuildOpt, logs io.Writer) (*controlapi.SolveResponse, error) {
+	ch := make(chan *controlapi.StatusResponse)
+	statusCh := watchStatus(ch, countSteps(), newProgressEventWriter(logs).watch)
+	done := make(chan struct{})
+	go func() {
+		discardProgress(statusCh)
+		close(done)
+	}()
+
+	resp, err := s.client.Build(namespaces.WithNamespace(ctx, "buildkit"), opt, ch)
+	<-done
+	return resp, err
+}
+
+// requestErrorCode returns the status code for an error reading a request:
+// 413 when the body was larger than the http.MaxBytesReader it was read
+// from allows or unpacked to more than untar allows, 400 otherwise.
+func requestErrorCode(err error) int {
+	if strings.Contains(err.Error(), "request body too large") || strings.Contains(err.Error(), errArchiveTooLarge.Error()) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func apiJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Debugf("writing API response failed: %v", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, code int, msg string) {
+	apiJSON(w, code, map[string]string{"message": msg})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAPIServer returns an HTTP build API for the users jess and
+// genuinetools, without a client to run builds.
+func testAPIServer() *apiServer {
+	return newAPIServer(context.Background(), nil, map[string]string{
+		"jesstoken": "jess",
+		"gttoken":   "genuinetools",
+	}, 1, 0)
+}
+
+// addAPIBuild records a finished build of the user, as if it was submitted
+// to the API.
+func addAPIBuild(s *apiServer, id, user string) *apiBuild {
+	b := &apiBuild{
+		id:   id,
+		user: user,
+		status: apiBuildStatus{
+			ID:      id,
+			Tag:     "docker.io/library/" + id + ":latest",
+			User:    user,
+			Status:  apiBuildSuccess,
+			Created: time.Now().UTC(),
+		},
+	}
+	b.Write([]byte(`{"id":"` + id + `"}` + "\n"))
+	s.mu.Lock()
+	s.builds[id] = b
+	s.mu.Unlock()
+	return b
+}
+
+// apiRequest makes a request to the API with the token, decoding the JSON
+// response into v. It returns the status code.
+func apiRequest(t *testing.T, s *apiServer, method, url, token string, body io.Reader, v interface{}) int {
+	req := httptest.NewRequest(method, url, body)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	if v != nil && w.Code < 300 {
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatalf("decoding the response of %s %s failed: %v", method, url, err)
+		}
+	}
+	return w.Code
+}
+
+func TestAPIAuthenticate(t *testing.T) {
+	s := testAPIServer()
+
+	for _, token := range []string{"", "wrong"} {
+		if code := apiRequest(t, s, http.MethodGet, "/v1/builds", token, nil, nil); code != http.StatusUnauthorized {
+			t.Fatalf("expected status %d with token %q, got %d", http.StatusUnauthorized, token, code)
+		}
+	}
+
+	var builds []apiBuildStatus
+	if code := apiRequest(t, s, http.MethodGet, "/v1/builds", "jesstoken", nil, &builds); code != http.StatusOK {
+		t.Fatalf("expected status %d with a valid token, got %d", http.StatusOK, code)
+	}
+	if len(builds) != 0 {
+		t.Fatalf("expected no builds, got: %#v", builds)
+	}
+}
+
+func TestAPIBuildsOfUsers(t *testing.T) {
+	s := testAPIServer()
+	addAPIBuild(s, "jessbuild", "jess")
+	addAPIBuild(s, "gtbuild", "genuinetools")
+
+	var builds []apiBuildStatus
+	apiRequest(t, s, http.MethodGet, "/v1/builds", "jesstoken", nil, &builds)
+	if len(builds) != 1 || builds[0].ID != "jessbuild" {
+		t.Fatalf("expected jess to only see her build, got: %#v", builds)
+	}
+
+	var b apiBuildStatus
+	if code := apiRequest(t, s, http.MethodGet, "/v1/builds/jessbuild", "jesstoken", nil, &b); code != http.StatusOK || b.Status != apiBuildSuccess {
+		t.Fatalf("expected the build with status %d, got %d: %#v", http.StatusOK, code, b)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/builds/jessbuild/logs?follow=0", nil)
+	req.Header.Set("Authorization", "Bearer jesstoken")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	if w.Body.String() != `{"id":"jessbuild"}`+"\n" {
+		t.Fatalf("expected the logs of the build, got: %q", w.Body.String())
+	}
+
+	tests := []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{http.MethodGet, "/v1/builds/gtbuild", http.StatusForbidden},
+		{http.MethodDelete, "/v1/builds/gtbuild", http.StatusForbidden},
+		{http.MethodGet, "/v1/builds/gtbuild/logs", http.StatusForbidden},
+		{http.MethodGet, "/v1/builds/nope", http.StatusNotFound},
+		{http.MethodPut, "/v1/builds/jessbuild", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if code := apiRequest(t, s, tt.method, tt.url, "jesstoken", nil, nil); code != tt.code {
+			t.Fatalf("expected status %d for %s %s, got %d", tt.code, tt.method, tt.url, code)
+		}
+	}
+}
+
+func TestAPISubmitErrors(t *testing.T) {
+	s := testAPIServer()
+
+	tests := []struct {
+		url      string
+		body     string
+		expected string
+	}{
+		{"/v1/builds?tag=Invalid:Tag", "", "parsing image name"},
+		{"/v1/builds?tag=x&push=maybe", "", "parsing push"},
+		{"/v1/builds?tag=x&priority=high", "", "parsing priority"},
+		{"/v1/builds?tag=x&build-arg=NOVALUE", "", "invalid build-arg value"},
+		{"/v1/builds?tag=x", "not a tar archive", "unpacking context failed"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.url, strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer jesstoken")
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.expected) {
+			t.Fatalf("expected status %d and %q for %s, got %d: %s", http.StatusBadRequest, tt.expected, tt.url, w.Code, w.Body.String())
+		}
+	}
+
+	if len(s.builds) != 0 {
+		t.Fatalf("expected no builds to be queued, got %d", len(s.builds))
+	}
+}
+
+func TestAPISubmitTooLarge(t *testing.T) {
+	s := testAPIServer()
+	s.maxContextSize = 1024
+
+	// The context compresses to less than the limit, but unpacks to more.
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	dt := make([]byte, 4096)
+	if err := tw.WriteHeader(&tar.Header{Name: "zeros", Mode: 0644, Size: int64(len(dt)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(dt); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() >= 1024 {
+		t.Fatalf("expected the context to compress to less than the limit, got %d bytes", buf.Len())
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/builds?tag=x", &buf)
+	req.Header.Set("Authorization", "Bearer jesstoken")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "archive is too large, it unpacks to more than 1KiB") {
+		t.Fatalf("expected status %d for a context that unpacks to more than the limit, got %d: %s", http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+	}
+}
+
+func TestAPIEvict(t *testing.T) {
+	s := testAPIServer()
+	now := time.Now()
+
+	finish := func(b *apiBuild, ago time.Duration) {
+		finished := now.Add(-ago)
+		b.status.Finished = &finished
+	}
+	old := addAPIBuild(s, "old", "jess")
+	finish(old, apiBuildRetention+time.Minute)
+	// Running builds are kept, however long ago they were submitted.
+	running := addAPIBuild(s, "running", "jess")
+	running.status.Status = apiBuildRunning
+	for i := 0; i < maxFinishedAPIBuilds; i++ {
+		finish(addAPIBuild(s, fmt.Sprintf("build%d", i), "jess"), time.Duration(i+1)*time.Minute)
+	}
+
+	s.evict(now)
+	if _, ok := s.builds["old"]; ok {
+		t.Fatal("expected the build that finished before the retention to be evicted")
+	}
+	if old.logs.Len() != 0 {
+		t.Fatalf("expected the logs of the evicted build to be released, got %d bytes", old.logs.Len())
+	}
+	if len(s.builds) != maxFinishedAPIBuilds+1 {
+		t.Fatalf("expected %d builds to be kept, got %d", maxFinishedAPIBuilds+1, len(s.builds))
+	}
+
+	// Past the maximum the oldest finished builds are evicted.
+	finish(addAPIBuild(s, "new", "jess"), 0)
+	s.evict(now)
+	if _, ok := s.builds[fmt.Sprintf("build%d", maxFinishedAPIBuilds-1)]; ok {
+		t.Fatal("expected the oldest finished build to be evicted")
+	}
+	for _, id := range []string{"new", "running", "build0"} {
+		if _, ok := s.builds[id]; !ok {
+			t.Fatalf("expected build %s to be kept", id)
+		}
+	}
+}
+
+func TestRequestErrorCode(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := http.MaxBytesReader(w, ioutil.NopCloser(strings.NewReader("0123456789")), 4)
+	_, err := ioutil.ReadAll(r)
+	if code := requestErrorCode(err); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status %d for a body that is too large, got %d", http.StatusRequestEntityTooLarge, code)
+	}
+	if code := requestErrorCode(fmt.Errorf("unpacking context failed: %v", errArchiveTooLarge)); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status %d for a context that unpacks to too much, got %d", http.StatusRequestEntityTooLarge, code)
+	}
+	if code := requestErrorCode(io.ErrUnexpectedEOF); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for other errors, got %d", http.StatusBadRequest, code)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync"
+)
+
+// buildQueue schedules the builds submitted through the HTTP API. At most
+// maxBuilds run at once and at most maxPerUser of them for the same user.
+// The next build is the queued one with the highest priority, ties go to the
+// user with the fewest running builds, then to the user with the fewest
+// builds started so far and then to the oldest build, so one user submitting
+// many builds does not starve the others.
+type buildQueue struct {
+	maxBuilds  int
+	maxPerUser int
+	run        func(*apiBuild)
+
+	mu      sync.Mutex
+	queued  []*apiBuild
+	running map[string]int
+	started map[string]int
+	total   int
+}
+
+func newBuildQueue(maxBuilds, maxPerUser int, run func(*apiBuild)) *buildQueue {
+	if maxBuilds < 1 {
+		maxBuilds = 1
+	}
+	return &buildQueue{
+		maxBuilds:  maxBuilds,
+		maxPerUser: maxPerUser,
+		run:        run,
+		running:    map[string]int{},
+		started:    map[string]int{},
+	}
+}
+
+// push queues a build and starts it if there is room.
+func (q *buildQueue) push(b *apiBuild) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.queued = append(q.queued, b)
+	q.schedule()
+}
+
+// remove takes a build that has not started yet out of the queue. It returns
+// false if the build is not queued.
+func (q *buildQueue) remove(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, b := range q.queued {
+		if b.id == id {
+			q.queued = append(q.queued[:i], q.queued[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// position returns the number of queued builds that start before the build
+// unless their users are busy, or -1 if it is not queued.
+func (q *buildQueue) position(id string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, b := range q.queued {
+		if b.id != id {
+			continue
+		}
+		pos := 0
+		for j, o := range q.queued {
+			if o.priority > b.priority || o.priority == b.priority && j < i {
+				pos++
+			}
+		}
+		return pos
+	}
+	return -1
+}
+
+// schedule starts queued builds while there is room, q.mu must be held.
+func (q *buildQueue) schedule() {
+	for q.total < q.maxBuilds {
+		i := q.next()
+		if i < 0 {
+			return
+		}
+		b := q.queued[i]
+		q.queued = append(q.queued[:i], q.queued[i+1:]...)
+		q.running[b.user]++
+		q.started[b.user]++
+		q.total++
+
+		go func() {
+			q.run(b)
+
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.running[b.user]--
+			q.total--
+			q.schedule()
+		}()
+	}
+}
+
+// next returns the index of the queued build to start next, or -1 if none of
+// them can start.
+func (q *buildQueue) next() int {
+	best := -1
+	for i, b := range q.queued {
+		if q.maxPerUser > 0 && q.running[b.user] >= q.maxPerUser {
+			continue
+		}
+		if best < 0 {
+			best = i
+			continue
+		}
+		if q.before(b, q.queued[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// before reports whether build a should start before build b, which was
+// submitted earlier.
+func (q *buildQueue) before(a, b *apiBuild) bool {
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	if q.running[a.user] != q.running[b.user] {
+		return q.running[a.user] < q.running[b.user]
+	}
+	return q.started[a.user] < q.started[b.user]
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/docker/distribution/reference"
+	"github.com/genuinetools/img/client"
+	"github.com/genuinetools/img/internal/yaml"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+const assembleShortHelp = `Assemble an image from apk packages declared in a YAML file.`
+
+var assembleLongHelp = assembleShortHelp + `
+Builds a minimal single layer image from the packages, accounts and
+configuration in an apko style YAML file, without a Dockerfile or RUN steps.
+
+  $ img assemble -t r.j3ss.co/base image.yaml`
+
+// defaultAssembleToolImage is the image apk runs in to install the packages
+// in the root filesystem of the image.
+const defaultAssembleToolImage = "docker.io/library/alpine:3.20"
+
+func (cmd *assembleCommand) Name() string       { return "assemble" }
+func (cmd *assembleCommand) Args() string       { return "[OPTIONS] FILE" }
+func (cmd *assembleCommand) ShortHelp() string  { return assembleShortHelp }
+func (cmd *assembleCommand) LongHelp() string   { return assembleLongHelp }
+func (cmd *assembleCommand) Hidden() bool       { return false }
+func (cmd *assembleCommand) DoReexec() bool     { return true }
+func (cmd *assembleCommand) RequiresRunc() bool { return true }
+
+func (cmd *assembleCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.tag, "t", "", "Name and optionally a tag in the 'name:tag' format")
+	fs.BoolVar(&cmd.push, "push", false, "Push the image to its registry once it is built")
+	fs.StringVar(&cmd.toolImage, "tool-image", defaultAssembleToolImage, "Image with apk to install the packages with, pin it by digest for reproducible images")
+}
+
+type assembleCommand struct {
+	tag       string
+	push      bool
+	toolImage string
+}
+
+// assembleSpec is the YAML file describing an image, a subset of the apko
+// configuration.
+type assembleSpec struct {
+	Contents struct {
+		Keyring      []string `json:"keyring"`
+		Repositories []string `json:"repositories"`
+		Packages     []string `json:"packages"`
+	} `json:"contents"`
+	Entrypoint struct {
+		Command string `json:"command"`
+	} `json:"entrypoint"`
+	Cmd         string            `json:"cmd"`
+	WorkDir     string            `json:"work-dir"`
+	Environment map[string]string `json:"environment"`
+	Accounts    struct {
+		Groups []struct {
+			GroupName string `json:"groupname"`
+			GID       string `json:"gid"`
+		} `json:"groups"`
+		Users []struct {
+			UserName string `json:"username"`
+			UID      string `json:"uid"`
+			GID      string `json:"gid"`
+			HomeDir  string `json:"homedir"`
+			Shell    string `json:"shell"`
+		} `json:"users"`
+		RunAs string `json:"run-as"`
+	} `json:"accounts"`
+	Annotations map[string]string `json:"annotations"`
+	Archs       []string          `json:"archs"`
+}
+
+// apkArchs maps the Go architectures to the apk ones.
+var apkArchs = map[string]string{
+	"amd64":   "x86_64",
+	"arm64":   "aarch64",
+	"arm":     "armv7",
+	"386":     "x86",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+	"riscv64": "riscv64",
+}
+
+func (cmd *assembleCommand) Run(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("must pass a YAML file to assemble")
+	}
+	if cmd.tag == "" {
+		return errors.New("please specify an image tag with `-t`")
+	}
+	named, err := reference.ParseNormalizedNamed(cmd.tag)
+	if err != nil {
+		return fmt.Errorf("parsing image name %q failed: %v", cmd.tag, err)
+	}
+	cmd.tag = reference.TagNameOnly(named).String()
+
+	spec, err := readAssembleSpec(args[0])
+	if err != nil {
+		return err
+	}
+
+	epoch, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	config, err := spec.imageConfig(epoch)
+	if err != nil {
+		return err
+	}
+	def, err := spec.definition(cmd.toolImage, epoch)
+	if err != nil {
+		return err
+	}
+
+	c, err := client.New(stateDir, backend, stateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	logrus.Infof("Assembling %s", cmd.tag)
+
+	exporterAttrs := map[string]string{
+		"name":                  cmd.tag,
+		"containerimage.config": string(config),
+	}
+	if cmd.push {
+		exporterAttrs["push"] = "true"
+	}
+
+	ctx := namespaces.WithNamespace(appcontext.Context(), "buildkit")
+	var resp *controlapi.SolveResponse
+	err = c.WithSession(ctx, nil, func(ctx context.Context, sessionID string) error {
+		eg, ctx := errgroup.WithContext(ctx)
+		ch := make(chan *controlapi.StatusResponse)
+		eg.Go(func() error {
+			var err error
+			resp, err = c.Solve(ctx, &controlapi.SolveRequest{
+				Ref:           identity.NewID(),
+				Session:       sessionID,
+				Definition:    def,
+				Exporter:      "image",
+				ExporterAttrs: exporterAttrs,
+			}, ch)
+			return err
+		})
+		eg.Go(func() error {
+			return showProgress(ch, progressAuto)
+		})
+		return eg.Wait()
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully assembled %s %s\n", cmd.tag, resp.ExporterResponse["containerimage.digest"])
+	return nil
+}
+
+func readAssembleSpec(file string) (*assembleSpec, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s failed: %v", file, err)
+	}
+	v, err := yaml.Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s failed: %v", file, err)
+	}
+	// The parsed values are plain strings, maps and lists, so they decode
+	// into the spec through JSON.
+	b, err = json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var spec assembleSpec
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return nil, fmt.Errorf("parsing %s failed: %v", file, err)
+	}
+
+	if len(spec.Contents.Packages) == 0 {
+		return nil, fmt.Errorf("%s has no contents.packages", file)
+	}
+	if len(spec.Contents.Repositories) == 0 {
+		return nil, fmt.Errorf("%s has no contents.repositories", file)
+	}
+	host := apkArchs[runtime.GOARCH]
+	for _, arch := range spec.Archs {
+		if arch != host && arch != runtime.GOARCH {
+			return nil, fmt.Errorf("assembling for %s is not supported, only for the architecture of the host %s", arch, host)
+		}
+	}
+	for _, u := range spec.Accounts.Users {
+		if u.UserName == "" || u.UID == "" {
+			return nil, fmt.Errorf("%s: users need a username and a uid", file)
+		}
+	}
+	for _, g := range spec.Accounts.Groups {
+		if g.GroupName == "" || g.GID == "" {
+			return nil, fmt.Errorf("%s: groups need a groupname and a gid", file)
+		}
+	}
+	return &spec, nil
+}
+
+// definition returns the LLB installing the packages and creating the
+// accounts in an empty root filesystem with apk from the tool image. Every
+// file gets the epoch as modification time so the layer is reproducible.
+func (spec *assembleSpec) definition(toolImage string, epoch time.Time) (*pb.Definition, error) {
+	run := []llb.RunOption{
+		llb.AddEnv("PATH", "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"),
+		llb.Args([]string{"/bin/sh", "-ec", spec.script(epoch)}),
+	}
+	for i, key := range spec.Contents.Keyring {
+		run = append(run, llb.AddMount(fmt.Sprintf("/keyring/%d", i), llb.HTTP(key, llb.Filename(path.Base(key))), llb.Readonly))
+	}
+	st := llb.Image(toolImage).Run(run...).AddMount("/out", llb.Scratch())
+
+	def, err := st.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("marshaling llb failed: %v", err)
+	}
+	return def.ToPB(), nil
+}
+
+// script returns the shell script run in the tool image.
+func (spec *assembleSpec) script(epoch time.Time) string {
+	var s []string
+	s = append(s, "mkdir -p /out/etc/apk/keys")
+	if len(spec.Contents.Keyring) > 0 {
+		s = append(s, "cp /keyring/*/* /out/etc/apk/keys/")
+	} else {
+		s = append(s, "cp /etc/apk/keys/* /out/etc/apk/keys/")
+	}
+
+	apk := []string{"apk", "add", "--root", "/out", "--initdb", "--no-cache", "--no-scripts", "--repositories-file", "/dev/null"}
+	for _, repo := range spec.Contents.Repositories {
+		apk = append(apk, "-X", shellQuote(repo))
+	}
+	for _, pkg := range spec.Contents.Packages {
+		apk = append(apk, shellQuote(pkg))
+	}
+	s = append(s, strings.Join(apk, " "))
+
+	for _, g := range spec.Accounts.Groups {
+		s = append(s, fmt.Sprintf("echo %s >> /out/etc/group", shellQuote(g.GroupName+":x:"+g.GID+":")))
+	}
+	for _, u := range spec.Accounts.Users {
+		gid, home, shell := u.GID, u.HomeDir, u.Shell
+		if gid == "" {
+			gid = u.UID
+		}
+		if home == "" {
+			home = "/home/" + u.UserName
+		}
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+		s = append(s,
+			fmt.Sprintf("echo %s >> /out/etc/passwd", shellQuote(strings.Join([]string{u.UserName, "x", u.UID, gid, u.UserName, home, shell}, ":"))),
+			fmt.Sprintf("mkdir -p /out%s && chown %s:%s /out%s", shellQuote(home), u.UID, gid, shellQuote(home)),
+		)
+	}
+
+	s = append(s, fmt.Sprintf("find /out -exec touch -h -d @%d {} +", epoch.Unix()))
+	return strings.Join(s, "\n")
+}
+
+// imageConfig returns the OCI image config for the image.
+func (spec *assembleSpec) imageConfig(epoch time.Time) ([]byte, error) {
+	var env []string
+	for k, v := range spec.Environment {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	if _, ok := spec.Environment["PATH"]; !ok {
+		env = append([]string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}, env...)
+	}
+
+	user := spec.Accounts.RunAs
+	if _, err := strconv.Atoi(user); user != "" && err != nil {
+		// Look the user up by name, so the image works without /etc/passwd
+		// lookups by the runtime.
+		for _, u := range spec.Accounts.Users {
+			if u.UserName == user {
+				user = u.UID
+			}
+		}
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"created":      epoch.UTC(),
+		"architecture": runtime.GOARCH,
+		"os":           "linux",
+		"config": map[string]interface{}{
+			"Entrypoint": strings.Fields(spec.Entrypoint.Command),
+			"Cmd":        strings.Fields(spec.Cmd),
+			"Env":        env,
+			"WorkingDir": spec.WorkDir,
+			"User":       user,
+			"Labels":     spec.Annotations,
+		},
+		"history": []map[string]interface{}{{
+			"created":    epoch.UTC(),
+			"created_by": "img assemble",
+		}},
+	})
+}
+
+// sourceDateEpoch returns the time set in SOURCE_DATE_EPOCH, or the Unix
+// epoch.
+func sourceDateEpoch() (time.Time, error) {
+	v := os.Getenv("SOURCE_DATE_EPOCH")
+	if v == "" {
+		return time.Unix(0, 0), nil
+	}
+	return parseSourceDateEpoch(v)
+}
+
+// parseSourceDateEpoch parses a time in the format of SOURCE_DATE_EPOCH, the
+// seconds since the Unix epoch.
+func parseSourceDateEpoch(v string) (time.Time, error) {
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing timestamp %q failed: %v", v, err)
+	}
+	return time.Unix(sec, 0), nil
+}
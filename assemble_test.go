@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAssembleSpec = `contents:
+  repositories:
+    - https://dl-cdn.alpinelinux.org/alpine/v3.20/main
+  packages:
+    - ca-certificates-bundle
+    - busybox
+entrypoint:
+  command: /bin/sh -l
+work-dir: /app
+environment:
+  MODE: test
+accounts:
+  groups:
+    - groupname: app
+      gid: 1000
+  users:
+    - username: app
+      uid: 1000
+  run-as: app
+annotations:
+  org.opencontainers.image.title: assembletest
+`
+
+func TestAssembleSpec(t *testing.T) {
+	dir := withFiles(t, map[string]string{"image.yaml": testAssembleSpec})
+	defer os.RemoveAll(dir)
+
+	spec, err := readAssembleSpec(filepath.Join(dir, "image.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dt, err := spec.imageConfig(time.Unix(10, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config struct {
+		Created time.Time `json:"created"`
+		Config  struct {
+			Entrypoint []string
+			Env        []string
+			WorkingDir string
+			User       string
+			Labels     map[string]string
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(dt, &config); err != nil {
+		t.Fatal(err)
+	}
+	if !config.Created.Equal(time.Unix(10, 0)) {
+		t.Fatalf("expected the epoch as creation time, got %s", config.Created)
+	}
+	if !reflect.DeepEqual(config.Config.Entrypoint, []string{"/bin/sh", "-l"}) {
+		t.Fatalf("expected the entrypoint, got %v", config.Config.Entrypoint)
+	}
+	if len(config.Config.Env) != 2 || !strings.HasPrefix(config.Config.Env[0], "PATH=") || config.Config.Env[1] != "MODE=test" {
+		t.Fatalf("expected the default PATH and the environment, got %v", config.Config.Env)
+	}
+	// The user is looked up by name.
+	if config.Config.User != "1000" || config.Config.WorkingDir != "/app" {
+		t.Fatalf("expected the uid of the user and the work dir, got %q and %q", config.Config.User, config.Config.WorkingDir)
+	}
+	if config.Config.Labels["org.opencontainers.image.title"] != "assembletest" {
+		t.Fatalf("expected the annotations as labels, got %v", config.Config.Labels)
+	}
+
+	script := spec.script(time.Unix(10, 0))
+	for _, expected := range []string{
+		"apk add --root /out --initdb --no-cache --no-scripts --repositories-file /dev/null -X 'https://dl-cdn.alpinelinux.org/alpine/v3.20/main' 'ca-certificates-bundle' 'busybox'",
+		"echo 'app:x:1000:' >> /out/etc/group",
+		"echo 'app:x:1000:1000:app:/home/app:/bin/sh' >> /out/etc/passwd",
+		"find /out -exec touch -h -d @10 {} +",
+	} {
+		if !strings.Contains(script, expected) {
+			t.Fatalf("expected %q in the script, got:\n%s", expected, script)
+		}
+	}
+
+	if _, err := spec.definition(defaultAssembleToolImage, time.Unix(10, 0)); err != nil {
+		t.Fatalf("creating the definition failed: %v", err)
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	dir := withFiles(t, map[string]string{
+		"nopackages.yaml": "contents:\n  repositories:\n    - https://dl-cdn.alpinelinux.org/alpine/v3.20/main\n",
+		"norepos.yaml":    "contents:\n  packages: [busybox]\n",
+		"arch.yaml":       "contents:\n  repositories: [https://dl-cdn.alpinelinux.org/alpine/v3.20/main]\n  packages: [busybox]\narchs: [mips]\n",
+		"user.yaml":       "contents:\n  repositories: [https://dl-cdn.alpinelinux.org/alpine/v3.20/main]\n  packages: [busybox]\naccounts:\n  users:\n    - username: app\n",
+	})
+	defer os.RemoveAll(dir)
+
+	tests := map[string]string{
+		"nopackages.yaml": "has no contents.packages",
+		"norepos.yaml":    "has no contents.repositories",
+		"arch.yaml":       "assembling for mips is not supported",
+		"user.yaml":       "users need a username and a uid",
+		"missing.yaml":    "reading",
+	}
+	for file, expected := range tests {
+		if _, err := readAssembleSpec(filepath.Join(dir, file)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected %q reading %s, got: %v", expected, file, err)
+		}
+	}
+
+	if err := (&assembleCommand{}).Run([]string{filepath.Join(dir, "user.yaml")}); err == nil || !strings.Contains(err.Error(), "please specify an image tag") {
+		t.Fatalf("expected a missing tag error, got: %v", err)
+	}
+	if err := (&assembleCommand{tag: "assembletest"}).Run(nil); err == nil || !strings.Contains(err.Error(), "must pass a YAML file to assemble") {
+		t.Fatalf("expected a missing file error, got: %v", err)
+	}
+}
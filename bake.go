@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/genuinetools/img/client"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+const bakeShortHelp = `Build the targets of a bake file.`
+
+var bakeLongHelp = bakeShortHelp + `
+Reads the targets and groups of buildx bake files in the HCL or JSON format
+(docker-bake.hcl or docker-bake.json by default) and builds the named targets,
+or the default group, concurrently with a shared cache.
+
+  $ img bake
+  $ img bake -f docker-bake.hcl app db
+  $ img bake -set '*.args.VERSION=1.2' -print release`
+
+func (cmd *bakeCommand) Name() string       { return "bake" }
+func (cmd *bakeCommand) Args() string       { return "[OPTIONS] [TARGET...]" }
+func (cmd *bakeCommand) ShortHelp() string  { return bakeShortHelp }
+func (cmd *bakeCommand) LongHelp() string   { return bakeLongHelp }
+func (cmd *bakeCommand) Hidden() bool       { return false }
+func (cmd *bakeCommand) DoReexec() bool     { return true }
+func (cmd *bakeCommand) RequiresRunc() bool { return true }
+
+func (cmd *bakeCommand) Register(fs *flag.FlagSet) {
+	fs.Var(&cmd.files, "f", "Bake file, can be repeated to override targets (default is docker-bake.json and docker-bake.hcl and their .override files)")
+	fs.BoolVar(&cmd.push, "push", false, "Push every tag of the targets once they are built")
+	fs.BoolVar(&cmd.noCache, "no-cache", false, "Do not use the cache for any target")
+	fs.BoolVar(&cmd.proxyEnv, "proxy-env", true, "Pass the HTTP_PROXY, HTTPS_PROXY, FTP_PROXY and NO_PROXY variables of the environment to the RUN steps, without them being part of the cache key or the images")
+	fs.Var(&cmd.sets, "set", "Override an attribute of the targets matching the pattern, as TARGET.KEY=VALUE, e.g. *.args.VERSION=1.2 or app.tags=app:dev, can be repeated")
+	fs.BoolVar(&cmd.print, "print", false, "Print the resolved targets as JSON without building them")
+}
+
+type bakeCommand struct {
+	files    stringSlice
+	sets     stringSlice
+	push     bool
+	noCache  bool
+	proxyEnv bool
+	print    bool
+}
+
+func (cmd *bakeCommand) Run(args []string) error {
+	bf, err := loadBakeFiles(cmd.files)
+	if err != nil {
+		return err
+	}
+	targets, err := bf.resolve(args)
+	if err != nil {
+		return err
+	}
+	if err := applyBakeOverrides(targets, cmd.sets); err != nil {
+		return err
+	}
+
+	if cmd.print {
+		out := map[string]map[string]bakeTarget{"target": {}}
+		for _, t := range targets {
+			out["target"][t.Name] = t
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+
+	// Only the platform of the host can be built.
+	host := platforms.DefaultSpec()
+	for _, t := range targets {
+		for _, p := range t.Platforms {
+			spec, err := platforms.Parse(p)
+			if err != nil {
+				return fmt.Errorf("target %s: %v", t.Name, err)
+			}
+			if !platforms.NewMatcher(host).Match(spec) {
+				return fmt.Errorf("target %s: building for %s is not supported, only for the platform of the host %s", t.Name, p, platforms.Format(host))
+			}
+		}
+	}
+
+	c, err := client.New(stateDir, backend, stateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	defer applyGCPolicy(c)
+
+	ctx := namespaces.WithNamespace(appcontext.Context(), "buildkit")
+	if offline {
+		for _, t := range targets {
+			opt := cmd.buildOpt(t)
+			if err := checkOfflineImages(ctx, c, filepath.Join(opt.DockerfileDir, opt.Dockerfile), t.Target, t.Args); err != nil {
+				return fmt.Errorf("target %s: %v", t.Name, err)
+			}
+		}
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+
+	chs := make([]chan *controlapi.StatusResponse, len(targets))
+	for i, t := range targets {
+		logrus.Infof("Building %s", t.Tags[0])
+		t := t
+		chs[i] = make(chan *controlapi.StatusResponse)
+		ch := chs[i]
+		eg.Go(func() error {
+			_, err := c.Build(ctx, cmd.buildOpt(t), ch)
+			if err != nil {
+				return fmt.Errorf("building target %s failed: %v", t.Name, err)
+			}
+			return nil
+		})
+	}
+	eg.Go(func() error {
+		return showProgress(mergeStatus(chs...), progressAuto)
+	})
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	// The build context is cancelled once the builds are done.
+	ctx = namespaces.WithNamespace(appcontext.Context(), "buildkit")
+	for _, t := range targets {
+		for _, tag := range t.Tags[1:] {
+			if err := c.TagImage(ctx, t.Tags[0], tag); err != nil {
+				return err
+			}
+			if cmd.push {
+				if err := pushWithSession(ctx, c, tag, false); err != nil {
+					return err
+				}
+			}
+		}
+		fmt.Printf("Successfully built %s\n", t.Tags[0])
+	}
+	return nil
+}
+
+// buildOpt returns the options to build a target with.
+func (cmd *bakeCommand) buildOpt(t bakeTarget) client.BuildOpt {
+	dockerfile := t.Dockerfile
+	if !filepath.IsAbs(dockerfile) {
+		dockerfile = filepath.Join(t.Context, dockerfile)
+	}
+
+	attrs := map[string]string{}
+	for k, v := range t.Labels {
+		attrs["label:"+k] = v
+	}
+	if cmd.proxyEnv {
+		for k, v := range proxyBuildArgs(t.Args) {
+			attrs["build-arg:"+k] = v
+		}
+	}
+	if t.NoCache || cmd.noCache {
+		attrs["no-cache"] = ""
+	} else if len(t.NoCacheFilter) > 0 {
+		attrs["no-cache"] = strings.Join(t.NoCacheFilter, ",")
+	}
+
+	return client.BuildOpt{
+		ContextDir:    t.Context,
+		DockerfileDir: filepath.Dir(dockerfile),
+		Dockerfile:    filepath.Base(dockerfile),
+		Tag:           t.Tags[0],
+		Target:        t.Target,
+		BuildArgs:     t.Args,
+		FrontendAttrs: attrs,
+		Push:          cmd.push,
+	}
+}
+
+// mergeStatus returns a channel that receives the status updates of several
+// builds, so they are displayed together. It is closed once all of the
+// channels are.
+func mergeStatus(chs ...chan *controlapi.StatusResponse) chan *controlapi.StatusResponse {
+	out := make(chan *controlapi.StatusResponse)
+	var wg sync.WaitGroup
+	wg.Add(len(chs))
+	for _, ch := range chs {
+		go func(ch chan *controlapi.StatusResponse) {
+			defer wg.Done()
+			for resp := range ch {
+				out <- resp
+			}
+		}(ch)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	controlapi "github.com/moby/buildkit/api/services/control"
+)
+
+const testBakeFile = `variable "TAG" {
+  default = "1"
+}
+
+group "default" {
+  targets = ["app", "db"]
+}
+
+target "app" {
+  context = "./app"
+  tags    = ["baketest/app:${TAG}", "baketest/app:latest"]
+  args = {
+    VERSION = "${TAG}"
+  }
+}
+
+target "db" {
+  context = "./db"
+  tags    = ["baketest/db:${TAG}"]
+}
+
+target "arm" {
+  inherits  = ["db"]
+  platforms = ["windows/arm64"]
+}
+`
+
+// withBakeFile creates a bake file with the app and db targets in a
+// temporary directory. The caller removes the directory.
+func withBakeFile(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "img-bake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := filepath.Join(dir, "docker-bake.hcl")
+	if err := ioutil.WriteFile(f, []byte(testBakeFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, f
+}
+
+func TestBakeResolve(t *testing.T) {
+	dir, f := withBakeFile(t)
+	defer os.RemoveAll(dir)
+
+	defer os.Unsetenv("TAG")
+	os.Setenv("TAG", "2")
+
+	bf, err := loadBakeFiles([]string{f})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The default group is built without targets.
+	targets, err := bf.resolve(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[0].Name != "app" || targets[1].Name != "db" {
+		t.Fatalf("expected the targets of the default group, got: %#v", targets)
+	}
+	app := targets[0]
+	if !reflect.DeepEqual(app.Tags, []string{"baketest/app:2", "baketest/app:latest"}) || app.Args["VERSION"] != "2" {
+		t.Fatalf("expected the variable to be set from the environment, got: %#v", app)
+	}
+
+	// Inherited attributes are merged with the ones of the target.
+	targets, err = bf.resolve([]string{"arm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].Context != "./db" || targets[0].Platforms[0] != "windows/arm64" {
+		t.Fatalf("expected arm to inherit from db, got: %#v", targets)
+	}
+
+	if _, err := bf.resolve([]string{"nope"}); err == nil || !strings.Contains(err.Error(), "no such target or group nope") {
+		t.Fatalf("expected an unknown target error, got: %v", err)
+	}
+}
+
+func TestBakeErrors(t *testing.T) {
+	dir, f := withBakeFile(t)
+	defer os.RemoveAll(dir)
+
+	cmd := &bakeCommand{files: stringSlice{f}}
+	if err := cmd.Run([]string{"arm"}); err == nil || !strings.Contains(err.Error(), "building for windows/arm64 is not supported, only for the platform of the host") {
+		t.Fatalf("expected an unsupported platform error, got: %v", err)
+	}
+
+	cmd = &bakeCommand{files: stringSlice{filepath.Join(dir, "missing.hcl")}}
+	if err := cmd.Run(nil); err == nil {
+		t.Fatal("expected a missing bake file to fail")
+	}
+}
+
+func TestMergeStatus(t *testing.T) {
+	a := make(chan *controlapi.StatusResponse)
+	b := make(chan *controlapi.StatusResponse)
+	out := mergeStatus(a, b)
+
+	go func() {
+		a <- &controlapi.StatusResponse{}
+		close(a)
+		b <- &controlapi.StatusResponse{}
+		b <- &controlapi.StatusResponse{}
+		close(b)
+	}()
+
+	n := 0
+	for range out {
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("expected the 3 status updates of both builds, got %d", n)
+	}
+}
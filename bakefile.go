@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/genuinetools/img/internal/hcl"
+)
+
+// defaultBakeFiles are the bake files loaded from the current directory when
+// none are given, every one of them that exists is loaded in order.
+var defaultBakeFiles = []string{"docker-bake.json", "docker-bake.override.json", "docker-bake.hcl", "docker-bake.override.hcl"}
+
+// bakeTarget is a target of a bake file.
+type bakeTarget struct {
+	Name          string            `json:"-"`
+	Context       string            `json:"context,omitempty"`
+	Dockerfile    string            `json:"dockerfile,omitempty"`
+	Target        string            `json:"target,omitempty"`
+	Tags          []string          `json:"tags,omitempty"`
+	Args          map[string]string `json:"args,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Platforms     []string          `json:"platforms,omitempty"`
+	NoCache       bool              `json:"no-cache,omitempty"`
+	NoCacheFilter []string          `json:"no-cache-filter,omitempty"`
+}
+
+// bakeFile is the merged content of the bake files, in the JSON layout.
+type bakeFile struct {
+	groups  map[string]interface{}
+	targets map[string]interface{}
+}
+
+// loadBakeFiles loads the bake files, later files override the targets of
+// earlier ones. Variables are substituted with their defaults, or their value
+// in the environment.
+func loadBakeFiles(files []string) (*bakeFile, error) {
+	if len(files) == 0 {
+		for _, f := range defaultBakeFiles {
+			if _, err := os.Stat(f); err == nil {
+				files = append(files, f)
+			}
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no bake file found, looked for %s", strings.Join(defaultBakeFiles, ", "))
+		}
+	}
+
+	doc := map[string]interface{}{}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading bake file failed: %v", err)
+		}
+		var m map[string]interface{}
+		if filepath.Ext(f) == ".json" {
+			err = json.Unmarshal(b, &m)
+		} else {
+			m, err = hcl.Parse(b)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing bake file %s failed: %v", f, err)
+		}
+		mergeComposeValues(doc, m)
+	}
+
+	env, err := bakeVariables(doc["variable"])
+	if err != nil {
+		return nil, err
+	}
+
+	bf := &bakeFile{}
+	for _, section := range []struct {
+		name string
+		dst  *map[string]interface{}
+	}{{"group", &bf.groups}, {"target", &bf.targets}} {
+		v, err := interpolateValue(doc[section.name], env)
+		if err != nil {
+			return nil, fmt.Errorf("substituting variables in %s failed: %v", section.name, err)
+		}
+		*section.dst, _ = v.(map[string]interface{})
+		if *section.dst == nil {
+			*section.dst = map[string]interface{}{}
+		}
+	}
+	return bf, nil
+}
+
+// bakeVariables returns the values of the variables of a bake file: the value
+// of the environment variable with the same name, or the default.
+func bakeVariables(v interface{}) (map[string]string, error) {
+	vars, _ := v.(map[string]interface{})
+	env := map[string]string{}
+	var names []string
+	for name, def := range vars {
+		names = append(names, name)
+		if value, ok := os.LookupEnv(name); ok {
+			env[name] = value
+			continue
+		}
+		if m, ok := def.(map[string]interface{}); ok && m["default"] != nil {
+			env[name] = bakeString(m["default"])
+		}
+	}
+
+	// Defaults may refer to other variables.
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := os.LookupEnv(name); ok {
+			continue
+		}
+		value, err := interpolate(env[name], env)
+		if err != nil {
+			return nil, fmt.Errorf("substituting variables in %s failed: %v", name, err)
+		}
+		env[name] = value
+	}
+	return env, nil
+}
+
+// resolve returns the targets named, or in the groups named, with the
+// targets they inherit from merged in. The default group or target is used
+// if no names are given.
+func (bf *bakeFile) resolve(names []string) ([]bakeTarget, error) {
+	if len(names) == 0 {
+		names = []string{"default"}
+	}
+
+	var (
+		order []string
+		seen  = map[string]bool{}
+		add   func(name string, path []string) error
+	)
+	add = func(name string, path []string) error {
+		for _, p := range path {
+			if p == name {
+				return fmt.Errorf("groups contain each other: %s", strings.Join(append(path, name), " -> "))
+			}
+		}
+		if g, ok := bf.groups[name].(map[string]interface{}); ok {
+			for _, t := range bakeStrings(g["targets"]) {
+				if err := add(t, append(path, name)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if _, ok := bf.targets[name]; !ok {
+			if name == "default" && len(path) == 0 {
+				return fmt.Errorf("no default group or target, pass the targets to build")
+			}
+			return fmt.Errorf("no such target or group %s", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			order = append(order, name)
+		}
+		return nil
+	}
+	for _, name := range names {
+		if err := add(name, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	targets := make([]bakeTarget, 0, len(order))
+	for _, name := range order {
+		m, err := bf.inherit(name, nil)
+		if err != nil {
+			return nil, err
+		}
+		t, err := decodeBakeTarget(name, m)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// inherit returns the attributes of a target merged over the ones of the
+// targets it inherits, in order.
+func (bf *bakeFile) inherit(name string, path []string) (map[string]interface{}, error) {
+	for _, p := range path {
+		if p == name {
+			return nil, fmt.Errorf("targets inherit from each other: %s", strings.Join(append(path, name), " -> "))
+		}
+	}
+	v, ok := bf.targets[name]
+	if !ok {
+		return nil, fmt.Errorf("target %s inherits from undefined target %s", path[len(path)-1], name)
+	}
+	own, _ := v.(map[string]interface{})
+
+	m := map[string]interface{}{}
+	for _, parent := range bakeStrings(own["inherits"]) {
+		pm, err := bf.inherit(parent, append(path, name))
+		if err != nil {
+			return nil, err
+		}
+		mergeComposeValues(m, pm)
+	}
+	// Copy the maps of the target so the targets inheriting it do not
+	// change them.
+	for k, v := range own {
+		if vm, ok := v.(map[string]interface{}); ok {
+			cp := map[string]interface{}{}
+			mergeComposeValues(cp, vm)
+			v = cp
+		}
+		if dm, ok := m[k].(map[string]interface{}); ok {
+			if vm, ok := v.(map[string]interface{}); ok {
+				mergeComposeValues(dm, vm)
+				continue
+			}
+		}
+		m[k] = v
+	}
+	delete(m, "inherits")
+	return m, nil
+}
+
+func decodeBakeTarget(name string, m map[string]interface{}) (bakeTarget, error) {
+	t := bakeTarget{
+		Name:          name,
+		Context:       bakeString(m["context"]),
+		Dockerfile:    bakeString(m["dockerfile"]),
+		Target:        bakeString(m["target"]),
+		Tags:          bakeStrings(m["tags"]),
+		Args:          bakeMap(m["args"]),
+		Labels:        bakeMap(m["labels"]),
+		Platforms:     bakeStrings(m["platforms"]),
+		NoCache:       bakeString(m["no-cache"]) == "true",
+		NoCacheFilter: bakeStrings(m["no-cache-filter"]),
+	}
+	if t.Context == "" {
+		t.Context = "."
+	}
+	if t.Dockerfile == "" {
+		t.Dockerfile = defaultDockerfileName
+	}
+	if len(t.Tags) == 0 {
+		return t, fmt.Errorf("target %s has no tags", name)
+	}
+	return t, nil
+}
+
+// applyBakeOverrides applies -set overrides in the TARGET.KEY=VALUE format of
+// buildx to the targets matching the TARGET pattern, where * matches every
+// target. The first override of a list replaces it, the next ones append to
+// it.
+func applyBakeOverrides(targets []bakeTarget, overrides []string) error {
+	set := map[string]bool{}
+	for _, o := range overrides {
+		kv := strings.SplitN(o, "=", 2)
+		keys := strings.SplitN(kv[0], ".", 3)
+		if len(kv) != 2 || len(keys) < 2 {
+			return fmt.Errorf("invalid set value %s, must be TARGET.KEY=VALUE", o)
+		}
+		value := kv[1]
+		matched := false
+		for i := range targets {
+			t := &targets[i]
+			ok, err := path.Match(keys[0], t.Name)
+			if err != nil {
+				return fmt.Errorf("invalid set value %s: %v", o, err)
+			}
+			if !ok {
+				continue
+			}
+			matched = true
+
+			// appendTo returns the list to add the value to.
+			appendTo := func(l []string) []string {
+				if !set[t.Name+"."+keys[1]] {
+					l = nil
+				}
+				return append(l, value)
+			}
+			switch key := strings.Join(keys[1:], "."); {
+			case len(keys) == 3 && (keys[1] == "args" || keys[1] == "labels"):
+				m := &t.Args
+				if keys[1] == "labels" {
+					m = &t.Labels
+				}
+				if *m == nil {
+					*m = map[string]string{}
+				}
+				(*m)[keys[2]] = value
+			case key == "context":
+				t.Context = value
+			case key == "dockerfile":
+				t.Dockerfile = value
+			case key == "target":
+				t.Target = value
+			case key == "tags":
+				t.Tags = appendTo(t.Tags)
+			case key == "platform":
+				t.Platforms = appendTo(t.Platforms)
+			case key == "no-cache":
+				t.NoCache = value == "true"
+			case key == "no-cache-filter":
+				t.NoCacheFilter = appendTo(t.NoCacheFilter)
+			default:
+				return fmt.Errorf("invalid set value %s: %s cannot be set", o, key)
+			}
+			set[t.Name+"."+keys[1]] = true
+		}
+		if !matched {
+			return fmt.Errorf("invalid set value %s: no target matches %s", o, keys[0])
+		}
+	}
+	return nil
+}
+
+// bakeString returns a string, bool or number attribute as a string.
+func bakeString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+// bakeStrings returns a list attribute as strings.
+func bakeStrings(v interface{}) []string {
+	l, _ := v.([]interface{})
+	s := make([]string, 0, len(l))
+	for _, item := range l {
+		s = append(s, bakeString(item))
+	}
+	if len(s) == 0 {
+		return nil
+	}
+	return s
+}
+
+// bakeMap returns a map attribute as strings, null values are left out.
+func bakeMap(v interface{}) map[string]string {
+	m, _ := v.(map[string]interface{})
+	if len(m) == 0 {
+		return nil
+	}
+	s := make(map[string]string, len(m))
+	for k, item := range m {
+		if item != nil {
+			s[k] = bakeString(item)
+		}
+	}
+	return s
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeBakeTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		attrs    map[string]interface{}
+		expected bakeTarget
+		err      string
+	}{
+		{
+			name:  "defaults",
+			attrs: map[string]interface{}{"tags": []interface{}{"jess/app"}},
+			expected: bakeTarget{
+				Name:       "app",
+				Context:    ".",
+				Dockerfile: defaultDockerfileName,
+				Tags:       []string{"jess/app"},
+			},
+		},
+		{
+			name: "all attributes",
+			attrs: map[string]interface{}{
+				"context":         "./app",
+				"dockerfile":      "Dockerfile.prod",
+				"target":          "release",
+				"tags":            []interface{}{"jess/app:1", "jess/app:latest"},
+				"args":            map[string]interface{}{"VERSION": "1", "DEBUG": true, "UNSET": nil},
+				"labels":          map[string]interface{}{"team": "img"},
+				"platforms":       []interface{}{"linux/amd64"},
+				"no-cache":        true,
+				"no-cache-filter": []interface{}{"deps"},
+			},
+			expected: bakeTarget{
+				Name:          "app",
+				Context:       "./app",
+				Dockerfile:    "Dockerfile.prod",
+				Target:        "release",
+				Tags:          []string{"jess/app:1", "jess/app:latest"},
+				Args:          map[string]string{"VERSION": "1", "DEBUG": "true"},
+				Labels:        map[string]string{"team": "img"},
+				Platforms:     []string{"linux/amd64"},
+				NoCache:       true,
+				NoCacheFilter: []string{"deps"},
+			},
+		},
+		{
+			name:  "no tags",
+			attrs: map[string]interface{}{"context": "."},
+			err:   "target app has no tags",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := decodeBakeTarget("app", tt.attrs)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error to contain %q, got: %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decoding target failed: %v", err)
+			}
+			if !reflect.DeepEqual(target, tt.expected) {
+				t.Fatalf("expected %#v, got %#v", tt.expected, target)
+			}
+		})
+	}
+}
+
+func TestApplyBakeOverrides(t *testing.T) {
+	targets := func() []bakeTarget {
+		return []bakeTarget{
+			{Name: "app", Context: ".", Tags: []string{"jess/app"}},
+			{Name: "db", Context: ".", Tags: []string{"jess/db"}, Args: map[string]string{"A": "1"}},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		overrides []string
+		expected  []bakeTarget
+		err       string
+	}{
+		{
+			name:      "args of every target",
+			overrides: []string{"*.args.VERSION=2"},
+			expected: []bakeTarget{
+				{Name: "app", Context: ".", Tags: []string{"jess/app"}, Args: map[string]string{"VERSION": "2"}},
+				{Name: "db", Context: ".", Tags: []string{"jess/db"}, Args: map[string]string{"A": "1", "VERSION": "2"}},
+			},
+		},
+		{
+			name:      "first list override replaces, next ones append",
+			overrides: []string{"app.tags=jess/app:dev", "app.tags=jess/app:test"},
+			expected: []bakeTarget{
+				{Name: "app", Context: ".", Tags: []string{"jess/app:dev", "jess/app:test"}},
+				{Name: "db", Context: ".", Tags: []string{"jess/db"}, Args: map[string]string{"A": "1"}},
+			},
+		},
+		{
+			name:      "scalars",
+			overrides: []string{"db.context=./db", "db.dockerfile=Dockerfile.db", "db.target=prod", "db.no-cache=true", "db.labels.team=img"},
+			expected: []bakeTarget{
+				{Name: "app", Context: ".", Tags: []string{"jess/app"}},
+				{Name: "db", Context: "./db", Dockerfile: "Dockerfile.db", Target: "prod", NoCache: true, Tags: []string{"jess/db"}, Args: map[string]string{"A": "1"}, Labels: map[string]string{"team": "img"}},
+			},
+		},
+		{
+			name:      "missing value",
+			overrides: []string{"app.tags"},
+			err:       "must be TARGET.KEY=VALUE",
+		},
+		{
+			name:      "missing key",
+			overrides: []string{"app=x"},
+			err:       "must be TARGET.KEY=VALUE",
+		},
+		{
+			name:      "unknown key",
+			overrides: []string{"app.output=type=local"},
+			err:       "output cannot be set",
+		},
+		{
+			name:      "no matching target",
+			overrides: []string{"web.tags=x"},
+			err:       "no target matches web",
+		},
+		{
+			name:      "bad pattern",
+			overrides: []string{"[.tags=x"},
+			err:       "invalid set value",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := targets()
+			err := applyBakeOverrides(got, tt.overrides)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error to contain %q, got: %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applying overrides failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected %#v, got %#v", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/genuinetools/img/client"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/sirupsen/logrus"
+)
+
+const benchShortHelp = `Benchmark building an image from a Dockerfile.`
+
+const benchLongHelp = `Benchmark building an image from a Dockerfile.
+
+The build is run -n times for each scenario and the percentiles of the time
+taken by each phase of the builds are reported:
+
+  cold     every step is run again, ignoring the build cache
+  warm     nothing changed since the previous build
+  context  a file of the build context changed since the previous build, the
+           .img-bench file is written to the context directory for it
+
+The warm and context scenarios build once before they are measured.`
+
+// benchScenarios are the cache conditions img bench can measure builds in.
+var benchScenarios = []string{"cold", "warm", "context"}
+
+// benchPhases are the phases the time of a build is split into.
+var benchPhases = []string{"context", "pull", "steps", "export", "total"}
+
+func (cmd *benchCommand) Name() string       { return "bench" }
+func (cmd *benchCommand) Args() string       { return "[OPTIONS] PATH" }
+func (cmd *benchCommand) ShortHelp() string  { return benchShortHelp }
+func (cmd *benchCommand) LongHelp() string   { return benchLongHelp }
+func (cmd *benchCommand) Hidden() bool       { return false }
+func (cmd *benchCommand) DoReexec() bool     { return true }
+func (cmd *benchCommand) RequiresRunc() bool { return true }
+
+func (cmd *benchCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.dockerfilePath, "f", "", "Name of the Dockerfile (Default is 'PATH/Dockerfile')")
+	fs.StringVar(&cmd.tag, "t", "img-bench", "Name and optionally a tag in the 'name:tag' format for the built image")
+	fs.StringVar(&cmd.target, "target", "", "Set the target build stage to build")
+	fs.Var(&cmd.buildArgs, "build-arg", "Set build-time variables")
+	fs.IntVar(&cmd.runs, "n", 5, "Number of builds to run for each scenario")
+	fs.Var(&cmd.scenarios, "scenario", fmt.Sprintf("Scenario to run, all of them by default, can be repeated (%v)", benchScenarios))
+}
+
+type benchCommand struct {
+	dockerfilePath string
+	tag            string
+	target         string
+	buildArgs      stringSlice
+	runs           int
+	scenarios      stringSlice
+}
+
+func (cmd *benchCommand) Run(args []string) error {
+	if len(args) < 1 {
+		return errors.New("must pass a path to build")
+	}
+	if cmd.runs < 1 {
+		return errors.New("-n must be at least 1")
+	}
+	scenarios := []string(cmd.scenarios)
+	if len(scenarios) == 0 {
+		scenarios = benchScenarios
+	}
+	for _, s := range scenarios {
+		valid := false
+		for _, v := range benchScenarios {
+			valid = valid || s == v
+		}
+		if !valid {
+			return fmt.Errorf("%s is not a valid scenario (%v)", s, benchScenarios)
+		}
+	}
+
+	contextDir := args[0]
+	dockerfile := cmd.dockerfilePath
+	if dockerfile == "" {
+		dockerfile = filepath.Join(contextDir, defaultDockerfileName)
+	}
+	opt := client.BuildOpt{
+		ContextDir:    contextDir,
+		DockerfileDir: filepath.Dir(dockerfile),
+		Dockerfile:    filepath.Base(dockerfile),
+		Tag:           cmd.tag,
+		Target:        cmd.target,
+		BuildArgs:     map[string]string{},
+	}
+	for _, buildArg := range cmd.buildArgs {
+		kv := strings.SplitN(buildArg, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid build-arg value %s", buildArg)
+		}
+		opt.BuildArgs[kv[0]] = kv[1]
+	}
+
+	c, err := client.New(stateDir, backend, stateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx := namespaces.WithNamespace(appcontext.Context(), "buildkit")
+
+	marker := filepath.Join(contextDir, ".img-bench")
+	defer os.Remove(marker)
+
+	results := map[string][]benchRun{}
+	for _, s := range scenarios {
+		opt := opt
+		if s == "cold" {
+			opt.FrontendAttrs = map[string]string{"no-cache": ""}
+		} else {
+			logrus.Infof("Warming up the %s scenario", s)
+			if _, err := benchBuild(ctx, c, opt); err != nil {
+				return err
+			}
+		}
+
+		for i := 0; i < cmd.runs; i++ {
+			if s == "context" {
+				if err := ioutil.WriteFile(marker, []byte(identity.NewID()), 0644); err != nil {
+					return fmt.Errorf("changing the build context failed: %v", err)
+				}
+			}
+			logrus.Infof("Running the %s scenario %d/%d", s, i+1, cmd.runs)
+			r, err := benchBuild(ctx, c, opt)
+			if err != nil {
+				return err
+			}
+			results[s] = append(results[s], r)
+		}
+	}
+
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, '\t', 0)
+	fmt.Fprintln(tw, "SCENARIO\tPHASE\tMIN\tP50\tP90\tP99\tMAX")
+	for _, s := range scenarios {
+		for _, phase := range benchPhases {
+			var d []time.Duration
+			for _, r := range results[s] {
+				d = append(d, r[phase])
+			}
+			sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s, phase,
+				benchDuration(d[0]), benchDuration(percentile(d, 50)), benchDuration(percentile(d, 90)), benchDuration(percentile(d, 99)), benchDuration(d[len(d)-1]))
+		}
+	}
+	return tw.Flush()
+}
+
+// benchRun is the time a build spent in each phase.
+type benchRun map[string]time.Duration
+
+// benchBuild runs a build and returns the time it spent in each phase. The
+// time of a phase is the time at least one of its vertexes was running.
+func benchBuild(ctx context.Context, c *client.Client, opt client.BuildOpt) (benchRun, error) {
+	ch := make(chan *controlapi.StatusResponse)
+	intervals := map[string][][2]time.Time{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for resp := range ch {
+			for _, v := range resp.Vertexes {
+				if v.Started == nil || v.Completed == nil {
+					continue
+				}
+				phase := "steps"
+				switch {
+				case strings.HasPrefix(v.Name, "local://"):
+					phase = "context"
+				case strings.HasPrefix(v.Name, "docker-image://"):
+					phase = "pull"
+				case strings.HasPrefix(v.Name, "exporting"):
+					phase = "export"
+				}
+				intervals[phase] = append(intervals[phase], [2]time.Time{*v.Started, *v.Completed})
+			}
+		}
+	}()
+
+	start := time.Now()
+	_, err := c.Build(ctx, opt, ch)
+	total := time.Since(start)
+	<-done
+	if err != nil {
+		return nil, err
+	}
+
+	r := benchRun{"total": total}
+	for phase, in := range intervals {
+		r[phase] = unionDuration(in)
+	}
+	return r, nil
+}
+
+// unionDuration returns how long at least one of the intervals lasted.
+func unionDuration(in [][2]time.Time) time.Duration {
+	sort.Slice(in, func(i, j int) bool { return in[i][0].Before(in[j][0]) })
+	var (
+		d   time.Duration
+		end time.Time
+	)
+	for _, i := range in {
+		if i[0].After(end) {
+			end = i[0]
+		}
+		if i[1].After(end) {
+			d += i[1].Sub(end)
+			end = i[1]
+		}
+	}
+	return d
+}
+
+// percentile returns the nearest-rank percentile of sorted durations.
+func percentile(d []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p/100*float64(len(d)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return d[i]
+}
+
+func benchDuration(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
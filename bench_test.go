@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBenchErrors(t *testing.T) {
+	tests := []struct {
+		cmd  *benchCommand
+		args []string
+		err  string
+	}{
+		{cmd: &benchCommand{runs: 1}, err: "must pass a path to build"},
+		{cmd: &benchCommand{}, args: []string{"."}, err: "-n must be at least 1"},
+		{cmd: &benchCommand{runs: 1, scenarios: stringSlice{"hot"}}, args: []string{"."}, err: "hot is not a valid scenario"},
+		{cmd: &benchCommand{runs: 1, buildArgs: stringSlice{"NOVALUE"}}, args: []string{"."}, err: "invalid build-arg value NOVALUE"},
+	}
+	for _, tt := range tests {
+		if err := tt.cmd.Run(tt.args); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("expected %q, got: %v", tt.err, err)
+		}
+	}
+}
+
+func TestUnionDuration(t *testing.T) {
+	at := func(s int) time.Time { return time.Unix(int64(s), 0) }
+
+	tests := []struct {
+		in       [][2]time.Time
+		expected time.Duration
+	}{
+		{nil, 0},
+		{[][2]time.Time{{at(0), at(2)}}, 2 * time.Second},
+		// Overlapping intervals are only counted once.
+		{[][2]time.Time{{at(1), at(4)}, {at(0), at(2)}}, 4 * time.Second},
+		{[][2]time.Time{{at(0), at(5)}, {at(1), at(2)}}, 5 * time.Second},
+		// Gaps between intervals are not counted.
+		{[][2]time.Time{{at(0), at(1)}, {at(3), at(5)}}, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		if d := unionDuration(tt.in); d != tt.expected {
+			t.Fatalf("expected %s for %v, got %s", tt.expected, tt.in, d)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	d := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	tests := map[float64]time.Duration{
+		0:   1,
+		50:  5,
+		90:  9,
+		95:  10,
+		100: 10,
+	}
+	for p, expected := range tests {
+		if got := percentile(d, p); got != expected {
+			t.Fatalf("expected %d for the %v percentile, got %d", expected, p, got)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"archive/tar"
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"context"
 	"errors"
 	"flag"
@@ -13,14 +12,22 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/containerd/console"
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/namespaces"
 	securejoin "github.com/cyphar/filepath-securejoin"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/pkg/archive"
+	units "github.com/docker/go-units"
 	"github.com/genuinetools/img/client"
+	"github.com/genuinetools/img/internal/metrics"
+	"github.com/genuinetools/img/internal/tracing"
 	controlapi "github.com/moby/buildkit/api/services/control"
 	bkclient "github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/identity"
@@ -28,6 +35,7 @@ import (
 	"github.com/moby/buildkit/util/appcontext"
 	"github.com/moby/buildkit/util/progress/progressui"
 	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -42,19 +50,119 @@ func (cmd *buildCommand) DoReexec() bool     { return true }
 func (cmd *buildCommand) RequiresRunc() bool { return true }
 
 func (cmd *buildCommand) Register(fs *flag.FlagSet) {
-	fs.StringVar(&cmd.dockerfilePath, "f", "", "Name of the Dockerfile (Default is 'PATH/Dockerfile')")
-	fs.StringVar(&cmd.tag, "t", "", "Name and optionally a tag in the 'name:tag' format")
-	fs.StringVar(&cmd.target, "target", "", "Set the target build stage to build")
+	fs.StringVar(&cmd.dockerfilePath, "f", "", "Name of the Dockerfile, '-' to read it from stdin or an http(s):// URL to download it from (Default is 'PATH/Dockerfile')")
+	fs.Var(&cmd.tags, "t", "Name and optionally a tag in the 'name:tag' format, can be repeated to tag the image with every name, or to name the image of every -target in order")
+	fs.Var(&cmd.targets, "target", "Set the target build stage to build, can be repeated to build several stages concurrently, each exported as the image of the -t in the same position")
 	fs.Var(&cmd.buildArgs, "build-arg", "Set build-time variables")
+	fs.BoolVar(&cmd.proxyEnv, "proxy-env", true, "Pass the HTTP_PROXY, HTTPS_PROXY, FTP_PROXY and NO_PROXY variables of the environment to the RUN steps, without them being part of the cache key or the image")
+	fs.Var(&cmd.buildArgFiles, "build-arg-file", "Read build-time variables from a file of KEY=VALUE lines, -build-arg overrides them, can be repeated")
+	fs.BoolVar(&cmd.noCache, "no-cache", false, "Do not use the build cache for any stage")
+	fs.Var(&cmd.noCacheFilter, "no-cache-filter", "Do not use the build cache for the stages, as a comma-separated list, can be repeated")
+	fs.StringVar(&cmd.contextChecksum, "context-checksum", "", "Verify a build context downloaded from an http(s):// URL against the digest, in the sha256:HEX format")
+	fs.Var(&cmd.labels, "label", "Set metadata for the image, as KEY=VALUE, can be repeated")
+	fs.Var(&cmd.addHosts, "add-host", "Add a custom host-to-IP mapping to /etc/hosts of the build steps, as HOST:IP, can be repeated")
+	fs.StringVar(&cmd.network, "network", "default", "Set the networking mode for the RUN instructions during build (default, host or none)")
+	fs.Var(&cmd.dns, "dns", "Set a DNS server of the RUN steps, instead of those of the host, can be repeated")
+	fs.Var(&cmd.dnsSearch, "dns-search", "Set a DNS search domain of the RUN steps, instead of those of the host, can be repeated")
+	fs.Var(&cmd.dnsOptions, "dns-option", "Set a DNS option of the RUN steps, instead of those of the host, can be repeated")
+	fs.StringVar(&cmd.security, "security", "", "Set the seccomp profile of the RUN steps, as seccomp=PROFILE with the path of a profile in the OCI runtime spec format, or seccomp=unconfined")
+	fs.Var(&cmd.ulimits, "ulimit", "Set a resource limit of the RUN steps, as NAME=SOFT[:HARD], e.g. nofile=65535:65535, can be repeated")
+	fs.StringVar(&cmd.cgroupParent, "cgroup-parent", "", "Create the cgroups of the RUN steps in the cgroup, e.g. /ci/builds")
+	fs.StringVar(&cmd.memory, "memory", "", "Limit the memory of every RUN step, e.g. 2g")
+	fs.StringVar(&cmd.cpus, "cpus", "", "Limit how many CPUs every RUN step can use, e.g. 1.5")
+	fs.Int64Var(&cmd.pidsLimit, "pids-limit", 0, "Limit how many processes every RUN step can run")
+	fs.Var(&cmd.buildContexts, "build-context", "Use an image (docker-image://REF), git URL or directory for FROM NAME and COPY --from=NAME, as NAME=VALUE, can be repeated")
+	fs.BoolVar(&cmd.quiet, "q", false, "Suppress the build output and print image digest on success")
+	fs.BoolVar(&cmd.quiet, "quiet", false, "Suppress the build output and print image digest on success")
+	fs.BoolVar(&cmd.noSummary, "no-summary", false, "Do not print a summary of the build steps to STDERR after the build")
+	fs.StringVar(&cmd.summaryFile, "summary-file", "", "Write a summary of the build steps as JSON to a file")
+	fs.StringVar(&cmd.progress, "progress", progressAuto, fmt.Sprintf("Set the type of progress output (%s)", strings.Join(progressModes, ", ")))
+	fs.StringVar(&cmd.progressFile, "progress-file", "", "Write every build progress event as a JSON line to a file")
+	fs.StringVar(&cmd.filter, "filter", "", "Only display the build steps with a name matching the regular expression")
+	fs.StringVar(&cmd.followStep, "follow-step", "", "Only display the complete output of the build steps matching the regular expression")
+	fs.StringVar(&cmd.dumpLogs, "dump-logs", "", "Print the complete output of the build steps matching the regular expression to STDERR after the build")
+	fs.Var(&cmd.outputs, "o", "Export the image with an exporter plugin as well, in the type=NAME[,KEY=VALUE...] format (runs img-exporter-NAME), can be repeated, or export the build instead of an image with type=local,dest=DIR or type=oci|docker,dest=FILE")
+	fs.Var(&cmd.outputs, "output", "Export the image with an exporter plugin as well, in the type=NAME[,KEY=VALUE...] format (runs img-exporter-NAME), can be repeated, or export the build instead of an image with type=local,dest=DIR or type=oci|docker,dest=FILE")
+	fs.BoolVar(&cmd.push, "push", false, "Push the image to its registry once it is built")
+	fs.StringVar(&cmd.cacheTo, "cache-to", "", "Export the build cache to a registry, in the type=registry,ref=REF[,mode=min|max] format")
+	fs.Var(&cmd.cacheFrom, "cache-from", "Import build cache from a registry, in the [type=registry,]ref=REF format or just REF, can be repeated")
+	fs.StringVar(&cmd.builder.Address, "builder", os.Getenv("IMG_BUILDER"), "Build on a remote img daemon or buildkitd (ssh://[USER@]HOST[/SOCKET], tcp://HOST:PORT or unix://SOCKET) (default is $IMG_BUILDER)")
+	fs.StringVar(&cmd.builder.TLSCACert, "builder-tls-ca", "", "CA certificate to verify a tcp:// builder with")
+	fs.StringVar(&cmd.builder.TLSCert, "builder-tls-cert", "", "Client certificate to authenticate to a tcp:// builder with")
+	fs.StringVar(&cmd.builder.TLSKey, "builder-tls-key", "", "Client key to authenticate to a tcp:// builder with")
+	fs.StringVar(&cmd.builder.TLSServerName, "builder-tls-servername", "", "Server name to verify the certificate of a tcp:// builder against (default is the host of the address)")
+	fs.BoolVar(&cmd.debugOnFailure, "debug-on-failure", false, "Start an interactive shell in the environment of a failed RUN step")
+	fs.StringVar(&cmd.containerdAddress, "containerd-address", "", "Publish the image to the containerd daemon listening on the socket, e.g. /run/containerd/containerd.sock")
+	fs.StringVar(&cmd.containerdNamespace, "containerd-namespace", client.DefaultContainerdNamespace, "containerd namespace to publish the image to")
+	fs.StringVar(&cmd.containersStorage, "containers-storage", "", "Publish the image to the containers/storage store used by podman in the directory, e.g. ~/.local/share/containers/storage")
+	fs.BoolVar(&cmd.squash, "squash", false, "Squash the layers of the image into a single layer")
+	fs.StringVar(&cmd.timestamp, "timestamp", os.Getenv("SOURCE_DATE_EPOCH"), "Clamp the times of the files and the creation time of the image to the Unix timestamp, for reproducible builds (default is $SOURCE_DATE_EPOCH)")
+	fs.StringVar(&cmd.provenance, "provenance", "", "Attach a SLSA provenance attestation to the image, with mode=min or mode=max to record the build arguments and the Dockerfile too")
+	fs.StringVar(&cmd.sbom, "sbom", "", "Attach an SBOM attestation of the apk and deb packages of the image, with format=spdx or format=cyclonedx")
+	fs.BoolVar(&cmd.dryRun, "dry-run", false, "Print the steps of the build with whether they are in the build cache and the digests of the base images, without building anything")
+	fs.StringVar(&cmd.iidFile, "iidfile", "", "Write the digest of the image to the file")
+	fs.StringVar(&cmd.resultsDir, "results-dir", "", "Write IMAGE_URL, IMAGE_DIGEST and PROVENANCE result files to the directory, e.g. for Tekton or Argo")
+	fs.StringVar(&cmd.containersRunRoot, "containers-runroot", defaultContainersRunRoot(), "Directory for the transient state of the containers/storage store")
+	cmd.notify.register(fs)
 }
 
 type buildCommand struct {
 	buildArgs      stringSlice
+	buildArgFiles  stringSlice
+	proxyEnv       bool
+	buildContexts  stringSlice
+	labels         stringSlice
+	addHosts       stringSlice
+	network        string
+	dns            stringSlice
+	dnsSearch      stringSlice
+	dnsOptions     stringSlice
+	security       string
+	ulimits        stringSlice
+	cgroupParent   string
+	memory         string
+	cpus           string
+	pidsLimit      int64
 	dockerfilePath string
 	target         string
+	targets        stringSlice
+	noCache        bool
+	noCacheFilter  stringSlice
 	tag            string
+	tags           stringSlice
+	quiet          bool
+	noSummary      bool
+	summaryFile    string
+	debugOnFailure bool
+	progress       string
+	progressFile   string
+	resultsDir     string
+	iidFile        string
+	timestamp      string
+	squash         bool
+	provenance     string
+	sbom           string
+	dryRun         bool
+	filter         string
+	followStep     string
+	dumpLogs       string
+	notify         notifyOptions
+	push           bool
+	outputs        stringSlice
+	cacheTo        string
+	cacheFrom      stringSlice
+	builder        client.RemoteBuilder
+	// client is used instead of creating one when set, since the state can
+	// only be opened once per process.
+	client *client.Client
 
-	contextDir string
+	containerdAddress   string
+	containerdNamespace string
+	containersStorage   string
+	containersRunRoot   string
+
+	contextDir      string
+	contextChecksum string
 }
 
 func (cmd *buildCommand) Run(args []string) (err error) {
@@ -62,14 +170,72 @@ func (cmd *buildCommand) Run(args []string) (err error) {
 		return fmt.Errorf("must pass a path to build")
 	}
 
-	if cmd.tag == "" {
+	// Parse the outputs, an output exported by the build replaces the
+	// image.
+	var (
+		outputs  = make([]buildOutput, 0, len(cmd.outputs))
+		solveOut *buildOutput
+	)
+	for _, o := range cmd.outputs {
+		out, err := parseOutput(o)
+		if err != nil {
+			return err
+		}
+		if !solveExporters[out.Type] {
+			outputs = append(outputs, out)
+			continue
+		}
+		if out.Attrs["dest"] == "" {
+			return fmt.Errorf("output %q has no dest", o)
+		}
+		if solveOut != nil {
+			return fmt.Errorf("only one output of type %s or %s can be set", solveOut.Type, out.Type)
+		}
+		solveOut = &out
+	}
+	if solveOut != nil && (len(outputs) > 0 || cmd.push || cmd.containerdAddress != "" || cmd.containersStorage != "" || cmd.iidFile != "") {
+		return fmt.Errorf("-output type=%s exports the build instead of an image and cannot be used with exporter plugins, -push, -containerd-address, -containers-storage or -iidfile", solveOut.Type)
+	}
+
+	// Several targets are solved concurrently in the session of the build,
+	// each exported as the image of its tag.
+	var (
+		extraTargets []buildTarget
+		extraTags    []string
+	)
+	if len(cmd.tags) > 0 {
+		cmd.tag = cmd.tags[0]
+	}
+	if len(cmd.targets) > 0 {
+		cmd.target = cmd.targets[0]
+	}
+	if len(cmd.targets) > 1 && !cmd.dryRun {
+		if len(cmd.tags) != len(cmd.targets) {
+			return fmt.Errorf("building %d targets needs as many -t image names, got %d", len(cmd.targets), len(cmd.tags))
+		}
+		for i, target := range cmd.targets[1:] {
+			extraTargets = append(extraTargets, buildTarget{target: target, tag: cmd.tags[i+1]})
+		}
+	} else if len(cmd.tags) > 1 {
+		extraTags = cmd.tags[1:]
+	}
+
+	if cmd.tag == "" && solveOut == nil && !cmd.dryRun {
 		return errors.New("please specify an image tag with `-t`")
 	}
 
 	// Get the specified context.
 	cmd.contextDir = args[0]
+	// source is where the context comes from, for the provenance.
+	var source string
+	if gitContextRe.MatchString(cmd.contextDir) || httpContextRe.MatchString(cmd.contextDir) {
+		source = cmd.contextDir
+	}
 
 	// Parse what is set to come from stdin.
+	if cmd.dockerfilePath == "-" && cmd.contextDir == "-" {
+		return errors.New("the dockerfile and the build context cannot both come from stdin")
+	}
 	if cmd.dockerfilePath == "-" {
 		cmd.dockerfilePath, err = dockerfileFromStdin()
 		if err != nil {
@@ -77,6 +243,12 @@ func (cmd *buildCommand) Run(args []string) (err error) {
 		}
 		// On exit cleanup the temporary file we used hold the dockerfile from stdin.
 		defer os.RemoveAll(cmd.dockerfilePath)
+	} else if httpContextRe.MatchString(cmd.dockerfilePath) {
+		cmd.dockerfilePath, err = dockerfileFromURL(cmd.dockerfilePath)
+		if err != nil {
+			return fmt.Errorf("downloading dockerfile failed: %v", err)
+		}
+		defer os.RemoveAll(cmd.dockerfilePath)
 	}
 
 	if cmd.contextDir == "" {
@@ -90,31 +262,201 @@ func (cmd *buildCommand) Run(args []string) (err error) {
 		}
 		// On exit cleanup the temporary directory we used hold the files from stdin.
 		defer os.RemoveAll(cmd.contextDir)
+		if err := cmd.dockerfileInContext(); err != nil {
+			return err
+		}
+	}
+
+	// Leave the URLs the frontend can fetch to it, with the Dockerfile path
+	// in the repository or archive, and clone or download the others.
+	var remoteContext string
+	if cmd.frontendContext() {
+		remoteContext, cmd.contextDir = cmd.contextDir, ""
+	} else if gitContextRe.MatchString(cmd.contextDir) {
+		tmp, err := ioutil.TempDir("", "img-build-git-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		if cmd.contextDir, err = cloneGitContext(cmd.contextDir, tmp); err != nil {
+			return fmt.Errorf("cloning build context failed: %v", err)
+		}
+		if err := cmd.dockerfileInContext(); err != nil {
+			return err
+		}
+	} else if httpContextRe.MatchString(cmd.contextDir) {
+		tmp, err := ioutil.TempDir("", "img-build-context-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		if err := downloadContext(cmd.contextDir, cmd.contextChecksum, tmp, cmd.dockerfilePath); err != nil {
+			return fmt.Errorf("downloading build context failed: %v", err)
+		}
+		cmd.contextDir = tmp
+		if err := cmd.dockerfileInContext(); err != nil {
+			return err
+		}
+	} else if cmd.contextChecksum != "" {
+		return errors.New("-context-checksum can only be used with a build context URL")
 	}
 
 	// Parse the image name and tag.
-	named, err := reference.ParseNormalizedNamed(cmd.tag)
-	if err != nil {
-		return fmt.Errorf("parsing image name %q failed: %v", cmd.tag, err)
+	if cmd.tag != "" {
+		named, err := reference.ParseNormalizedNamed(cmd.tag)
+		if err != nil {
+			return fmt.Errorf("parsing image name %q failed: %v", cmd.tag, err)
+		}
+		// Add the latest lag if they did not provide one.
+		named = reference.TagNameOnly(named)
+		cmd.tag = named.String()
+	}
+	names := make([]*string, 0, len(extraTags)+len(extraTargets))
+	for i := range extraTags {
+		names = append(names, &extraTags[i])
+	}
+	for i := range extraTargets {
+		names = append(names, &extraTargets[i].tag)
+	}
+	for _, name := range names {
+		named, err := reference.ParseNormalizedNamed(*name)
+		if err != nil {
+			return fmt.Errorf("parsing image name %q failed: %v", *name, err)
+		}
+		*name = reference.TagNameOnly(named).String()
+	}
+	// built is what the build produces, for the messages.
+	built := cmd.tag
+	for _, t := range extraTargets {
+		built += ", " + t.tag
+	}
+	if solveOut != nil {
+		built = solveOut.Attrs["dest"]
 	}
-	// Add the latest lag if they did not provide one.
-	named = reference.TagNameOnly(named)
-	cmd.tag = named.String()
 
 	// Set the dockerfile path as the default if one was not given.
-	if cmd.dockerfilePath == "" {
+	if cmd.dockerfilePath == "" && remoteContext != "" {
+		cmd.dockerfilePath = defaultDockerfileName
+	} else if cmd.dockerfilePath == "" {
 		cmd.dockerfilePath, err = securejoin.SecureJoin(cmd.contextDir, defaultDockerfileName)
 		if err != nil {
 			return err
 		}
 	}
 
-	// Create the client.
-	c, err := client.New(stateDir, backend, cmd.getLocalDirs())
+	if err := validateProgressMode(cmd.progress); err != nil {
+		return err
+	}
+
+	var filterRe, followRe, dumpRe *regexp.Regexp
+	for _, f := range []struct {
+		re   **regexp.Regexp
+		flag string
+		expr string
+	}{
+		{&filterRe, "filter", cmd.filter},
+		{&followRe, "follow-step", cmd.followStep},
+		{&dumpRe, "dump-logs", cmd.dumpLogs},
+	} {
+		if f.expr == "" {
+			continue
+		}
+		if *f.re, err = regexp.Compile(f.expr); err != nil {
+			return fmt.Errorf("parsing -%s expression %q failed: %v", f.flag, f.expr, err)
+		}
+	}
+
+	if cmd.builder.Address != "" && (cmd.debugOnFailure || cmd.containerdAddress != "" || cmd.containersStorage != "" || len(cmd.outputs) > 0) {
+		return errors.New("-debug-on-failure, -containerd-address, -containers-storage and -output need the image in the local state and cannot be used with -builder")
+	}
+	if cmd.builder.Address != "" && (len(cmd.addHosts) > 0 || (cmd.network != "" && cmd.network != "default") || len(cmd.dns) > 0 || len(cmd.dnsSearch) > 0 || len(cmd.dnsOptions) > 0 || cmd.security != "" || len(cmd.ulimits) > 0 || cmd.cgroupParent != "" || cmd.memory != "" || cmd.cpus != "" || cmd.pidsLimit != 0) {
+		return errors.New("-add-host, -network, -dns, -dns-search, -dns-option, -security, -ulimit, -cgroup-parent, -memory, -cpus and -pids-limit set up the containers of the local executor and cannot be used with -builder")
+	}
+	// Clamp the times of the image, so the same inputs build the same
+	// image.
+	var epoch *time.Time
+	if cmd.timestamp != "" {
+		t, err := parseSourceDateEpoch(cmd.timestamp)
+		if err != nil {
+			return err
+		}
+		epoch = &t
+	}
+	provenance, err := parseProvenanceMode(cmd.provenance)
+	if err != nil {
+		return err
+	}
+	sbom, err := parseSBOMFormat(cmd.sbom)
+	if err != nil {
+		return err
+	}
+	rewrite := epoch != nil || cmd.squash || provenance != "" || sbom != ""
+	if rewrite && (cmd.builder.Address != "" || solveOut != nil) {
+		return errors.New("-squash, -timestamp, SOURCE_DATE_EPOCH, -provenance and -sbom rewrite the image in the local state and cannot be used with -builder or -output type=local|oci|docker")
+	}
+	if len(extraTargets) > 0 && (rewrite || solveOut != nil || len(outputs) > 0 || cmd.builder.Address != "" || cmd.debugOnFailure || cmd.containerdAddress != "" || cmd.containersStorage != "" || cmd.iidFile != "" || cmd.resultsDir != "") {
+		return errors.New("several -target only export their images and cannot be used with -squash, -timestamp, SOURCE_DATE_EPOCH, -provenance, -sbom, -output, -builder, -debug-on-failure, -containerd-address, -containers-storage, -iidfile or -results-dir")
+	}
+	if len(extraTags) > 0 && (solveOut != nil || cmd.builder.Address != "") {
+		return errors.New("several -t tag the image in the local state and cannot be used with -builder or -output type=local|oci|docker")
+	}
+	if cmd.builder.Address != "" && cmd.dryRun {
+		return errors.New("-dry-run looks up the build cache in the local state and cannot be used with -builder")
+	}
+	if cmd.builder.Address != "" && offline {
+		return errors.New("-builder needs network access and cannot be used with -offline")
+	}
+	if (cmd.cacheTo != "" || len(cmd.cacheFrom) > 0) && offline {
+		return errors.New("-cache-to and -cache-from need network access and cannot be used with -offline")
+	}
+	cache, err := parseCacheOptions(cmd.cacheTo, cmd.cacheFrom)
 	if err != nil {
 		return err
 	}
-	defer c.Close()
+
+	// Create the client, unless the build shares one with other commands.
+	c := cmd.client
+	if c == nil {
+		if c, err = client.New(stateDir, backend, stateLock, cmd.getLocalDirs()); err != nil {
+			return err
+		}
+		defer c.Close()
+		if cmd.builder.Address == "" && !cmd.dryRun {
+			defer applyGCPolicy(c)
+		}
+		opt, err := cmd.execOpt()
+		if err != nil {
+			return err
+		}
+		if err := c.SetExecOpt(opt); err != nil {
+			return err
+		}
+	}
+
+	// Point the Dockerfile at the named build contexts.
+	if len(cmd.buildContexts) > 0 {
+		ctx := namespaces.WithNamespace(appcontext.Context(), "buildkit")
+		refs, err := buildContexts(ctx, c, cmd.buildContexts, cmd.builder.Address == "")
+		if err != nil {
+			return err
+		}
+		dt, err := ioutil.ReadFile(cmd.dockerfilePath)
+		if err != nil {
+			return fmt.Errorf("reading dockerfile failed: %v", err)
+		}
+		if dt, err = rewriteDockerfile(dt, refs); err != nil {
+			return err
+		}
+		dir, err := ioutil.TempDir("", "img-build-dockerfile-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		cmd.dockerfilePath = filepath.Join(dir, filepath.Base(cmd.dockerfilePath))
+		if err := ioutil.WriteFile(cmd.dockerfilePath, dt, 0644); err != nil {
+			return err
+		}
+	}
 
 	// Create the frontend attrs.
 	frontendAttrs := map[string]string{
@@ -122,8 +464,23 @@ func (cmd *buildCommand) Run(args []string) (err error) {
 		"filename": filepath.Base(cmd.dockerfilePath),
 		"target":   cmd.target,
 	}
+	// The frontend fetches the context and reads the Dockerfile from it.
+	if remoteContext != "" {
+		frontendAttrs["context"] = remoteContext
+		frontendAttrs["filename"] = cmd.dockerfilePath
+	}
 
-	// Get the build args and add them to frontend attrs.
+	// Get the build args and add them to frontend attrs, the flags override
+	// the files.
+	for _, file := range cmd.buildArgFiles {
+		args, err := readEnvFile(file)
+		if err != nil {
+			return err
+		}
+		for k, v := range args {
+			frontendAttrs["build-arg:"+k] = v
+		}
+	}
 	for _, buildArg := range cmd.buildArgs {
 		kv := strings.SplitN(buildArg, "=", 2)
 		if len(kv) != 2 {
@@ -131,50 +488,527 @@ func (cmd *buildCommand) Run(args []string) (err error) {
 		}
 		frontendAttrs["build-arg:"+kv[0]] = kv[1]
 	}
+	if cmd.proxyEnv {
+		for k, v := range proxyBuildArgs(filterFrontendAttrs(frontendAttrs, "build-arg:")) {
+			frontendAttrs["build-arg:"+k] = v
+		}
+	}
+	for _, label := range cmd.labels {
+		kv := strings.SplitN(label, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid label value %s", label)
+		}
+		frontendAttrs["label:"+kv[0]] = kv[1]
+	}
+	// The build steps can use the timestamp too, unless it is set to
+	// something else.
+	if _, ok := frontendAttrs["build-arg:SOURCE_DATE_EPOCH"]; epoch != nil && !ok {
+		frontendAttrs["build-arg:SOURCE_DATE_EPOCH"] = strconv.FormatInt(epoch.Unix(), 10)
+	}
+	// Build every stage, or only the stages of the filter, without the cache.
+	if cmd.noCache {
+		frontendAttrs["no-cache"] = ""
+	} else if len(cmd.noCacheFilter) > 0 {
+		stages, err := parseNoCacheFilter(cmd.noCacheFilter, cmd.dockerfilePath, filterFrontendAttrs(frontendAttrs, "build-arg:"))
+		if err != nil {
+			return err
+		}
+		if stages != "" {
+			frontendAttrs["no-cache"] = stages
+		}
+	}
+	if len(cache.ImportRefs) > 0 {
+		frontendAttrs["cache-from"] = strings.Join(cache.ImportRefs, ",")
+	}
 
-	fmt.Printf("Building %s\n", cmd.tag)
-	fmt.Println("Setting up the rootfs... this may take a bit.")
+	if offline {
+		ctx := namespaces.WithNamespace(appcontext.Context(), "buildkit")
+		for _, target := range append([]string{cmd.target}, targetNames(extraTargets)...) {
+			if err := checkOfflineImages(ctx, c, cmd.dockerfilePath, target, filterFrontendAttrs(frontendAttrs, "build-arg:")); err != nil {
+				return err
+			}
+		}
+	}
+
+	if cmd.dryRun {
+		targets := []string(cmd.targets)
+		if len(targets) == 0 {
+			targets = []string{cmd.target}
+		}
+		return cmd.plan(c, frontendAttrs, targets)
+	}
+
+	gha, inActions := newGitHubActions()
+	if inActions {
+		gha.AnnotateDockerfile(os.Stderr, cmd.dockerfilePath)
+	}
+
+	if cmd.verbose() {
+		logrus.Infof("Building %s", built)
+		logrus.Info("Setting up the rootfs... this may take a bit.")
+	}
 
 	// Create the context.
 	ctx := appcontext.Context()
-	sess, sessDialer, err := c.Session(ctx)
+	sess, sessDialer, err := c.SessionWithLocalDirs(ctx, cmd.getLocalDirs())
 	if err != nil {
 		return err
 	}
+	exporter, exporterAttrs := "image", map[string]string{"name": cmd.tag}
+	// Images rewritten after the build are pushed once they are.
+	if cmd.push && !rewrite {
+		exporterAttrs["push"] = "true"
+	}
+	if solveOut != nil {
+		a, err := solveOut.attachable()
+		if err != nil {
+			return err
+		}
+		sess.Allow(a)
+		// The tarballs name the image with the tag, if there is one.
+		exporter = solveOut.Type
+		if cmd.tag == "" || solveOut.Type == "local" {
+			exporterAttrs = nil
+		}
+	}
 	id := identity.NewID()
 	ctx = session.NewContext(ctx, sess.ID())
 	ctx = namespaces.WithNamespace(ctx, "buildkit")
 	eg, ctx := errgroup.WithContext(ctx)
 
+	start := time.Now()
+	var resp *controlapi.SolveResponse
+	defer func() {
+		var digest string
+		if resp != nil {
+			digest = resp.ExporterResponse["containerimage.digest"]
+		}
+		cmd.notify.notify("build", cmd.tag, digest, start, err)
+	}()
+
+	solveSpan := tracer.Start("solve", commandSpan)
+	solveSpan.SetAttr("img.image", cmd.tag)
+
 	ch := make(chan *controlapi.StatusResponse)
+	// The updates of every target are displayed together.
+	chs := []chan *controlapi.StatusResponse{ch}
+	for range extraTargets {
+		chs = append(chs, make(chan *controlapi.StatusResponse))
+	}
+	summary := newBuildSummary()
+	logs := newStepLogs()
+	defer logs.Close()
+	watchers := []func(*controlapi.StatusResponse){traceVertexes(solveSpan), countSteps(), summary.watch}
+	if dumpRe != nil {
+		watchers = append(watchers, logs.watch)
+	}
+	if cmd.progressFile != "" {
+		f, err := os.Create(cmd.progressFile)
+		if err != nil {
+			return fmt.Errorf("creating progress file failed: %v", err)
+		}
+		defer f.Close()
+		watchers = append(watchers, newProgressEventWriter(f).watch)
+	}
+	statusCh := watchStatus(mergeStatus(chs...), watchers...)
 	eg.Go(func() error {
 		return sess.Run(ctx, sessDialer)
 	})
+	// The session is closed once every target is solved.
+	var solves sync.WaitGroup
+	solves.Add(1 + len(extraTargets))
+	go func() {
+		solves.Wait()
+		sess.Close()
+	}()
 	// Solve the dockerfile.
 	eg.Go(func() error {
-		defer sess.Close()
-		return c.Solve(ctx, &controlapi.SolveRequest{
-			Ref:      id,
-			Session:  sess.ID(),
-			Exporter: "image",
-			ExporterAttrs: map[string]string{
-				"name": cmd.tag,
-			},
+		defer solves.Done()
+		var err error
+		if cmd.builder.Address != "" {
+			localDirs := cmd.getLocalDirs()
+			resp, err = cmd.builder.Build(ctx, client.BuildOpt{
+				ContextDir:    localDirs["context"],
+				DockerfileDir: localDirs["dockerfile"],
+				Tag:           cmd.tag,
+				FrontendAttrs: frontendAttrs,
+				Push:          cmd.push,
+				CacheTo:       cache.ExportRef,
+				CacheToMode:   cache.ExportAttrs["mode"],
+				CacheFrom:     cache.ImportRefs,
+			}, ch)
+			return err
+		}
+		resp, err = c.Solve(ctx, &controlapi.SolveRequest{
+			Ref:           id,
+			Session:       sess.ID(),
+			Exporter:      exporter,
+			ExporterAttrs: exporterAttrs,
 			Frontend:      "dockerfile.v0",
 			FrontendAttrs: frontendAttrs,
+			Cache:         cache,
 		}, ch)
+		return err
 	})
+	for i := range extraTargets {
+		t, ch := &extraTargets[i], chs[i+1]
+		attrs := map[string]string{}
+		for k, v := range frontendAttrs {
+			attrs[k] = v
+		}
+		attrs["target"] = t.target
+		exporterAttrs := map[string]string{"name": t.tag}
+		if cmd.push {
+			exporterAttrs["push"] = "true"
+		}
+		eg.Go(func() error {
+			defer solves.Done()
+			var err error
+			t.resp, err = c.Solve(ctx, &controlapi.SolveRequest{
+				Ref:           identity.NewID(),
+				Session:       sess.ID(),
+				Exporter:      "image",
+				ExporterAttrs: exporterAttrs,
+				Frontend:      "dockerfile.v0",
+				FrontendAttrs: attrs,
+				Cache:         cache,
+			}, ch)
+			if err != nil {
+				return fmt.Errorf("building target %s failed: %v", t.target, err)
+			}
+			return nil
+		})
+	}
 	eg.Go(func() error {
-		return showProgress(ch)
+		switch {
+		case cmd.quiet:
+			return discardProgress(statusCh)
+		case followRe != nil:
+			return followStep(statusCh, followRe)
+		case filterRe != nil:
+			return showProgress(filterStatus(statusCh, filterRe), cmd.progress)
+		}
+		return showProgress(statusCh, cmd.progress)
 	})
-	if err := eg.Wait(); err != nil {
+	err = eg.Wait()
+	if err == nil && rewrite {
+		p := cmd.newProvenance(resp, source, frontendAttrs, summary.Steps(), start)
+		err = cmd.rewriteImage(c, resp, epoch, provenance, p, sbom)
+	}
+	solveSpan.Finish(err)
+	metrics.BuildsTotal.WithLabelValues(metrics.Result(err)).Inc()
+	metrics.BuildDuration.Observe(time.Since(start).Seconds())
+
+	// Write the summary even if the build failed, it shows which step did.
+	if cmd.summaryFile != "" {
+		if err := summary.WriteJSON(cmd.summaryFile); err != nil {
+			return err
+		}
+	}
+	if dumpRe != nil {
+		fmt.Fprintln(os.Stderr)
+		if logs.Dump(os.Stderr, dumpRe) == 0 {
+			logrus.Warnf("no build steps matched -dump-logs %q", cmd.dumpLogs)
+		}
+	}
+	if !cmd.noSummary && cmd.verbose() {
+		fmt.Fprintln(os.Stderr)
+		summary.Print(os.Stderr)
+		fmt.Fprintln(os.Stderr)
+	}
+
+	if inActions {
+		var digest string
+		if resp != nil {
+			digest = resp.ExporterResponse["containerimage.digest"]
+		}
+		if err := gha.WriteSummary(cmd.tag, digest, summary.Steps(), err); err != nil {
+			logrus.Warnf("writing GitHub Actions step summary failed: %v", err)
+		}
+		if err != nil {
+			gha.AnnotateError(os.Stderr, cmd.dockerfilePath, err)
+		} else if err := gha.WriteOutputs(cmd.tag, digest); err != nil {
+			return err
+		}
+	}
+
+	if err != nil {
+		if step, ok := summary.FailedStep(); ok && cmd.debugOnFailure {
+			if derr := cmd.runDebugShell(c, frontendAttrs, sess.ID(), step); derr != nil {
+				logrus.Warnf("running debug shell failed: %v", derr)
+			}
+		}
 		return err
 	}
-	fmt.Printf("Successfully built %s\n", cmd.tag)
+
+	if cmd.resultsDir != "" {
+		p := cmd.newProvenance(resp, source, frontendAttrs, summary.Steps(), start)
+		if err := writeResults(cmd.resultsDir, p); err != nil {
+			return err
+		}
+	}
+
+	if cmd.iidFile != "" {
+		if err := ioutil.WriteFile(cmd.iidFile, []byte(resp.ExporterResponse["containerimage.digest"]), 0644); err != nil {
+			return fmt.Errorf("writing image digest failed: %v", err)
+		}
+	}
+
+	// The build context is cancelled once the build is done.
+	publishCtx := namespaces.WithNamespace(appcontext.Context(), "buildkit")
+	for _, tag := range extraTags {
+		if err := c.TagImage(publishCtx, cmd.tag, tag); err != nil {
+			return err
+		}
+		if cmd.push {
+			if err := pushWithSession(publishCtx, c, tag, false); err != nil {
+				return err
+			}
+		}
+	}
+	if cmd.containerdAddress != "" {
+		if err := c.PublishToContainerd(publishCtx, cmd.tag, cmd.containerdAddress, cmd.containerdNamespace); err != nil {
+			return err
+		}
+		if cmd.verbose() {
+			fmt.Printf("Published %s to containerd namespace %s\n", cmd.tag, cmd.containerdNamespace)
+		}
+	}
+	for _, out := range outputs {
+		if err := c.ExportToPlugin(publishCtx, out.Type, cmd.tag, out.Attrs, os.Stdout, os.Stderr); err != nil {
+			return err
+		}
+	}
+	if cmd.containersStorage != "" {
+		if err := c.PublishToContainersStorage(publishCtx, cmd.tag, cmd.containersStorage, cmd.containersRunRoot); err != nil {
+			return err
+		}
+		if cmd.verbose() {
+			fmt.Printf("Published %s to containers/storage in %s\n", cmd.tag, cmd.containersStorage)
+		}
+	}
+
+	if solveOut != nil {
+		if cmd.verbose() {
+			fmt.Printf("Successfully exported the build to %s\n", built)
+		}
+		return nil
+	}
+	for _, t := range append([]buildTarget{{tag: cmd.tag, resp: resp}}, extraTargets...) {
+		switch {
+		case cmd.quiet:
+			fmt.Println(t.resp.ExporterResponse["containerimage.digest"])
+		case cmd.progress == progressJSON:
+			newProgressEventWriter(os.Stdout).result(t.tag, t.resp.ExporterResponse["containerimage.digest"])
+		default:
+			fmt.Printf("Successfully built %s\n", t.tag)
+		}
+	}
 
 	return nil
 }
 
+// buildTarget is a target of a build solved with the first one, and the
+// response of its solve.
+type buildTarget struct {
+	target string
+	tag    string
+	resp   *controlapi.SolveResponse
+}
+
+func targetNames(targets []buildTarget) []string {
+	names := make([]string, 0, len(targets))
+	for _, t := range targets {
+		names = append(names, t.target)
+	}
+	return names
+}
+
+// parseNoCacheFilter returns the stages of the -no-cache-filter flags as the
+// comma-separated list of the frontend, checking the Dockerfile has them.
+func parseNoCacheFilter(filters []string, dockerfile string, buildArgs map[string]string) (string, error) {
+	dt, err := ioutil.ReadFile(dockerfile)
+	if err != nil {
+		return "", fmt.Errorf("reading dockerfile failed: %v", err)
+	}
+	stages, err := dockerfileStages(dt, buildArgs)
+	if err != nil {
+		return "", err
+	}
+
+	var names []string
+	for _, f := range filters {
+		for _, name := range strings.Split(f, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			found := false
+			for _, st := range stages {
+				found = found || strings.EqualFold(st.Name, name)
+			}
+			if !found {
+				return "", fmt.Errorf("invalid no-cache-filter value %s: the dockerfile has no stage named %s", f, name)
+			}
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ","), nil
+}
+
+// newProvenance returns how the image of the build response was built.
+func (cmd *buildCommand) newProvenance(resp *controlapi.SolveResponse, source string, frontendAttrs map[string]string, steps []buildStep, start time.Time) buildProvenance {
+	p := newBuildProvenance(cmd.tag, resp.ExporterResponse["containerimage.digest"])
+	p.Dockerfile = cmd.dockerfilePath
+	p.Source = source
+	p.Target = cmd.target
+	p.BuildArgs = map[string]string{}
+	for k, v := range frontendAttrs {
+		// The proxy variables may hold credentials.
+		if name := strings.TrimPrefix(k, "build-arg:"); name != k && !isProxyArg(name) {
+			p.BuildArgs[name] = v
+		}
+	}
+	p.Materials = buildMaterials(steps)
+	p.Started = start.UTC()
+	p.Finished = time.Now().UTC()
+	return p
+}
+
+// rewriteImage squashes the built image with -squash, clamps its times to
+// epoch when it is set and attaches the provenance attestation of the image
+// in the provenance mode and its SBOM in the sbom format, then pushes it,
+// since the exporter pushed nothing.
+func (cmd *buildCommand) rewriteImage(c *client.Client, resp *controlapi.SolveResponse, epoch *time.Time, provenance string, p buildProvenance, sbom string) error {
+	ctx := namespaces.WithNamespace(appcontext.Context(), "buildkit")
+	if resp.ExporterResponse == nil {
+		resp.ExporterResponse = map[string]string{}
+	}
+	var (
+		img images.Image
+		err error
+	)
+	if cmd.squash {
+		if img, err = c.SquashImage(ctx, cmd.tag); err != nil {
+			return err
+		}
+		resp.ExporterResponse["containerimage.digest"] = img.Target.Digest.String()
+	}
+	if epoch != nil {
+		if img, err = c.ClampImageTimestamps(ctx, cmd.tag, *epoch); err != nil {
+			return fmt.Errorf("clamping the timestamps of %s failed: %v", cmd.tag, err)
+		}
+		resp.ExporterResponse["containerimage.digest"] = img.Target.Digest.String()
+	}
+	// The attestations are about the rewritten image, so they are attached
+	// last.
+	manifest := digest.Digest(resp.ExporterResponse["containerimage.digest"])
+	if provenance != "" {
+		var dockerfile []byte
+		if provenance == provenanceMax {
+			if dockerfile, err = ioutil.ReadFile(cmd.dockerfilePath); err != nil {
+				return fmt.Errorf("reading dockerfile failed: %v", err)
+			}
+		}
+		p.Digest = manifest.String()
+		statement, err := provenanceStatement(p, provenance, dockerfile)
+		if err != nil {
+			return err
+		}
+		if img, err = c.AttachAttestation(ctx, cmd.tag, slsaProvenancePredType, statement); err != nil {
+			return fmt.Errorf("attaching the provenance of %s failed: %v", cmd.tag, err)
+		}
+		resp.ExporterResponse["containerimage.digest"] = img.Target.Digest.String()
+	}
+	if sbom != "" {
+		release, pkgs, err := c.ImagePackages(ctx, cmd.tag)
+		if err != nil {
+			return fmt.Errorf("listing the packages of %s failed: %v", cmd.tag, err)
+		}
+		created := time.Now().UTC()
+		if epoch != nil {
+			created = epoch.UTC()
+		}
+		statement, err := sbomStatement(cmd.tag, manifest, sbom, release, pkgs, created)
+		if err != nil {
+			return err
+		}
+		if img, err = c.AttachAttestation(ctx, cmd.tag, sbomPredicateTypes[sbom], statement); err != nil {
+			return fmt.Errorf("attaching the sbom of %s failed: %v", cmd.tag, err)
+		}
+		resp.ExporterResponse["containerimage.digest"] = img.Target.Digest.String()
+	}
+	if !cmd.push {
+		return nil
+	}
+	return pushWithSession(ctx, c, cmd.tag, false)
+}
+
+// execOpt returns the settings of the containers running the build steps.
+func (cmd *buildCommand) execOpt() (client.ExecOpt, error) {
+	// There is no network set up for the build steps by img, the default is
+	// the network of the host.
+	opt := client.ExecOpt{
+		Network:      cmd.network,
+		ExtraHosts:   cmd.addHosts,
+		PidsLimit:    cmd.pidsLimit,
+		DNS:          cmd.dns,
+		DNSSearch:    cmd.dnsSearch,
+		DNSOptions:   cmd.dnsOptions,
+		Ulimits:      cmd.ulimits,
+		CgroupParent: cmd.cgroupParent,
+	}
+	if opt.Network == "default" {
+		opt.Network = client.NetworkHost
+	}
+	if cmd.security != "" {
+		kv := strings.SplitN(cmd.security, "=", 2)
+		if len(kv) != 2 || kv[0] != "seccomp" || kv[1] == "" {
+			return opt, fmt.Errorf("invalid -security %q, must be seccomp=PROFILE or seccomp=%s", cmd.security, client.SeccompUnconfined)
+		}
+		opt.Seccomp = kv[1]
+	}
+	if cmd.memory != "" {
+		m, err := units.RAMInBytes(cmd.memory)
+		if err != nil {
+			return opt, fmt.Errorf("parsing -memory %q failed: %v", cmd.memory, err)
+		}
+		opt.Memory = m
+	}
+	if cmd.cpus != "" {
+		cpus, err := strconv.ParseFloat(cmd.cpus, 64)
+		if err != nil {
+			return opt, fmt.Errorf("parsing -cpus %q failed: %v", cmd.cpus, err)
+		}
+		opt.CPUs = cpus
+	}
+	return opt, nil
+}
+
+// verbose returns whether to print messages about the build on stdout, which
+// only has the digest with -quiet and the events with -progress json.
+func (cmd *buildCommand) verbose() bool {
+	return !cmd.quiet && cmd.progress != progressJSON
+}
+
+// defaultContainersRunRoot returns the directory podman keeps the transient
+// state of the containers/storage store in for the user.
+func defaultContainersRunRoot() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "containers")
+	}
+	return "/run/containers/storage"
+}
+
+// dockerfileInContext resolves a relative -f in the build context, for
+// contexts that are unpacked or cloned to a temporary directory.
+func (cmd *buildCommand) dockerfileInContext() (err error) {
+	if cmd.dockerfilePath != "" && !filepath.IsAbs(cmd.dockerfilePath) {
+		cmd.dockerfilePath, err = securejoin.SecureJoin(cmd.contextDir, cmd.dockerfilePath)
+	}
+	return err
+}
+
 // dockerfileFromStdin copies a dockerfile from stdin to a temporary file.
 func dockerfileFromStdin() (string, error) {
 	stdin, err := ioutil.ReadAll(os.Stdin)
@@ -196,54 +1030,82 @@ func dockerfileFromStdin() (string, error) {
 	return f.Name(), nil
 }
 
+// dockerfileFromURL downloads a dockerfile to a temporary file.
+func dockerfileFromURL(url string) (string, error) {
+	body, err := httpGet(url, maxDockerfileSize)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	f, err := ioutil.TempFile("", "img-build-dockerfile-")
+	if err != nil {
+		return "", fmt.Errorf("unable to create temporary file for dockerfile: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, body); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("writing to temporary file for dockerfile failed: %v", err)
+	}
+	return f.Name(), nil
+}
+
 // contextFromStdin will read the contents of stdin as either a
 // Dockerfile or tar archive. Returns the path to a temporary directory
 // for the build context..
 func contextFromStdin(dockerfileName string) (string, error) {
-	// Set the dockerfile name if it is empty.
-	if dockerfileName == "" {
-		dockerfileName = defaultDockerfileName
-	}
-
 	// Create a temporary directory for the build context.
 	tmpDir, err := ioutil.TempDir("", "img-build-context-")
 	if err != nil {
 		return "", fmt.Errorf("unable to create temporary context directory: %v", err)
 	}
+	return tmpDir, extractContext(tmpDir, os.Stdin, dockerfileName)
+}
 
-	// Create a new reader from stdin.
-	buf := bufio.NewReader(os.Stdin)
+// extractContext unpacks a tar archive to dir, or writes a lone Dockerfile
+// to it when r is not an archive.
+func extractContext(dir string, r io.Reader, dockerfileName string) error {
+	// Set the dockerfile name if it is empty.
+	if dockerfileName == "" {
+		dockerfileName = defaultDockerfileName
+	}
+
+	buf := bufio.NewReader(r)
 
 	// Grab the magic number range from the reader.
 	archiveHeaderSize := 512 // number of bytes in an archive header
 	magic, err := buf.Peek(archiveHeaderSize)
 	if err != nil && err != io.EOF {
-		return tmpDir, fmt.Errorf("failed to peek context header from STDIN: %v", err)
+		return fmt.Errorf("failed to peek context header: %v", err)
 	}
 
 	// Validate if it is a tar archive.
 	if isArchive(magic) {
-		return tmpDir, untar(tmpDir, buf)
+		return untar(dir, buf, maxContextSize)
 	}
 
 	if dockerfileName == "-" {
-		return tmpDir, errors.New("build context is not an archive")
+		return errors.New("build context is not an archive")
 	}
 
-	// Create the dockerfile in the temporary directory.
-	dockerfilePath, err := securejoin.SecureJoin(tmpDir, dockerfileName)
+	// Create the dockerfile in the directory.
+	dockerfilePath, err := securejoin.SecureJoin(dir, dockerfileName)
 	if err != nil {
-		return tmpDir, err
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dockerfilePath), 0755); err != nil {
+		return err
 	}
 	f, err := os.Create(dockerfilePath)
 	if err != nil {
-		return tmpDir, err
+		return err
 	}
 	defer f.Close()
 
 	// Copy the contents of the reader to the file.
 	_, err = io.Copy(f, buf)
-	return tmpDir, err
+	return err
 }
 
 // isArchive checks for the magic bytes of a tar or any supported compression algorithm.
@@ -257,15 +1119,21 @@ func isArchive(header []byte) bool {
 	return err == nil
 }
 
-// untar unpacks a tarball to a given directory.
-func untar(dest string, r io.Reader) error {
-	gzr, err := gzip.NewReader(r)
+// errArchiveTooLarge is returned by untar for archives that unpack to more
+// than its limit.
+var errArchiveTooLarge = errors.New("archive is too large")
+
+// untar unpacks a tarball, which may be compressed, to a given directory.
+// At most limit bytes are unpacked, so a small compressed archive cannot
+// fill the disk.
+func untar(dest string, r io.Reader, limit int64) error {
+	gzr, err := archive.DecompressStream(r)
 	if err != nil {
 		return err
 	}
 	defer gzr.Close()
 
-	tr := tar.NewReader(gzr)
+	tr := tar.NewReader(&archiveLimitReader{r: gzr, limit: limit})
 	for {
 		header, err := tr.Next()
 		switch {
@@ -297,6 +1165,10 @@ func untar(dest string, r io.Reader) error {
 			}
 		// if it's a file create it
 		case tar.TypeReg:
+			// archives do not always have entries for the parent directories
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
 			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
 			if err != nil {
 				return err
@@ -310,43 +1182,133 @@ func untar(dest string, r io.Reader) error {
 			if err != nil {
 				return err
 			}
+		// if it's a symlink recreate it, without following it
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
 		}
 	}
 }
 
+// archiveLimitReader reads from r until limit bytes are read, then fails
+// with errArchiveTooLarge unless r is done.
+type archiveLimitReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func (l *archiveLimitReader) Read(p []byte) (int, error) {
+	if l.n >= l.limit {
+		// Only fail if there is more to read.
+		if n, err := l.r.Read(make([]byte, 1)); n == 0 && err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("%v, it unpacks to more than %s", errArchiveTooLarge, units.BytesSize(float64(l.limit)))
+	}
+	if int64(len(p)) > l.limit-l.n {
+		p = p[:l.limit-l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	return n, err
+}
+
 func (cmd *buildCommand) getLocalDirs() map[string]string {
+	// The context the frontend fetches has no local directories.
+	if cmd.contextDir == "" {
+		return nil
+	}
 	return map[string]string{
 		"context":    cmd.contextDir,
 		"dockerfile": filepath.Dir(cmd.dockerfilePath),
 	}
 }
 
-func showProgress(ch chan *controlapi.StatusResponse) error {
-	c, err := console.ConsoleFromFile(os.Stderr)
-	if err != nil {
-		vtxNames := make(map[digest.Digest]string)
-		// FIXME: more beautiful logs for non-console session
+// watchStatus returns a channel that receives every status update sent on ch
+// after it has been passed to each of the watchers.
+func watchStatus(ch chan *controlapi.StatusResponse, watchers ...func(*controlapi.StatusResponse)) chan *controlapi.StatusResponse {
+	out := make(chan *controlapi.StatusResponse)
+	go func() {
+		defer close(out)
 		for resp := range ch {
-			for _, v := range resp.Vertexes {
-				vtxNames[v.Digest] = v.Name
+			for _, watch := range watchers {
+				watch(resp)
 			}
-			for _, v := range resp.Logs {
-				name := vtxNames[v.Vertex]
-				if name == "" {
-					name = "?"
-				}
-				log := fmt.Sprintf("[%s]: %s", name, string(v.Msg))
-				if !strings.HasSuffix(log, "\n") {
-					log += "\n"
-				}
-				if v.Stream == 1 {
-					os.Stdout.Write([]byte(log))
-				} else {
-					os.Stderr.Write([]byte(log))
-				}
+			out <- resp
+		}
+	}()
+	return out
+}
+
+// traceVertexes returns a status watcher that records a span for every
+// completed vertex as a child of parent.
+func traceVertexes(parent *tracing.Span) func(*controlapi.StatusResponse) {
+	recorded := map[digest.Digest]bool{}
+	return func(resp *controlapi.StatusResponse) {
+		for _, v := range resp.Vertexes {
+			if v.Started == nil || v.Completed == nil || recorded[v.Digest] {
+				continue
+			}
+			recorded[v.Digest] = true
+
+			attrs := map[string]string{
+				"img.vertex.digest": v.Digest.String(),
+				"img.vertex.cached": strconv.FormatBool(v.Cached),
+			}
+			// Local sources are the transfer of the build context from the
+			// session.
+			if strings.HasPrefix(v.Name, "local://") {
+				attrs["img.vertex.kind"] = "context-transfer"
 			}
+			var err error
+			if v.Error != "" {
+				err = errors.New(v.Error)
+			}
+			tracer.Record(v.Name, parent, *v.Started, *v.Completed, attrs, err)
 		}
-		return nil
+	}
+}
+
+// countSteps returns a status watcher that counts the completed vertexes by
+// cache status.
+func countSteps() func(*controlapi.StatusResponse) {
+	counted := map[digest.Digest]bool{}
+	return func(resp *controlapi.StatusResponse) {
+		for _, v := range resp.Vertexes {
+			if v.Completed == nil || counted[v.Digest] {
+				continue
+			}
+			counted[v.Digest] = true
+			metrics.BuildStepsTotal.WithLabelValues(strconv.FormatBool(v.Cached)).Inc()
+		}
+	}
+}
+
+// discardProgress drains the status channel without displaying anything.
+func discardProgress(ch chan *controlapi.StatusResponse) error {
+	for range ch {
+	}
+	return nil
+}
+
+// showProgress displays the status updates in the -progress mode: the
+// interactive display of buildkit with tty, lines with plain, and tty when
+// stderr is a terminal with auto. With json the events are written to
+// stdout.
+func showProgress(ch chan *controlapi.StatusResponse, mode string) error {
+	c, err := console.ConsoleFromFile(os.Stderr)
+	switch {
+	case mode == progressJSON:
+		return jsonProgress(os.Stdout, ch)
+	case mode == progressPlain || (mode != progressTTY && err != nil):
+		return plainProgress(os.Stderr, ch)
+	case err != nil:
+		return fmt.Errorf("-progress %s needs stderr to be a terminal: %v", mode, err)
 	}
 	// Use BuildKit progress UI if console is available
 	displayCh := make(chan *bkclient.SolveStatus)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"regexp"
 	"runtime"
 	"testing"
 )
@@ -107,3 +108,12 @@ func TestBuildAPT(t *testing.T) {
   RUN apt update
   `))
 }
+
+func TestBuildQuiet(t *testing.T) {
+	name := "testbuildquiet"
+
+	out := runStdout(t, "build", "-q", "-t", name, "-f", "testdata/Dockerfile.test-build-dockerfile-not-in-context", ".")
+	if !regexp.MustCompile(`^sha256:[a-f0-9]{64}\n$`).MatchString(out) {
+		t.Fatalf("expected only the image digest line in quiet build output, got: %q", out)
+	}
+}
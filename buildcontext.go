@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	units "github.com/docker/go-units"
+	"github.com/genuinetools/img/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// gitContextRe matches the git URLs build contexts can be cloned from,
+	// with an optional #REF[:DIR] fragment.
+	gitContextRe = regexp.MustCompile(`^(git://|git@|ssh://|https?://.*\.git(#|$))`)
+
+	// httpContextRe matches the URLs of archives or Dockerfiles build
+	// contexts can be downloaded from.
+	httpContextRe = regexp.MustCompile(`^https?://`)
+
+	// commitRe matches the refs of git contexts that are commits rather than
+	// branches or tags.
+	commitRe = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+	fromImageRe = regexp.MustCompile(`(?i)^(\s*FROM\s+(?:--\S+\s+)*)(\S+)`)
+	copyFromRe  = regexp.MustCompile(`(?i)(--from=)(\S+)`)
+)
+
+// buildContexts resolves the -build-context flags, in the NAME=VALUE format,
+// to the images the Dockerfile should use for NAME. VALUE is an image as
+// docker-image://REF, a git URL, or a directory. Directories and git
+// repositories are imported as images, unless local is false.
+func buildContexts(ctx context.Context, c *client.Client, flags []string, local bool) (map[string]string, error) {
+	refs := map[string]string{}
+	for _, f := range flags {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid build-context value %s, must be NAME=VALUE", f)
+		}
+		name, value := kv[0], kv[1]
+
+		if strings.HasPrefix(value, "docker-image://") {
+			named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(value, "docker-image://"))
+			if err != nil {
+				return nil, fmt.Errorf("parsing build context %s failed: %v", name, err)
+			}
+			refs[name] = reference.TagNameOnly(named).String()
+			continue
+		}
+		if !local {
+			return nil, fmt.Errorf("build context %s is imported to the local state and can only be an image with -builder", name)
+		}
+
+		img, err := importBuildContext(ctx, c, value)
+		if err != nil {
+			return nil, fmt.Errorf("importing build context %s failed: %v", name, err)
+		}
+		logrus.Debugf("imported build context %s from %s as %s", name, value, img)
+		refs[name] = img
+	}
+	return refs, nil
+}
+
+// importBuildContext imports a directory or git URL as an image and returns
+// its name.
+func importBuildContext(ctx context.Context, c *client.Client, value string) (string, error) {
+	dir := value
+	if gitContextRe.MatchString(value) {
+		tmp, err := ioutil.TempDir("", "img-build-context-")
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(tmp)
+		if dir, err = cloneGitContext(value, tmp); err != nil {
+			return "", err
+		}
+	}
+	img, err := c.ImportBuildContext(ctx, dir)
+	if err != nil {
+		return "", err
+	}
+	return img.Name, nil
+}
+
+// frontendContext returns whether the build context is a URL the dockerfile
+// frontend fetches itself, with the git or http source of buildkit, rather
+// than one cloned or downloaded to a temporary directory.
+func (cmd *buildCommand) frontendContext() bool {
+	if cmd.readsDockerfile() {
+		return false
+	}
+	if gitContextRe.MatchString(cmd.contextDir) {
+		return frontendGitContext(cmd.contextDir)
+	}
+	// The http source cannot pin the checksum of the download.
+	return httpContextRe.MatchString(cmd.contextDir) && cmd.contextChecksum == ""
+}
+
+// readsDockerfile returns whether the build reads the Dockerfile before the
+// frontend does, which needs it on the local filesystem.
+func (cmd *buildCommand) readsDockerfile() bool {
+	if len(cmd.buildContexts) > 0 || len(cmd.noCacheFilter) > 0 || offline || cmd.dryRun || cmd.debugOnFailure {
+		return true
+	}
+	if mode, err := parseProvenanceMode(cmd.provenance); err == nil && mode == provenanceMax {
+		return true
+	}
+	// A Dockerfile from STDIN, a URL or outside of the context.
+	return filepath.IsAbs(cmd.dockerfilePath)
+}
+
+// frontendGitContext returns whether the git source of the vendored
+// frontend can fetch the git URL: it only knows git://, git@ and http(s)
+// URLs of a .git repository, takes the fragment as the ref without a
+// directory, and cannot authenticate.
+func frontendGitContext(url string) bool {
+	if strings.HasPrefix(url, "ssh://") || os.Getenv("GIT_AUTH_TOKEN") != "" {
+		return false
+	}
+	i := strings.LastIndex(url, "#")
+	if i < 0 {
+		return true
+	}
+	ref := url[i+1:]
+	return ref != "" && !strings.Contains(ref, ":")
+}
+
+// cloneGitContext clones a git URL with an optional #REF[:DIR] fragment to
+// dir and returns the directory of the context in it. REF is a branch, a tag
+// or a commit.
+//
+// It is used for the git contexts the frontend cannot fetch itself, see
+// frontendGitContext, and for the builds reading the Dockerfile. Unlike the
+// git source of buildkit, it also checks out the submodules.
+func cloneGitContext(url, dir string) (string, error) {
+	var ref, subdir string
+	if i := strings.LastIndex(url, "#"); i >= 0 {
+		url, ref = url[:i], url[i+1:]
+		if j := strings.Index(ref, ":"); j >= 0 {
+			ref, subdir = ref[:j], ref[j+1:]
+		}
+	}
+
+	// Authenticate to HTTPS remotes with the token in $GIT_AUTH_TOKEN, in
+	// the environment so it is not in the arguments of the process. The
+	// header is only sent to the host of the remote, not to the ones of its
+	// submodules.
+	env := os.Environ()
+	if token := os.Getenv("GIT_AUTH_TOKEN"); token != "" && strings.HasPrefix(url, "https://") {
+		u, err := neturl.Parse(url)
+		if err != nil {
+			return "", fmt.Errorf("parsing git URL %s failed: %v", url, err)
+		}
+		auth := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + token))
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http."+u.Scheme+"://"+u.Host+"/.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+		)
+	}
+	git := func(args ...string) error {
+		cmd := exec.Command("git", args...)
+		cmd.Env = env
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("git %s: %v: %s", args[0], err, bytes.TrimSpace(out))
+		}
+		return nil
+	}
+
+	if commitRe.MatchString(ref) {
+		// Only branches and tags can be cloned shallowly, commits are checked
+		// out of a full clone.
+		if err := git("clone", "--no-checkout", url, dir); err != nil {
+			return "", err
+		}
+		if err := git("-C", dir, "checkout", "--detach", ref); err != nil {
+			return "", err
+		}
+		if err := git("-C", dir, "submodule", "update", "--init", "--recursive"); err != nil {
+			return "", err
+		}
+	} else {
+		args := []string{"clone", "--depth", "1", "--recurse-submodules", "--shallow-submodules"}
+		if ref != "" {
+			args = append(args, "--branch", ref)
+		}
+		if err := git(append(args, url, dir)...); err != nil {
+			return "", err
+		}
+	}
+
+	// The directory may not leave the repository through symlinks.
+	contextDir, err := securejoin.SecureJoin(dir, subdir)
+	if err != nil {
+		return "", err
+	}
+	if fi, err := os.Stat(contextDir); err != nil || !fi.IsDir() {
+		return "", fmt.Errorf("%s is not a directory of the repository", subdir)
+	}
+	return contextDir, nil
+}
+
+// downloadContext downloads a tar archive, which may be compressed, or a
+// lone Dockerfile from url and extracts it to dir. It is verified against
+// checksum, when it is set, before anything is extracted.
+//
+// It is used for the contexts pinned to a checksum, which the http source
+// of buildkit cannot verify, and for the builds reading the Dockerfile; the
+// frontend downloads the others itself.
+func downloadContext(url, checksum, dir, dockerfileName string) error {
+	var expected digest.Digest
+	if checksum != "" {
+		var err error
+		if expected, err = digest.Parse(checksum); err != nil {
+			return fmt.Errorf("invalid context checksum %s: %v", checksum, err)
+		}
+	}
+
+	body, err := httpGet(url, maxContextSize)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f, err := ioutil.TempFile("", "img-build-context-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	algorithm := digest.Canonical
+	if expected != "" {
+		algorithm = expected.Algorithm()
+	}
+	dgstr := algorithm.Digester()
+	if _, err := io.Copy(io.MultiWriter(f, dgstr.Hash()), body); err != nil {
+		return err
+	}
+	if expected != "" && dgstr.Digest() != expected {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", expected, dgstr.Digest())
+	}
+	logrus.Debugf("downloaded build context %s with digest %s", url, dgstr.Digest())
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return extractContext(dir, f, dockerfileName)
+}
+
+const (
+	// maxContextSize is the largest build context that is downloaded or
+	// read from STDIN, compressed or unpacked.
+	maxContextSize = 4 << 30
+	// maxDockerfileSize is the largest Dockerfile that is downloaded.
+	maxDockerfileSize = 10 << 20
+	// downloadTimeout is how long downloading a build context or a
+	// Dockerfile may take.
+	downloadTimeout = 30 * time.Minute
+)
+
+var downloadClient = &http.Client{Timeout: downloadTimeout}
+
+// httpGet returns the body of a successful GET request to url. Reading more
+// than max bytes of it fails.
+func httpGet(url string, max int64) (io.ReadCloser, error) {
+	resp, err := downloadClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	if resp.ContentLength > max {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s exceeds the limit of %s", url, units.BytesSize(float64(resp.ContentLength)), units.BytesSize(float64(max)))
+	}
+	return &limitedBody{
+		Reader: io.LimitReader(resp.Body, max+1),
+		Closer: resp.Body,
+		url:    url,
+		max:    max,
+	}, nil
+}
+
+// limitedBody is the body of a response, which fails past max bytes rather
+// than being truncated.
+type limitedBody struct {
+	io.Reader
+	io.Closer
+	url  string
+	max  int64
+	read int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	b.read += int64(n)
+	if b.read > b.max {
+		return n, fmt.Errorf("GET %s: the response exceeds the limit of %s", b.url, units.BytesSize(float64(b.max)))
+	}
+	return n, err
+}
+
+// rewriteDockerfile replaces NAME with the image of the named build contexts
+// in the FROM NAME and COPY --from=NAME instructions of a Dockerfile.
+func rewriteDockerfile(dt []byte, refs map[string]string) ([]byte, error) {
+	result, err := parser.Parse(bytes.NewReader(dt))
+	if err != nil {
+		return nil, fmt.Errorf("parsing dockerfile failed: %v", err)
+	}
+
+	lookup := func(name string) (string, bool) {
+		for k, v := range refs {
+			if strings.EqualFold(k, name) {
+				return v, true
+			}
+		}
+		return "", false
+	}
+
+	// The flags of the instructions are on their first line.
+	lines := strings.Split(string(dt), "\n")
+	for _, n := range result.AST.Children {
+		if n.StartLine < 1 || n.StartLine > len(lines) {
+			continue
+		}
+		i := n.StartLine - 1
+		switch n.Value {
+		case "from":
+			if m := fromImageRe.FindStringSubmatchIndex(lines[i]); m != nil {
+				if ref, ok := lookup(lines[i][m[4]:m[5]]); ok {
+					lines[i] = lines[i][:m[4]] + ref + lines[i][m[5]:]
+				}
+			}
+		case "copy":
+			lines[i] = copyFromRe.ReplaceAllStringFunc(lines[i], func(s string) string {
+				if ref, ok := lookup(strings.SplitN(s, "=", 2)[1]); ok {
+					return "--from=" + ref
+				}
+				return s
+			})
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
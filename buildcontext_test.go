@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRewriteDockerfile(t *testing.T) {
+	refs := map[string]string{
+		"base":  "docker-image://r.j3ss.co/base:latest",
+		"Tools": "local://tools",
+	}
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "from",
+			input:    "FROM base\nRUN make\n",
+			expected: "FROM docker-image://r.j3ss.co/base:latest\nRUN make\n",
+		},
+		{
+			name:     "from with flags and a stage name",
+			input:    "from --platform=$BUILDPLATFORM base AS build\n",
+			expected: "from --platform=$BUILDPLATFORM docker-image://r.j3ss.co/base:latest AS build\n",
+		},
+		{
+			name:     "copy from, case insensitive",
+			input:    "FROM alpine\nCOPY --from=tools /bin/tool /usr/bin/\ncopy --chown=1:1 --from=TOOLS /etc /etc\n",
+			expected: "FROM alpine\nCOPY --from=local://tools /bin/tool /usr/bin/\ncopy --chown=1:1 --from=local://tools /etc /etc\n",
+		},
+		{
+			name:     "other names and instructions",
+			input:    "FROM alpine AS base\nRUN echo base \\\n  base\nCOPY --from=builder /x /x\n",
+			expected: "FROM alpine AS base\nRUN echo base \\\n  base\nCOPY --from=builder /x /x\n",
+		},
+		{
+			name:     "comments and continuations",
+			input:    "# FROM base\nFROM \\\n  base\n",
+			expected: "# FROM base\nFROM \\\n  base\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dt, err := rewriteDockerfile([]byte(tt.input), refs)
+			if err != nil {
+				t.Fatalf("rewriting dockerfile failed: %v", err)
+			}
+			if string(dt) != tt.expected {
+				t.Fatalf("expected:\n%s\ngot:\n%s", tt.expected, dt)
+			}
+		})
+	}
+}
+
+func TestRewriteDockerfileInvalid(t *testing.T) {
+	_, err := rewriteDockerfile([]byte("# escape=x\nFROM base\n"), nil)
+	if err == nil || !strings.Contains(err.Error(), "parsing dockerfile failed") {
+		t.Fatalf("expected a parse error, got: %v", err)
+	}
+}
+
+func TestFrontendContext(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmd      buildCommand
+		token    string
+		expected bool
+	}{
+		{
+			name:     "https repository",
+			cmd:      buildCommand{contextDir: "https://github.com/genuinetools/img.git"},
+			expected: true,
+		},
+		{
+			name:     "git repository with a branch",
+			cmd:      buildCommand{contextDir: "git@github.com:genuinetools/img.git#master", dockerfilePath: "docker/Dockerfile"},
+			expected: true,
+		},
+		{
+			name: "repository directory",
+			cmd:  buildCommand{contextDir: "https://github.com/genuinetools/img.git#master:docker"},
+		},
+		{
+			name: "empty fragment",
+			cmd:  buildCommand{contextDir: "https://github.com/genuinetools/img.git#"},
+		},
+		{
+			name: "ssh repository",
+			cmd:  buildCommand{contextDir: "ssh://git@github.com/genuinetools/img.git"},
+		},
+		{
+			name:  "token",
+			cmd:   buildCommand{contextDir: "https://github.com/genuinetools/img.git"},
+			token: "secret",
+		},
+		{
+			name: "local dockerfile",
+			cmd:  buildCommand{contextDir: "https://github.com/genuinetools/img.git", dockerfilePath: "/tmp/Dockerfile"},
+		},
+		{
+			name: "dry run",
+			cmd:  buildCommand{contextDir: "https://github.com/genuinetools/img.git", dryRun: true},
+		},
+		{
+			name: "max provenance",
+			cmd:  buildCommand{contextDir: "https://github.com/genuinetools/img.git", provenance: "mode=max"},
+		},
+		{
+			name:     "min provenance",
+			cmd:      buildCommand{contextDir: "https://github.com/genuinetools/img.git", provenance: "mode=min"},
+			expected: true,
+		},
+		{
+			name:     "archive",
+			cmd:      buildCommand{contextDir: "https://example.com/thing/context.tar.gz", dockerfilePath: "docker/Dockerfile"},
+			expected: true,
+		},
+		{
+			name: "archive with a checksum",
+			cmd:  buildCommand{contextDir: "https://example.com/thing/context.tar.gz", contextChecksum: "sha256:5719d2d19a8f5aae76ed65d505ac5b421fc7c61683752675840283556d90e466"},
+		},
+		{
+			name: "archive with a build context",
+			cmd:  buildCommand{contextDir: "https://example.com/thing/context.tar.gz", buildContexts: []string{"base=docker-image://alpine"}},
+		},
+		{
+			name: "directory",
+			cmd:  buildCommand{contextDir: "."},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("GIT_AUTH_TOKEN", tt.token)
+			defer os.Unsetenv("GIT_AUTH_TOKEN")
+			if got := tt.cmd.frontendContext(); got != tt.expected {
+				t.Fatalf("expected %t for %s, got %t", tt.expected, tt.cmd.contextDir, got)
+			}
+		})
+	}
+}
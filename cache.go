@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"strings"
+
+	controlapi "github.com/moby/buildkit/api/services/control"
+)
+
+// parseCacheOptions parses the -cache-to and -cache-from flags of a build.
+// -cache-to is in the type=registry,ref=REF[,mode=min|max] format, and
+// -cache-from in the [type=registry,]ref=REF format or just REF.
+func parseCacheOptions(to string, from []string) (controlapi.CacheOptions, error) {
+	var cache controlapi.CacheOptions
+	if to != "" {
+		attrs, err := parseCacheAttrs("cache-to", to)
+		if err != nil {
+			return cache, err
+		}
+		cache.ExportRef = attrs["ref"]
+		switch mode := attrs["mode"]; mode {
+		case "":
+		case "min", "max":
+			cache.ExportAttrs = map[string]string{"mode": mode}
+		default:
+			return cache, fmt.Errorf("invalid -cache-to mode %q, must be min or max", mode)
+		}
+	}
+	for _, f := range from {
+		if !strings.Contains(f, "=") {
+			cache.ImportRefs = append(cache.ImportRefs, f)
+			continue
+		}
+		attrs, err := parseCacheAttrs("cache-from", f)
+		if err != nil {
+			return cache, err
+		}
+		cache.ImportRefs = append(cache.ImportRefs, attrs["ref"])
+	}
+	return cache, nil
+}
+
+// parseCacheAttrs parses the KEY=VALUE attributes of a registry cache.
+func parseCacheAttrs(flag, s string) (map[string]string, error) {
+	fields, err := csv.NewReader(strings.NewReader(s)).Read()
+	if err != nil {
+		return nil, fmt.Errorf("parsing -%s %q failed: %v", flag, s, err)
+	}
+	attrs := map[string]string{"type": "registry"}
+	for _, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid -%s %q, must be KEY=VALUE pairs", flag, s)
+		}
+		attrs[strings.ToLower(strings.TrimSpace(kv[0]))] = kv[1]
+	}
+	if attrs["type"] != "registry" {
+		return nil, fmt.Errorf("invalid -%s type %q, only registry is supported", flag, attrs["type"])
+	}
+	if attrs["ref"] == "" {
+		return nil, fmt.Errorf("-%s %q has no ref", flag, s)
+	}
+	return attrs, nil
+}
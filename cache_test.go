@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	controlapi "github.com/moby/buildkit/api/services/control"
+)
+
+func TestParseCacheOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		to       string
+		from     []string
+		expected controlapi.CacheOptions
+		err      string
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:     "cache-to",
+			to:       "type=registry,ref=r.j3ss.co/img:cache",
+			expected: controlapi.CacheOptions{ExportRef: "r.j3ss.co/img:cache"},
+		},
+		{
+			name:     "cache-to without a type",
+			to:       "ref=r.j3ss.co/img:cache, Mode=max",
+			expected: controlapi.CacheOptions{ExportRef: "r.j3ss.co/img:cache", ExportAttrs: map[string]string{"mode": "max"}},
+		},
+		{
+			name:     "cache-from",
+			from:     []string{"r.j3ss.co/img:cache", "type=registry,ref=r.j3ss.co/img:main"},
+			expected: controlapi.CacheOptions{ImportRefs: []string{"r.j3ss.co/img:cache", "r.j3ss.co/img:main"}},
+		},
+		{
+			name: "invalid mode",
+			to:   "ref=r.j3ss.co/img:cache,mode=all",
+			err:  `invalid -cache-to mode "all", must be min or max`,
+		},
+		{
+			name: "inline cache",
+			to:   "type=inline",
+			err:  `invalid -cache-to type "inline", only registry is supported`,
+		},
+		{
+			name: "no ref",
+			from: []string{"type=registry"},
+			err:  `-cache-from "type=registry" has no ref`,
+		},
+		{
+			name: "not key value",
+			to:   "ref=r.j3ss.co/img:cache,max",
+			err:  "must be KEY=VALUE pairs",
+		},
+		{
+			name: "bad quoting",
+			to:   `"ref=r.j3ss.co/img:cache`,
+			err:  "parsing -cache-to",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, err := parseCacheOptions(tt.to, tt.from)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error to contain %q, got: %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsing cache options failed: %v", err)
+			}
+			if !reflect.DeepEqual(cache, tt.expected) {
+				t.Fatalf("expected %#v, got %#v", tt.expected, cache)
+			}
+		})
+	}
+}
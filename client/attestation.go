@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// MediaTypeInToto is the media type of the in-toto statements of
+	// attestations.
+	MediaTypeInToto = "application/vnd.in-toto+json"
+
+	// The annotations of the attestation manifests in an index, as set by
+	// buildkit, pointing them at the image manifest they are about.
+	annotationReferenceDigest = "vnd.docker.reference.digest"
+	annotationReferenceType   = "vnd.docker.reference.type"
+	referenceTypeAttestation  = "attestation-manifest"
+	annotationPredicateType   = "in-toto.io/predicate-type"
+)
+
+// AttachAttestation attaches an in-toto statement about an image to it the
+// way buildkit does: the image is replaced by an index of its manifest and
+// an attestation manifest with the statement as its layer, for the unknown
+// platform so runtimes skip it. The attestation manifest is added to the
+// index of an image with attestations already.
+func (c *Client) AttachAttestation(ctx context.Context, image, predicateType string, statement []byte) (images.Image, error) {
+	opt, err := c.createWorkerOpt()
+	if err != nil {
+		return images.Image{}, fmt.Errorf("creating worker opt failed: %v", err)
+	}
+	cs := opt.ContentStore
+
+	img, err := getImage(ctx, opt.ImageStore, image)
+	if err != nil {
+		return images.Image{}, err
+	}
+	// The manifests of the index, the image manifest first.
+	var manifests []ocispec.Descriptor
+	switch img.Target.MediaType {
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		manifest := img.Target
+		platform := platforms.DefaultSpec()
+		manifest.Platform = &platform
+		manifests = []ocispec.Descriptor{manifest}
+	case ocispec.MediaTypeImageIndex:
+		dt, err := content.ReadBlob(ctx, cs, img.Target.Digest)
+		if err != nil {
+			return images.Image{}, err
+		}
+		var index ocispec.Index
+		if err := json.Unmarshal(dt, &index); err != nil {
+			return images.Image{}, err
+		}
+		manifests = index.Manifests
+	default:
+		return images.Image{}, fmt.Errorf("attaching attestations to %s of type %s is not supported", img.Name, img.Target.MediaType)
+	}
+	subject, err := platformManifest(ctx, cs, img.Target)
+	if err != nil {
+		return images.Image{}, err
+	}
+
+	layer, err := writeBlob(ctx, cs, MediaTypeInToto, statement)
+	if err != nil {
+		return images.Image{}, err
+	}
+	layer.Annotations = map[string]string{annotationPredicateType: predicateType}
+	config, err := writeJSON(ctx, cs, ocispec.MediaTypeImageConfig, ocispec.Image{
+		Architecture: "unknown",
+		OS:           "unknown",
+		RootFS:       ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{layer.Digest}},
+	})
+	if err != nil {
+		return images.Image{}, err
+	}
+	// The manifest is labeled without walking it like writeManifest does,
+	// which warns about the unknown media type of the statement.
+	attestation, err := writeJSON(ctx, cs, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		return images.Image{}, err
+	}
+	if err := labelChildren(ctx, cs, attestation, config, layer); err != nil {
+		return images.Image{}, err
+	}
+	attestation.Platform = &ocispec.Platform{Architecture: "unknown", OS: "unknown"}
+	attestation.Annotations = map[string]string{
+		annotationReferenceDigest: subject.Digest.String(),
+		annotationReferenceType:   referenceTypeAttestation,
+	}
+
+	if img.Target, err = writeIndex(ctx, cs, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: append(manifests, attestation),
+	}); err != nil {
+		return images.Image{}, err
+	}
+	img.CreatedAt = time.Now()
+	if err := putImage(ctx, opt.ImageStore, img); err != nil {
+		return images.Image{}, err
+	}
+	return img, nil
+}
+
+// writeIndex writes an index to the content store and labels the manifests
+// it references so they are not garbage collected.
+func writeIndex(ctx context.Context, cs content.Store, index ocispec.Index) (ocispec.Descriptor, error) {
+	desc, err := writeJSON(ctx, cs, ocispec.MediaTypeImageIndex, struct {
+		MediaType string `json:"mediaType"`
+		ocispec.Index
+	}{ocispec.MediaTypeImageIndex, index})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err := labelChildren(ctx, cs, desc, index.Manifests...); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// labelChildren labels a blob with the blobs it references, so they are not
+// garbage collected before it is.
+func labelChildren(ctx context.Context, cs content.Store, desc ocispec.Descriptor, children ...ocispec.Descriptor) error {
+	_, err := images.SetChildrenLabels(cs, func(context.Context, ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		return children, nil
+	})(ctx, desc)
+	if err != nil {
+		return fmt.Errorf("labeling content of %s failed: %v", desc.Digest, err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestAttachAttestation(t *testing.T) {
+	c, cleanup := testWorkerClient(t, testImage{
+		name:   "docker.io/library/attesttest:latest",
+		config: ocispec.Image{OS: "linux", Architecture: runtime.GOARCH},
+		layers: []map[string]string{{"app": "app"}},
+	})
+	defer cleanup()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+	cs := c.workerOpt.ContentStore
+
+	img, err := getImage(ctx, c.workerOpt.ImageStore, "docker.io/library/attesttest:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := img.Target
+
+	statements := []struct {
+		predicateType string
+		statement     string
+	}{
+		{"https://slsa.dev/provenance/v0.2", `{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"https://slsa.dev/provenance/v0.2"}`},
+		{"https://spdx.dev/Document", `{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"https://spdx.dev/Document"}`},
+	}
+	for i, s := range statements {
+		img, err = c.AttachAttestation(ctx, "docker.io/library/attesttest:latest", s.predicateType, []byte(s.statement))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Target.MediaType != ocispec.MediaTypeImageIndex {
+			t.Fatalf("expected the image to be an index, got %s", img.Target.MediaType)
+		}
+
+		var index ocispec.Index
+		readTestJSON(t, cs, img.Target, &index)
+		// The image manifest comes first, for the default platform, with
+		// the attestation manifests after it.
+		if len(index.Manifests) != i+2 {
+			t.Fatalf("expected %d manifests in the index, got %d", i+2, len(index.Manifests))
+		}
+		m := index.Manifests[0]
+		if m.Digest != subject.Digest || m.Platform == nil || platforms.Format(*m.Platform) != platforms.Format(platforms.DefaultSpec()) {
+			t.Fatalf("expected the image manifest %s for the default platform first, got %s for %v", subject.Digest, m.Digest, m.Platform)
+		}
+
+		a := index.Manifests[i+1]
+		if a.MediaType != ocispec.MediaTypeImageManifest || a.Platform == nil || a.Platform.OS != "unknown" || a.Platform.Architecture != "unknown" {
+			t.Fatalf("expected an attestation manifest for the unknown platform, got %s for %v", a.MediaType, a.Platform)
+		}
+		if a.Annotations[annotationReferenceDigest] != subject.Digest.String() || a.Annotations[annotationReferenceType] != referenceTypeAttestation {
+			t.Fatalf("expected the attestation to be about %s, got the annotations %v", subject.Digest, a.Annotations)
+		}
+
+		var manifest ocispec.Manifest
+		readTestJSON(t, cs, a, &manifest)
+		if len(manifest.Layers) != 1 {
+			t.Fatalf("expected the statement as the only layer, got %d layers", len(manifest.Layers))
+		}
+		l := manifest.Layers[0]
+		if l.MediaType != MediaTypeInToto || l.Annotations[annotationPredicateType] != s.predicateType {
+			t.Fatalf("expected an in-toto statement of type %s, got %s with the annotations %v", s.predicateType, l.MediaType, l.Annotations)
+		}
+		dt, err := content.ReadBlob(ctx, cs, l.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(dt) != s.statement {
+			t.Fatalf("expected the statement %s, got %s", s.statement, dt)
+		}
+		var config ocispec.Image
+		readTestJSON(t, cs, manifest.Config, &config)
+		if len(config.RootFS.DiffIDs) != 1 || config.RootFS.DiffIDs[0] != l.Digest {
+			t.Fatalf("expected the digest of the statement as the diff ID, got %v", config.RootFS.DiffIDs)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/identity"
+)
+
+// DefaultDockerfileName is the name of the Dockerfile used when BuildOpt
+// does not set one.
+const DefaultDockerfileName = "Dockerfile"
+
+// BuildOpt holds the options for building an image from a Dockerfile.
+type BuildOpt struct {
+	// ContextDir is the directory of the build context. It may be empty if
+	// the context is a git repository or URL set with the "context"
+	// frontend attribute.
+	ContextDir string
+	// DockerfileDir is the directory of the Dockerfile, it defaults to
+	// ContextDir.
+	DockerfileDir string
+	// Dockerfile is the name of the Dockerfile in DockerfileDir, it defaults
+	// to DefaultDockerfileName.
+	Dockerfile string
+	// Tag is the name of the image, "latest" is used if it has no tag.
+	Tag string
+	// Target is the stage of the Dockerfile to build.
+	Target string
+	// BuildArgs are the build-time variables.
+	BuildArgs map[string]string
+	// FrontendAttrs are extra attributes passed to the Dockerfile frontend,
+	// they override the attributes set from the other options.
+	FrontendAttrs map[string]string
+	// Ref identifies the build in the status updates, a random one is used
+	// if it is empty.
+	Ref string
+	// Push pushes the image to its registry once it is built.
+	Push bool
+	// CacheTo is the registry reference to export the build cache to.
+	CacheTo string
+	// CacheToMode is "min" to export the cache of the layers of the image
+	// only, the default, or "max" to export the cache of every step.
+	CacheToMode string
+	// CacheFrom are registry references to import build cache from.
+	CacheFrom []string
+}
+
+// Build builds an image from a Dockerfile and stores it in the image store.
+// The status updates of the build are sent on ch, which is closed when the
+// build finishes. ch may be nil if the updates are not needed.
+func (c *Client) Build(ctx context.Context, opt BuildOpt, ch chan *controlapi.StatusResponse) (*controlapi.SolveResponse, error) {
+	if ch == nil {
+		ch = make(chan *controlapi.StatusResponse)
+		go func() {
+			for range ch {
+			}
+		}()
+	}
+
+	exporterAttrs, frontendAttrs, localDirs, err := opt.solveAttrs()
+	if err != nil {
+		close(ch)
+		return nil, err
+	}
+	if opt.Ref == "" {
+		opt.Ref = identity.NewID()
+	}
+
+	var (
+		resp   *controlapi.SolveResponse
+		solved bool
+	)
+	err = c.WithSession(ctx, localDirs, func(ctx context.Context, sessionID string) error {
+		solved = true
+		var err error
+		resp, err = c.Solve(ctx, &controlapi.SolveRequest{
+			Ref:           opt.Ref,
+			Session:       sessionID,
+			Exporter:      "image",
+			ExporterAttrs: exporterAttrs,
+			Frontend:      "dockerfile.v0",
+			FrontendAttrs: frontendAttrs,
+			Cache:         opt.cacheOptions(),
+		}, ch)
+		return err
+	})
+	// Solve closes the channel, make sure it is closed if we never got
+	// that far.
+	if !solved {
+		close(ch)
+	}
+	return resp, err
+}
+
+// solveAttrs returns the image exporter and Dockerfile frontend attributes
+// for the options, and the local dirs the build needs.
+func (opt BuildOpt) solveAttrs() (exporterAttrs, frontendAttrs, localDirs map[string]string, err error) {
+	named, err := reference.ParseNormalizedNamed(opt.Tag)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("parsing image name %q failed: %v", opt.Tag, err)
+	}
+	exporterAttrs = map[string]string{
+		"name": reference.TagNameOnly(named).String(),
+	}
+	if opt.Push {
+		exporterAttrs["push"] = "true"
+	}
+
+	frontendAttrs = map[string]string{
+		"filename": opt.Dockerfile,
+		"target":   opt.Target,
+	}
+	if frontendAttrs["filename"] == "" {
+		frontendAttrs["filename"] = DefaultDockerfileName
+	}
+	for k, v := range opt.BuildArgs {
+		frontendAttrs["build-arg:"+k] = v
+	}
+	if len(opt.CacheFrom) > 0 {
+		frontendAttrs["cache-from"] = strings.Join(opt.CacheFrom, ",")
+	}
+	for k, v := range opt.FrontendAttrs {
+		frontendAttrs[k] = v
+	}
+
+	if opt.ContextDir != "" {
+		dockerfileDir := opt.DockerfileDir
+		if dockerfileDir == "" {
+			dockerfileDir = opt.ContextDir
+		}
+		localDirs = map[string]string{
+			"context":    opt.ContextDir,
+			"dockerfile": dockerfileDir,
+		}
+	}
+
+	return exporterAttrs, frontendAttrs, localDirs, nil
+}
+
+// cacheOptions returns the cache export and import options of the solve
+// request for the options. The Dockerfile frontend imports the cache itself,
+// from the "cache-from" attribute.
+func (opt BuildOpt) cacheOptions() controlapi.CacheOptions {
+	cache := controlapi.CacheOptions{
+		ExportRef:  opt.CacheTo,
+		ImportRefs: opt.CacheFrom,
+	}
+	if opt.CacheToMode != "" {
+		cache.ExportAttrs = map[string]string{"mode": opt.CacheToMode}
+	}
+	return cache
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// BuildContextRepository is the repository directories used as named build
+// contexts are imported to. Its registry does not exist, so the images are
+// resolved from the image store.
+const BuildContextRepository = "localhost/img-build-context"
+
+// ImportBuildContext imports a directory as an image with a single layer, so
+// Dockerfiles can build or copy from it by name. The image is tagged with
+// the digest of its layer, directories with the same content share it.
+func (c *Client) ImportBuildContext(ctx context.Context, dir string) (images.Image, error) {
+	opt, err := c.createWorkerOpt()
+	if err != nil {
+		return images.Image{}, fmt.Errorf("creating worker opt failed: %v", err)
+	}
+	cs := opt.ContentStore
+
+	layer, err := writeDirLayer(ctx, cs, dir)
+	if err != nil {
+		return images.Image{}, fmt.Errorf("importing build context %s failed: %v", dir, err)
+	}
+
+	config, err := writeJSON(ctx, cs, ocispec.MediaTypeImageConfig, ocispec.Image{
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+		RootFS:       ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{layer.Digest}},
+	})
+	if err != nil {
+		return images.Image{}, err
+	}
+	manifest, err := writeManifest(ctx, cs, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		return images.Image{}, err
+	}
+
+	img := images.Image{
+		Name:      BuildContextRepository + ":" + layer.Digest.Hex(),
+		Target:    manifest,
+		CreatedAt: time.Now(),
+	}
+	if err := putImage(ctx, opt.ImageStore, img); err != nil {
+		return images.Image{}, err
+	}
+	return img, nil
+}
+
+// writeDirLayer writes the content of a directory to the content store as
+// an uncompressed layer.
+func writeDirLayer(ctx context.Context, cs content.Store, dir string) (ocispec.Descriptor, error) {
+	if fi, err := os.Stat(dir); err != nil {
+		return ocispec.Descriptor{}, err
+	} else if !fi.IsDir() {
+		return ocispec.Descriptor{}, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	rc, err := archive.TarWithOptions(dir, &archive.TarOptions{Compression: archive.Uncompressed})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer rc.Close()
+
+	tmp, err := ioutil.TempFile("", "img-build-context-")
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	dgstr := digest.SHA256.Digester()
+	size, err := io.Copy(io.MultiWriter(tmp, dgstr.Hash()), rc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: dgstr.Digest(), Size: size}
+	if err := content.WriteBlob(ctx, cs, "build-context-"+desc.Digest.String(), tmp, desc.Size, desc.Digest); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("writing layer %s failed: %v", desc.Digest, err)
+	}
+	return desc, nil
+}
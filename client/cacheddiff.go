@@ -0,0 +1,542 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/continuity/fs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// maxCachedTrees is how many snapshot trees the differ keeps in memory.
+const maxCachedTrees = 8
+
+// maxCachedTreeMemory is about the memory the snapshot trees the differ keeps
+// may take in bytes, when there is no memory budget.
+const maxCachedTreeMemory = 256 << 20
+
+// fileNodeSize is about the memory a fileNode takes, with its name and file
+// info.
+const fileNodeSize = 256
+
+// memoryBudget is the memory img tries to stay under in bytes, 0 if there is
+// no budget.
+var memoryBudget int64
+
+// errTreeTooLarge is returned when the tree of a snapshot would take more of
+// the memory budget than the differ may use.
+var errTreeTooLarge = errors.New("snapshot tree exceeds the memory budget")
+
+// SetMemoryBudget sets the memory img tries to stay under in bytes. The
+// differ then keeps two snapshot trees in memory at most, of up to an eighth
+// of the budget each, and diffs the snapshots with larger trees by walking
+// them like containerd's walking differ, without keeping their trees. It must
+// be called before the client is used.
+func SetMemoryBudget(n int64) {
+	memoryBudget = n
+}
+
+// maxTreeNodes returns how many files the tree of a snapshot may have, 0 if
+// there is no limit.
+func maxTreeNodes() int {
+	if memoryBudget <= 0 {
+		return 0
+	}
+	n := int(memoryBudget / 8 / fileNodeSize)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// cachingDiff computes layer diffs like containerd's walking differ, but
+// keeps the file metadata and content digests of the read-only snapshots it
+// walks. A layer's snapshot is the snapshot below the next layer, so when an
+// image is exported every snapshot is walked once instead of twice, and the
+// content of files whose timestamps cannot tell whether they changed is
+// hashed once instead of being compared every time.
+type cachingDiff struct {
+	store content.Store
+
+	mu    sync.Mutex
+	trees map[string]*snapshotTree
+	order []string
+}
+
+// snapshotTree is the file tree of a snapshot, read once by the first diff
+// that needs it.
+type snapshotTree struct {
+	once  sync.Once
+	root  *fileNode
+	nodes int
+	err   error
+}
+
+// fileNode is a file of a snapshot. The digest of its content is computed
+// when a diff needs it.
+type fileNode struct {
+	name       string
+	fi         os.FileInfo
+	capability []byte
+	children   []*fileNode
+
+	hashOnce sync.Once
+	dgst     digest.Digest
+	hashErr  error
+}
+
+func newCachingDiff(store content.Store) diff.Comparer {
+	return &cachingDiff{
+		store: store,
+		trees: map[string]*snapshotTree{},
+	}
+}
+
+// Compare creates a diff between the given mounts and writes it to the
+// content store.
+func (d *cachingDiff) Compare(ctx context.Context, lower, upper []mount.Mount, opts ...diff.Opt) (ocispec.Descriptor, error) {
+	var config diff.Config
+	for _, opt := range opts {
+		if err := opt(&config); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	if config.MediaType == "" {
+		config.MediaType = ocispec.MediaTypeImageLayerGzip
+	}
+	var isCompressed bool
+	switch config.MediaType {
+	case ocispec.MediaTypeImageLayer:
+	case ocispec.MediaTypeImageLayerGzip:
+		isCompressed = true
+	default:
+		return ocispec.Descriptor{}, fmt.Errorf("unsupported diff media type: %v", config.MediaType)
+	}
+
+	var desc ocispec.Descriptor
+	err := mount.WithTempMount(ctx, lower, func(lowerRoot string) error {
+		return mount.WithTempMount(ctx, upper, func(upperRoot string) (err error) {
+			newReference := config.Reference == ""
+			if newReference {
+				config.Reference = uniqueRef()
+			}
+			cw, err := d.store.Writer(ctx, config.Reference, 0, "")
+			if err != nil {
+				return fmt.Errorf("opening writer failed: %v", err)
+			}
+			defer func() {
+				if err != nil {
+					cw.Close()
+					if newReference {
+						d.store.Abort(ctx, config.Reference)
+					}
+				}
+			}()
+			if !newReference {
+				if err := cw.Truncate(0); err != nil {
+					return err
+				}
+			}
+
+			if isCompressed {
+				dgstr := digest.SHA256.Digester()
+				compressed, err := compression.CompressStream(cw, compression.Gzip)
+				if err != nil {
+					return err
+				}
+				err = d.writeDiff(ctx, io.MultiWriter(compressed, dgstr.Hash()), lower, lowerRoot, upper, upperRoot)
+				compressed.Close()
+				if err != nil {
+					return fmt.Errorf("writing diff failed: %v", err)
+				}
+				if config.Labels == nil {
+					config.Labels = map[string]string{}
+				}
+				config.Labels["containerd.io/uncompressed"] = dgstr.Digest().String()
+			} else if err := d.writeDiff(ctx, cw, lower, lowerRoot, upper, upperRoot); err != nil {
+				return fmt.Errorf("writing diff failed: %v", err)
+			}
+
+			var commitOpts []content.Opt
+			if config.Labels != nil {
+				commitOpts = append(commitOpts, content.WithLabels(config.Labels))
+			}
+			dgst := cw.Digest()
+			if err := cw.Commit(ctx, 0, dgst, commitOpts...); err != nil {
+				return fmt.Errorf("committing diff failed: %v", err)
+			}
+			info, err := d.store.Info(ctx, dgst)
+			if err != nil {
+				return err
+			}
+			desc = ocispec.Descriptor{
+				MediaType: config.MediaType,
+				Size:      info.Size,
+				Digest:    info.Digest,
+			}
+			return nil
+		})
+	})
+	return desc, err
+}
+
+// writeDiff writes the changes from the lower to the upper snapshot as a
+// layer tarball.
+func (d *cachingDiff) writeDiff(ctx context.Context, w io.Writer, lower []mount.Mount, lowerRoot string, upper []mount.Mount, upperRoot string) error {
+	start := time.Now()
+	lw := newLayerWriter(w, upperRoot)
+	lowerTree, err := d.tree(lower, lowerRoot)
+	if err == nil {
+		var upperTree *fileNode
+		if upperTree, err = d.tree(upper, upperRoot); err == nil {
+			td := &treeDiff{ctx: ctx, lowerRoot: lowerRoot, upperRoot: upperRoot, changeFn: lw.HandleChange}
+			err = td.dir("/", lowerTree, upperTree)
+		}
+	}
+	if err == errTreeTooLarge {
+		// Walk the snapshots instead, without keeping their trees.
+		logrus.Debug("snapshot tree exceeds the memory budget, walking the snapshots")
+		err = fs.Changes(ctx, lowerRoot, upperRoot, lw.HandleChange)
+	}
+	if err != nil {
+		return err
+	}
+	logrus.WithField("d", time.Since(start)).Debug("computed layer diff")
+	return lw.Close()
+}
+
+// tree returns the file tree of the snapshot mounted at root, from the cache
+// if the snapshot is read-only.
+func (d *cachingDiff) tree(mounts []mount.Mount, root string) (*fileNode, error) {
+	key, ok := snapshotKey(mounts)
+	if !ok {
+		n, _, err := readTree(root, maxTreeNodes())
+		return n, err
+	}
+
+	maxTrees := maxCachedTrees
+	if memoryBudget > 0 {
+		maxTrees = 2
+	}
+	d.mu.Lock()
+	t, ok := d.trees[key]
+	if !ok {
+		t = &snapshotTree{}
+		d.trees[key] = t
+		d.order = append(d.order, key)
+		if len(d.order) > maxTrees {
+			delete(d.trees, d.order[0])
+			d.order = d.order[1:]
+		}
+	}
+	d.mu.Unlock()
+
+	t.once.Do(func() {
+		var nodes int
+		t.root, nodes, t.err = readTree(root, maxTreeNodes())
+		d.mu.Lock()
+		t.nodes = nodes
+		d.evictTrees(key)
+		d.mu.Unlock()
+	})
+	// A snapshot too large for the budget stays cached as such, so it is
+	// not read again.
+	if t.err != nil && t.err != errTreeTooLarge {
+		d.mu.Lock()
+		if d.trees[key] == t {
+			delete(d.trees, key)
+		}
+		d.mu.Unlock()
+	}
+	return t.root, t.err
+}
+
+// evictTrees drops the oldest cached trees, other than the tree of keep,
+// until the trees left take less memory than they may. d.mu must be held.
+func (d *cachingDiff) evictTrees(keep string) {
+	limit := int64(maxCachedTreeMemory)
+	if memoryBudget > 0 {
+		limit = memoryBudget / 4
+	}
+	var size int64
+	for _, t := range d.trees {
+		size += int64(t.nodes) * fileNodeSize
+	}
+	for i := 0; size > limit && i < len(d.order); {
+		key := d.order[i]
+		if key == keep {
+			i++
+			continue
+		}
+		size -= int64(d.trees[key].nodes) * fileNodeSize
+		delete(d.trees, key)
+		d.order = append(d.order[:i], d.order[i+1:]...)
+	}
+}
+
+// snapshotKey returns the key the tree of a snapshot is cached under, false
+// if the snapshot can change. Committed snapshots are mounted read-only, as
+// read-only bind mounts or overlays without an upper directory, and keep
+// their directories for as long as they exist.
+func snapshotKey(mounts []mount.Mount) (string, bool) {
+	if len(mounts) != 1 {
+		return "", false
+	}
+	m := mounts[0]
+	switch m.Type {
+	case "bind", "rbind":
+		for _, o := range m.Options {
+			if o == "ro" {
+				return m.Source, true
+			}
+		}
+	case "overlay":
+		var lowerDirs string
+		for _, o := range m.Options {
+			if strings.HasPrefix(o, "upperdir=") {
+				return "", false
+			}
+			if strings.HasPrefix(o, "lowerdir=") {
+				lowerDirs = strings.TrimPrefix(o, "lowerdir=")
+			}
+		}
+		if lowerDirs != "" {
+			return lowerDirs, true
+		}
+	}
+	return "", false
+}
+
+// readTree reads the file tree at root and returns it with how many files it
+// has. An empty root reads an empty tree, which is what the lower snapshot of
+// a base layer is. Reading stops with errTreeTooLarge past max files, unless
+// max is 0.
+func readTree(root string, max int) (*fileNode, int, error) {
+	fi, err := os.Lstat(root)
+	if err != nil {
+		return nil, 0, err
+	}
+	n := &fileNode{fi: fi}
+	left, nodes := max, 1
+	if err := readChildren(n, root, &left, &nodes); err != nil {
+		return nil, 0, err
+	}
+	return n, nodes, nil
+}
+
+// readChildren reads the files under the directory n at path and adds them
+// to nodes. left is how many files may still be read when the tree is
+// limited, it is not when it starts at 0.
+func readChildren(n *fileNode, path string, left, nodes *int) error {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	*nodes += len(infos)
+	if *left != 0 {
+		if *left -= len(infos); *left <= 0 {
+			return errTreeTooLarge
+		}
+	}
+	n.children = make([]*fileNode, 0, len(infos))
+	for _, fi := range infos {
+		p := filepath.Join(path, fi.Name())
+		capability, err := lgetxattr(p, "security.capability")
+		if err != nil {
+			return err
+		}
+		child := &fileNode{name: fi.Name(), fi: fi, capability: capability}
+		if fi.IsDir() {
+			if err := readChildren(child, p, left, nodes); err != nil {
+				return err
+			}
+		}
+		n.children = append(n.children, child)
+	}
+	return nil
+}
+
+// digest returns the digest of the content of a file, computing it the first
+// time.
+func (n *fileNode) digest(path string) (digest.Digest, error) {
+	n.hashOnce.Do(func() {
+		f, err := os.Open(path)
+		if err != nil {
+			n.hashErr = err
+			return
+		}
+		defer f.Close()
+		n.dgst, n.hashErr = digest.SHA256.FromReader(f)
+	})
+	return n.dgst, n.hashErr
+}
+
+// treeDiff walks the trees of two snapshots together, calling changeFn with
+// the changes in the same order fs.Changes does.
+type treeDiff struct {
+	ctx       context.Context
+	lowerRoot string
+	upperRoot string
+	changeFn  fs.ChangeFunc
+}
+
+// dir compares the children of a directory in both snapshots. The children
+// are sorted by name.
+func (td *treeDiff) dir(p string, lower, upper *fileNode) error {
+	if err := td.ctx.Err(); err != nil {
+		return err
+	}
+	i, j := 0, 0
+	for i < len(lower.children) || j < len(upper.children) {
+		switch {
+		case j == len(upper.children) || (i < len(lower.children) && lower.children[i].name < upper.children[j].name):
+			if err := td.changeFn(fs.ChangeKindDelete, filepath.Join(p, lower.children[i].name), nil, nil); err != nil {
+				return err
+			}
+			i++
+		case i == len(lower.children) || upper.children[j].name < lower.children[i].name:
+			if err := td.add(filepath.Join(p, upper.children[j].name), upper.children[j]); err != nil {
+				return err
+			}
+			j++
+		default:
+			if err := td.compare(filepath.Join(p, upper.children[j].name), lower.children[i], upper.children[j]); err != nil {
+				return err
+			}
+			i++
+			j++
+		}
+	}
+	return nil
+}
+
+// add reports a file, and everything under it, as added.
+func (td *treeDiff) add(p string, n *fileNode) error {
+	if err := td.changeFn(fs.ChangeKindAdd, p, n.fi, nil); err != nil {
+		return err
+	}
+	for _, c := range n.children {
+		if err := td.add(filepath.Join(p, c.name), c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compare reports the change of a file that is in both snapshots.
+func (td *treeDiff) compare(p string, lower, upper *fileNode) error {
+	same, err := td.sameFile(p, lower, upper)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case lower.fi.IsDir() && upper.fi.IsDir():
+		if !same {
+			if err := td.changeFn(fs.ChangeKindModify, p, upper.fi, nil); err != nil {
+				return err
+			}
+		}
+		return td.dir(p, lower, upper)
+	case upper.fi.IsDir():
+		if err := td.changeFn(fs.ChangeKindModify, p, upper.fi, nil); err != nil {
+			return err
+		}
+		for _, c := range upper.children {
+			if err := td.add(filepath.Join(p, c.name), c); err != nil {
+				return err
+			}
+		}
+		return nil
+	case !same:
+		return td.changeFn(fs.ChangeKindModify, p, upper.fi, nil)
+	case upper.fi.Sys().(*syscall.Stat_t).Nlink > 1:
+		// Unmodified hard links are reported, the layer writer needs them
+		// to link the modified files they share an inode with.
+		return td.changeFn(fs.ChangeKindUnmodified, p, upper.fi, nil)
+	}
+	return nil
+}
+
+// sameFile returns whether a file is unchanged. Like fs.Changes the content
+// is only compared when both modification times may have been truncated to
+// seconds, but the digests compared are computed once per snapshot.
+func (td *treeDiff) sameFile(p string, lower, upper *fileNode) (bool, error) {
+	if os.SameFile(lower.fi, upper.fi) {
+		return true, nil
+	}
+	ls, ok1 := lower.fi.Sys().(*syscall.Stat_t)
+	us, ok2 := upper.fi.Sys().(*syscall.Stat_t)
+	if !ok1 || !ok2 {
+		return false, nil
+	}
+	if ls.Mode != us.Mode || ls.Uid != us.Uid || ls.Gid != us.Gid || ls.Rdev != us.Rdev {
+		return false, nil
+	}
+	if !bytes.Equal(lower.capability, upper.capability) {
+		return false, nil
+	}
+	if upper.fi.IsDir() {
+		return true, nil
+	}
+
+	if lower.fi.Size() != upper.fi.Size() {
+		return false, nil
+	}
+	t1, t2 := lower.fi.ModTime(), upper.fi.ModTime()
+	if t1.Unix() != t2.Unix() {
+		return false, nil
+	}
+	if t1.Nanosecond() != 0 || t2.Nanosecond() != 0 {
+		return t1.Nanosecond() == t2.Nanosecond(), nil
+	}
+
+	lowerPath, upperPath := filepath.Join(td.lowerRoot, p), filepath.Join(td.upperRoot, p)
+	if upper.fi.Mode()&os.ModeSymlink != 0 {
+		l1, err := os.Readlink(lowerPath)
+		if err != nil {
+			return false, err
+		}
+		l2, err := os.Readlink(upperPath)
+		if err != nil {
+			return false, err
+		}
+		return l1 == l2, nil
+	}
+	if upper.fi.Size() == 0 || !upper.fi.Mode().IsRegular() {
+		return true, nil
+	}
+	d1, err := lower.digest(lowerPath)
+	if err != nil {
+		return false, err
+	}
+	d2, err := upper.digest(upperPath)
+	if err != nil {
+		return false, err
+	}
+	return d1 == d2, nil
+}
+
+func uniqueRef() string {
+	var b [3]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), base64.URLEncoding.EncodeToString(b[:]))
+}
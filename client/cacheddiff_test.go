@@ -0,0 +1,273 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/containerd/continuity/fs"
+	"golang.org/x/sys/unix"
+)
+
+// testTreeTime is the modification time of the files of the test trees. It
+// has no nanoseconds, so files of the same size have their content compared.
+var testTreeTime = time.Unix(1500000000, 0)
+
+// testTreeFiles creates the files under root, directories for the paths
+// ending with a slash, and gives them all the same modification time.
+func testTreeFiles(t *testing.T, root string, files map[string]string) {
+	for p, content := range files {
+		p = filepath.Join(root, p)
+		if content == "/" {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testTreeTimes(t, root)
+}
+
+// testTreeTimes sets the modification time of every file under root to
+// testTreeTime.
+func testTreeTimes(t *testing.T, root string) {
+	if err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(p, testTreeTime, testTreeTime)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// treeChanges returns the changes from lower to upper as computed by
+// treeDiff.
+func treeChanges(t *testing.T, lowerRoot, upperRoot string) []string {
+	lower, _, err := readTree(lowerRoot, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upper, _, err := readTree(upperRoot, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes []string
+	td := &treeDiff{ctx: context.Background(), lowerRoot: lowerRoot, upperRoot: upperRoot, changeFn: func(k fs.ChangeKind, p string, _ os.FileInfo, _ error) error {
+		changes = append(changes, fmt.Sprintf("%s %s", k, p))
+		return nil
+	}}
+	if err := td.dir("/", lower, upper); err != nil {
+		t.Fatal(err)
+	}
+	return changes
+}
+
+// walkChanges returns the changes from lower to upper as computed by
+// fs.Changes.
+func walkChanges(t *testing.T, lowerRoot, upperRoot string) []string {
+	var changes []string
+	if err := fs.Changes(context.Background(), lowerRoot, upperRoot, func(k fs.ChangeKind, p string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		changes = append(changes, fmt.Sprintf("%s %s", k, p))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return changes
+}
+
+func TestTreeDiff(t *testing.T) {
+	tests := map[string]struct {
+		lower, upper map[string]string
+		// setup changes the trees after the files are created.
+		setup    func(t *testing.T, lowerRoot, upperRoot string)
+		expected []string
+	}{
+		"unchanged": {
+			lower: map[string]string{"a": "a", "d/b": "b"},
+			upper: map[string]string{"a": "a", "d/b": "b"},
+		},
+		"added, modified and deleted files": {
+			lower:    map[string]string{"a": "a", "b": "b", "c": "c"},
+			upper:    map[string]string{"a": "a", "b": "bb", "d": "d"},
+			expected: []string{"modify /b", "delete /c", "add /d"},
+		},
+		"content change at the same size and time": {
+			lower:    map[string]string{"a": "a"},
+			upper:    map[string]string{"a": "b"},
+			expected: []string{"modify /a"},
+		},
+		"mode change": {
+			lower: map[string]string{"a": "a"},
+			upper: map[string]string{"a": "a"},
+			setup: func(t *testing.T, _, upperRoot string) {
+				if err := os.Chmod(filepath.Join(upperRoot, "a"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			},
+			expected: []string{"modify /a"},
+		},
+		"directory replaced by a file": {
+			lower:    map[string]string{"d/a": "a", "d/e/b": "b"},
+			upper:    map[string]string{"d": "d"},
+			expected: []string{"modify /d"},
+		},
+		"file replaced by a directory": {
+			lower:    map[string]string{"d": "d"},
+			upper:    map[string]string{"d/a": "a", "d/e/b": "b"},
+			expected: []string{"modify /d", "add /d/a", "add /d/e", "add /d/e/b"},
+		},
+		"deleted subtree": {
+			lower:    map[string]string{"a": "a", "d/e/f/b": "b", "d/c": "c", "d/g/": "/"},
+			upper:    map[string]string{"a": "a"},
+			expected: []string{"delete /d"},
+		},
+		"unmodified hard links": {
+			lower: map[string]string{"a": "a", "c": "c"},
+			upper: map[string]string{"a": "a", "c": "c"},
+			setup: func(t *testing.T, lowerRoot, upperRoot string) {
+				for _, root := range []string{lowerRoot, upperRoot} {
+					if err := os.Link(filepath.Join(root, "a"), filepath.Join(root, "b")); err != nil {
+						t.Fatal(err)
+					}
+					testTreeTimes(t, root)
+				}
+			},
+			expected: []string{"unmodified /a", "unmodified /b"},
+		},
+		"capability added": {
+			lower: map[string]string{"bin/ping": "ping"},
+			upper: map[string]string{"bin/ping": "ping"},
+			setup: func(t *testing.T, _, upperRoot string) {
+				// A version 2 capability set with CAP_NET_RAW effective and
+				// permitted.
+				capability := []byte{1, 0, 0, 2, 0, 32, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+				if err := unix.Setxattr(filepath.Join(upperRoot, "bin/ping"), "security.capability", capability, 0); err != nil {
+					t.Skipf("setting file capabilities is not supported: %v", err)
+				}
+			},
+			expected: []string{"modify /bin/ping"},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "img-treediff")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			lowerRoot, upperRoot := filepath.Join(dir, "lower"), filepath.Join(dir, "upper")
+			for _, root := range []string{lowerRoot, upperRoot} {
+				if err := os.Mkdir(root, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			testTreeFiles(t, lowerRoot, tt.lower)
+			testTreeFiles(t, upperRoot, tt.upper)
+			if tt.setup != nil {
+				tt.setup(t, lowerRoot, upperRoot)
+			}
+
+			changes := treeChanges(t, lowerRoot, upperRoot)
+			if !reflect.DeepEqual(changes, tt.expected) {
+				t.Fatalf("expected the changes %v, got %v", tt.expected, changes)
+			}
+			if walked := walkChanges(t, lowerRoot, upperRoot); !reflect.DeepEqual(changes, walked) {
+				t.Fatalf("expected the changes of fs.Changes %v, got %v", walked, changes)
+			}
+		})
+	}
+}
+
+// tarEntries returns the names and types of the entries of a layer
+// tarball.
+func tarEntries(t *testing.T, r io.Reader) []string {
+	var entries []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, fmt.Sprintf("%c %s", hdr.Typeflag, hdr.Name))
+	}
+}
+
+func TestCachingDiffMemoryBudget(t *testing.T) {
+	defer SetMemoryBudget(0)
+
+	dir, err := ioutil.TempDir("", "img-treediff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lowerRoot, upperRoot := filepath.Join(dir, "lower"), filepath.Join(dir, "upper")
+	testTreeFiles(t, lowerRoot, map[string]string{"a": "a", "b": "b", "d/c": "c"})
+	testTreeFiles(t, upperRoot, map[string]string{"a": "aa", "d/c": "c", "d/e": "e", "f": "f"})
+
+	diff := func() []string {
+		d := &cachingDiff{trees: map[string]*snapshotTree{}}
+		var b bytes.Buffer
+		if err := d.writeDiff(context.Background(), &b, nil, lowerRoot, nil, upperRoot); err != nil {
+			t.Fatal(err)
+		}
+		return tarEntries(t, &b)
+	}
+	expected := diff()
+
+	// Leave room for two files per tree, the snapshots are then walked.
+	SetMemoryBudget(2 * 8 * fileNodeSize)
+	if _, _, err := readTree(upperRoot, maxTreeNodes()); err != errTreeTooLarge {
+		t.Fatalf("expected reading the tree over the budget to fail with %v, got %v", errTreeTooLarge, err)
+	}
+	if entries := diff(); !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("expected the layer entries %v when walking the snapshots, got %v", expected, entries)
+	}
+}
+
+func TestCachingDiffEvictTrees(t *testing.T) {
+	defer SetMemoryBudget(0)
+
+	// The trees may take a quarter of the budget, ten files.
+	SetMemoryBudget(4 * 10 * fileNodeSize)
+	d := &cachingDiff{
+		trees: map[string]*snapshotTree{
+			"a": {nodes: 4},
+			"b": {nodes: 4},
+			"c": {nodes: 4},
+		},
+		order: []string{"a", "b", "c"},
+	}
+	d.evictTrees("c")
+	if !reflect.DeepEqual(d.order, []string{"b", "c"}) || len(d.trees) != 2 {
+		t.Fatalf("expected the oldest tree to be evicted, got %v", d.order)
+	}
+
+	// The tree being kept is not evicted even if it is the oldest.
+	d.trees["b"].nodes = 20
+	d.evictTrees("b")
+	if !reflect.DeepEqual(d.order, []string{"b"}) || len(d.trees) != 1 {
+		t.Fatalf("expected only the kept tree to be left, got %v", d.order)
+	}
+}
@@ -1,13 +1,17 @@
 package client
 
 import (
+	"context"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/containerd/containerd/snapshots/overlay"
 	"github.com/genuinetools/img/types"
 	"github.com/moby/buildkit/control"
 	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/worker/base"
 	"github.com/sirupsen/logrus"
 )
 
@@ -15,27 +19,36 @@ import (
 // with the buildkit controller.
 type Client struct {
 	backend   string
+	stateLock string
 	localDirs map[string]string
 	root      string
+	execOpt   ExecOpt
 
 	sessionManager *session.Manager
 	controller     *control.Controller
+	worker         *base.Worker
+	cacheStorage   solver.CacheKeyStorage
+	workerOpt      *base.WorkerOpt
+	lease          *stateLease
+	collectGarbage func(context.Context) error
+
+	// mu, smu, wmu and lmu guard creating the controller, the session
+	// manager, the worker opt and the lease, which may happen concurrently
+	// when the client is serving requests.
+	mu  sync.Mutex
+	smu sync.Mutex
+	wmu sync.Mutex
+	lmu sync.Mutex
 }
 
 // New returns a new client for communicating with the buildkit controller.
-func New(root, backend string, localDirs map[string]string) (*Client, error) {
+// The stateLock is the locking used for the state directory, see
+// ResolveStateLock.
+func New(root, backend, stateLock string, localDirs map[string]string) (*Client, error) {
 	// Set the name for the directory executor.
 	name := "runc"
 
-	switch backend {
-	case types.AutoBackend:
-		if overlay.Supported(root) == nil {
-			backend = types.OverlayFSBackend
-		} else {
-			backend = types.NativeBackend
-		}
-		logrus.Debugf("using backend: %s", backend)
-	}
+	backend = ResolveBackend(root, backend)
 
 	// Create the root/
 	root = filepath.Join(root, name, backend)
@@ -46,12 +59,57 @@ func New(root, backend string, localDirs map[string]string) (*Client, error) {
 	// Create the start of the client.
 	return &Client{
 		backend:   backend,
+		stateLock: ResolveStateLock(root, stateLock),
 		root:      root,
 		localDirs: localDirs,
 	}, nil
 }
 
-// Close safely closes the client.
-// This used to shut down the FUSE server but since that was removed
-// it is basically a no-op now.
-func (c *Client) Close() {}
+// ResolveBackend returns the snapshots backend that will be used for the
+// given backend, resolving the "auto" backend for the state directory root.
+func ResolveBackend(root, backend string) string {
+	if backend != types.AutoBackend {
+		return backend
+	}
+
+	backend = types.NativeBackend
+	if overlay.Supported(root) == nil {
+		backend = types.OverlayFSBackend
+	}
+	logrus.WithField("backend", backend).Debug("resolved auto backend")
+	return backend
+}
+
+// Close safely closes the client, releasing the lease on the state directory
+// if it holds one.
+func (c *Client) Close() {
+	c.lmu.Lock()
+	defer c.lmu.Unlock()
+	if c.lease == nil {
+		return
+	}
+	if err := c.lease.release(); err != nil {
+		logrus.Warn(err)
+	}
+	c.lease = nil
+}
+
+// lockState acquires the lease on the state directory when it is locked with
+// a lease file. With flock the databases lock themselves when opened.
+func (c *Client) lockState(ctx context.Context) error {
+	if c.stateLock != types.LeaseStateLock {
+		return nil
+	}
+
+	c.lmu.Lock()
+	defer c.lmu.Unlock()
+	if c.lease != nil {
+		return nil
+	}
+	lease, err := acquireStateLease(ctx, c.root)
+	if err != nil {
+		return err
+	}
+	c.lease = lease
+	return nil
+}
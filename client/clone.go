@@ -0,0 +1,147 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/images"
+)
+
+// CloneOpt holds the changes to make to the config of a cloned image.
+type CloneOpt struct {
+	// Labels are set on the image.
+	Labels map[string]string
+	// Env are KEY=VALUE environment variables set on the image.
+	Env []string
+	// User and WorkingDir replace the ones of the image when they are set.
+	User       string
+	WorkingDir string
+}
+
+func (o CloneOpt) empty() bool {
+	return len(o.Labels) == 0 && len(o.Env) == 0 && o.User == "" && o.WorkingDir == ""
+}
+
+// CloneImage creates the image dest sharing the layers of src, with the
+// changes of opt made to its config. Only a new config and manifest are
+// written, so cloning takes about as long as tagging. Without changes the
+// clone refers to the same manifest, or index, as src.
+func (c *Client) CloneImage(ctx context.Context, src, dest string, opt CloneOpt) (images.Image, error) {
+	wopt, err := c.createWorkerOpt()
+	if err != nil {
+		return images.Image{}, fmt.Errorf("creating worker opt failed: %v", err)
+	}
+	cs := wopt.ContentStore
+
+	img, err := getImage(ctx, wopt.ImageStore, src)
+	if err != nil {
+		return images.Image{}, err
+	}
+	dest, err = normalizeImageName(dest)
+	if err != nil {
+		return images.Image{}, err
+	}
+
+	clone := images.Image{Name: dest, Target: img.Target, CreatedAt: time.Now()}
+	if !opt.empty() {
+		manifest, config, _, err := readImage(ctx, cs, img.Target)
+		if err != nil {
+			return images.Image{}, fmt.Errorf("reading image %s failed: %v", img.Name, err)
+		}
+		if err := config.change(opt); err != nil {
+			return images.Image{}, fmt.Errorf("changing the config of %s failed: %v", img.Name, err)
+		}
+		if manifest.Config, err = writeJSON(ctx, cs, config.mediaType, config.fields); err != nil {
+			return images.Image{}, err
+		}
+		if clone.Target, err = writeManifest(ctx, cs, manifest); err != nil {
+			return images.Image{}, err
+		}
+	}
+
+	if err := putImage(ctx, wopt.ImageStore, clone); err != nil {
+		return images.Image{}, err
+	}
+	return clone, nil
+}
+
+// change makes the changes of opt to the container config of the image,
+// keeping the fields it does not know about.
+func (c *imageConfig) change(opt CloneOpt) error {
+	cfg := map[string]json.RawMessage{}
+	if dt, ok := c.fields["config"]; ok && string(dt) != "null" {
+		if err := json.Unmarshal(dt, &cfg); err != nil {
+			return err
+		}
+	}
+	set := func(key string, v interface{}) error {
+		dt, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		cfg[key] = dt
+		return nil
+	}
+
+	if len(opt.Labels) > 0 {
+		labels := map[string]string{}
+		if dt, ok := cfg["Labels"]; ok {
+			if err := json.Unmarshal(dt, &labels); err != nil {
+				return err
+			}
+		}
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		for k, v := range opt.Labels {
+			labels[k] = v
+		}
+		if err := set("Labels", labels); err != nil {
+			return err
+		}
+	}
+
+	if len(opt.Env) > 0 {
+		var env []string
+		if dt, ok := cfg["Env"]; ok {
+			if err := json.Unmarshal(dt, &env); err != nil {
+				return err
+			}
+		}
+	next:
+		for _, e := range opt.Env {
+			key := strings.SplitN(e, "=", 2)[0]
+			for i, old := range env {
+				if strings.SplitN(old, "=", 2)[0] == key {
+					env[i] = e
+					continue next
+				}
+			}
+			env = append(env, e)
+		}
+		if err := set("Env", env); err != nil {
+			return err
+		}
+	}
+
+	if opt.User != "" {
+		if err := set("User", opt.User); err != nil {
+			return err
+		}
+	}
+	if opt.WorkingDir != "" {
+		if err := set("WorkingDir", opt.WorkingDir); err != nil {
+			return err
+		}
+	}
+
+	dt, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	c.fields["config"] = dt
+	return nil
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestImageConfigChange(t *testing.T) {
+	config := &imageConfig{fields: map[string]json.RawMessage{
+		"architecture": json.RawMessage(`"amd64"`),
+		"config":       json.RawMessage(`{"Env":["PATH=/bin","MODE=build"],"Labels":{"team":"docker"},"User":"root","Cmd":["sh"]}`),
+	}}
+
+	if err := config.change(CloneOpt{
+		Labels:     map[string]string{"team": "img", "version": "1"},
+		Env:        []string{"MODE=clone", "DEBUG=1"},
+		User:       "nobody",
+		WorkingDir: "/srv",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg struct {
+		Env        []string
+		Labels     map[string]string
+		User       string
+		WorkingDir string
+		Cmd        []string
+	}
+	if err := json.Unmarshal(config.fields["config"], &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Env, []string{"PATH=/bin", "MODE=clone", "DEBUG=1"}) {
+		t.Fatalf("expected the variables to be replaced or added, got %v", cfg.Env)
+	}
+	if !reflect.DeepEqual(cfg.Labels, map[string]string{"team": "img", "version": "1"}) {
+		t.Fatalf("expected the labels to be merged, got %v", cfg.Labels)
+	}
+	if cfg.User != "nobody" || cfg.WorkingDir != "/srv" {
+		t.Fatalf("expected the user and working dir to be set, got %q and %q", cfg.User, cfg.WorkingDir)
+	}
+	// The fields not changed are kept.
+	if !reflect.DeepEqual(cfg.Cmd, []string{"sh"}) || string(config.fields["architecture"]) != `"amd64"` {
+		t.Fatalf("expected the other fields to be kept, got %s", config.fields["config"])
+	}
+
+	// Images without a container config get one.
+	config = &imageConfig{fields: map[string]json.RawMessage{"config": json.RawMessage("null")}}
+	if err := config.change(CloneOpt{Labels: map[string]string{"team": "img"}}); err != nil {
+		t.Fatal(err)
+	}
+	if string(config.fields["config"]) != `{"Labels":{"team":"img"}}` {
+		t.Fatalf("expected a config with the labels, got %s", config.fields["config"])
+	}
+}
+
+func TestCloneOptEmpty(t *testing.T) {
+	if !(CloneOpt{Labels: map[string]string{}}).empty() {
+		t.Fatal("expected options without changes to be empty")
+	}
+	if (CloneOpt{User: "nobody"}).empty() {
+		t.Fatal("expected options with a user not to be empty")
+	}
+}
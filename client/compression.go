@@ -0,0 +1,451 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// The compressions of the layers of pushed and saved images.
+const (
+	// CompressionGzip compresses the layers with gzip, which every
+	// runtime can pull.
+	CompressionGzip = "gzip"
+	// CompressionZstd compresses the layers with zstd, which is faster
+	// to compress and decompress than gzip. The layers are compressed by
+	// the zstd binary, and the manifests get OCI media types, as docker
+	// manifests have no zstd layers.
+	CompressionZstd = "zstd"
+	// CompressionNone leaves the layers uncompressed.
+	CompressionNone = "none"
+)
+
+// Compressions are the compressions of the layers of pushed and saved
+// images.
+var Compressions = []string{CompressionGzip, CompressionZstd, CompressionNone}
+
+// mediaTypeImageLayerZstd is the media type of zstd compressed layers, which
+// the vendored image spec predates.
+const mediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+// Compression is how the layers of an image are compressed when it is
+// pushed or saved. The zero value leaves the layers as they are.
+type Compression struct {
+	// Type is one of Compressions.
+	Type string
+	// Level is the compression level, 1 to 9 for gzip and 1 to 19 for
+	// zstd. Zero is the default level of the compression. Layers already
+	// compressed with Type are recompressed when it is set.
+	Level int
+}
+
+// Validate returns an error if the compression is not supported.
+func (c Compression) Validate() error {
+	maxLevel := 0
+	switch c.Type {
+	case "":
+		if c.Level != 0 {
+			return fmt.Errorf("compression level requires a compression")
+		}
+		return nil
+	case CompressionGzip:
+		maxLevel = gzip.BestCompression
+	case CompressionZstd:
+		maxLevel = 19
+		if _, err := exec.LookPath("zstd"); err != nil {
+			return fmt.Errorf("zstd compression requires the zstd binary: %v", err)
+		}
+	case CompressionNone:
+		if c.Level != 0 {
+			return fmt.Errorf("compression level requires a compression other than %s", CompressionNone)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown compression %q, must be one of %s", c.Type, strings.Join(Compressions, ", "))
+	}
+	if c.Level < 0 || c.Level > maxLevel {
+		return fmt.Errorf("invalid %s compression level %d, must be between 1 and %d", c.Type, c.Level, maxLevel)
+	}
+	return nil
+}
+
+// recompressor rewrites images to the content store with their layers
+// compressed as requested. The blobs it writes are only needed while the
+// image is pushed or saved, so the ones that were not in the content store
+// before are deleted by cleanup.
+type recompressor struct {
+	cs          content.Store
+	compression Compression
+	// done are the descriptors already rewritten by their digest, as the
+	// images of an index or of a save share their layers.
+	done    map[digest.Digest]ocispec.Descriptor
+	written []digest.Digest
+}
+
+// newRecompressor returns a recompressor, or nil if the compression leaves
+// the layers as they are.
+func newRecompressor(cs content.Store, c Compression) *recompressor {
+	if c.Type == "" {
+		return nil
+	}
+	return &recompressor{
+		cs:          cs,
+		compression: c,
+		done:        map[digest.Digest]ocispec.Descriptor{},
+	}
+}
+
+// recompress returns the descriptor of the index or manifest with its layers
+// compressed, which is desc itself when no layer had to be.
+func (r *recompressor) recompress(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	if d, ok := r.done[desc.Digest]; ok {
+		d.Platform, d.Annotations = desc.Platform, desc.Annotations
+		return d, nil
+	}
+
+	var (
+		d   ocispec.Descriptor
+		err error
+	)
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		d, err = r.index(ctx, desc)
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		d, err = r.manifest(ctx, desc)
+	default:
+		return desc, nil
+	}
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	r.done[desc.Digest] = d
+	d.Platform, d.Annotations = desc.Platform, desc.Annotations
+	return d, nil
+}
+
+func (r *recompressor) index(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	dt, err := content.ReadBlob(ctx, r.cs, desc.Digest)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("reading index %s failed: %v", desc.Digest, err)
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(dt, &index); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("parsing index %s failed: %v", desc.Digest, err)
+	}
+
+	changed := false
+	rewritten := map[string]string{}
+	for i, m := range index.Manifests {
+		nm, err := r.recompress(ctx, m)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if nm.Digest != m.Digest {
+			changed = true
+			rewritten[m.Digest.String()] = nm.Digest.String()
+		}
+		index.Manifests[i] = nm
+	}
+	// Point the attestation manifests at the rewritten image manifests.
+	for i, m := range index.Manifests {
+		if ref, ok := rewritten[m.Annotations[annotationReferenceDigest]]; ok {
+			annotations := map[string]string{}
+			for k, v := range m.Annotations {
+				annotations[k] = v
+			}
+			annotations[annotationReferenceDigest] = ref
+			index.Manifests[i].Annotations = annotations
+		}
+	}
+
+	mediaType := desc.MediaType
+	if r.compression.Type == CompressionZstd {
+		mediaType = ocispec.MediaTypeImageIndex
+	}
+	if !changed && mediaType == desc.MediaType {
+		return desc, nil
+	}
+	return r.writeJSON(ctx, mediaType, struct {
+		MediaType string `json:"mediaType"`
+		ocispec.Index
+	}{mediaType, index})
+}
+
+func (r *recompressor) manifest(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	dt, err := content.ReadBlob(ctx, r.cs, desc.Digest)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("reading manifest %s failed: %v", desc.Digest, err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(dt, &manifest); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("parsing manifest %s failed: %v", desc.Digest, err)
+	}
+
+	// Docker manifests have no zstd layers, they become OCI manifests.
+	docker := desc.MediaType == images.MediaTypeDockerSchema2Manifest
+	changed := false
+	if r.compression.Type == CompressionZstd {
+		if docker {
+			docker, changed = false, true
+		}
+		if manifest.Config.MediaType == images.MediaTypeDockerSchema2Config {
+			manifest.Config.MediaType, changed = ocispec.MediaTypeImageConfig, true
+		}
+	}
+
+	for i, l := range manifest.Layers {
+		nl, err := r.layer(ctx, l, docker)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if nl.Digest != l.Digest || nl.MediaType != l.MediaType {
+			changed = true
+		}
+		manifest.Layers[i] = nl
+	}
+	if !changed {
+		return desc, nil
+	}
+
+	mediaType := ocispec.MediaTypeImageManifest
+	if docker {
+		mediaType = images.MediaTypeDockerSchema2Manifest
+	}
+	return r.writeJSON(ctx, mediaType, struct {
+		MediaType string `json:"mediaType"`
+		ocispec.Manifest
+	}{mediaType, manifest})
+}
+
+// layer returns the layer compressed as requested, with a docker media type
+// if docker is set.
+func (r *recompressor) layer(ctx context.Context, desc ocispec.Descriptor, docker bool) (ocispec.Descriptor, error) {
+	from, ok := layerCompression(desc.MediaType)
+	if !ok {
+		// Leave the layers that are not tarballs, such as the in-toto
+		// statements of attestations, or the foreign layers.
+		return desc, nil
+	}
+	mediaType := layerMediaType(r.compression.Type, docker)
+	if from == r.compression.Type && (r.compression.Level == 0 || from == CompressionNone) {
+		desc.MediaType = mediaType
+		return desc, nil
+	}
+	if d, ok := r.done[desc.Digest]; ok {
+		d.MediaType, d.Annotations = mediaType, desc.Annotations
+		return d, nil
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"digest":      desc.Digest,
+		"from":        from,
+		"compression": r.compression.Type,
+		"level":       r.compression.Level,
+	}).Debug("recompressing layer")
+
+	ra, err := r.cs.ReaderAt(ctx, desc.Digest)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer ra.Close()
+	ds, err := decompressLayer(ctx, content.NewReader(ra), from)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("decompressing layer %s failed: %v", desc.Digest, err)
+	}
+	defer ds.Close()
+
+	tmp, err := ioutil.TempFile("", "img-compress-")
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	dgstr := digest.SHA256.Digester()
+	diffID := digest.SHA256.Digester()
+	cw, err := compressStream(ctx, io.MultiWriter(tmp, dgstr.Hash()), r.compression)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if _, err := io.Copy(cw, io.TeeReader(ds, diffID.Hash())); err != nil {
+		cw.Close()
+		return ocispec.Descriptor{}, fmt.Errorf("compressing layer %s failed: %v", desc.Digest, err)
+	}
+	if err := cw.Close(); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("compressing layer %s failed: %v", desc.Digest, err)
+	}
+
+	fi, err := tmp.Stat()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	nd := ocispec.Descriptor{MediaType: mediaType, Digest: dgstr.Digest(), Size: fi.Size(), Annotations: desc.Annotations}
+	r.track(ctx, nd.Digest)
+	if err := content.WriteBlob(ctx, r.cs, "compress-"+nd.Digest.String(), tmp, nd.Size, nd.Digest, content.WithLabels(map[string]string{
+		"containerd.io/uncompressed": diffID.Digest().String(),
+	})); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("writing layer %s failed: %v", nd.Digest, err)
+	}
+	r.done[desc.Digest] = nd
+	return nd, nil
+}
+
+// writeJSON writes a manifest or index to the content store, like the
+// writeJSON of optimize.
+func (r *recompressor) writeJSON(ctx context.Context, mediaType string, v interface{}) (ocispec.Descriptor, error) {
+	dt, err := json.MarshalIndent(v, "", "   ")
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	r.track(ctx, digest.FromBytes(dt))
+	return writeBlob(ctx, r.cs, mediaType, dt)
+}
+
+// track records a blob about to be written to be deleted by cleanup, unless
+// it is in the content store already.
+func (r *recompressor) track(ctx context.Context, dgst digest.Digest) {
+	if _, err := r.cs.Info(ctx, dgst); errdefs.IsNotFound(err) {
+		r.written = append(r.written, dgst)
+	}
+}
+
+// cleanup deletes the blobs the recompressor wrote.
+func (r *recompressor) cleanup(ctx context.Context) {
+	for _, dgst := range r.written {
+		if err := r.cs.Delete(ctx, dgst); err != nil && !errdefs.IsNotFound(err) {
+			logrus.WithError(err).WithField("digest", dgst).Warn("deleting recompressed blob failed")
+		}
+	}
+	r.written = nil
+}
+
+// layerCompression returns the compression of a layer from its media type,
+// and false if it is not a layer tarball.
+func layerCompression(mediaType string) (string, bool) {
+	switch mediaType {
+	case images.MediaTypeDockerSchema2Layer, ocispec.MediaTypeImageLayer:
+		return CompressionNone, true
+	case images.MediaTypeDockerSchema2LayerGzip, ocispec.MediaTypeImageLayerGzip:
+		return CompressionGzip, true
+	case mediaTypeImageLayerZstd:
+		return CompressionZstd, true
+	}
+	return "", false
+}
+
+// layerMediaType returns the media type of a layer with a compression.
+func layerMediaType(c string, docker bool) string {
+	switch c {
+	case CompressionGzip:
+		if docker {
+			return images.MediaTypeDockerSchema2LayerGzip
+		}
+		return ocispec.MediaTypeImageLayerGzip
+	case CompressionZstd:
+		return mediaTypeImageLayerZstd
+	}
+	if docker {
+		return images.MediaTypeDockerSchema2Layer
+	}
+	return ocispec.MediaTypeImageLayer
+}
+
+// compressStream returns a writer compressing to w.
+func compressStream(ctx context.Context, w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c.Type {
+	case CompressionGzip:
+		level := gzip.DefaultCompression
+		if c.Level != 0 {
+			level = c.Level
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		args := []string{"-q", "-c", "-T0"}
+		if c.Level != 0 {
+			args = append(args, fmt.Sprintf("-%d", c.Level))
+		}
+		cmd := exec.CommandContext(ctx, "zstd", args...)
+		cmd.Stdout = w
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("starting zstd failed: %v", err)
+		}
+		return &cmdWriteCloser{WriteCloser: stdin, cmd: cmd, stderr: stderr}, nil
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// decompressLayer returns the tarball of a layer compressed with c.
+func decompressLayer(ctx context.Context, r io.Reader, c string) (io.ReadCloser, error) {
+	if c != CompressionZstd {
+		return compression.DecompressStream(r)
+	}
+	cmd := exec.CommandContext(ctx, "zstd", "-q", "-d", "-c")
+	cmd.Stdin = r
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting zstd failed: %v", err)
+	}
+	return &cmdReadCloser{Reader: stdout, cmd: cmd, stderr: stderr}, nil
+}
+
+// cmdWriteCloser writes to the stdin of a command, closing it waits for the
+// command to exit.
+type cmdWriteCloser struct {
+	io.WriteCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (w *cmdWriteCloser) Close() error {
+	w.WriteCloser.Close()
+	if err := w.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", w.cmd.Path, err, strings.TrimSpace(w.stderr.String()))
+	}
+	return nil
+}
+
+// cmdReadCloser reads the stdout of a command, closing it waits for the
+// command to exit.
+type cmdReadCloser struct {
+	io.Reader
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (r *cmdReadCloser) Close() error {
+	// Let the command exit if the output was not read to the end.
+	io.Copy(ioutil.Discard, r.Reader)
+	if err := r.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", r.cmd.Path, err, strings.TrimSpace(r.stderr.String()))
+	}
+	return nil
+}
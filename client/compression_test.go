@@ -0,0 +1,179 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestRecompress(t *testing.T) {
+	tests := []struct {
+		compression Compression
+		// index, manifest, config and layer are the media types expected
+		// in the recompressed image.
+		index, manifest, config, layer string
+	}{
+		{
+			compression: Compression{Type: CompressionGzip},
+			index:       images.MediaTypeDockerSchema2ManifestList,
+			manifest:    images.MediaTypeDockerSchema2Manifest,
+			config:      images.MediaTypeDockerSchema2Config,
+			layer:       images.MediaTypeDockerSchema2LayerGzip,
+		},
+		{
+			compression: Compression{Type: CompressionZstd, Level: 3},
+			index:       ocispec.MediaTypeImageIndex,
+			manifest:    ocispec.MediaTypeImageManifest,
+			config:      ocispec.MediaTypeImageConfig,
+			layer:       mediaTypeImageLayerZstd,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.compression.Type, func(t *testing.T) {
+			if tt.compression.Type == CompressionZstd {
+				if _, err := exec.LookPath("zstd"); err != nil {
+					t.Skip("zstd is not installed")
+				}
+			}
+			ctx := context.Background()
+			cs, cleanup := testContentStore(t)
+			defer cleanup()
+
+			// Two docker images sharing their base layer, in a manifest
+			// list with the first image for two platforms.
+			base, baseDiffID := testLayer(t, cs, images.MediaTypeDockerSchema2Layer, map[string]string{"etc/": "", "etc/os-release": "ID=test\n"})
+			app, appDiffID := testLayer(t, cs, images.MediaTypeDockerSchema2Layer, map[string]string{"app": "app"})
+			diffIDs := map[digest.Digest]digest.Digest{base.Digest: baseDiffID, app.Digest: appDiffID}
+			image := func(arch string, layers ...ocispec.Descriptor) ocispec.Descriptor {
+				config, err := writeJSON(ctx, cs, images.MediaTypeDockerSchema2Config, ocispec.Image{Architecture: arch, OS: "linux"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				manifest := ocispec.Manifest{Config: config, Layers: layers}
+				manifest.SchemaVersion = 2
+				desc, err := writeJSON(ctx, cs, images.MediaTypeDockerSchema2Manifest, struct {
+					MediaType string `json:"mediaType"`
+					ocispec.Manifest
+				}{images.MediaTypeDockerSchema2Manifest, manifest})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return desc
+			}
+			amd64 := image("amd64", base, app)
+			arm64 := image("arm64", base)
+			manifests := []ocispec.Descriptor{amd64, amd64, arm64}
+			manifests[0].Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+			manifests[1].Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64", Variant: "v2"}
+			manifests[2].Platform = &ocispec.Platform{OS: "linux", Architecture: "arm64"}
+			index, err := writeJSON(ctx, cs, images.MediaTypeDockerSchema2ManifestList, struct {
+				MediaType string `json:"mediaType"`
+				ocispec.Index
+			}{images.MediaTypeDockerSchema2ManifestList, ocispec.Index{Manifests: manifests}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rc := newRecompressor(cs, tt.compression)
+			desc, err := rc.recompress(ctx, index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if desc.MediaType != tt.index || desc.Digest == index.Digest {
+				t.Fatalf("expected a new index of type %s, got %s %s", tt.index, desc.MediaType, desc.Digest)
+			}
+
+			var idx ocispec.Index
+			readTestJSON(t, cs, desc, &idx)
+			if len(idx.Manifests) != 3 {
+				t.Fatalf("expected 3 manifests in the index, got %d", len(idx.Manifests))
+			}
+			// The manifest of both amd64 platforms is converted once.
+			if idx.Manifests[0].Digest != idx.Manifests[1].Digest || idx.Manifests[1].Platform.Variant != "v2" {
+				t.Fatalf("expected the same manifest for both amd64 platforms, got %+v", idx.Manifests)
+			}
+
+			layers := map[digest.Digest]ocispec.Descriptor{}
+			for i, m := range idx.Manifests {
+				if m.MediaType != tt.manifest {
+					t.Fatalf("expected the manifest %d to be a %s, got %s", i, tt.manifest, m.MediaType)
+				}
+				var manifest ocispec.Manifest
+				readTestJSON(t, cs, m, &manifest)
+				if manifest.Config.MediaType != tt.config {
+					t.Fatalf("expected the config to be a %s, got %s", tt.config, manifest.Config.MediaType)
+				}
+				original := []ocispec.Descriptor{base, app}
+				for j, l := range manifest.Layers {
+					if l.MediaType != tt.layer {
+						t.Fatalf("expected the layer %d to be a %s, got %s", j, tt.layer, l.MediaType)
+					}
+					// The layers shared by the images are converted once.
+					if prev, ok := layers[original[j].Digest]; ok && prev.Digest != l.Digest {
+						t.Fatalf("expected the converted layer %s to be reused, got %s", prev.Digest, l.Digest)
+					}
+					layers[original[j].Digest] = l
+				}
+			}
+
+			// The converted layers hold the tarballs they were converted
+			// from.
+			for from, l := range layers {
+				if l.Digest == from {
+					t.Fatalf("expected the layer %s to be compressed", from)
+				}
+				ra, err := cs.ReaderAt(ctx, l.Digest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ds, err := decompressLayer(ctx, content.NewReader(ra), tt.compression.Type)
+				if err != nil {
+					t.Fatal(err)
+				}
+				diffID, err := digest.SHA256.FromReader(ds)
+				ds.Close()
+				ra.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diffID != diffIDs[from] {
+					t.Fatalf("expected the diff ID %s of the layer, got %s", diffIDs[from], diffID)
+				}
+			}
+
+			// Converting the index again reuses what was converted.
+			written := len(rc.written)
+			if again, err := rc.recompress(ctx, index); err != nil || again.Digest != desc.Digest || len(rc.written) != written {
+				t.Fatalf("expected the converted index %s to be reused, got %s with %d blobs written: %v", desc.Digest, again.Digest, len(rc.written)-written, err)
+			}
+
+			rc.cleanup(ctx)
+			if _, err := cs.Info(ctx, desc.Digest); err == nil {
+				t.Fatal("expected the converted index to be deleted by cleanup")
+			}
+			if _, err := cs.Info(ctx, base.Digest); err != nil {
+				t.Fatalf("expected the original layer to be kept: %v", err)
+			}
+		})
+	}
+}
+
+// readTestJSON unmarshals the blob of desc into v. The namespace is only
+// needed by the content store of a metadata database.
+func readTestJSON(t *testing.T, cs content.Store, desc ocispec.Descriptor, v interface{}) {
+	dt, err := content.ReadBlob(namespaces.WithNamespace(context.Background(), "buildkit"), cs, desc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(dt, v); err != nil {
+		t.Fatal(err)
+	}
+}
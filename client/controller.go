@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"path/filepath"
 
+	"github.com/moby/buildkit/cache/remotecache"
+	"github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/control"
 	"github.com/moby/buildkit/frontend"
 	"github.com/moby/buildkit/frontend/dockerfile"
@@ -13,6 +15,12 @@ import (
 )
 
 func (c *Client) createController() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.controller != nil {
+		return nil
+	}
+
 	sm, err := c.getSessionManager()
 	if err != nil {
 		return fmt.Errorf("creating session manager failed: %v", err)
@@ -29,6 +37,17 @@ func (c *Client) createController() error {
 		return fmt.Errorf("creating worker failed: %v", err)
 	}
 
+	// Upload the layers of pushed images while they are exported.
+	w.Exporters[client.ExporterImage] = &pipelinedImageExporter{
+		Exporter:       w.Exporters[client.ExporterImage],
+		sessionManager: sm,
+		contentStore:   opt.ContentStore,
+	}
+
+	// Add the exporter for debug shells.
+	w.Exporters[DebugShellExporter] = &debugShellExporter{worker: w}
+	c.worker = w
+
 	// Create the worker controller.
 	wc := &worker.Controller{}
 	if err := wc.Add(w); err != nil {
@@ -44,6 +63,7 @@ func (c *Client) createController() error {
 	if err != nil {
 		return err
 	}
+	c.cacheStorage = cacheStorage
 
 	// Create the controller.
 	controller, err := control.NewController(control.Opt{
@@ -51,7 +71,8 @@ func (c *Client) createController() error {
 		WorkerController: wc,
 		Frontends:        frontends,
 		CacheKeyStorage:  cacheStorage,
-		// No cache importer/exporter
+		CacheExporter:    remotecache.NewCacheExporter(remotecache.ExporterOpt{SessionManager: sm}),
+		CacheImporter:    remotecache.NewCacheImporter(remotecache.ImportOpt{SessionManager: sm, Worker: w}),
 	})
 	if err != nil {
 		return fmt.Errorf("creating new controller failed: %v", err)
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/util/progress"
+	"github.com/moby/buildkit/util/push"
+	"github.com/moby/buildkit/util/tracing"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// CopyImage copies an image from a registry to another, with the manifests
+// of every platform of a manifest list. The blobs are fetched into the content
+// store and pushed from it, without unpacking the layers or adding the image
+// to the image store. The blobs that were not in the content store before are
+// deleted once pushed.
+func (c *Client) CopyImage(ctx context.Context, src, dst string, insecure bool) (ocispec.Descriptor, error) {
+	srcNamed, err := reference.ParseNormalizedNamed(src)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("parsing image name %q failed: %v", src, err)
+	}
+	src = reference.TagNameOnly(srcNamed).String()
+	dstNamed, err := reference.ParseNormalizedNamed(dst)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("parsing image name %q failed: %v", dst, err)
+	}
+	dst = reference.TagNameOnly(dstNamed).String()
+
+	// Create the worker opts.
+	opt, err := c.createWorkerOpt()
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("creating worker opt failed: %v", err)
+	}
+	cs := opt.ContentStore
+
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Client:      tracing.DefaultClient,
+		Credentials: sessionCredentials(ctx, opt.SessionManager),
+		PlainHTTP:   insecure,
+	})
+	name, desc, err := resolver.Resolve(ctx, src)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("resolving %s failed: %v", src, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"src":    src,
+		"dst":    dst,
+		"digest": desc.Digest,
+	}).Debug("copying image")
+
+	// Record the blobs that are fetched, to delete them once pushed.
+	var (
+		mu      sync.Mutex
+		fetched []digest.Digest
+	)
+	record := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if _, err := cs.Info(ctx, desc.Digest); errdefs.IsNotFound(err) {
+			mu.Lock()
+			fetched = append(fetched, desc.Digest)
+			mu.Unlock()
+		}
+		return nil, nil
+	})
+	defer func() {
+		for _, dgst := range fetched {
+			if err := cs.Delete(ctx, dgst); err != nil && !errdefs.IsNotFound(err) {
+				logrus.WithError(err).WithField("digest", dgst).Warn("deleting copied blob failed")
+			}
+		}
+	}()
+
+	fetchDone := oneOffProgress(ctx, "fetching "+src)
+	err = images.Dispatch(ctx, images.Handlers(
+		record,
+		remotes.FetchHandler(cs, fetcher),
+		images.ChildrenHandler(cs),
+	), desc)
+	fetchDone(err)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("fetching %s failed: %v", src, err)
+	}
+
+	if err := push.Push(ctx, opt.SessionManager, cs, desc.Digest, dst, insecure); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("pushing %s failed: %v", dst, err)
+	}
+	return desc, nil
+}
+
+// oneOffProgress writes the progress of a step with no progress of its own to
+// the progress writer of the context.
+func oneOffProgress(ctx context.Context, id string) func(err error) error {
+	pw, _, _ := progress.FromContext(ctx)
+	now := time.Now()
+	st := progress.Status{
+		Started: &now,
+	}
+	pw.Write(id, st)
+	return func(err error) error {
+		now := time.Now()
+		st.Completed = &now
+		pw.Write(id, st)
+		pw.Close()
+		return err
+	}
+}
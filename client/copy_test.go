@@ -0,0 +1,22 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCopyImageNames(t *testing.T) {
+	c := &Client{}
+	tests := []struct {
+		src, dst string
+	}{
+		{"Invalid", "r.j3ss.co/busybox"},
+		{"busybox", "Invalid:Tag"},
+	}
+	for _, tt := range tests {
+		if _, err := c.CopyImage(context.Background(), tt.src, tt.dst, false); err == nil || !strings.Contains(err.Error(), "parsing image name") {
+			t.Fatalf("expected copying %s to %s to fail, got: %v", tt.src, tt.dst, err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/executor"
+	"github.com/moby/buildkit/exporter"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/worker/base"
+	"github.com/opencontainers/go-digest"
+)
+
+// DebugShellExporter is the name of the exporter that starts an interactive
+// shell in the solved root filesystem instead of exporting it.
+const DebugShellExporter = "img.debugshell"
+
+// DebugShellMetaAttr is the exporter attribute holding the JSON encoded
+// pb.Meta the shell should be started with.
+const DebugShellMetaAttr = "meta"
+
+var defaultDebugShell = []string{"/bin/sh", "-i"}
+
+type debugShellExporter struct {
+	worker *base.Worker
+}
+
+func (e *debugShellExporter) Resolve(ctx context.Context, attrs map[string]string) (exporter.ExporterInstance, error) {
+	i := &debugShellInstance{
+		worker: e.worker,
+		meta: executor.Meta{
+			Args: defaultDebugShell,
+			Cwd:  "/",
+		},
+	}
+
+	if v, ok := attrs[DebugShellMetaAttr]; ok {
+		var meta pb.Meta
+		if err := json.Unmarshal([]byte(v), &meta); err != nil {
+			return nil, fmt.Errorf("parsing debug shell meta failed: %v", err)
+		}
+		i.meta.Env = meta.Env
+		i.meta.User = meta.User
+		if meta.Cwd != "" {
+			i.meta.Cwd = meta.Cwd
+		}
+	}
+
+	return i, nil
+}
+
+type debugShellInstance struct {
+	worker *base.Worker
+	meta   executor.Meta
+}
+
+func (i *debugShellInstance) Name() string {
+	return "starting debug shell"
+}
+
+func (i *debugShellInstance) Export(ctx context.Context, ref cache.ImmutableRef, opt map[string][]byte) (map[string]string, error) {
+	return nil, i.worker.Exec(ctx, i.meta, ref, ioutil.NopCloser(os.Stdin), nopWriteCloser{os.Stdout}, nopWriteCloser{os.Stderr})
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// FindExecOp returns the index in the definition of the exec op with the
+// given vertex digest. If no op has that digest the first exec op whose
+// command matches name is returned.
+func FindExecOp(def *pb.Definition, vertex digest.Digest, name string) (int, error) {
+	byName := -1
+	for i, dt := range def.Def {
+		var op pb.Op
+		if err := op.Unmarshal(dt); err != nil {
+			return -1, fmt.Errorf("parsing llb op failed: %v", err)
+		}
+		exec := op.GetExec()
+		if exec == nil {
+			continue
+		}
+		if digest.FromBytes(dt) == vertex {
+			return i, nil
+		}
+		if byName < 0 && strings.Join(exec.Meta.Args, " ") == name {
+			byName = i
+		}
+	}
+
+	if byName < 0 {
+		return -1, fmt.Errorf("no exec op found for vertex %s (%s)", vertex, name)
+	}
+	return byName, nil
+}
+
+// DebugShellDefinition returns a definition that solves the root filesystem
+// the exec op at index ran in, along with the op's meta so a shell can be
+// started with the same environment.
+func DebugShellDefinition(def *pb.Definition, index int) (*pb.Definition, *pb.Meta, error) {
+	if index < 0 || index >= len(def.Def) {
+		return nil, nil, fmt.Errorf("op index %d out of range", index)
+	}
+
+	var op pb.Op
+	if err := op.Unmarshal(def.Def[index]); err != nil {
+		return nil, nil, fmt.Errorf("parsing llb op failed: %v", err)
+	}
+	exec := op.GetExec()
+	if exec == nil {
+		return nil, nil, errors.New("op is not an exec op")
+	}
+
+	// Find the input that is mounted as the root filesystem.
+	var root *pb.Input
+	for _, m := range exec.Mounts {
+		if m.Dest == "/" && m.Input >= 0 && int(m.Input) < len(op.Inputs) {
+			root = op.Inputs[m.Input]
+			break
+		}
+	}
+	if root == nil {
+		return nil, nil, errors.New("exec op has no root filesystem input")
+	}
+
+	// The last op of a definition is the terminal op pointing at the result,
+	// replace it with one that points at the root filesystem.
+	terminal, err := (&pb.Op{Inputs: []*pb.Input{root}}).Marshal()
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshaling terminal op failed: %v", err)
+	}
+
+	out := &pb.Definition{
+		Def:      append(append([][]byte{}, def.Def[:len(def.Def)-1]...), terminal),
+		Metadata: def.Metadata,
+	}
+
+	return out, exec.Meta, nil
+}
@@ -0,0 +1,197 @@
+package client
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/continuity/fs"
+	"github.com/containerd/continuity/sysx"
+	"golang.org/x/sys/unix"
+)
+
+// whiteoutPrefix marks the files removed from the layers below in OCI style
+// layer tarballs.
+const whiteoutPrefix = ".wh."
+
+// layerWriter writes the changes between two snapshots as an OCI style layer
+// tarball. It is the change writer of containerd's archive package, which is
+// not exported, so the changes can be computed by something else than
+// fs.Changes.
+type layerWriter struct {
+	tw        *tar.Writer
+	source    string
+	whiteoutT time.Time
+	inodeSrc  map[uint64]string
+	inodeRefs map[uint64][]string
+	addedDirs map[string]struct{}
+}
+
+func newLayerWriter(w io.Writer, source string) *layerWriter {
+	return &layerWriter{
+		tw:        tar.NewWriter(w),
+		source:    source,
+		whiteoutT: time.Now(),
+		inodeSrc:  map[uint64]string{},
+		inodeRefs: map[uint64][]string{},
+		addedDirs: map[string]struct{}{},
+	}
+}
+
+// HandleChange writes a change to the tarball, p is the path of the changed
+// file relative to the snapshot, with a leading slash.
+func (lw *layerWriter) HandleChange(k fs.ChangeKind, p string, f os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
+	if k == fs.ChangeKindDelete {
+		whiteout := filepath.Join(filepath.Dir(p), whiteoutPrefix+filepath.Base(p))
+		hdr := &tar.Header{
+			Typeflag:   tar.TypeReg,
+			Name:       whiteout[1:],
+			ModTime:    lw.whiteoutT,
+			AccessTime: lw.whiteoutT,
+			ChangeTime: lw.whiteoutT,
+		}
+		if err := lw.includeParents(hdr); err != nil {
+			return err
+		}
+		if err := lw.tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("writing whiteout header failed: %v", err)
+		}
+		return nil
+	}
+
+	source := filepath.Join(lw.source, p)
+	var link string
+	switch {
+	case f.Mode()&os.ModeSocket != 0:
+		return nil
+	case f.Mode()&os.ModeSymlink != 0:
+		if link, err = os.Readlink(source); err != nil {
+			return err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(f, link)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimPrefix(p, string(filepath.Separator))
+	if f.IsDir() && !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	hdr.Name = name
+
+	if s, ok := f.Sys().(*syscall.Stat_t); ok && (s.Mode&syscall.S_IFBLK != 0 || s.Mode&syscall.S_IFCHR != 0) {
+		hdr.Devmajor = int64(unix.Major(uint64(s.Rdev)))
+		hdr.Devminor = int64(unix.Minor(uint64(s.Rdev)))
+	}
+
+	// Hard links to a file are written as links to the first of its names
+	// in the tarball.
+	var additionalLinks []string
+	if inode, isHardlink := fs.GetLinkInfo(f); isHardlink {
+		if src, ok := lw.inodeSrc[inode]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = src
+			hdr.Size = 0
+		} else {
+			if k == fs.ChangeKindUnmodified {
+				lw.inodeRefs[inode] = append(lw.inodeRefs[inode], name)
+				return nil
+			}
+			lw.inodeSrc[inode] = name
+			additionalLinks = lw.inodeRefs[inode]
+			delete(lw.inodeRefs, inode)
+		}
+	} else if k == fs.ChangeKindUnmodified {
+		return nil
+	}
+
+	capability, err := lgetxattr(source, "security.capability")
+	if err != nil {
+		return fmt.Errorf("getting capabilities of %s failed: %v", source, err)
+	}
+	if capability != nil {
+		hdr.PAXRecords = map[string]string{"SCHILY.xattrs.security.capability": string(capability)}
+	}
+
+	if err := lw.includeParents(hdr); err != nil {
+		return err
+	}
+	if err := lw.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("writing file header failed: %v", err)
+	}
+
+	if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+		file, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		n, err := io.Copy(lw.tw, file)
+		if err != nil {
+			return fmt.Errorf("copying %s failed: %v", source, err)
+		}
+		if n != hdr.Size {
+			return fmt.Errorf("short write copying %s", source)
+		}
+	}
+
+	for _, extra := range additionalLinks {
+		hdr.Name = extra
+		hdr.Typeflag = tar.TypeLink
+		hdr.Linkname = name
+		hdr.Size = 0
+		hdr.PAXRecords = nil
+		if err := lw.includeParents(hdr); err != nil {
+			return err
+		}
+		if err := lw.tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("writing file header failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// includeParents writes the parent directory of a file, unless it already
+// is in the tarball.
+func (lw *layerWriter) includeParents(hdr *tar.Header) error {
+	name := strings.TrimRight(hdr.Name, "/")
+	parent := filepath.Dir(name)
+	if parent != "." {
+		if _, ok := lw.addedDirs[parent]; !ok {
+			lw.addedDirs[parent] = struct{}{}
+			fi, err := os.Lstat(filepath.Join(lw.source, parent))
+			if err != nil {
+				return err
+			}
+			if err := lw.HandleChange(fs.ChangeKindModify, "/"+parent, fi, nil); err != nil {
+				return err
+			}
+		}
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		lw.addedDirs[name] = struct{}{}
+	}
+	return nil
+}
+
+func (lw *layerWriter) Close() error {
+	return lw.tw.Close()
+}
+
+// lgetxattr returns an extended attribute of a file, nil if it has none.
+func lgetxattr(path, attr string) ([]byte, error) {
+	b, err := sysx.LGetxattr(path, attr)
+	if err == unix.ENOTSUP || err == sysx.ENODATA {
+		return nil, nil
+	}
+	return b, err
+}
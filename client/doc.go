@@ -0,0 +1,38 @@
+/*
+Package client provides the rootless image builder of img as a library.
+
+A Client holds the state directory of img and the BuildKit controller and
+worker using it. It can build images from Dockerfiles and pull, push, tag,
+list, save, load and remove images:
+
+	c, err := client.New("/tmp/img", types.AutoBackend, types.AutoStateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+	resp, err := c.Build(ctx, client.BuildOpt{
+		ContextDir: ".",
+		Tag:        "jess/img",
+	}, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Println(resp.ExporterResponse["containerimage.digest"])
+
+	// Pushing needs a session to provide the registry credentials.
+	err = c.WithSession(ctx, nil, func(ctx context.Context, _ string) error {
+		return c.Push(ctx, "jess/img", false)
+	})
+
+The context passed to the client must hold the "buildkit" containerd
+namespace. Builds run the steps with runc, so the process has to be able to
+create containers, when not running as root this means it must run in a user
+namespace the way the img binary re-executes itself.
+
+When the state directory is locked with a lease file, losing the lease, to
+a process that found it stale, aborts the process: another process may be
+writing the state directory by then.
+*/
+package client
@@ -0,0 +1,474 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd/contrib/seccomp"
+	"github.com/containerd/containerd/mount"
+	containerdoci "github.com/containerd/containerd/oci"
+	"github.com/containerd/continuity/fs"
+	runc "github.com/containerd/go-runc"
+	units "github.com/docker/go-units"
+	"github.com/docker/libnetwork/resolvconf"
+	"github.com/docker/libnetwork/types"
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/executor"
+	"github.com/moby/buildkit/executor/oci"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/util/libcontainer_specconv"
+	"github.com/moby/buildkit/util/system"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// NetworkHost runs the build steps in the network namespace of img, it
+	// is the default.
+	NetworkHost = "host"
+	// NetworkNone runs the build steps in a network namespace of their own
+	// with only a loopback interface.
+	NetworkNone = "none"
+)
+
+// SeccompUnconfined runs the build steps without a seccomp profile.
+const SeccompUnconfined = "unconfined"
+
+// defaultHosts is the hosts file of the containers running the build steps.
+const defaultHosts = `
+127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+`
+
+// ExecOpt holds the settings of the containers running the build steps.
+type ExecOpt struct {
+	// Network is the network mode of the containers, NetworkHost when it is
+	// empty.
+	Network string
+	// ExtraHosts are added to /etc/hosts of the containers, in the HOST:IP
+	// format.
+	ExtraHosts []string
+	// Memory is the memory limit of the containers in bytes, CPUs how many
+	// CPUs they can use and PidsLimit how many processes they can run,
+	// there is no limit when they are zero.
+	Memory    int64
+	CPUs      float64
+	PidsLimit int64
+	// DNS, DNSSearch and DNSOptions replace the nameservers, search domains
+	// and options of the resolv.conf of the host in that of the containers.
+	DNS        []string
+	DNSSearch  []string
+	DNSOptions []string
+	// Seccomp is the path of the seccomp profile of the containers, in the
+	// format of the OCI runtime spec, or SeccompUnconfined. The default
+	// profile of containerd is used when it is empty.
+	Seccomp string
+	// Ulimits replace the resource limits of the processes of the
+	// containers, in the NAME=SOFT[:HARD] format, e.g. nofile=65535:65535.
+	Ulimits []string
+	// CgroupParent is the cgroup the cgroups of the containers are created
+	// in, relative to the root of the cgroup hierarchy.
+	CgroupParent string
+}
+
+// SetExecOpt sets the settings of the containers running the build steps.
+// It must be called before the client is used.
+func (c *Client) SetExecOpt(opt ExecOpt) error {
+	switch opt.Network {
+	case "", NetworkHost, NetworkNone:
+	default:
+		return fmt.Errorf("invalid network mode %s, must be %s or %s", opt.Network, NetworkHost, NetworkNone)
+	}
+	for _, h := range opt.ExtraHosts {
+		kv := strings.SplitN(h, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || net.ParseIP(kv[1]) == nil {
+			return fmt.Errorf("invalid extra host %s, must be HOST:IP", h)
+		}
+	}
+	for _, ip := range opt.DNS {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid DNS server %s, must be an IP address", ip)
+		}
+	}
+	for _, u := range opt.Ulimits {
+		if _, err := units.ParseUlimit(u); err != nil {
+			return fmt.Errorf("parsing ulimit %s failed: %v", u, err)
+		}
+	}
+	if opt.Seccomp != "" && opt.Seccomp != SeccompUnconfined {
+		dt, err := ioutil.ReadFile(opt.Seccomp)
+		if err != nil {
+			return fmt.Errorf("reading seccomp profile failed: %v", err)
+		}
+		if err := json.Unmarshal(dt, &specs.LinuxSeccomp{}); err != nil {
+			return fmt.Errorf("parsing seccomp profile %s failed: %v", opt.Seccomp, err)
+		}
+	}
+	if opt.Memory < 0 || opt.CPUs < 0 || opt.PidsLimit < 0 {
+		return errors.New("the resource limits of the containers cannot be negative")
+	}
+	c.execOpt = opt
+	return nil
+}
+
+// runcExecutor runs the build steps with runc. It is the runc executor of
+// buildkit with the settings of ExecOpt applied to the spec of the
+// containers.
+type runcExecutor struct {
+	runc     *runc.Runc
+	root     string
+	rootless bool
+	opt      ExecOpt
+}
+
+func newRuncExecutor(root string, rootless bool, opt ExecOpt) (executor.Executor, error) {
+	var cmd string
+	for _, name := range []string{"buildkit-runc", "runc"} {
+		if _, err := exec.LookPath(name); err == nil {
+			cmd = name
+			break
+		}
+	}
+	if cmd == "" {
+		return nil, errors.New("failed to find runc binary")
+	}
+
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", root, err)
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &runcExecutor{
+		runc: &runc.Runc{
+			Command:      cmd,
+			Log:          filepath.Join(root, "runc-log.json"),
+			LogFormat:    runc.JSON,
+			PdeathSignal: syscall.SIGKILL,
+			Setpgid:      true,
+		},
+		root:     root,
+		rootless: rootless,
+		opt:      opt,
+	}, nil
+}
+
+func (w *runcExecutor) Exec(ctx context.Context, meta executor.Meta, root cache.Mountable, mounts []executor.Mount, stdin io.ReadCloser, stdout, stderr io.WriteCloser) error {
+	resolvConf, err := oci.GetResolvConf(ctx, w.root)
+	if err != nil {
+		return err
+	}
+
+	mountable, err := root.Mount(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	rootMount, err := mountable.Mount()
+	if err != nil {
+		return err
+	}
+	defer mountable.Release()
+
+	id := identity.NewID()
+	bundle := filepath.Join(w.root, id)
+
+	if err := os.Mkdir(bundle, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(bundle)
+
+	// The hosts file is in the bundle, since the extra hosts may differ
+	// between the builds sharing the executor root.
+	hostsFile := filepath.Join(bundle, "hosts")
+	if err := ioutil.WriteFile(hostsFile, w.hosts(), 0644); err != nil {
+		return err
+	}
+	if len(w.opt.DNS) > 0 || len(w.opt.DNSSearch) > 0 || len(w.opt.DNSOptions) > 0 {
+		if resolvConf, err = w.writeResolvConf(resolvConf, bundle); err != nil {
+			return err
+		}
+	}
+
+	rootFSPath := filepath.Join(bundle, "rootfs")
+	if err := os.Mkdir(rootFSPath, 0700); err != nil {
+		return err
+	}
+	if err := mount.All(rootMount, rootFSPath); err != nil {
+		return err
+	}
+	defer mount.Unmount(rootFSPath, 0)
+
+	uid, gid, err := oci.GetUser(ctx, rootFSPath, meta.User)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	opts := []containerdoci.SpecOpts{containerdoci.WithUIDGID(uid, gid)}
+	switch w.opt.Seccomp {
+	case "":
+		if system.SeccompSupported() {
+			opts = append(opts, seccomp.WithDefaultProfile())
+		}
+	case SeccompUnconfined:
+	default:
+		opts = append(opts, seccomp.WithProfile(w.opt.Seccomp))
+	}
+	if meta.ReadonlyRootFS {
+		opts = append(opts, containerdoci.WithRootFSReadonly())
+	}
+	spec, cleanup, err := oci.GenerateSpec(ctx, meta, mounts, id, resolvConf, hostsFile, opts...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	spec.Root.Path = rootFSPath
+	if _, ok := root.(cache.ImmutableRef); ok { // TODO: pass in with mount, not ref type
+		spec.Root.Readonly = true
+	}
+
+	newp, err := fs.RootPath(rootFSPath, meta.Cwd)
+	if err != nil {
+		return errors.Wrapf(err, "working dir %s points to invalid target", newp)
+	}
+	if err := os.MkdirAll(newp, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create working directory %s", newp)
+	}
+
+	if w.rootless {
+		specconv.ToRootless(spec, &specconv.RootlessOpts{
+			MapSubUIDGID: true,
+		})
+		// TODO(AkihiroSuda): keep Cgroups enabled if /sys/fs/cgroup/cpuset/buildkit exists and writable
+		spec.Linux.CgroupsPath = ""
+		if err := setOOMScoreAdj(spec); err != nil {
+			return err
+		}
+	}
+
+	// The spec of buildkit always uses the network namespace of the host,
+	// runc sets up the loopback interface of a new one.
+	if w.opt.Network == NetworkNone {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, specs.LinuxNamespace{Type: specs.NetworkNamespace})
+	}
+
+	if err := w.setResources(spec, id); err != nil {
+		return err
+	}
+	if err := w.setUlimits(spec); err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(f).Encode(spec); err != nil {
+		return err
+	}
+
+	logrus.Debugf("> running %s %v", id, meta.Args)
+
+	status, err := w.runc.Run(ctx, id, bundle, &runc.CreateOpts{
+		IO: &forwardIO{stdin: stdin, stdout: stdout, stderr: stderr},
+	})
+	logrus.Debugf("< completed %s %v %v", id, status, err)
+	if status != 0 {
+		select {
+		case <-ctx.Done():
+			// runc can't report context.Cancelled directly
+			return errors.Wrapf(ctx.Err(), "exit code %d", status)
+		default:
+		}
+		return errors.Errorf("exit code %d", status)
+	}
+
+	return err
+}
+
+// writeResolvConf writes the resolv.conf of the host with the DNS settings of
+// ExecOpt replacing its own to the bundle, and returns its path.
+func (w *runcExecutor) writeResolvConf(hostResolvConf, bundle string) (string, error) {
+	dt, err := ioutil.ReadFile(hostResolvConf)
+	if err != nil {
+		return "", err
+	}
+	dns, search, options := w.opt.DNS, w.opt.DNSSearch, w.opt.DNSOptions
+	if len(dns) == 0 {
+		dns = resolvconf.GetNameservers(dt, types.IP)
+	}
+	if len(search) == 0 {
+		search = resolvconf.GetSearchDomains(dt)
+	}
+	if len(options) == 0 {
+		options = resolvconf.GetOptions(dt)
+	}
+	p := filepath.Join(bundle, "resolv.conf")
+	if _, err := resolvconf.Build(p, dns, search, options); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// cpuPeriod is the CFS period of the containers with a CPU limit, in
+// microseconds.
+const cpuPeriod = 100000
+
+// setResources sets the cgroup and the resource limits of ExecOpt in the
+// spec. Rootless containers have no cgroup of their own unless they have a
+// cgroup parent. With resource limits they are put in a cgroup below the one
+// of img, which must be a cgroup v2 delegated to the user, e.g. with
+// `systemd-run --user -p Delegate=yes`.
+func (w *runcExecutor) setResources(spec *specs.Spec, id string) error {
+	limited := w.opt.Memory != 0 || w.opt.CPUs != 0 || w.opt.PidsLimit != 0
+	switch {
+	case w.opt.CgroupParent != "":
+		spec.Linux.CgroupsPath = filepath.Join("/", w.opt.CgroupParent, "img-"+id)
+	case w.rootless && limited:
+		parent, err := delegatedCgroup()
+		if err != nil {
+			return fmt.Errorf("limiting the resources of rootless build steps needs a delegated cgroup: %v", err)
+		}
+		spec.Linux.CgroupsPath = filepath.Join(parent, "img-"+id)
+	}
+	if !limited {
+		return nil
+	}
+
+	if spec.Linux.Resources == nil {
+		spec.Linux.Resources = &specs.LinuxResources{}
+	}
+	r := spec.Linux.Resources
+	if w.opt.Memory > 0 {
+		r.Memory = &specs.LinuxMemory{Limit: &w.opt.Memory}
+	}
+	if w.opt.CPUs > 0 {
+		period := uint64(cpuPeriod)
+		quota := int64(w.opt.CPUs * cpuPeriod)
+		r.CPU = &specs.LinuxCPU{Period: &period, Quota: &quota}
+	}
+	if w.opt.PidsLimit > 0 {
+		r.Pids = &specs.LinuxPids{Limit: w.opt.PidsLimit}
+	}
+	return nil
+}
+
+// setUlimits replaces the resource limits of the spec with the ulimits of
+// ExecOpt.
+func (w *runcExecutor) setUlimits(spec *specs.Spec) error {
+	for _, v := range w.opt.Ulimits {
+		u, err := units.ParseUlimit(v)
+		if err != nil {
+			return err
+		}
+		rlimit := specs.POSIXRlimit{
+			Type: "RLIMIT_" + strings.ToUpper(u.Name),
+			Hard: uint64(u.Hard),
+			Soft: uint64(u.Soft),
+		}
+		replaced := false
+		for i, r := range spec.Process.Rlimits {
+			if r.Type == rlimit.Type {
+				spec.Process.Rlimits[i] = rlimit
+				replaced = true
+			}
+		}
+		if !replaced {
+			spec.Process.Rlimits = append(spec.Process.Rlimits, rlimit)
+		}
+	}
+	return nil
+}
+
+// delegatedCgroup returns the cgroup v2 of the current process, if the user
+// can create cgroups below it.
+func delegatedCgroup() (string, error) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		return "", errors.New("cgroup v2 is not mounted at /sys/fs/cgroup")
+	}
+	b, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		if !strings.HasPrefix(line, "0::") {
+			continue
+		}
+		cgroup := strings.TrimPrefix(line, "0::")
+		if err := unix.Access(filepath.Join("/sys/fs/cgroup", cgroup), unix.W_OK); err != nil {
+			return "", fmt.Errorf("cgroup %s is not writable: %v", cgroup, err)
+		}
+		return cgroup, nil
+	}
+	return "", errors.New("no cgroup v2 found in /proc/self/cgroup")
+}
+
+// hosts returns the content of the hosts file of the containers.
+func (w *runcExecutor) hosts() []byte {
+	b := bytes.NewBufferString(defaultHosts)
+	for _, h := range w.opt.ExtraHosts {
+		kv := strings.SplitN(h, ":", 2)
+		fmt.Fprintf(b, "%s\t%s\n", kv[1], kv[0])
+	}
+	return b.Bytes()
+}
+
+type forwardIO struct {
+	stdin          io.ReadCloser
+	stdout, stderr io.WriteCloser
+}
+
+func (s *forwardIO) Close() error {
+	return nil
+}
+
+func (s *forwardIO) Set(cmd *exec.Cmd) {
+	cmd.Stdin = s.stdin
+	cmd.Stdout = s.stdout
+	cmd.Stderr = s.stderr
+}
+
+func (s *forwardIO) Stdin() io.WriteCloser {
+	return nil
+}
+
+func (s *forwardIO) Stdout() io.ReadCloser {
+	return nil
+}
+
+func (s *forwardIO) Stderr() io.ReadCloser {
+	return nil
+}
+
+// setOOMScoreAdj sets the oom_score_adj of the containers to that of the
+// current process.
+func setOOMScoreAdj(spec *specs.Spec) error {
+	b, err := ioutil.ReadFile("/proc/self/oom_score_adj")
+	if err != nil {
+		return errors.Wrap(err, "failed to read /proc/self/oom_score_adj")
+	}
+	s := strings.TrimSpace(string(b))
+	oom, err := strconv.Atoi(s)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse %s as int", s)
+	}
+	spec.Process.OOMScoreAdj = &oom
+	return nil
+}
@@ -0,0 +1,170 @@
+package client
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/idtools"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/runc/libcontainer/system"
+)
+
+// ExportOptions are the options of ExportImage.
+type ExportOptions struct {
+	// Platform is the platform of the image to export from a manifest
+	// list, and the one other images must be for. It is the default
+	// platform when empty.
+	Platform string
+	// UIDMap and GIDMap shift the owners of the files into the ranges of
+	// a user namespace, as the ID maps of the namespace would. Owners
+	// outside of the maps are an error.
+	UIDMap []idtools.IDMap
+	GIDMap []idtools.IDMap
+	// Chown is the owner of every file when set, instead of the owners
+	// in the image.
+	Chown *idtools.IDPair
+}
+
+// ExportImage writes the filesystem of an image as a single tarball, with the
+// files of all its layers applied in order and the files removed by a layer
+// left out.
+func (c *Client) ExportImage(ctx context.Context, image string, options ExportOptions, writer io.WriteCloser) error {
+	if options.Chown != nil && (len(options.UIDMap) > 0 || len(options.GIDMap) > 0) {
+		return errors.New("the owners of the files cannot be both set and mapped")
+	}
+	platform := options.Platform
+	if platform == "" {
+		platform = platforms.Default()
+	}
+	p, err := platforms.Parse(platform)
+	if err != nil {
+		return fmt.Errorf("parsing platform %q failed: %v", platform, err)
+	}
+
+	is, cs, err := c.readImageStores(ctx)
+	if err != nil {
+		return err
+	}
+	if is == nil {
+		return fmt.Errorf("image %q does not exist", image)
+	}
+
+	img, err := getImage(ctx, is, image)
+	if err != nil {
+		return err
+	}
+	target, err := manifestForPlatform(ctx, cs, img.Target, p)
+	if err != nil {
+		return fmt.Errorf("getting the manifest of %s failed: %v", img.Name, err)
+	}
+	// An image that is not a manifest list has the platform of its config.
+	if target.Digest == img.Target.Digest {
+		cp, err := configPlatform(ctx, cs, target)
+		if err != nil {
+			return fmt.Errorf("reading the config of %s failed: %v", img.Name, err)
+		}
+		if cp.OS != "" && !platforms.NewMatcher(p).Match(platforms.Normalize(*cp)) {
+			return fmt.Errorf("%s is an image for platform %s, not %s", img.Name, platforms.Format(*cp), platforms.Format(p))
+		}
+	}
+	dt, err := content.ReadBlob(ctx, cs, target.Digest)
+	if err != nil {
+		return fmt.Errorf("reading manifest %s failed: %v", target.Digest, err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(dt, &manifest); err != nil {
+		return fmt.Errorf("parsing manifest %s failed: %v", target.Digest, err)
+	}
+
+	tw := tar.NewWriter(writer)
+	if _, err := flattenLayers(ctx, cs, manifest.Layers, tw, options.chown); err != nil {
+		return fmt.Errorf("exporting the filesystem of %s failed: %v", img.Name, err)
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
+
+// UnpackImage unpacks the filesystem of an image, as ExportImage exports it,
+// to the directory dest. The files keep the owners in the image when
+// unpacked by root, otherwise they belong to the user unpacking them, like
+// tar does. Owners set or mapped by the options are always kept.
+func (c *Client) UnpackImage(ctx context.Context, image, dest string, options ExportOptions) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	exported := make(chan error, 1)
+	go func() {
+		err := c.ExportImage(ctx, image, options, pw)
+		pw.CloseWithError(err)
+		exported <- err
+	}()
+
+	err := archive.Untar(pr, dest, &archive.TarOptions{
+		NoLchown: !options.changesOwners() && (os.Geteuid() != 0 || system.RunningInUserNS()),
+		InUserNS: system.RunningInUserNS(),
+	})
+	// Stop the export if unpacking failed.
+	pr.CloseWithError(err)
+	exportErr := <-exported
+	if err != nil && err != exportErr {
+		return fmt.Errorf("unpacking %s failed: %v", image, err)
+	}
+	return exportErr
+}
+
+// changesOwners returns whether the options set or map the owners of the
+// files.
+func (o ExportOptions) changesOwners() bool {
+	return o.Chown != nil || len(o.UIDMap) > 0 || len(o.GIDMap) > 0
+}
+
+// chown changes the owner of a file as the options request. The user and
+// group names are removed, so the files are extracted with the new IDs
+// rather than those of the names on the host.
+func (o ExportOptions) chown(hdr *tar.Header) error {
+	switch {
+	case o.Chown != nil:
+		hdr.Uid, hdr.Gid = o.Chown.UID, o.Chown.GID
+	case len(o.UIDMap) > 0 || len(o.GIDMap) > 0:
+		uid, err := mapID(hdr.Uid, o.UIDMap)
+		if err != nil {
+			return fmt.Errorf("mapping the owner of %s failed: uid %v", hdr.Name, err)
+		}
+		gid, err := mapID(hdr.Gid, o.GIDMap)
+		if err != nil {
+			return fmt.Errorf("mapping the group of %s failed: gid %v", hdr.Name, err)
+		}
+		hdr.Uid, hdr.Gid = uid, gid
+	default:
+		return nil
+	}
+	hdr.Uname, hdr.Gname = "", ""
+	return nil
+}
+
+// mapID returns the ID an ID is mapped to, the ID itself when there are no
+// maps.
+func mapID(id int, maps []idtools.IDMap) (int, error) {
+	if len(maps) == 0 {
+		return id, nil
+	}
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID, nil
+		}
+	}
+	return 0, fmt.Errorf("%d is not in the maps", id)
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/docker/docker/pkg/idtools"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestFlattenLayers(t *testing.T) {
+	ctx := context.Background()
+	cs, cleanup := testContentStore(t)
+	defer cleanup()
+
+	base, _ := testLayer(t, cs, ocispec.MediaTypeImageLayer, map[string]string{
+		"etc/":   "",
+		"etc/a":  "a",
+		"etc/b":  "b",
+		"bin/":   "",
+		"bin/sh": "sh",
+	})
+	// A whiteout removes a file and a file replaces a directory.
+	changed, _ := testLayer(t, cs, ocispec.MediaTypeImageLayer, map[string]string{
+		"etc/.wh.a": "",
+		"etc/c":     "c",
+		"bin":       "bin",
+	})
+	// An opaque directory removes the files of the layers below.
+	opaque, _ := testLayer(t, cs, ocispec.MediaTypeImageLayer, map[string]string{
+		"etc/.wh..wh..opq": "",
+		"etc/d":            "d",
+	})
+	layers := []ocispec.Descriptor{base, changed, opaque}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries, err := flattenLayers(ctx, cs, layers, tw, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		dt, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, strings.TrimSuffix(hdr.Name, "/")+"="+string(dt))
+	}
+	// The directories are written first.
+	if strings.Join(names, " ") != "etc= bin=bin etc/d=d" || entries != 3 {
+		t.Fatalf("expected the files left once the layers are applied, got %d entries: %v", entries, names)
+	}
+}
+
+func TestUnpackImage(t *testing.T) {
+	c, cleanup := testClient(t, testImage{
+		name:   "docker.io/library/unpacktest:latest",
+		config: ocispec.Image{OS: "linux", Architecture: "amd64"},
+		layers: []map[string]string{
+			{"etc/": "", "etc/a": "a", "etc/b": "b"},
+			{"etc/.wh.a": "", "bin/": "", "bin/sh": "sh"},
+		},
+	})
+	defer cleanup()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+
+	dest := filepath.Join(c.root, "rootfs")
+	if err := c.UnpackImage(ctx, "unpacktest", dest, ExportOptions{Platform: "linux/amd64"}); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"etc/b": "b", "bin/sh": "sh"} {
+		dt, err := ioutil.ReadFile(filepath.Join(dest, name))
+		if err != nil || string(dt) != expected {
+			t.Fatalf("expected %s to be unpacked with %q, got %q: %v", name, expected, dt, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dest, "etc", "a")); !os.IsNotExist(err) {
+		t.Fatalf("expected the removed file not to be unpacked, got: %v", err)
+	}
+
+	err := c.UnpackImage(ctx, "unpacktest", filepath.Join(c.root, "arm64"), ExportOptions{Platform: "linux/arm64"})
+	if err == nil || !strings.Contains(err.Error(), "is an image for platform linux/amd64, not linux/arm64") {
+		t.Fatalf("expected an image for another platform to fail, got: %v", err)
+	}
+	err = c.UnpackImage(ctx, "nope", filepath.Join(c.root, "nope"), ExportOptions{})
+	if err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Fatalf("expected a missing image to fail, got: %v", err)
+	}
+}
+
+func TestExportOptionsChown(t *testing.T) {
+	maps := []idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 1000}}
+	tests := []struct {
+		options  ExportOptions
+		uid, gid int
+	}{
+		{ExportOptions{}, 10, 20},
+		{ExportOptions{UIDMap: maps, GIDMap: maps}, 100010, 100020},
+		// Without maps for the groups they are kept.
+		{ExportOptions{UIDMap: maps}, 100010, 20},
+		{ExportOptions{Chown: &idtools.IDPair{UID: 1, GID: 2}}, 1, 2},
+	}
+	for _, tt := range tests {
+		hdr := &tar.Header{Name: "etc/a", Uid: 10, Gid: 20, Uname: "user", Gname: "group"}
+		if err := tt.options.chown(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Uid != tt.uid || hdr.Gid != tt.gid {
+			t.Fatalf("expected %d:%d with %+v, got %d:%d", tt.uid, tt.gid, tt.options, hdr.Uid, hdr.Gid)
+		}
+		// The names are only kept with the owners of the image.
+		if tt.options.changesOwners() == (hdr.Uname != "") {
+			t.Fatalf("expected the names to be dropped only when the owners change, got %q", hdr.Uname)
+		}
+	}
+
+	hdr := &tar.Header{Name: "etc/a", Uid: 1000}
+	err := ExportOptions{UIDMap: maps}.chown(hdr)
+	if err == nil || !strings.Contains(err.Error(), "mapping the owner of etc/a failed: uid 1000 is not in the maps") {
+		t.Fatalf("expected an owner outside of the maps to fail, got: %v", err)
+	}
+}
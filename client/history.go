@@ -0,0 +1,62 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// HistoryEntry is an entry of the history of an image.
+type HistoryEntry struct {
+	Created   time.Time
+	CreatedBy string
+	Comment   string
+	// EmptyLayer is true for the entries that did not create a layer, like
+	// those of ENV or CMD.
+	EmptyLayer bool
+	// Layer and Size are the digest and compressed size of the layer the
+	// entry created.
+	Layer digest.Digest
+	Size  int64
+}
+
+// ImageHistory returns the history of an image in the image store, the most
+// recent entry first.
+func (c *Client) ImageHistory(ctx context.Context, image string) ([]HistoryEntry, error) {
+	img, err := c.InspectImage(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]HistoryEntry, 0, len(img.Config.History))
+	layers := img.Layers
+	for _, h := range img.Config.History {
+		entry := HistoryEntry{
+			CreatedBy:  h.CreatedBy,
+			Comment:    h.Comment,
+			EmptyLayer: h.EmptyLayer,
+		}
+		if h.Created != nil {
+			entry.Created = *h.Created
+		}
+		// The entries that created a layer are in the order of the layers.
+		if !h.EmptyLayer && len(layers) > 0 {
+			entry.Layer = layers[0].Digest
+			entry.Size = layers[0].Size
+			layers = layers[1:]
+		}
+		entries = append(entries, entry)
+	}
+	// Images without a history, or with fewer entries than layers, still
+	// show every layer.
+	for _, l := range layers {
+		entries = append(entries, HistoryEntry{Layer: l.Digest, Size: l.Size})
+	}
+
+	// Reverse the entries so the most recent is first.
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
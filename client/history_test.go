@@ -0,0 +1,62 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestImageHistory(t *testing.T) {
+	c, cleanup := testClient(t,
+		testImage{
+			name: "docker.io/library/historytest:latest",
+			config: ocispec.Image{History: []ocispec.History{
+				{CreatedBy: "ADD file in /"},
+				{CreatedBy: "LABEL step=label", EmptyLayer: true},
+				{CreatedBy: "RUN echo history > /history", Comment: "buildkit"},
+			}},
+			layers: []map[string]string{{"bin/sh": "sh"}, {"history": "history"}},
+		},
+		// The layers without a history entry are still shown.
+		testImage{
+			name:   "docker.io/library/nohistory:latest",
+			layers: []map[string]string{{"bin/sh": "sh"}},
+		},
+	)
+	defer cleanup()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+
+	entries, err := c.ImageHistory(ctx, "historytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %#v", entries)
+	}
+	// The most recent entry is first.
+	img, err := c.InspectImage(ctx, "historytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, history := img.Layers[0], img.Layers[1]
+	if entries[0].CreatedBy != "RUN echo history > /history" || entries[0].Layer != history.Digest || entries[0].Size != history.Size || entries[0].Comment != "buildkit" {
+		t.Fatalf("expected the RUN step with the last layer first, got %#v", entries[0])
+	}
+	if !entries[1].EmptyLayer || entries[1].Layer != "" {
+		t.Fatalf("expected the LABEL step without a layer, got %#v", entries[1])
+	}
+	if entries[2].Layer != base.Digest {
+		t.Fatalf("expected the first layer last, got %#v", entries[2])
+	}
+
+	entries, err = c.ImageHistory(ctx, "nohistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The layer is the same as the first one of historytest.
+	if len(entries) != 1 || entries[0].Layer != base.Digest {
+		t.Fatalf("expected an entry for the layer, got %#v", entries)
+	}
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The kinds of changes of a file between two images.
+const (
+	// FileAdded is a file only the second image has.
+	FileAdded = "A"
+	// FileDeleted is a file only the first image has.
+	FileDeleted = "D"
+	// FileChanged is a file with another content, type, mode or owner in
+	// the second image.
+	FileChanged = "C"
+)
+
+// ImageDiff is the difference between two images.
+type ImageDiff struct {
+	From, To *InspectedImage
+	// SharedLayers are the layers of both images, RemovedLayers those
+	// only From has and AddedLayers those only To has. Layers are the same
+	// when they have the same diff ID.
+	SharedLayers  []InspectedLayer
+	RemovedLayers []InspectedLayer
+	AddedLayers   []InspectedLayer
+	// Changes are the changed files, sorted by path.
+	Changes []FileChange
+}
+
+// FileChange is a file that differs between two images.
+type FileChange struct {
+	Kind string
+	Path string
+	// FromSize and ToSize are the size of the file in each image, zero
+	// when the image does not have it.
+	FromSize int64
+	ToSize   int64
+}
+
+// diffFile is a file of the filesystem of an image.
+type diffFile struct {
+	sig  string
+	size int64
+}
+
+// DiffImages compares the layers and the files of two images of the image
+// store, for the default platform. The modification times of the files are
+// ignored, so rebuilding a file with the same content is not a change.
+func (c *Client) DiffImages(ctx context.Context, from, to string) (*ImageDiff, error) {
+	d := &ImageDiff{}
+	var err error
+	if d.From, err = c.InspectImage(ctx, from); err != nil {
+		return nil, err
+	}
+	if d.To, err = c.InspectImage(ctx, to); err != nil {
+		return nil, err
+	}
+
+	fromLayers := map[digest.Digest]bool{}
+	for _, l := range d.From.Layers {
+		fromLayers[l.DiffID] = true
+	}
+	toLayers := map[digest.Digest]bool{}
+	for _, l := range d.To.Layers {
+		toLayers[l.DiffID] = true
+	}
+	for _, l := range d.From.Layers {
+		if toLayers[l.DiffID] {
+			d.SharedLayers = append(d.SharedLayers, l)
+		} else {
+			d.RemovedLayers = append(d.RemovedLayers, l)
+		}
+	}
+	for _, l := range d.To.Layers {
+		if !fromLayers[l.DiffID] {
+			d.AddedLayers = append(d.AddedLayers, l)
+		}
+	}
+
+	// Images with the same layers have the same files.
+	if len(d.RemovedLayers) == 0 && len(d.AddedLayers) == 0 {
+		return d, nil
+	}
+
+	_, cs, err := c.readImageStores(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fromFiles, err := imageFiles(ctx, cs, d.From.Manifest.Layers)
+	if err != nil {
+		return nil, fmt.Errorf("reading the files of %s failed: %v", d.From.Name, err)
+	}
+	toFiles, err := imageFiles(ctx, cs, d.To.Manifest.Layers)
+	if err != nil {
+		return nil, fmt.Errorf("reading the files of %s failed: %v", d.To.Name, err)
+	}
+
+	for name, f := range fromFiles {
+		t, ok := toFiles[name]
+		switch {
+		case !ok:
+			d.Changes = append(d.Changes, FileChange{Kind: FileDeleted, Path: name, FromSize: f.size})
+		case t.sig != f.sig:
+			d.Changes = append(d.Changes, FileChange{Kind: FileChanged, Path: name, FromSize: f.size, ToSize: t.size})
+		}
+	}
+	for name, t := range toFiles {
+		if _, ok := fromFiles[name]; !ok {
+			d.Changes = append(d.Changes, FileChange{Kind: FileAdded, Path: name, ToSize: t.size})
+		}
+	}
+	sort.Slice(d.Changes, func(i, j int) bool {
+		return d.Changes[i].Path < d.Changes[j].Path
+	})
+	return d, nil
+}
+
+// imageFiles returns the files of the filesystem the layers create when
+// they are applied in order, by their absolute path.
+func imageFiles(ctx context.Context, cs content.Store, layers []ocispec.Descriptor) (map[string]diffFile, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		_, err := flattenLayers(ctx, cs, layers, tw, nil)
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	files := map[string]diffFile{}
+	tr := tar.NewReader(pr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		dgstr := digest.SHA256.Digester()
+		if _, err := io.Copy(dgstr.Hash(), tr); err != nil {
+			return nil, err
+		}
+		// Leave the modification time out of the signature.
+		sig := *hdr
+		sig.ModTime = time.Time{}
+		files[path.Join("/", hdr.Name)] = diffFile{
+			sig:  entrySignature(&sig, dgstr.Digest()),
+			size: hdr.Size,
+		}
+	}
+}
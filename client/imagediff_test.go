@@ -0,0 +1,68 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+)
+
+func TestDiffImages(t *testing.T) {
+	base := map[string]string{"bin/": "", "bin/sh": "sh", "etc/": "", "etc/conf": "conf"}
+	c, cleanup := testClient(t,
+		testImage{
+			name:   "docker.io/library/from:latest",
+			layers: []map[string]string{base, {"app": "v1", "old": "old"}},
+		},
+		testImage{
+			name:   "docker.io/library/to:latest",
+			layers: []map[string]string{base, {"app": "v2!", "new": "new", "etc/conf": "conf"}},
+		},
+		testImage{
+			name:   "docker.io/library/same:latest",
+			layers: []map[string]string{base},
+		},
+	)
+	defer cleanup()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+
+	d, err := c.DiffImages(ctx, "from", "to")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.SharedLayers) != 1 || len(d.RemovedLayers) != 1 || len(d.AddedLayers) != 1 {
+		t.Fatalf("expected a shared, a removed and an added layer, got %d, %d and %d", len(d.SharedLayers), len(d.RemovedLayers), len(d.AddedLayers))
+	}
+
+	// The file written again with the same content is not a change.
+	expected := []FileChange{
+		{Kind: FileChanged, Path: "/app", FromSize: 2, ToSize: 3},
+		{Kind: FileAdded, Path: "/new", ToSize: 3},
+		{Kind: FileDeleted, Path: "/old", FromSize: 3},
+	}
+	if len(d.Changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %#v", len(expected), d.Changes)
+	}
+	for i, change := range expected {
+		if d.Changes[i] != change {
+			t.Fatalf("expected change %#v, got %#v", change, d.Changes[i])
+		}
+	}
+
+	// Images with the same layers have no changes.
+	d, err = c.DiffImages(ctx, "from", "from")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.SharedLayers) != 2 || len(d.Changes) != 0 {
+		t.Fatalf("expected no changes between the same images, got %#v", d)
+	}
+
+	d, err = c.DiffImages(ctx, "same", "from")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.AddedLayers) != 1 || len(d.Changes) != 2 {
+		t.Fatalf("expected the files of the added layer, got %#v", d.Changes)
+	}
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// InspectedImage is an image as InspectImage reads it from the content
+// store.
+type InspectedImage struct {
+	Name      string        `json:"name"`
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+	CreatedAt time.Time     `json:"createdAt"`
+	UpdatedAt time.Time     `json:"updatedAt"`
+	// Index is the manifest list or index of a multi-platform image.
+	Index *ocispec.Index `json:"index,omitempty"`
+	// Manifest and Config are those of the image for the default platform.
+	Manifest ocispec.Manifest `json:"manifest"`
+	Config   ocispec.Image    `json:"config"`
+	Layers   []InspectedLayer `json:"layers"`
+	// Size is the size of the config and the compressed layers.
+	Size int64 `json:"size"`
+}
+
+// InspectedLayer is a layer of an InspectedImage.
+type InspectedLayer struct {
+	Digest    digest.Digest `json:"digest"`
+	DiffID    digest.Digest `json:"diffID"`
+	MediaType string        `json:"mediaType"`
+	Size      int64         `json:"size"`
+}
+
+// InspectImage returns the manifests, config and layers of an image in the
+// image store.
+func (c *Client) InspectImage(ctx context.Context, image string) (*InspectedImage, error) {
+	is, cs, err := c.readImageStores(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if is == nil {
+		return nil, fmt.Errorf("image %q does not exist", image)
+	}
+
+	img, err := getImage(ctx, is, image)
+	if err != nil {
+		return nil, err
+	}
+
+	inspected := &InspectedImage{
+		Name:      img.Name,
+		Digest:    img.Target.Digest,
+		MediaType: img.Target.MediaType,
+		CreatedAt: img.CreatedAt,
+		UpdatedAt: img.UpdatedAt,
+	}
+	switch img.Target.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		dt, err := content.ReadBlob(ctx, cs, img.Target.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("reading index %s failed: %v", img.Target.Digest, err)
+		}
+		inspected.Index = &ocispec.Index{}
+		if err := json.Unmarshal(dt, inspected.Index); err != nil {
+			return nil, fmt.Errorf("parsing index %s failed: %v", img.Target.Digest, err)
+		}
+	}
+
+	desc, err := platformManifest(ctx, cs, img.Target)
+	if err != nil {
+		return nil, err
+	}
+	dt, err := content.ReadBlob(ctx, cs, desc.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest %s failed: %v", desc.Digest, err)
+	}
+	if err := json.Unmarshal(dt, &inspected.Manifest); err != nil {
+		return nil, fmt.Errorf("parsing manifest %s failed: %v", desc.Digest, err)
+	}
+	dt, err = content.ReadBlob(ctx, cs, inspected.Manifest.Config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("reading config %s failed: %v", inspected.Manifest.Config.Digest, err)
+	}
+	if err := json.Unmarshal(dt, &inspected.Config); err != nil {
+		return nil, fmt.Errorf("parsing config %s failed: %v", inspected.Manifest.Config.Digest, err)
+	}
+
+	inspected.Size = inspected.Manifest.Config.Size
+	inspected.Layers = []InspectedLayer{}
+	for i, l := range inspected.Manifest.Layers {
+		layer := InspectedLayer{Digest: l.Digest, MediaType: l.MediaType, Size: l.Size}
+		if i < len(inspected.Config.RootFS.DiffIDs) {
+			layer.DiffID = inspected.Config.RootFS.DiffIDs[i]
+		}
+		inspected.Layers = append(inspected.Layers, layer)
+		inspected.Size += l.Size
+	}
+	return inspected, nil
+}
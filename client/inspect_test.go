@@ -0,0 +1,165 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	ctdmetadata "github.com/containerd/containerd/metadata"
+	"github.com/containerd/containerd/namespaces"
+	ctdsnapshot "github.com/containerd/containerd/snapshots"
+	"github.com/moby/buildkit/worker/base"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testImage is an image written to the stores of a test client, with a
+// layer for each of the file sets, as testLayer writes them.
+type testImage struct {
+	name   string
+	config ocispec.Image
+	layers []map[string]string
+	// modTime is the modification time of the files of the layers, that of
+	// testLayer if it is zero.
+	modTime time.Time
+}
+
+// testClient returns a client with the images in the stores of its state
+// directory, and a function removing it. The stores are only read by the
+// client, like those of a state directory without a running build.
+func testClient(t *testing.T, imgs ...testImage) (*Client, func()) {
+	root, err := ioutil.TempDir("", "img-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := testMetadata(t, root, imgs...)
+	db.Close()
+	return &Client{root: root}, func() { os.RemoveAll(root) }
+}
+
+// testWorkerClient returns a client with the images in the stores of its
+// worker, for the methods rewriting images, and a function closing and
+// removing them.
+func testWorkerClient(t *testing.T, imgs ...testImage) (*Client, func()) {
+	root, err := ioutil.TempDir("", "img-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, mdb := testMetadata(t, root, imgs...)
+	c := &Client{root: root, workerOpt: &base.WorkerOpt{
+		ContentStore: mdb.ContentStore(),
+		ImageStore:   ctdmetadata.NewImageStore(mdb),
+	}}
+	return c, func() {
+		db.Close()
+		os.RemoveAll(root)
+	}
+}
+
+// testMetadata opens the stores of the state directory root with the images
+// written to them.
+func testMetadata(t *testing.T, root string, imgs ...testImage) (*bolt.DB, *ctdmetadata.DB) {
+	store, err := local.NewStore(filepath.Join(root, "content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(root, "containerdmeta.db"), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdb := ctdmetadata.NewDB(db, store, map[string]ctdsnapshot.Snapshotter{})
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+	if err := mdb.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cs := mdb.ContentStore()
+
+	for _, img := range imgs {
+		modTime := img.modTime
+		if modTime.IsZero() {
+			modTime = testLayerTime
+		}
+		var manifest ocispec.Manifest
+		manifest.SchemaVersion = 2
+		for _, files := range img.layers {
+			desc, diffID := testLayerAt(t, cs, ocispec.MediaTypeImageLayer, files, modTime)
+			manifest.Layers = append(manifest.Layers, desc)
+			img.config.RootFS.DiffIDs = append(img.config.RootFS.DiffIDs, diffID)
+		}
+		img.config.RootFS.Type = "layers"
+		if manifest.Config, err = writeJSON(ctx, cs, ocispec.MediaTypeImageConfig, img.config); err != nil {
+			t.Fatal(err)
+		}
+		desc, err := writeManifest(ctx, cs, manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ctdmetadata.NewImageStore(mdb).Create(ctx, images.Image{Name: img.name, Target: desc}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db, mdb
+}
+
+func TestInspectImage(t *testing.T) {
+	created := time.Unix(10, 0).UTC()
+	c, cleanup := testClient(t, testImage{
+		name: "docker.io/library/inspecttest:latest",
+		config: ocispec.Image{
+			Created:      &created,
+			Architecture: "amd64",
+			OS:           "linux",
+			Config:       ocispec.ImageConfig{Labels: map[string]string{"team": "img"}},
+		},
+		layers: []map[string]string{{"one": "1"}, {"three": "3"}},
+	})
+	defer cleanup()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+
+	img, err := c.InspectImage(ctx, "inspecttest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Name != "docker.io/library/inspecttest:latest" || img.MediaType != ocispec.MediaTypeImageManifest || img.Index != nil {
+		t.Fatalf("expected the manifest of inspecttest, got %#v", img)
+	}
+	if img.Config.Config.Labels["team"] != "img" || !img.Config.Created.Equal(created) {
+		t.Fatalf("expected the config of inspecttest, got %#v", img.Config)
+	}
+	if len(img.Layers) != 2 {
+		t.Fatalf("expected the 2 layers of inspecttest, got %#v", img.Layers)
+	}
+	size := img.Manifest.Config.Size
+	for i, l := range img.Manifest.Layers {
+		if img.Layers[i].Digest != l.Digest || img.Layers[i].Size != l.Size || img.Layers[i].DiffID != img.Config.RootFS.DiffIDs[i] {
+			t.Fatalf("expected layer %d with the diff ID of the config, got %#v", i, img.Layers[i])
+		}
+		size += l.Size
+	}
+	if img.Size != size {
+		t.Fatalf("expected the size of the config and the layers %d, got %d", size, img.Size)
+	}
+
+	if _, err := c.InspectImage(ctx, "nope"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected a missing image to fail, got: %v", err)
+	}
+}
+
+func TestInspectImageEmptyState(t *testing.T) {
+	root, err := ioutil.TempDir("", "img-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	c := &Client{root: root}
+	if _, err := c.InspectImage(context.Background(), "busybox"); err == nil || !strings.Contains(err.Error(), `image "busybox" does not exist`) {
+		t.Fatalf("expected an image of an empty state directory not to exist, got: %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/genuinetools/img/types"
+	"github.com/moby/buildkit/identity"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// leaseFile is the name of the lease file in the state directory.
+	leaseFile = "state.lease"
+	// leaseTTL is how long a lease file may go without being renewed before
+	// it is considered stale and broken by the next process.
+	leaseTTL = 30 * time.Second
+	// leaseRenewInterval is how often the holder renews the lease.
+	leaseRenewInterval = leaseTTL / 3
+	// leasePollInterval is how often a waiting process checks the lease.
+	leasePollInterval = time.Second
+)
+
+// Magic numbers of the network filesystems from statfs(2).
+const (
+	nfsSuperMagic  = 0x6969
+	smbSuperMagic  = 0x517b
+	cifsSuperMagic = 0xff534d42
+	smb2SuperMagic = 0xfe534d42
+)
+
+// ResolveStateLock returns the locking that will be used for the given state
+// lock for the state directory root, resolving the "auto" lock to lease on
+// network filesystems.
+func ResolveStateLock(root, lock string) string {
+	if lock != types.AutoStateLock {
+		return lock
+	}
+
+	lock = types.FlockStateLock
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(root, &st); err == nil {
+		switch uint32(st.Type) {
+		case nfsSuperMagic, smbSuperMagic, cifsSuperMagic, smb2SuperMagic:
+			lock = types.LeaseStateLock
+		}
+	}
+	logrus.WithField("lock", lock).Debug("resolved auto state lock")
+	return lock
+}
+
+// stateLease is an exclusive lease on a state directory held through a lease
+// file. Unlike flock(2), which is often unsupported or only local on NFS and
+// CIFS, the lease only relies on exclusive creates and renames, so runners on
+// different hosts sharing one state directory take turns with it.
+//
+// The holder renews the lease by rewriting the file with an incremented
+// counter. Others only check whether the file changed within leaseTTL by
+// their own clock, so clock skew between the hosts does not matter. A lease
+// left behind by a runner that died is broken once it is stale.
+type stateLease struct {
+	path   string
+	holder leaseHolder
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// leaseHolder is the content of the lease file.
+type leaseHolder struct {
+	ID       string `json:"id"`
+	Hostname string `json:"hostname"`
+	PID      int    `json:"pid"`
+	// Renewed counts the renewals of the lease.
+	Renewed int64 `json:"renewed"`
+}
+
+// acquireStateLease waits until it holds the lease on the state directory
+// root and renews it in the background until it is released.
+func acquireStateLease(ctx context.Context, root string) (*stateLease, error) {
+	hostname, _ := os.Hostname()
+	l := &stateLease{
+		path: filepath.Join(root, leaseFile),
+		holder: leaseHolder{
+			ID:       identity.NewID(),
+			Hostname: hostname,
+			PID:      os.Getpid(),
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	var (
+		last    []byte
+		changed time.Time
+		waiting bool
+	)
+	for {
+		f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			err = l.write(f)
+			f.Close()
+			if err != nil {
+				os.Remove(l.path)
+				return nil, err
+			}
+			go l.renewLoop()
+			return l, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("creating lease %s failed: %v", l.path, err)
+		}
+
+		b, err := ioutil.ReadFile(l.path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("reading lease %s failed: %v", l.path, err)
+		}
+		if changed.IsZero() || !bytes.Equal(b, last) {
+			last, changed = b, time.Now()
+		}
+		if !waiting {
+			var other leaseHolder
+			json.Unmarshal(b, &other)
+			logrus.Infof("waiting for the lease on %s held by %s (pid %d)", root, other.Hostname, other.PID)
+			waiting = true
+		}
+		if time.Since(changed) > leaseTTL {
+			logrus.Warnf("breaking stale lease %s", l.path)
+			if err := breakLease(l.path, b); err != nil {
+				return nil, err
+			}
+			changed = time.Time{}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(leasePollInterval):
+		}
+	}
+}
+
+// breakLease removes the stale lease file with the content stale. The file
+// is renamed first so only one of the processes breaking it at the same time
+// succeeds, a lease acquired again in the meantime is put back.
+func breakLease(path string, stale []byte) error {
+	broken := path + ".broken-" + identity.NewID()
+	if err := os.Rename(path, broken); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("breaking lease %s failed: %v", path, err)
+	}
+	defer os.Remove(broken)
+
+	if b, err := ioutil.ReadFile(broken); err == nil && !bytes.Equal(b, stale) {
+		// Link does not replace a lease created since.
+		os.Link(broken, path)
+	}
+	return nil
+}
+
+func (l *stateLease) write(f *os.File) error {
+	b, err := json.Marshal(l.holder)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		return fmt.Errorf("writing lease %s failed: %v", l.path, err)
+	}
+	return f.Sync()
+}
+
+// held reports whether the lease file is still ours.
+func (l *stateLease) held() bool {
+	b, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return false
+	}
+	var holder leaseHolder
+	return json.Unmarshal(b, &holder) == nil && holder.ID == l.holder.ID
+}
+
+// errLeaseLost is returned when renewing a lease another process broke.
+var errLeaseLost = errors.New("lease was lost")
+
+// renew rewrites the lease file in place. It is not created again if it was
+// broken, since another process may hold the state directory by now.
+func (l *stateLease) renew() error {
+	if !l.held() {
+		return errLeaseLost
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("renewing lease %s failed: %v", l.path, err)
+	}
+	defer f.Close()
+	l.holder.Renewed++
+	return l.write(f)
+}
+
+// renewLoop renews the lease until it is released. It aborts the process
+// when the lease is lost, or could not be renewed for leaseTTL so others may
+// break it, since carrying on would let two processes write the state
+// directory.
+func (l *stateLease) renewLoop() {
+	defer close(l.done)
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			err := l.renew()
+			switch {
+			case err == nil:
+				renewed = time.Now()
+			case err == errLeaseLost:
+				logrus.Fatalf("lease %s was lost, another process may be using the state directory", l.path)
+			case time.Since(renewed) > leaseTTL:
+				logrus.Fatalf("lease %s could not be renewed for %s: %v", l.path, leaseTTL, err)
+			default:
+				logrus.Error(err)
+			}
+		}
+	}
+}
+
+// release stops renewing the lease and removes the lease file.
+func (l *stateLease) release() error {
+	close(l.stop)
+	<-l.done
+	if !l.held() {
+		return nil
+	}
+	if err := os.Remove(l.path); err != nil {
+		return fmt.Errorf("removing lease %s failed: %v", l.path, err)
+	}
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/boltdb/bolt"
+	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/content/local"
 	"github.com/containerd/containerd/images"
 	ctdmetadata "github.com/containerd/containerd/metadata"
@@ -23,32 +24,62 @@ type ListedImage struct {
 
 // ListImages returns the images from the image store.
 func (c *Client) ListImages(ctx context.Context, filters ...string) ([]ListedImage, error) {
-	dbPath := filepath.Join(c.root, "containerdmeta.db")
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+	imageStore, contentStore, err := c.readImageStores(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if imageStore == nil {
 		// The metadata database does not exist so we should just return as if there
 		// were no results.
 		return nil, nil
 	}
 
+	return listImages(ctx, imageStore, contentStore, filters...)
+}
+
+// readImageStores returns the image and content stores to read images from,
+// without the worker the other operations need. The stores are nil if the
+// metadata database does not exist yet.
+func (c *Client) readImageStores(ctx context.Context) (images.Store, content.Store, error) {
+	// Use the open stores if the client has them, the database can not be
+	// opened a second time.
+	c.wmu.Lock()
+	opt := c.workerOpt
+	c.wmu.Unlock()
+	if opt != nil {
+		return opt.ImageStore, opt.ContentStore, nil
+	}
+
+	dbPath := filepath.Join(c.root, "containerdmeta.db")
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+
+	if err := c.lockState(ctx); err != nil {
+		return nil, nil, err
+	}
+
 	// Open the bolt database for metadata.
-	// Since we are only listing we can open it as read-only.
+	// Since we are only reading we can open it as read-only.
 	db, err := bolt.Open(dbPath, 0644, &bolt.Options{ReadOnly: true})
 	if err != nil {
-		return nil, fmt.Errorf("opening boltdb failed: %v", err)
+		return nil, nil, fmt.Errorf("opening boltdb failed: %v", err)
 	}
 
 	// Create the content store locally.
 	contentStore, err := local.NewStore(filepath.Join(c.root, "content"))
 	if err != nil {
-		return nil, fmt.Errorf("creating content store failed: %v", err)
+		return nil, nil, fmt.Errorf("creating content store failed: %v", err)
 	}
 
 	// Create the database for metadata.
 	mdb := ctdmetadata.NewDB(db, contentStore, nil)
 
 	// Create the image store.
-	imageStore := ctdmetadata.NewImageStore(mdb)
+	return ctdmetadata.NewImageStore(mdb), contentStore, nil
+}
 
+func listImages(ctx context.Context, imageStore images.Store, contentStore content.Provider, filters ...string) ([]ListedImage, error) {
 	// List the images in the image store.
 	i, err := imageStore.List(ctx, filters...)
 	if err != nil {
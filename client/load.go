@@ -0,0 +1,286 @@
+package client
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LoadImage imports the images in a tarball with an OCI image layout, such as
+// the ones created by `img save` and `docker save`, into the image store.
+// Tarballs of older versions of `docker save`, with a manifest.json and the
+// layers and configs but no OCI image layout, are imported too.
+// The images are named after the tags in the manifest.json of the tarball
+// or the ref name annotation in the index, name is used for images without
+// either of them.
+func (c *Client) LoadImage(ctx context.Context, r io.Reader, name string) ([]images.Image, error) {
+	// Create the worker opts.
+	opt, err := c.createWorkerOpt()
+	if err != nil {
+		return nil, fmt.Errorf("creating worker opt failed: %v", err)
+	}
+
+	var (
+		index     *ocispec.Index
+		manifests []dockerArchiveManifest
+		repoTags  = map[digest.Digest][]string{}
+		tr        = tar.NewReader(r)
+		foundBlob = false
+		// The other files of the tarball, the configs and layers of a
+		// docker archive, and the links to them.
+		files = map[string]ocispec.Descriptor{}
+		links = map[string]string{}
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading tarball failed: %v", err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+		case tar.TypeSymlink:
+			// Layers that are the same as other layers are symlinks.
+			links[path.Clean(hdr.Name)] = path.Join(path.Dir(hdr.Name), hdr.Linkname)
+			continue
+		case tar.TypeLink:
+			links[path.Clean(hdr.Name)] = path.Clean(hdr.Linkname)
+			continue
+		default:
+			continue
+		}
+
+		switch p := path.Clean(hdr.Name); {
+		case p == "index.json":
+			index = &ocispec.Index{}
+			if err := json.NewDecoder(tr).Decode(index); err != nil {
+				return nil, fmt.Errorf("decoding index.json failed: %v", err)
+			}
+		case p == "manifest.json":
+			if manifests, err = readDockerArchiveManifest(tr); err != nil {
+				return nil, err
+			}
+			repoTags = dockerArchiveRepoTags(manifests)
+		case strings.HasPrefix(p, "blobs/"):
+			// The path is like blobs/sha256/deadbeef.
+			parts := strings.Split(p, "/")
+			if len(parts) != 3 {
+				return nil, fmt.Errorf("unexpected blob %s in tarball", p)
+			}
+			dgst := digest.NewDigestFromHex(parts[1], parts[2])
+			if err := dgst.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid blob %s in tarball: %v", p, err)
+			}
+			if err := content.WriteBlob(ctx, opt.ContentStore, "load-"+dgst.String(), tr, hdr.Size, dgst); err != nil {
+				return nil, fmt.Errorf("writing blob %s failed: %v", dgst, err)
+			}
+			foundBlob = true
+		case p == "oci-layout" || p == "repositories" || path.Base(p) == "json" || path.Base(p) == "VERSION":
+			// The files of an OCI image layout or a docker archive that
+			// are not needed.
+		default:
+			desc, err := writeArchiveFile(ctx, opt.ContentStore, "load-"+p, tr, hdr.Size)
+			if err != nil {
+				return nil, fmt.Errorf("writing %s failed: %v", p, err)
+			}
+			files[p] = desc
+		}
+	}
+
+	if index == nil && len(manifests) > 0 {
+		// A docker archive without an OCI image layout, the image
+		// manifests are created from its manifest.json.
+		if index, err = dockerArchiveIndex(ctx, opt.ContentStore, manifests, files, links); err != nil {
+			return nil, err
+		}
+		foundBlob = true
+	}
+	if index == nil || !foundBlob {
+		return nil, errors.New("tarball is neither an OCI image layout nor a docker archive, it has no index.json, manifest.json or blobs")
+	}
+
+	var loaded []images.Image
+	for _, desc := range index.Manifests {
+		names, err := loadedImageNames(ctx, opt.ContentStore, desc, repoTags, name)
+		if err != nil {
+			return loaded, err
+		}
+
+		// Label the blobs the image references so they are not garbage
+		// collected.
+		handler := images.SetChildrenLabels(opt.ContentStore, images.FilterPlatforms(images.ChildrenHandler(opt.ContentStore), platforms.Default()))
+		if err := images.Walk(ctx, handler, desc); err != nil {
+			return loaded, fmt.Errorf("labeling content of %s failed: %v", desc.Digest, err)
+		}
+
+		for _, n := range names {
+			img := images.Image{Name: n, Target: desc}
+			if _, err := opt.ImageStore.Create(ctx, img); err != nil {
+				if !errdefs.IsAlreadyExists(err) {
+					return loaded, fmt.Errorf("creating image %s failed: %v", n, err)
+				}
+				if _, err := opt.ImageStore.Update(ctx, img); err != nil {
+					return loaded, fmt.Errorf("updating image %s failed: %v", n, err)
+				}
+			}
+			loaded = append(loaded, img)
+		}
+	}
+
+	return loaded, nil
+}
+
+// dockerArchiveManifest is an image in the manifest.json of a docker
+// archive, with the paths of its config and layers in the archive.
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// readDockerArchiveManifest reads the manifest.json of a docker archive.
+func readDockerArchiveManifest(r io.Reader) ([]dockerArchiveManifest, error) {
+	var manifests []dockerArchiveManifest
+	if err := json.NewDecoder(r).Decode(&manifests); err != nil {
+		return nil, fmt.Errorf("decoding manifest.json failed: %v", err)
+	}
+	return manifests, nil
+}
+
+// dockerArchiveRepoTags returns the tags in a docker manifest.json by the
+// digest of the image config.
+func dockerArchiveRepoTags(manifests []dockerArchiveManifest) map[digest.Digest][]string {
+	tags := map[digest.Digest][]string{}
+	for _, m := range manifests {
+		// The config is either blobs/sha256/deadbeef or deadbeef.json.
+		hex := strings.TrimSuffix(path.Base(m.Config), ".json")
+		tags[digest.NewDigestFromHex(string(digest.SHA256), hex)] = m.RepoTags
+	}
+	return tags
+}
+
+// dockerArchiveIndex writes the image manifests of the images of a docker
+// archive, from the configs and layers written from the archive, and returns
+// an index of them.
+func dockerArchiveIndex(ctx context.Context, cs content.Store, manifests []dockerArchiveManifest, files map[string]ocispec.Descriptor, links map[string]string) (*ocispec.Index, error) {
+	file := func(p string) (ocispec.Descriptor, error) {
+		p = path.Clean(p)
+		// Follow the links to the file, but not forever.
+		for i := 0; i < 10; i++ {
+			target, ok := links[p]
+			if !ok {
+				break
+			}
+			p = target
+		}
+		desc, ok := files[p]
+		if !ok {
+			return ocispec.Descriptor{}, fmt.Errorf("file %s of manifest.json is not in the tarball", p)
+		}
+		return desc, nil
+	}
+
+	index := &ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}}
+	for _, m := range manifests {
+		config, err := file(m.Config)
+		if err != nil {
+			return nil, err
+		}
+		config.MediaType = images.MediaTypeDockerSchema2Config
+		manifest := ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			Config:    config,
+			Layers:    []ocispec.Descriptor{},
+		}
+		for _, l := range m.Layers {
+			layer, err := file(l)
+			if err != nil {
+				return nil, err
+			}
+			manifest.Layers = append(manifest.Layers, layer)
+		}
+		desc, err := writeJSON(ctx, cs, images.MediaTypeDockerSchema2Manifest, struct {
+			MediaType string `json:"mediaType"`
+			ocispec.Manifest
+		}{images.MediaTypeDockerSchema2Manifest, manifest})
+		if err != nil {
+			return nil, err
+		}
+		index.Manifests = append(index.Manifests, desc)
+	}
+	return index, nil
+}
+
+// writeArchiveFile writes a file of a docker archive to the content store,
+// with the media type of a compressed or uncompressed layer.
+func writeArchiveFile(ctx context.Context, cs content.Store, ref string, r io.Reader, size int64) (ocispec.Descriptor, error) {
+	br := bufio.NewReader(r)
+	mediaType := images.MediaTypeDockerSchema2Layer
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		mediaType = images.MediaTypeDockerSchema2LayerGzip
+	}
+
+	w, err := content.OpenWriter(ctx, cs, ref, size, "")
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer w.Close()
+	if _, err := io.Copy(w, br); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	dgst := w.Digest()
+	if err := w.Commit(ctx, size, dgst); err != nil && !errdefs.IsAlreadyExists(err) {
+		return ocispec.Descriptor{}, err
+	}
+	return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: size}, nil
+}
+
+// loadedImageNames returns the names for an image in a loaded tarball.
+func loadedImageNames(ctx context.Context, provider content.Provider, desc ocispec.Descriptor, repoTags map[digest.Digest][]string, name string) ([]string, error) {
+	var names []string
+	// The annotation is either a full image name or only a tag. A full name
+	// names the entry of the index alone, the tags of the manifest.json are
+	// those of every entry with the same config.
+	ref := desc.Annotations[ocispec.AnnotationRefName]
+	if strings.ContainsAny(ref, "/:@") {
+		names = append(names, ref)
+	} else if config, err := images.Config(ctx, provider, desc, platforms.Default()); err == nil {
+		names = append(names, repoTags[config.Digest]...)
+	}
+	if ref != "" && len(names) == 0 && name != "" {
+		names = append(names, name+":"+ref)
+	}
+	if len(names) == 0 && name != "" {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("image %s in tarball has no name", desc.Digest)
+	}
+
+	// Normalize the names the same way the other commands do.
+	for i, n := range names {
+		named, err := reference.ParseNormalizedNamed(n)
+		if err != nil {
+			return nil, fmt.Errorf("parsing image name %q failed: %v", n, err)
+		}
+		names[i] = reference.TagNameOnly(named).String()
+	}
+	return names, nil
+}
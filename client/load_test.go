@@ -0,0 +1,111 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestDockerArchiveIndex(t *testing.T) {
+	ctx := context.Background()
+	cs, cleanup := testContentStore(t)
+	defer cleanup()
+
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`)
+	configDesc, err := writeArchiveFile(ctx, cs, "config", bytes.NewReader(config), int64(len(config)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := []byte{0x1f, 0x8b, 0, 0}
+	layerDesc, err := writeArchiveFile(ctx, cs, "layer", bytes.NewReader(layer), int64(len(layer)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layerDesc.MediaType != images.MediaTypeDockerSchema2LayerGzip {
+		t.Fatalf("expected a gzip compressed layer, got %s", layerDesc.MediaType)
+	}
+
+	manifests, err := readDockerArchiveManifest(strings.NewReader(`[{
+		"Config": "` + configDesc.Digest.Hex() + `.json",
+		"RepoTags": ["loadtest:v1", "jess/loadtest"],
+		"Layers": ["abc/layer.tar"]
+	}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoTags := dockerArchiveRepoTags(manifests)
+	if len(repoTags[configDesc.Digest]) != 2 {
+		t.Fatalf("expected the tags by the digest of the config, got %v", repoTags)
+	}
+
+	// The layer is a link to another layer of the archive.
+	files := map[string]ocispec.Descriptor{
+		configDesc.Digest.Hex() + ".json": configDesc,
+		"def/layer.tar":                   layerDesc,
+	}
+	links := map[string]string{"abc/layer.tar": "def/layer.tar"}
+	index, err := dockerArchiveIndex(ctx, cs, manifests, files, links)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].MediaType != images.MediaTypeDockerSchema2Manifest {
+		t.Fatalf("expected a docker manifest, got %#v", index.Manifests)
+	}
+
+	names, err := loadedImageNames(ctx, cs, index.Manifests[0], repoTags, "ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "docker.io/library/loadtest:v1,docker.io/jess/loadtest:latest" {
+		t.Fatalf("expected the tags of manifest.json, got %v", names)
+	}
+
+	if _, err := dockerArchiveIndex(ctx, cs, manifests, files, nil); err == nil || !strings.Contains(err.Error(), "file abc/layer.tar of manifest.json is not in the tarball") {
+		t.Fatalf("expected a missing layer to fail, got: %v", err)
+	}
+}
+
+func TestLoadedImageNames(t *testing.T) {
+	ctx := context.Background()
+	cs, cleanup := testContentStore(t)
+	defer cleanup()
+
+	desc := func(ref string) ocispec.Descriptor {
+		d := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString(ref)}
+		if ref != "" {
+			d.Annotations = map[string]string{ocispec.AnnotationRefName: ref}
+		}
+		return d
+	}
+
+	tests := []struct {
+		ref      string
+		name     string
+		expected string
+	}{
+		{"jess/img:v1", "ignored", "docker.io/jess/img:v1"},
+		{"v1", "loadtest", "docker.io/library/loadtest:v1"},
+		{"", "loadtest", "docker.io/library/loadtest:latest"},
+	}
+	for _, tt := range tests {
+		names, err := loadedImageNames(ctx, cs, desc(tt.ref), nil, tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 1 || names[0] != tt.expected {
+			t.Fatalf("expected %s for %q named %q, got %v", tt.expected, tt.ref, tt.name, names)
+		}
+	}
+
+	if _, err := loadedImageNames(ctx, cs, desc("v1"), nil, ""); err == nil || !strings.Contains(err.Error(), "in tarball has no name") {
+		t.Fatalf("expected an image without a name to fail, got: %v", err)
+	}
+	if _, err := loadedImageNames(ctx, cs, desc("Invalid:Tag"), nil, ""); err == nil || !strings.Contains(err.Error(), "parsing image name") {
+		t.Fatalf("expected an invalid name to fail, got: %v", err)
+	}
+}
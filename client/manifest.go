@@ -0,0 +1,218 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// CreateManifestList creates a manifest list named list in the image store
+// from the manifests of images, each with the platform of its config. The
+// manifests of an image that is a manifest list or index already are added
+// as they are. With amend the manifests are added to the existing list,
+// replacing those with the same digest.
+func (c *Client) CreateManifestList(ctx context.Context, list string, imgs []string, amend bool) (images.Image, error) {
+	name, err := normalizeImageName(list)
+	if err != nil {
+		return images.Image{}, err
+	}
+
+	opt, err := c.createWorkerOpt()
+	if err != nil {
+		return images.Image{}, fmt.Errorf("creating worker opt failed: %v", err)
+	}
+	cs := opt.ContentStore
+
+	var manifests []ocispec.Descriptor
+	if amend {
+		img, err := getImage(ctx, opt.ImageStore, list)
+		if err != nil {
+			return images.Image{}, err
+		}
+		index, err := readIndex(ctx, cs, img.Target)
+		if err != nil {
+			return images.Image{}, err
+		}
+		manifests = index.Manifests
+	}
+
+	for _, image := range imgs {
+		img, err := getImage(ctx, opt.ImageStore, image)
+		if err != nil {
+			return images.Image{}, err
+		}
+
+		var add []ocispec.Descriptor
+		switch img.Target.MediaType {
+		case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+			desc := img.Target
+			platform, err := configPlatform(ctx, cs, desc)
+			if err != nil {
+				return images.Image{}, fmt.Errorf("reading platform of %s failed: %v", img.Name, err)
+			}
+			desc.Platform = platform
+			add = []ocispec.Descriptor{desc}
+		case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			index, err := readIndex(ctx, cs, img.Target)
+			if err != nil {
+				return images.Image{}, err
+			}
+			add = index.Manifests
+		default:
+			return images.Image{}, fmt.Errorf("adding %s of type %s to a manifest list is not supported", img.Name, img.Target.MediaType)
+		}
+
+		for _, desc := range add {
+			manifests = replaceManifest(manifests, desc)
+		}
+	}
+
+	target, err := writeIndex(ctx, cs, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: manifests,
+	})
+	if err != nil {
+		return images.Image{}, err
+	}
+	img := images.Image{
+		Name:      name,
+		Target:    target,
+		CreatedAt: time.Now(),
+	}
+	if err := putImage(ctx, opt.ImageStore, img); err != nil {
+		return images.Image{}, err
+	}
+	return img, nil
+}
+
+// ManifestAnnotation is the platform to set on the manifest of an image in a
+// manifest list. Empty fields are left as they are.
+type ManifestAnnotation struct {
+	OS         string
+	OSVersion  string
+	OSFeatures []string
+	Arch       string
+	Variant    string
+}
+
+// AnnotateManifestList sets the platform of the manifest of image in the
+// manifest list named list.
+func (c *Client) AnnotateManifestList(ctx context.Context, list, image string, annotation ManifestAnnotation) (images.Image, error) {
+	opt, err := c.createWorkerOpt()
+	if err != nil {
+		return images.Image{}, fmt.Errorf("creating worker opt failed: %v", err)
+	}
+	cs := opt.ContentStore
+
+	img, err := getImage(ctx, opt.ImageStore, list)
+	if err != nil {
+		return images.Image{}, err
+	}
+	index, err := readIndex(ctx, cs, img.Target)
+	if err != nil {
+		return images.Image{}, err
+	}
+
+	entry, err := getImage(ctx, opt.ImageStore, image)
+	if err != nil {
+		return images.Image{}, err
+	}
+	i := -1
+	for j, m := range index.Manifests {
+		if m.Digest == entry.Target.Digest {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		return images.Image{}, fmt.Errorf("manifest list %s has no manifest %s of %s", img.Name, entry.Target.Digest, entry.Name)
+	}
+
+	platform := ocispec.Platform{}
+	if index.Manifests[i].Platform != nil {
+		platform = *index.Manifests[i].Platform
+	}
+	if annotation.OS != "" {
+		platform.OS = annotation.OS
+	}
+	if annotation.OSVersion != "" {
+		platform.OSVersion = annotation.OSVersion
+	}
+	if len(annotation.OSFeatures) > 0 {
+		platform.OSFeatures = annotation.OSFeatures
+	}
+	if annotation.Arch != "" {
+		platform.Architecture = annotation.Arch
+	}
+	if annotation.Variant != "" {
+		platform.Variant = annotation.Variant
+	}
+	index.Manifests[i].Platform = &platform
+
+	if img.Target, err = writeIndex(ctx, cs, index); err != nil {
+		return images.Image{}, err
+	}
+	img.CreatedAt = time.Now()
+	if err := putImage(ctx, opt.ImageStore, img); err != nil {
+		return images.Image{}, err
+	}
+	return img, nil
+}
+
+// readIndex reads a manifest list or index from the content store.
+func readIndex(ctx context.Context, cs content.Provider, desc ocispec.Descriptor) (ocispec.Index, error) {
+	var index ocispec.Index
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+	default:
+		return index, fmt.Errorf("%s of type %s is not a manifest list", desc.Digest, desc.MediaType)
+	}
+	dt, err := content.ReadBlob(ctx, cs, desc.Digest)
+	if err != nil {
+		return index, fmt.Errorf("reading manifest list %s failed: %v", desc.Digest, err)
+	}
+	if err := json.Unmarshal(dt, &index); err != nil {
+		return index, fmt.Errorf("parsing manifest list %s failed: %v", desc.Digest, err)
+	}
+	return index, nil
+}
+
+// configPlatform returns the platform in the config of an image manifest.
+func configPlatform(ctx context.Context, cs content.Provider, desc ocispec.Descriptor) (*ocispec.Platform, error) {
+	dt, err := content.ReadBlob(ctx, cs, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(dt, &manifest); err != nil {
+		return nil, err
+	}
+	if dt, err = content.ReadBlob(ctx, cs, manifest.Config.Digest); err != nil {
+		return nil, err
+	}
+	// The config of the vendored image spec has no variant, the platform
+	// fields are read from the config directly.
+	var platform ocispec.Platform
+	if err := json.Unmarshal(dt, &platform); err != nil {
+		return nil, err
+	}
+	return &platform, nil
+}
+
+// replaceManifest adds a manifest to the manifests of a list, replacing the
+// one with the same digest.
+func replaceManifest(manifests []ocispec.Descriptor, desc ocispec.Descriptor) []ocispec.Descriptor {
+	for i, m := range manifests {
+		if m.Digest == desc.Digest {
+			manifests[i] = desc
+			return manifests
+		}
+	}
+	return append(manifests, desc)
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestManifestListContent(t *testing.T) {
+	ctx := context.Background()
+	cs, cleanup := testContentStore(t)
+	defer cleanup()
+
+	// The variant is read from the config, the vendored image spec has none.
+	config, err := writeBlob(ctx, cs, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"arm64","os":"linux","variant":"v8"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := writeJSON(ctx, cs, ocispec.MediaTypeImageManifest, ocispec.Manifest{Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	platform, err := configPlatform(ctx, cs, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if platform.OS != "linux" || platform.Architecture != "arm64" || platform.Variant != "v8" {
+		t.Fatalf("expected the platform of the config, got %#v", platform)
+	}
+
+	list, err := writeJSON(ctx, cs, images.MediaTypeDockerSchema2ManifestList, ocispec.Index{Manifests: []ocispec.Descriptor{manifest}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := readIndex(ctx, cs, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].Digest != manifest.Digest {
+		t.Fatalf("expected the manifest in the list, got %#v", index.Manifests)
+	}
+	if _, err := readIndex(ctx, cs, manifest); err == nil || !strings.Contains(err.Error(), "is not a manifest list") {
+		t.Fatalf("expected a manifest not to be read as a list, got: %v", err)
+	}
+}
+
+func TestReplaceManifest(t *testing.T) {
+	a := ocispec.Descriptor{Digest: digest.FromString("a")}
+	b := ocispec.Descriptor{Digest: digest.FromString("b")}
+	annotated := ocispec.Descriptor{Digest: a.Digest, Platform: &ocispec.Platform{OS: "linux", Architecture: "arm64"}}
+
+	manifests := replaceManifest([]ocispec.Descriptor{a}, b)
+	if len(manifests) != 2 || manifests[1].Digest != b.Digest {
+		t.Fatalf("expected the manifest to be added, got %#v", manifests)
+	}
+	manifests = replaceManifest(manifests, annotated)
+	if len(manifests) != 2 || manifests[0].Platform == nil {
+		t.Fatalf("expected the manifest with the same digest to be replaced, got %#v", manifests)
+	}
+}
@@ -0,0 +1,33 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/moby/buildkit/util/tracing"
+)
+
+// ErrOffline is returned for every network request once DisableNetwork was
+// called.
+var ErrOffline = errors.New("network access is disabled in offline mode")
+
+// DisableNetwork makes every registry, HTTP and git request of the process
+// fail with ErrOffline, so only the images and content already in the state
+// directory are used. Images are resolved from the image store instead of
+// their registry. It must be called before the client is used.
+func DisableNetwork() {
+	http.DefaultTransport = offlineTransport{}
+	tracing.DefaultTransport = offlineTransport{}
+	tracing.DefaultClient.Transport = offlineTransport{}
+
+	// Git sources run the git binary, only allow it to clone local
+	// repositories.
+	os.Setenv("GIT_ALLOW_PROTOCOL", "file")
+}
+
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, ErrOffline
+}
@@ -0,0 +1,606 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Actions optimizing can take on a layer.
+const (
+	// LayerShared is a layer the reference images already have.
+	LayerShared = "shared"
+	// LayerReused is a layer with the same content as a layer of the
+	// reference images, replaced by it.
+	LayerReused = "reused"
+	// LayerSplit is a layer containing layers of the reference images,
+	// replaced by them and a layer with the rest of its content.
+	LayerSplit = "split"
+	// LayerKept is a layer left as it is.
+	LayerKept = "kept"
+)
+
+// OptimizedLayer is what optimizing an image did to one of its layers.
+type OptimizedLayer struct {
+	Original ocispec.Descriptor
+	Action   string
+	// Layers are the layers replacing the original one.
+	Layers []ocispec.Descriptor
+}
+
+// OptimizeResult describes an optimized image. The pull sizes are the size of
+// the layers a host that has the reference images has to pull.
+type OptimizeResult struct {
+	Image             images.Image
+	Layers            []OptimizedLayer
+	PullSize          int64
+	OptimizedPullSize int64
+}
+
+// OptimizeImage rewrites the layers of an image so it shares as many layers
+// as possible with reference images, and names the result target. Layers
+// with the same content as a layer of the references use its blob, and
+// layers containing the files of a layer of the references, such as a
+// dependency layer copied into a squashed image, are split into that layer
+// and one with the rest of their files. The filesystem of the image is
+// unchanged. Only the image for the default platform is rewritten.
+func (c *Client) OptimizeImage(ctx context.Context, image, target string, refs []string) (*OptimizeResult, error) {
+	opt, err := c.createWorkerOpt()
+	if err != nil {
+		return nil, fmt.Errorf("creating worker opt failed: %v", err)
+	}
+	cs := opt.ContentStore
+
+	img, err := getImage(ctx, opt.ImageStore, image)
+	if err != nil {
+		return nil, err
+	}
+	target, err = normalizeImageName(target)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, config, diffIDs, err := readImage(ctx, cs, img.Target)
+	if err != nil {
+		return nil, fmt.Errorf("reading image %s failed: %v", img.Name, err)
+	}
+
+	// Index the layers of the reference images.
+	var (
+		refBlobs   = map[digest.Digest]bool{}
+		refLayers  = map[digest.Digest]ocispec.Descriptor{}
+		refDiffIDs []digest.Digest
+	)
+	for _, name := range refs {
+		ref, err := getImage(ctx, opt.ImageStore, name)
+		if err != nil {
+			return nil, err
+		}
+		m, _, ids, err := readImage(ctx, cs, ref.Target)
+		if err != nil {
+			return nil, fmt.Errorf("reading image %s failed: %v", ref.Name, err)
+		}
+		for i, l := range m.Layers {
+			refBlobs[l.Digest] = true
+			if _, ok := refLayers[ids[i]]; !ok {
+				refLayers[ids[i]] = l
+				refDiffIDs = append(refDiffIDs, ids[i])
+			}
+		}
+	}
+
+	imageDiffIDs := map[digest.Digest]bool{}
+	for _, id := range diffIDs {
+		imageDiffIDs[id] = true
+	}
+	// The candidates to split layers into are the layers of the references
+	// the image does not have, largest first.
+	var candidates []digest.Digest
+	for _, id := range refDiffIDs {
+		if !imageDiffIDs[id] {
+			candidates = append(candidates, id)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return refLayers[candidates[i]].Size > refLayers[candidates[j]].Size
+	})
+
+	var (
+		res        = &OptimizeResult{}
+		newLayers  []ocispec.Descriptor
+		newDiffIDs []digest.Digest
+		// inserted are the history entries to add before the layer at the
+		// index, for the layers split out of it.
+		inserted   = map[int][]ocispec.History{}
+		refEntries = map[digest.Digest]*layerEntries{}
+	)
+	for i, l := range manifest.Layers {
+		ol := OptimizedLayer{Original: l, Action: LayerKept, Layers: []ocispec.Descriptor{l}}
+		ids := []digest.Digest{diffIDs[i]}
+
+		switch rl, ok := refLayers[diffIDs[i]]; {
+		case refBlobs[l.Digest]:
+			ol.Action = LayerShared
+		case ok:
+			ol.Action, ol.Layers = LayerReused, []ocispec.Descriptor{rl}
+		default:
+			split, splitIDs, err := splitLayer(ctx, cs, l, candidates, refLayers, refEntries)
+			if err != nil {
+				return nil, fmt.Errorf("splitting layer %s failed: %v", l.Digest, err)
+			}
+			if split != nil {
+				ol.Action, ol.Layers, ids = LayerSplit, split, splitIDs
+				if splitIDs[len(splitIDs)-1] == "" {
+					// Nothing is left in the layer.
+					ol.Layers, ids = split[:len(split)-1], splitIDs[:len(splitIDs)-1]
+				}
+				// The history entry of the layer is kept for the last of
+				// the layers replacing it.
+				for _, rl := range ol.Layers[:len(ol.Layers)-1] {
+					inserted[i] = append(inserted[i], ocispec.History{
+						Created:   config.created(),
+						CreatedBy: "img optimize: split " + rl.Digest.String() + " out of " + l.Digest.String(),
+					})
+				}
+			}
+		}
+
+		res.Layers = append(res.Layers, ol)
+		newLayers = append(newLayers, ol.Layers...)
+		newDiffIDs = append(newDiffIDs, ids...)
+		if !refBlobs[l.Digest] {
+			res.PullSize += l.Size
+		}
+		for _, nl := range ol.Layers {
+			if !refBlobs[nl.Digest] {
+				res.OptimizedPullSize += nl.Size
+			}
+		}
+	}
+
+	// Write the config and manifest of the optimized image.
+	configDesc, err := config.write(ctx, cs, newDiffIDs, inserted, len(manifest.Layers))
+	if err != nil {
+		return nil, err
+	}
+	manifest.Config = configDesc
+	manifest.Layers = newLayers
+	manifestDesc, err := writeManifest(ctx, cs, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	res.Image = images.Image{Name: target, Target: manifestDesc, CreatedAt: time.Now()}
+	if err := putImage(ctx, opt.ImageStore, res.Image); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// writeManifest writes a manifest to the content store, with the media type
+// of its config, and labels the blobs it references so they are not garbage
+// collected.
+func writeManifest(ctx context.Context, cs content.Store, manifest ocispec.Manifest) (ocispec.Descriptor, error) {
+	m := struct {
+		MediaType string `json:"mediaType,omitempty"`
+		ocispec.Manifest
+	}{Manifest: manifest}
+	mediaType := ocispec.MediaTypeImageManifest
+	if manifest.Config.MediaType == images.MediaTypeDockerSchema2Config {
+		m.MediaType = images.MediaTypeDockerSchema2Manifest
+		mediaType = m.MediaType
+	}
+	desc, err := writeJSON(ctx, cs, mediaType, m)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	handler := images.SetChildrenLabels(cs, images.ChildrenHandler(cs))
+	if err := images.Walk(ctx, handler, desc); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("labeling content of %s failed: %v", desc.Digest, err)
+	}
+	return desc, nil
+}
+
+// putImage updates an image of the image store, creating it if it does not
+// exist.
+func putImage(ctx context.Context, store images.Store, img images.Image) error {
+	if _, err := store.Update(ctx, img); err != nil {
+		if !errdefs.IsNotFound(err) {
+			return fmt.Errorf("updating image store for %s failed: %v", img.Name, err)
+		}
+		if _, err := store.Create(ctx, img); err != nil {
+			return fmt.Errorf("creating image in image store for %s failed: %v", img.Name, err)
+		}
+	}
+	return nil
+}
+
+// getImage returns an image of the image store by name, adding the latest
+// tag to names without one.
+func getImage(ctx context.Context, store images.Store, name string) (images.Image, error) {
+	n, err := normalizeImageName(name)
+	if err != nil {
+		return images.Image{}, err
+	}
+	img, err := store.Get(ctx, n)
+	if err != nil {
+		return images.Image{}, fmt.Errorf("getting image %s from image store failed: %v", n, err)
+	}
+	return img, nil
+}
+
+func normalizeImageName(name string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return "", fmt.Errorf("parsing image name %q failed: %v", name, err)
+	}
+	return reference.TagNameOnly(named).String(), nil
+}
+
+// imageConfig is the config of an image, keeping the fields it does not
+// change as they are.
+type imageConfig struct {
+	mediaType string
+	fields    map[string]json.RawMessage
+	history   []ocispec.History
+}
+
+// readImage returns the manifest, config and layer diff IDs of an image.
+func readImage(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (ocispec.Manifest, *imageConfig, []digest.Digest, error) {
+	manifest, err := images.Manifest(ctx, cs, desc, platforms.Default())
+	if err != nil {
+		return manifest, nil, nil, err
+	}
+	dt, err := content.ReadBlob(ctx, cs, manifest.Config.Digest)
+	if err != nil {
+		return manifest, nil, nil, err
+	}
+	config := &imageConfig{mediaType: manifest.Config.MediaType}
+	if err := json.Unmarshal(dt, &config.fields); err != nil {
+		return manifest, nil, nil, err
+	}
+	var img ocispec.Image
+	if err := json.Unmarshal(dt, &img); err != nil {
+		return manifest, nil, nil, err
+	}
+	if len(img.RootFS.DiffIDs) != len(manifest.Layers) {
+		return manifest, nil, nil, errors.New("the image config does not have a diff ID for every layer")
+	}
+	config.history = img.History
+	return manifest, config, img.RootFS.DiffIDs, nil
+}
+
+// created returns the creation time of the image.
+func (c *imageConfig) created() *time.Time {
+	var t time.Time
+	if err := json.Unmarshal(c.fields["created"], &t); err != nil {
+		return nil
+	}
+	return &t
+}
+
+// write writes the config with new layers to the content store. The history
+// entries in inserted are added before the entry of the layer at their
+// index.
+func (c *imageConfig) write(ctx context.Context, cs content.Store, diffIDs []digest.Digest, inserted map[int][]ocispec.History, layers int) (ocispec.Descriptor, error) {
+	var history []ocispec.History
+	layer := 0
+	for _, h := range c.history {
+		if !h.EmptyLayer {
+			history = append(history, inserted[layer]...)
+			layer++
+		}
+		history = append(history, h)
+	}
+	// Images without history for every layer get none for the new ones.
+	if layer != layers {
+		history = c.history
+	}
+
+	rootfs, err := json.Marshal(ocispec.RootFS{Type: "layers", DiffIDs: diffIDs})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	c.fields["rootfs"] = rootfs
+	if history != nil {
+		h, err := json.Marshal(history)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		c.fields["history"] = h
+	}
+	return writeJSON(ctx, cs, c.mediaType, c.fields)
+}
+
+// writeJSON writes a JSON document to the content store.
+func writeJSON(ctx context.Context, cs content.Store, mediaType string, v interface{}) (ocispec.Descriptor, error) {
+	dt, err := json.MarshalIndent(v, "", "   ")
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return writeBlob(ctx, cs, mediaType, dt)
+}
+
+// writeBlob writes a blob to the content store.
+func writeBlob(ctx context.Context, cs content.Store, mediaType string, dt []byte) (ocispec.Descriptor, error) {
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(dt), Size: int64(len(dt))}
+	if err := content.WriteBlob(ctx, cs, "optimize-"+desc.Digest.String(), bytes.NewReader(dt), desc.Size, desc.Digest); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("writing %s failed: %v", desc.Digest, err)
+	}
+	return desc, nil
+}
+
+// layerEntries are the entries of a layer tarball by name.
+type layerEntries struct {
+	names   []string
+	entries map[string]layerEntry
+}
+
+// layerEntry is a file of a layer, sig identifies its metadata and content.
+type layerEntry struct {
+	dir bool
+	sig string
+}
+
+// readLayerEntries reads the entries of a layer.
+func readLayerEntries(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*layerEntries, error) {
+	le := &layerEntries{entries: map[string]layerEntry{}}
+	err := walkLayer(ctx, cs, desc, func(hdr *tar.Header, r io.Reader) error {
+		dgstr := digest.SHA256.Digester()
+		if _, err := io.Copy(dgstr.Hash(), r); err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		le.names = append(le.names, name)
+		le.entries[name] = layerEntry{dir: hdr.Typeflag == tar.TypeDir, sig: entrySignature(hdr, dgstr.Digest())}
+		return nil
+	})
+	return le, err
+}
+
+// entrySignature returns a string that is the same for tar entries creating
+// the same file.
+func entrySignature(hdr *tar.Header, dgst digest.Digest) string {
+	var pax []string
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "SCHILY.xattr.") {
+			pax = append(pax, k+"="+v)
+		}
+	}
+	sort.Strings(pax)
+	return fmt.Sprintf("%c %o %d:%d %d %d %q %d,%d %s %q", hdr.Typeflag, hdr.Mode, hdr.Uid, hdr.Gid, hdr.Size, hdr.ModTime.UnixNano(), hdr.Linkname, hdr.Devmajor, hdr.Devminor, dgst, pax)
+}
+
+// walkLayer calls fn for every entry of a layer tarball.
+func walkLayer(ctx context.Context, cs content.Store, desc ocispec.Descriptor, fn func(*tar.Header, io.Reader) error) error {
+	ra, err := cs.ReaderAt(ctx, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+	c, _ := layerCompression(desc.MediaType)
+	ds, err := decompressLayer(ctx, content.NewReader(ra), c)
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+
+	tr := tar.NewReader(ds)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// splitLayer returns the candidate layers containing files of the layer,
+// followed by a layer with the rest of its files, and their diff IDs. The
+// last diff ID is empty if no file is left. It returns nil if no candidate is
+// contained in the layer.
+func splitLayer(ctx context.Context, cs content.Store, l ocispec.Descriptor, candidates []digest.Digest, refLayers map[digest.Digest]ocispec.Descriptor, cache map[digest.Digest]*layerEntries) ([]ocispec.Descriptor, []digest.Digest, error) {
+	if len(candidates) == 0 {
+		return nil, nil, nil
+	}
+	le, err := readLayerEntries(ctx, cs, l)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		split   []ocispec.Descriptor
+		ids     []digest.Digest
+		removed = map[string]bool{}
+	)
+	for _, id := range candidates {
+		rle, ok := cache[id]
+		if !ok {
+			if rle, err = readLayerEntries(ctx, cs, refLayers[id]); err != nil {
+				return nil, nil, err
+			}
+			cache[id] = rle
+		}
+		files, ok := containedFiles(le, rle)
+		if !ok || len(files) == 0 {
+			continue
+		}
+		newFiles := false
+		for _, f := range files {
+			newFiles = newFiles || !removed[f]
+		}
+		if !newFiles {
+			continue
+		}
+		for _, f := range files {
+			removed[f] = true
+		}
+		split = append(split, refLayers[id])
+		ids = append(ids, id)
+	}
+	if len(split) == 0 {
+		return nil, nil, nil
+	}
+
+	// Applying the split out layers first must not change what the rest of
+	// the layer does: no whiteout left in it may remove their files.
+	for _, name := range le.names {
+		if removed[name] || !strings.HasPrefix(path.Base(name), ".wh.") {
+			continue
+		}
+		dir := path.Dir(name)
+		if path.Base(name) != ".wh..wh..opq" {
+			dir = path.Join(dir, strings.TrimPrefix(path.Base(name), ".wh."))
+		}
+		for f := range removed {
+			if f == dir || strings.HasPrefix(f, dir+"/") {
+				return nil, nil, nil
+			}
+		}
+	}
+
+	rest, restID, err := writeLayerWithout(ctx, cs, l, removed)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(split, rest), append(ids, restID), nil
+}
+
+// containedFiles returns the files of the reference layer the layer has too,
+// false if the reference layer creates a file the layer does not. The
+// directories of the reference layer only need to be in the layer, it creates
+// them again with their own metadata.
+func containedFiles(le, rle *layerEntries) ([]string, bool) {
+	var files []string
+	for _, name := range rle.names {
+		re := rle.entries[name]
+		e, ok := le.entries[name]
+		switch {
+		case !ok:
+			return nil, false
+		case re.dir && e.dir:
+			if re.sig == e.sig {
+				files = append(files, name)
+			}
+		case re.sig != e.sig:
+			return nil, false
+		default:
+			files = append(files, name)
+		}
+	}
+	return files, true
+}
+
+// writeLayerWithout writes the layer without the removed files to the
+// content store, compressed like it was. The returned diff ID is empty if
+// no file is left.
+func writeLayerWithout(ctx context.Context, cs content.Store, l ocispec.Descriptor, removed map[string]bool) (ocispec.Descriptor, digest.Digest, error) {
+	return rewriteLayer(ctx, cs, l, func(hdr *tar.Header) bool {
+		return !removed[path.Clean(hdr.Name)]
+	})
+}
+
+// rewriteLayer writes the entries of the layer keep returns true for to the
+// content store, gzip compressed. keep may change the header of the entry.
+// The returned diff ID is empty if no entry is left.
+func rewriteLayer(ctx context.Context, cs content.Store, l ocispec.Descriptor, keep func(*tar.Header) bool) (ocispec.Descriptor, digest.Digest, error) {
+	return writeLayer(ctx, cs, l.MediaType, func(tw *tar.Writer) (int, error) {
+		left := 0
+		err := walkLayer(ctx, cs, l, func(hdr *tar.Header, r io.Reader) error {
+			if !keep(hdr) {
+				return nil
+			}
+			left++
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, r)
+			return err
+		})
+		return left, err
+	})
+}
+
+// writeLayer writes the tarball written by fn to the content store as a
+// gzip compressed layer, with a docker media type if mediaType, the type of
+// the layers it replaces, is one. fn returns the number of entries it
+// wrote, nothing is written and the returned diff ID is empty if there are
+// none.
+func writeLayer(ctx context.Context, cs content.Store, mediaType string, fn func(*tar.Writer) (int, error)) (ocispec.Descriptor, digest.Digest, error) {
+	tmp, err := ioutil.TempFile("", "img-optimize-")
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	defer tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	dgstr := digest.SHA256.Digester()
+	compressed, err := compression.CompressStream(tmp, compression.Gzip)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	tw := tar.NewWriter(io.MultiWriter(compressed, dgstr.Hash()))
+	entries, err := fn(tw)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	if err := tw.Close(); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	if err := compressed.Close(); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	if entries == 0 {
+		return ocispec.Descriptor{}, "", nil
+	}
+
+	fi, err := tmp.Stat()
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	dgst, err := digest.SHA256.FromReader(tmp)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: dgst, Size: fi.Size()}
+	if strings.HasPrefix(mediaType, "application/vnd.docker.") {
+		desc.MediaType = images.MediaTypeDockerSchema2LayerGzip
+	}
+	if err := content.WriteBlob(ctx, cs, "optimize-"+dgst.String(), tmp, desc.Size, dgst, content.WithLabels(map[string]string{
+		"containerd.io/uncompressed": dgstr.Digest().String(),
+	})); err != nil {
+		return ocispec.Descriptor{}, "", fmt.Errorf("writing layer %s failed: %v", dgst, err)
+	}
+	return desc, dgstr.Digest(), nil
+}
@@ -0,0 +1,187 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testContentStore returns a content store in a temporary directory, and a
+// function removing it.
+func testContentStore(t *testing.T) (content.Store, func()) {
+	dir, err := ioutil.TempDir("", "img-content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := local.NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cs, func() { os.RemoveAll(dir) }
+}
+
+// testLayerTime is the modification time of the files testLayer writes.
+var testLayerTime = time.Unix(10, 0)
+
+// testLayer writes a layer with the files to the content store and returns
+// it with its diff ID. Names ending with a slash are directories.
+func testLayer(t *testing.T, cs content.Store, mediaType string, files map[string]string) (ocispec.Descriptor, digest.Digest) {
+	return testLayerAt(t, cs, mediaType, files, testLayerTime)
+}
+
+// testLayerAt is testLayer with the files modified at modTime.
+func testLayerAt(t *testing.T, cs content.Store, mediaType string, files map[string]string, modTime time.Time) (ocispec.Descriptor, digest.Digest) {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		dt := files[name]
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(dt)), ModTime: modTime, Typeflag: tar.TypeReg}
+		if strings.HasSuffix(name, "/") {
+			hdr.Mode, hdr.Size, hdr.Typeflag = 0755, 0, tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(dt)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	diffID := digest.FromBytes(buf.Bytes())
+
+	dt := buf.Bytes()
+	if strings.HasSuffix(mediaType, "gzip") {
+		var compressed bytes.Buffer
+		gw := gzip.NewWriter(&compressed)
+		if _, err := gw.Write(dt); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		dt = compressed.Bytes()
+	}
+
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(dt), Size: int64(len(dt))}
+	// The namespace is only needed by the content store of a metadata
+	// database.
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+	if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(dt), desc.Size, desc.Digest, content.WithLabels(map[string]string{
+		"containerd.io/uncompressed": diffID.String(),
+	})); err != nil {
+		t.Fatal(err)
+	}
+	return desc, diffID
+}
+
+func TestOptimizeLayers(t *testing.T) {
+	ctx := context.Background()
+	cs, cleanup := testContentStore(t)
+	defer cleanup()
+
+	l, _ := testLayer(t, cs, images.MediaTypeDockerSchema2LayerGzip, map[string]string{
+		"bin/":     "",
+		"bin/sh":   "sh",
+		"app":      "app",
+		"etc/":     "",
+		"etc/conf": "conf",
+	})
+	ref, _ := testLayer(t, cs, ocispec.MediaTypeImageLayer, map[string]string{
+		"bin/":   "",
+		"bin/sh": "sh",
+	})
+
+	le, err := readLayerEntries(ctx, cs, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rle, err := readLayerEntries(ctx, cs, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, ok := containedFiles(le, rle)
+	if !ok || !reflect.DeepEqual(files, []string{"bin", "bin/sh"}) {
+		t.Fatalf("expected the files of the reference layer to be contained, got %v, %t", files, ok)
+	}
+	if _, ok := containedFiles(rle, le); ok {
+		t.Fatal("expected the layer not to be contained in the reference layer")
+	}
+
+	// A file with other content is not the same file.
+	other, _ := testLayer(t, cs, ocispec.MediaTypeImageLayer, map[string]string{"bin/sh": "bash"})
+	ole, err := readLayerEntries(ctx, cs, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := containedFiles(le, ole); ok {
+		t.Fatal("expected a file with other content not to be contained")
+	}
+
+	rest, diffID, err := writeLayerWithout(ctx, cs, l, map[string]bool{"bin": true, "bin/sh": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffID == "" {
+		t.Fatal("expected files to be left")
+	}
+	restEntries, err := readLayerEntries(ctx, cs, rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restEntries.names) != 3 || restEntries.entries["etc/conf"] != le.entries["etc/conf"] {
+		t.Fatalf("expected the other files to be kept as they were, got %v", restEntries.names)
+	}
+
+	_, diffID, err = writeLayerWithout(ctx, cs, ref, map[string]bool{"bin": true, "bin/sh": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffID != "" {
+		t.Fatalf("expected an empty diff ID without files left, got %s", diffID)
+	}
+}
+
+func TestNormalizeImageName(t *testing.T) {
+	tests := map[string]string{
+		"busybox":                  "docker.io/library/busybox:latest",
+		"jess/img:v1":              "docker.io/jess/img:v1",
+		"r.j3ss.co/img":            "r.j3ss.co/img:latest",
+		"localhost:5000/img:1.0.0": "localhost:5000/img:1.0.0",
+	}
+	for name, expected := range tests {
+		n, err := normalizeImageName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != expected {
+			t.Fatalf("expected %s for %s, got %s", expected, name, n)
+		}
+	}
+	if _, err := normalizeImageName("Invalid"); err == nil {
+		t.Fatal("expected an invalid name to fail")
+	}
+}
@@ -0,0 +1,230 @@
+package client
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/exporter"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/auth"
+	"github.com/moby/buildkit/util/push"
+	"github.com/moby/buildkit/util/tracing"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// pipelinedImageExporter wraps the image exporter so pushed images start
+// uploading their layers as soon as each one is diffed and compressed,
+// instead of once the whole image is exported. The image is then pushed as
+// before, skipping the layers the registry already has.
+type pipelinedImageExporter struct {
+	exporter.Exporter
+	sessionManager *session.Manager
+	contentStore   content.Store
+}
+
+func (e *pipelinedImageExporter) Resolve(ctx context.Context, attrs map[string]string) (exporter.ExporterInstance, error) {
+	// Invalid values are left for the image exporter to report.
+	doPush, err := boolAttr(attrs, "push")
+	if err != nil || !doPush {
+		return e.Exporter.Resolve(ctx, attrs)
+	}
+	insecure, err := boolAttr(attrs, "registry.insecure")
+	if err != nil {
+		return e.Exporter.Resolve(ctx, attrs)
+	}
+
+	// Export the image without pushing it, it is pushed once its layers
+	// are uploaded.
+	innerAttrs := map[string]string{}
+	for k, v := range attrs {
+		if k != "push" {
+			innerAttrs[k] = v
+		}
+	}
+	inst, err := e.Exporter.Resolve(ctx, innerAttrs)
+	if err != nil {
+		return nil, err
+	}
+	return &pipelinedImageInstance{
+		ExporterInstance: inst,
+		exporter:         e,
+		name:             attrs["name"],
+		insecure:         insecure,
+	}, nil
+}
+
+// boolAttr returns whether a boolean exporter attribute is set, an empty
+// value is true.
+func boolAttr(attrs map[string]string, key string) (bool, error) {
+	v, ok := attrs[key]
+	if !ok {
+		return false, nil
+	}
+	if v == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+type pipelinedImageInstance struct {
+	exporter.ExporterInstance
+	exporter *pipelinedImageExporter
+	name     string
+	insecure bool
+}
+
+func (i *pipelinedImageInstance) Export(ctx context.Context, ref cache.ImmutableRef, opt map[string][]byte) (map[string]string, error) {
+	if i.name == "" {
+		return i.ExporterInstance.Export(ctx, ref, opt)
+	}
+
+	up, err := newLayerUploader(ctx, i.exporter.sessionManager, i.exporter.contentStore, i.name, i.insecure)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := i.ExporterInstance.Export(context.WithValue(ctx, layerUploaderKey{}, up), ref, opt)
+	// Wait for the uploads even if the export failed, so they do not
+	// outlive it. Failed uploads are retried by the push.
+	up.wait()
+	if err != nil {
+		return nil, err
+	}
+
+	dgst, err := digest.Parse(resp["containerimage.digest"])
+	if err != nil {
+		return nil, err
+	}
+	if err := push.Push(ctx, i.exporter.sessionManager, i.exporter.contentStore, dgst, i.name, i.insecure); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type layerUploaderKey struct{}
+
+// layerUploader uploads the layers of an image to its registry in the
+// background while the image is exported.
+type layerUploader struct {
+	ctx    context.Context
+	store  content.Provider
+	pusher remotes.Pusher
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	started map[digest.Digest]bool
+}
+
+func newLayerUploader(ctx context.Context, sm *session.Manager, store content.Provider, name string, insecure bool) (*layerUploader, error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, err
+	}
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Client:      tracing.DefaultClient,
+		Credentials: sessionCredentials(ctx, sm),
+		PlainHTTP:   insecure,
+	})
+	pusher, err := resolver.Pusher(ctx, reference.TagNameOnly(named).String())
+	if err != nil {
+		return nil, err
+	}
+	return &layerUploader{ctx: ctx, store: store, pusher: pusher, started: map[digest.Digest]bool{}}, nil
+}
+
+// upload starts uploading a layer, unless it already is.
+func (u *layerUploader) upload(desc ocispec.Descriptor) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.started[desc.Digest] {
+		return
+	}
+	u.started[desc.Digest] = true
+
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		start := time.Now()
+		log := logrus.WithFields(logrus.Fields{
+			"digest": desc.Digest,
+			"size":   desc.Size,
+		})
+		if _, err := remotes.PushHandler(u.pusher, u.store)(u.ctx, desc); err != nil {
+			log.WithError(err).Debug("uploading layer while exporting failed")
+			return
+		}
+		log.WithField("d", time.Since(start)).Debug("uploaded layer while exporting")
+	}()
+}
+
+func (u *layerUploader) wait() {
+	u.wg.Wait()
+}
+
+// sessionCredentials returns the registry credentials of the session in the
+// context, the same way pushes get them.
+func sessionCredentials(ctx context.Context, sm *session.Manager) func(string) (string, string, error) {
+	id := session.FromContext(ctx)
+	if id == "" {
+		return nil
+	}
+	return func(host string) (string, string, error) {
+		timeoutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		caller, err := sm.Get(timeoutCtx, id)
+		if err != nil {
+			return "", "", err
+		}
+		return auth.CredentialsFunc(context.TODO(), caller)(host)
+	}
+}
+
+// uploadingStore is the content store layers are diffed into. Layers written
+// while an image is exported for a push start uploading once committed.
+type uploadingStore struct {
+	content.Store
+}
+
+func (s uploadingStore) Writer(ctx context.Context, ref string, size int64, expected digest.Digest) (content.Writer, error) {
+	w, err := s.Store.Writer(ctx, ref, size, expected)
+	if err != nil {
+		return nil, err
+	}
+	up, ok := ctx.Value(layerUploaderKey{}).(*layerUploader)
+	if !ok {
+		return w, nil
+	}
+	return &uploadingWriter{Writer: w, store: s.Store, up: up}, nil
+}
+
+type uploadingWriter struct {
+	content.Writer
+	store content.Store
+	up    *layerUploader
+}
+
+func (w *uploadingWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	if err := w.Writer.Commit(ctx, size, expected, opts...); err != nil {
+		return err
+	}
+	info, err := w.store.Info(ctx, w.Writer.Digest())
+	if err != nil {
+		return nil
+	}
+	w.up.upload(ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2LayerGzip,
+		Digest:    info.Digest,
+		Size:      info.Size,
+	})
+	return nil
+}
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/exporter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testExporter resolves to itself and exports an image the way the image
+// exporter does, writing its layers one after the other through the store
+// layers are diffed into.
+type testExporter struct {
+	store  content.Store
+	layers [][]byte
+	// layerDone is called once a layer is written, before the next one is.
+	layerDone func(ocispec.Descriptor) error
+	attrs     map[string]string
+}
+
+func (e *testExporter) Resolve(ctx context.Context, attrs map[string]string) (exporter.ExporterInstance, error) {
+	e.attrs = attrs
+	return e, nil
+}
+
+func (e *testExporter) Name() string {
+	return "exporting to image"
+}
+
+func (e *testExporter) Export(ctx context.Context, ref cache.ImmutableRef, opt map[string][]byte) (map[string]string, error) {
+	manifest := ocispec.Manifest{}
+	manifest.SchemaVersion = 2
+	store := uploadingStore{e.store}
+	for _, dt := range e.layers {
+		desc := ocispec.Descriptor{MediaType: images.MediaTypeDockerSchema2LayerGzip, Digest: digest.FromBytes(dt), Size: int64(len(dt))}
+		if err := content.WriteBlob(ctx, store, desc.Digest.String(), bytes.NewReader(dt), desc.Size, desc.Digest); err != nil {
+			return nil, err
+		}
+		if err := e.layerDone(desc); err != nil {
+			return nil, err
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+	}
+
+	var err error
+	if manifest.Config, err = writeJSON(ctx, e.store, images.MediaTypeDockerSchema2Config, ocispec.Image{Architecture: "amd64", OS: "linux"}); err != nil {
+		return nil, err
+	}
+	desc, err := writeJSON(ctx, e.store, images.MediaTypeDockerSchema2Manifest, struct {
+		MediaType string `json:"mediaType"`
+		ocispec.Manifest
+	}{images.MediaTypeDockerSchema2Manifest, manifest})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"containerimage.digest": desc.Digest.String()}, nil
+}
+
+func TestPipelinedPush(t *testing.T) {
+	reg, cleanup := testRegistry(t, true)
+	defer cleanup()
+
+	// Record the requests the registry gets.
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		reg.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	name := host + "/jess/pipelined:latest"
+
+	cs, csCleanup := testContentStore(t)
+	defer csCleanup()
+
+	// The registry has a layer before the next one is written.
+	hasBlob := func(dgst digest.Digest) bool {
+		resp, err := http.Head(srv.URL + "/v2/jess/pipelined/blobs/" + dgst.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}
+	inner := &testExporter{
+		store:  cs,
+		layers: [][]byte{[]byte("first layer"), []byte("second layer"), []byte("third layer")},
+		layerDone: func(desc ocispec.Descriptor) error {
+			for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if hasBlob(desc.Digest) {
+					return nil
+				}
+			}
+			return errors.New("the layer was not uploaded while the image was exported")
+		},
+	}
+	e := &pipelinedImageExporter{Exporter: inner, contentStore: cs}
+
+	inst, err := e.Resolve(context.Background(), map[string]string{
+		"name":              name,
+		"push":              "true",
+		"registry.insecure": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := inner.attrs["push"]; ok {
+		t.Fatalf("expected the image to be exported without pushing it, got the attributes %v", inner.attrs)
+	}
+	resp, err := inst.Export(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The manifest is pushed last, with the layers it references.
+	dgst := resp["containerimage.digest"]
+	w := registryRequest(reg, http.MethodGet, "/v2/jess/pipelined/manifests/latest", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Docker-Content-Digest") != dgst {
+		t.Fatalf("expected the manifest %s to be tagged latest, got %d %s", dgst, w.Code, w.Header().Get("Docker-Content-Digest"))
+	}
+	var manifest ocispec.Manifest
+	readTestJSON(t, cs, ocispec.Descriptor{Digest: digest.Digest(dgst)}, &manifest)
+	for _, l := range append(manifest.Layers, manifest.Config) {
+		w := registryRequest(reg, http.MethodGet, "/v2/jess/pipelined/blobs/"+l.Digest.String(), nil)
+		if w.Code != http.StatusOK || digest.FromBytes(w.Body.Bytes()) != l.Digest {
+			t.Fatalf("expected the registry to have the blob %s, got %d", l.Digest, w.Code)
+		}
+	}
+
+	// Every layer is uploaded once, while the image is exported, and the
+	// push only finds them in the registry.
+	mu.Lock()
+	defer mu.Unlock()
+	uploads := 0
+	for _, r := range requests {
+		if strings.HasPrefix(r, http.MethodPost+" /v2/jess/pipelined/blobs/uploads") {
+			uploads++
+		}
+	}
+	if expected := len(inner.layers) + 1; uploads != expected {
+		t.Fatalf("expected %d blob uploads, the layers and the config, got %d: %v", expected, uploads, requests)
+	}
+	if last := requests[len(requests)-1]; last != http.MethodPut+" /v2/jess/pipelined/manifests/latest" {
+		t.Fatalf("expected the manifest to be pushed last, got %s", last)
+	}
+}
@@ -0,0 +1,325 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The cache predictions of a PlannedStep.
+const (
+	// StepCached is a step whose result is in the build cache.
+	StepCached = "cached"
+	// StepRun is a step that runs, it is not in the build cache or its
+	// stage is built without the cache.
+	StepRun = "run"
+	// StepUnknown is a step that depends on the files of a build context,
+	// the cache of which is only known once they are transferred.
+	StepUnknown = "unknown"
+)
+
+// The cache types of the ops, which are part of their cache keys, see
+// github.com/moby/buildkit/solver/llbsolver/ops.
+const (
+	sourceCacheType = "buildkit.source.v0"
+	execCacheType   = "buildkit.exec.v0"
+)
+
+// PlannedStep is a step of an LLB definition with the prediction of whether
+// solving it uses the build cache.
+type PlannedStep struct {
+	Digest digest.Digest
+	Name   string
+	// Inputs are the indexes of the steps the step uses.
+	Inputs []int
+	// Image and ImageDigest are the image a source step pulls and the
+	// digest it resolves to.
+	Image       string
+	ImageDigest digest.Digest
+	Cache       string
+}
+
+// planKey is an output of an op, the cache of which is looked up.
+type planKey struct {
+	dgst   digest.Digest
+	output pb.OutputIndex
+}
+
+// PlanDefinition returns the steps of an LLB definition in the order they
+// are solved, predicting which are in the build cache without solving
+// anything. The cache keys of the steps are computed the way the solver does
+// and looked up in the cache storage, so the images of the sources are
+// resolved but not pulled. The keys of the steps that use the files of a
+// build context depend on the content of the files, those steps are
+// StepUnknown.
+func (c *Client) PlanDefinition(ctx context.Context, def *pb.Definition) ([]PlannedStep, error) {
+	if c.controller == nil {
+		// Create the controller.
+		if err := c.createController(); err != nil {
+			return nil, err
+		}
+	}
+	if len(def.Def) == 0 {
+		return nil, nil
+	}
+
+	var (
+		steps   []PlannedStep
+		ops     = map[digest.Digest]*pb.Op{}
+		indexes = map[digest.Digest]int{}
+		used    = map[digest.Digest][]pb.OutputIndex{}
+	)
+	// The last op of a definition is the terminal op pointing at the
+	// result, the others are in the order they are solved.
+	for _, dt := range def.Def[:len(def.Def)-1] {
+		var op pb.Op
+		if err := op.Unmarshal(dt); err != nil {
+			return nil, fmt.Errorf("parsing llb op failed: %v", err)
+		}
+		dgst := digest.FromBytes(dt)
+		ops[dgst] = &op
+		indexes[dgst] = len(steps)
+		step := PlannedStep{Digest: dgst, Name: opName(&op, def.Metadata[dgst])}
+		for _, in := range op.Inputs {
+			step.Inputs = append(step.Inputs, indexes[in.Digest])
+			used[in.Digest] = append(used[in.Digest], in.Index)
+		}
+		steps = append(steps, step)
+	}
+	var terminal pb.Op
+	if err := terminal.Unmarshal(def.Def[len(def.Def)-1]); err != nil {
+		return nil, fmt.Errorf("parsing llb op failed: %v", err)
+	}
+	for _, in := range terminal.Inputs {
+		used[in.Digest] = append(used[in.Digest], in.Index)
+	}
+
+	p := &planner{c: c, ops: ops, keys: map[planKey][]string{}, known: map[planKey]bool{}}
+	for i, step := range steps {
+		op := ops[step.Digest]
+		if src := op.GetSource(); src != nil && strings.HasPrefix(src.Identifier, "docker-image://") {
+			steps[i].Image = strings.TrimPrefix(src.Identifier, "docker-image://")
+			dgst, _, err := c.ResolveImageConfig(ctx, steps[i].Image)
+			if err != nil {
+				return nil, fmt.Errorf("resolving image %s failed: %v", steps[i].Image, err)
+			}
+			steps[i].ImageDigest = dgst
+		}
+
+		// The step is cached when the outputs the other steps use are.
+		outputs := used[step.Digest]
+		if len(outputs) == 0 {
+			outputs = []pb.OutputIndex{0}
+		}
+		steps[i].Cache = StepCached
+		for _, output := range outputs {
+			ids, known, err := p.key(ctx, planKey{step.Digest, output})
+			if err != nil {
+				return nil, err
+			}
+			if !known {
+				steps[i].Cache = StepUnknown
+				break
+			}
+			if !p.hasResult(ids) {
+				steps[i].Cache = StepRun
+			}
+		}
+		if steps[i].Cache == StepCached && def.Metadata[step.Digest].IgnoreCache {
+			steps[i].Cache = StepRun
+		}
+	}
+	return steps, nil
+}
+
+// opName returns the name of an op as the progress of a build shows it.
+func opName(op *pb.Op, meta pb.OpMetadata) string {
+	if name, ok := meta.Description["llb.customname"]; ok {
+		return name
+	}
+	switch o := op.Op.(type) {
+	case *pb.Op_Source:
+		return o.Source.Identifier
+	case *pb.Op_Exec:
+		return strings.Join(o.Exec.Meta.Args, " ")
+	case *pb.Op_Build:
+		return "build"
+	}
+	return "unknown"
+}
+
+// planner computes the cache keys of the ops of a definition.
+type planner struct {
+	c   *Client
+	ops map[digest.Digest]*pb.Op
+
+	keys  map[planKey][]string
+	known map[planKey]bool
+}
+
+// key returns the IDs in the cache storage of the cache keys of an output of
+// an op, and whether they can be known before the op's inputs are solved.
+func (p *planner) key(ctx context.Context, k planKey) ([]string, bool, error) {
+	if known, ok := p.known[k]; ok {
+		return p.keys[k], known, nil
+	}
+	ids, known, err := p.computeKey(ctx, k)
+	if err != nil {
+		return nil, false, err
+	}
+	p.keys[k], p.known[k] = ids, known
+	return ids, known, nil
+}
+
+func (p *planner) computeKey(ctx context.Context, k planKey) ([]string, bool, error) {
+	op, ok := p.ops[k.dgst]
+	if !ok {
+		return nil, false, fmt.Errorf("no llb op with digest %s", k.dgst)
+	}
+
+	switch o := op.Op.(type) {
+	case *pb.Op_Source:
+		// Only the keys of images are known, those of local sources and
+		// the others depend on what they fetch.
+		if !strings.HasPrefix(o.Source.Identifier, "docker-image://") {
+			return nil, false, nil
+		}
+		dgst, config, err := p.c.ResolveImageConfig(ctx, strings.TrimPrefix(o.Source.Identifier, "docker-image://"))
+		if err != nil {
+			return nil, false, err
+		}
+		manifestKey, err := json.Marshal(struct {
+			Digest digest.Digest
+			OS     string
+			Arch   string
+		}{
+			Digest: dgst,
+			OS:     runtime.GOOS,
+			Arch:   runtime.GOARCH,
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		var ids []string
+		for _, key := range []string{digest.FromBytes(manifestKey).String(), configKey(config).String()} {
+			id := rootKey(digest.FromBytes([]byte(sourceCacheType+":"+key)), k.output)
+			if p.c.cacheStorage.Exists(id) {
+				ids = append(ids, id)
+			}
+		}
+		return ids, true, nil
+
+	case *pb.Op_Exec:
+		// The mounts are not part of the cache key of an exec op, the
+		// solver only copies the fields of its meta.
+		exec := *o.Exec
+		meta := *exec.Meta
+		meta.ProxyEnv = nil
+		exec.Meta = &meta
+		exec.Mounts = nil
+		dt, err := json.Marshal(struct {
+			Type string
+			Exec *pb.ExecOp
+			OS   string
+			Arch string
+		}{
+			Type: execCacheType,
+			Exec: &exec,
+			OS:   runtime.GOOS,
+			Arch: runtime.GOARCH,
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		dgst := digest.FromBytes(dt)
+
+		selectors := make([][][]byte, len(op.Inputs))
+		for _, m := range o.Exec.Mounts {
+			if m.Input == pb.Empty || int(m.Input) >= len(op.Inputs) || m.Selector == "" {
+				continue
+			}
+			selectors[m.Input] = append(selectors[m.Input], []byte(path.Join("/", m.Selector)))
+		}
+
+		// The key of an output is linked from the keys of every input.
+		var matches map[string]bool
+		for i, in := range op.Inputs {
+			depIDs, known, err := p.key(ctx, planKey{in.Digest, in.Index})
+			if err != nil || !known {
+				return nil, false, err
+			}
+			link := solver.CacheInfoLink{Input: solver.Index(i), Output: solver.Index(k.output), Digest: dgst}
+			if len(selectors[i]) > 0 {
+				link.Selector = digest.FromBytes(bytes.Join(selectors[i], []byte{0}))
+			}
+			found := map[string]bool{}
+			for _, id := range depIDs {
+				if err := p.c.cacheStorage.WalkLinks(id, link, func(id string) error {
+					if matches == nil || matches[id] {
+						found[id] = true
+					}
+					return nil
+				}); err != nil {
+					return nil, false, err
+				}
+			}
+			matches = found
+		}
+		ids := make([]string, 0, len(matches))
+		for id := range matches {
+			ids = append(ids, id)
+		}
+		return ids, true, nil
+	}
+	return nil, false, nil
+}
+
+// hasResult returns whether any of the cache keys has a result that is
+// still in the cache of the worker.
+func (p *planner) hasResult(ids []string) bool {
+	for _, id := range ids {
+		found := false
+		p.c.cacheStorage.WalkResults(id, func(r solver.CacheResult) error {
+			parts := strings.Split(r.ID, "::")
+			if len(parts) != 2 || parts[0] != p.c.worker.ID() {
+				return nil
+			}
+			ref, err := p.c.worker.LoadRef(parts[1])
+			if err != nil {
+				return nil
+			}
+			ref.Release(context.TODO())
+			found = true
+			return nil
+		})
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// rootKey returns the ID of the cache key of an op without inputs.
+func rootKey(dgst digest.Digest, output pb.OutputIndex) string {
+	return digest.FromBytes([]byte(fmt.Sprintf("%s@%d", dgst, output))).String()
+}
+
+// configKey returns the cache key of an image from its config, the chain ID
+// of its layers.
+func configKey(dt []byte) digest.Digest {
+	var img ocispec.Image
+	if err := json.Unmarshal(dt, &img); err != nil || img.RootFS.Type != "layers" {
+		return digest.FromBytes(dt)
+	}
+	return identity.ChainID(img.RootFS.DiffIDs)
+}
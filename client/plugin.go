@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+// ExporterPluginPrefix is the prefix of exporter plugin executables, the
+// exporter plugin foo is the img-exporter-foo executable in the PATH.
+const ExporterPluginPrefix = "img-exporter-"
+
+// ExportToPlugin exports an image with the exporter plugin of the given
+// name, so third parties can add output targets without changing img.
+//
+// The plugin is run with the image as a docker tarball (as created by
+// `img save`) on its standard input. The name and digest of the image are in
+// the IMG_IMAGE and IMG_DIGEST environment variables, each of the options is
+// in an IMG_OPT_<KEY> variable with the key uppercased and dashes replaced by
+// underscores. The export fails if the plugin exits with a non-zero status.
+func (c *Client) ExportToPlugin(ctx context.Context, name, image string, opts map[string]string, stdout, stderr io.Writer) error {
+	path, err := exec.LookPath(ExporterPluginPrefix + name)
+	if err != nil {
+		return fmt.Errorf("finding exporter plugin %s failed, %s%s must be in the PATH: %v", name, ExporterPluginPrefix, name, err)
+	}
+
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return fmt.Errorf("parsing image name %q failed: %v", image, err)
+	}
+	image = reference.TagNameOnly(named).String()
+
+	opt, err := c.createWorkerOpt()
+	if err != nil {
+		return fmt.Errorf("creating worker opt failed: %v", err)
+	}
+	img, err := opt.ImageStore.Get(ctx, image)
+	if err != nil {
+		return fmt.Errorf("getting image %s from image store failed: %v", image, err)
+	}
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = append(os.Environ(), "IMG_IMAGE="+image, "IMG_DIGEST="+img.Target.Digest.String())
+	for k, v := range opts {
+		key := strings.ToUpper(strings.Replace(k, "-", "_", -1))
+		cmd.Env = append(cmd.Env, "IMG_OPT_"+key+"="+v)
+	}
+
+	if err := c.saveToCmd(ctx, image, cmd); err != nil {
+		return fmt.Errorf("exporting %s with plugin %s failed: %v", image, name, err)
+	}
+	return nil
+}
+
+// ExporterPlugins returns the names of the exporter plugins in the PATH.
+func ExporterPlugins() []string {
+	seen := map[string]bool{}
+	var plugins []string
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		matches, _ := filepath.Glob(filepath.Join(dir, ExporterPluginPrefix+"*"))
+		for _, m := range matches {
+			fi, err := os.Stat(m)
+			if err != nil || fi.IsDir() || fi.Mode()&0111 == 0 {
+				continue
+			}
+			name := strings.TrimPrefix(filepath.Base(m), ExporterPluginPrefix)
+			if !seen[name] {
+				seen[name] = true
+				plugins = append(plugins, name)
+			}
+		}
+	}
+	sort.Strings(plugins)
+	return plugins
+}
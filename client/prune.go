@@ -0,0 +1,142 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/containerd/containerd/errdefs"
+	bkclient "github.com/moby/buildkit/client"
+)
+
+// PruneOptions select the build cache records a rule of Prune removes.
+type PruneOptions struct {
+	// Filters are the conditions a record must all match to be pruned, see
+	// ParseRecordFilters.
+	Filters []string
+	// KeepStorage is the number of bytes the build cache may keep using.
+	// When it is set the least recently used records are pruned first, until
+	// the cache uses no more than KeepStorage.
+	KeepStorage int64
+	// All also prunes the internal records: the local, git and http sources
+	// kept between builds so they are transferred incrementally.
+	All bool
+}
+
+// Prune removes the build cache records that are not in use and match the
+// rules, and returns them. The rules are applied in order, each to the
+// records the previous ones kept, like the rules of a buildkitd GC policy.
+// Records are removed before their parents, and a record that is the parent
+// of a kept record is kept too.
+//
+// The prune of the vendored buildkit removes every record, so the selected
+// records are removed from the snapshotter and the metadata store directly.
+// The client must not be used to build afterwards.
+func (c *Client) Prune(ctx context.Context, rules ...PruneOptions) ([]*bkclient.UsageInfo, error) {
+	if err := c.createController(); err != nil {
+		return nil, err
+	}
+	opt, err := c.createWorkerOpt()
+	if err != nil {
+		return nil, fmt.Errorf("creating worker opt failed: %v", err)
+	}
+
+	matches := make([]RecordFilter, len(rules))
+	for i, rule := range rules {
+		if matches[i], err = c.ParseRecordFilters(ctx, rule.Filters); err != nil {
+			return nil, err
+		}
+	}
+
+	du, err := c.worker.DiskUsage(ctx, bkclient.DiskUsageInfo{})
+	if err != nil {
+		return nil, fmt.Errorf("getting disk usage failed: %v", err)
+	}
+	sort.SliceStable(du, func(i, j int) bool {
+		return lastUsed(du[i]).Before(lastUsed(du[j]))
+	})
+
+	var total int64
+	children := map[string]int{}
+	for _, di := range du {
+		if di.Size > 0 {
+			total += di.Size
+		}
+		if di.Parent != "" {
+			children[di.Parent]++
+		}
+	}
+
+	// The immutable records that share the snapshot of a mutable record are
+	// removed with it.
+	twins := map[string][]string{}
+	items, err := opt.MetadataStore.All()
+	if err != nil {
+		return nil, fmt.Errorf("listing cache metadata failed: %v", err)
+	}
+	for _, si := range items {
+		v := si.Get("cache.equalMutable")
+		if v == nil {
+			continue
+		}
+		var mutable string
+		if err := v.Unmarshal(&mutable); err == nil && mutable != "" {
+			twins[mutable] = append(twins[mutable], si.ID())
+		}
+	}
+
+	var (
+		pruned  []*bkclient.UsageInfo
+		removed = map[string]bool{}
+	)
+	for i, rule := range rules {
+		var candidates []*bkclient.UsageInfo
+		for _, di := range du {
+			if !removed[di.ID] && !di.InUse && matches[i](di) && (rule.All || !isInternal(di)) {
+				candidates = append(candidates, di)
+			}
+		}
+
+		for rule.KeepStorage <= 0 || total > rule.KeepStorage {
+			// Take the least recently used record without children left.
+			j := -1
+			for k, di := range candidates {
+				if children[di.ID] == 0 {
+					j = k
+					break
+				}
+			}
+			if j < 0 {
+				break
+			}
+			di := candidates[j]
+			candidates = append(candidates[:j], candidates[j+1:]...)
+
+			if err := opt.Snapshotter.Remove(ctx, di.ID); err != nil && !errdefs.IsNotFound(err) {
+				return pruned, fmt.Errorf("removing snapshot %s failed: %v", di.ID, err)
+			}
+			for _, id := range append(twins[di.ID], di.ID) {
+				if err := opt.MetadataStore.Clear(id); err != nil {
+					return pruned, fmt.Errorf("removing metadata of %s failed: %v", id, err)
+				}
+			}
+
+			pruned = append(pruned, di)
+			removed[di.ID] = true
+			if di.Size > 0 {
+				total -= di.Size
+			}
+			if di.Parent != "" {
+				children[di.Parent]--
+			}
+		}
+	}
+
+	if len(pruned) > 0 {
+		if err := c.collectGarbage(ctx); err != nil {
+			return pruned, fmt.Errorf("garbage collection failed: %v", err)
+		}
+	}
+
+	return pruned, nil
+}
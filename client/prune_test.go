@@ -0,0 +1,125 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+)
+
+// testRecords are build cache records of each type, the regular ones last
+// used an hour ago.
+func testRecords() []*bkclient.UsageInfo {
+	hourAgo := time.Now().Add(-time.Hour)
+	return []*bkclient.UsageInfo{
+		{ID: "abc1", Description: "/bin/sh -c echo prunetest", CreatedAt: hourAgo.Add(-time.Hour), LastUsedAt: &hourAgo},
+		{ID: "abc2", Description: "pulled from docker.io/library/busybox:latest@sha256:abc", CreatedAt: hourAgo},
+		{ID: "def1", Description: "local source for context", CreatedAt: time.Now()},
+		{ID: "def2", Description: "shared git repo for https://github.com/genuinetools/img", CreatedAt: time.Now()},
+		{ID: "def3", Description: "cached mount /root/.cache from exec /bin/sh -c go build", CreatedAt: time.Now()},
+	}
+}
+
+// matchingRecords returns the IDs of the records the filter matches.
+func matchingRecords(fn RecordFilter, records []*bkclient.UsageInfo) string {
+	var ids []string
+	for _, di := range records {
+		if fn(di) {
+			ids = append(ids, di.ID)
+		}
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestParseRecordFilters(t *testing.T) {
+	c := &Client{root: "testdata"}
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+	records := testRecords()
+
+	tests := []struct {
+		filters  []string
+		expected string
+	}{
+		{nil, "abc1,abc2,def1,def2,def3"},
+		{[]string{"until=30m"}, "abc1,abc2"},
+		{[]string{"until=90m"}, ""},
+		{[]string{"id=abc"}, "abc1,abc2"},
+		{[]string{"description=echo prunetest"}, "abc1"},
+		{[]string{"id=abc", "description=pulled"}, "abc2"},
+		{[]string{"type=regular"}, "abc1,abc2"},
+		{[]string{"type=source.local"}, "def1"},
+		{[]string{"type=internal"}, "def2"},
+		{[]string{"type=exec.cachemount"}, "def3"},
+		// The records pulled for an image match it even once it is
+		// removed.
+		{[]string{"reference=busybox"}, "abc2"},
+	}
+	for _, tt := range tests {
+		fn, err := c.ParseRecordFilters(ctx, tt.filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := matchingRecords(fn, records); got != tt.expected {
+			t.Fatalf("expected the records %q for the filters %v, got %q", tt.expected, tt.filters, got)
+		}
+	}
+
+	for filter, expected := range map[string]string{
+		"until":           `filter "until" is not of the form key=value`,
+		"until=yesterday": `parsing until filter "yesterday" failed`,
+		"type=layer":      `unknown record type "layer"`,
+		"label=team":      "label filters are not supported",
+		"size=1GB":        `unknown filter "size"`,
+		"reference=A":     "parsing image name",
+	} {
+		if _, err := c.ParseRecordFilters(ctx, []string{filter}); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected %q for the filter %s, got: %v", expected, filter, err)
+		}
+	}
+}
+
+func TestIsInternal(t *testing.T) {
+	var internal []string
+	for _, di := range testRecords() {
+		if isInternal(di) {
+			internal = append(internal, di.ID)
+		}
+	}
+	if strings.Join(internal, ",") != "def1,def2" {
+		t.Fatalf("expected the local and git sources to be internal, got %v", internal)
+	}
+}
+
+func TestReferenceFilter(t *testing.T) {
+	c, cleanup := testClient(t, testImage{
+		name:   "docker.io/library/prunetest:latest",
+		layers: []map[string]string{{"bin/sh": "sh"}, {"prunetest": "prunetest"}},
+	})
+	defer cleanup()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+
+	img, err := c.InspectImage(ctx, "prunetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The records of the layers are named after their chain IDs.
+	base := img.Layers[0].DiffID.String()
+	records := []*bkclient.UsageInfo{
+		{ID: base},
+		{ID: identity.ChainID([]digest.Digest{img.Layers[0].DiffID, img.Layers[1].DiffID}).String()},
+		{ID: img.Layers[1].DiffID.String()},
+	}
+
+	fn, err := c.ParseRecordFilters(ctx, []string{"reference=prunetest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := matchingRecords(fn, records); got != base+","+records[1].ID {
+		t.Fatalf("expected the records of both layers, got %q", got)
+	}
+}
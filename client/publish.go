@@ -0,0 +1,83 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// DefaultContainerdNamespace is the containerd namespace images are
+// published to by default, the one used by the Kubernetes CRI plugin.
+const DefaultContainerdNamespace = "k8s.io"
+
+// PublishToContainerd adds an image to the image store of the containerd
+// daemon listening on address, so it can be used by ctr and Kubernetes on the
+// same node.
+//
+// img does not ship a containerd client, the image is streamed to
+// `ctr images import` which must be in the PATH of the user running img.
+func (c *Client) PublishToContainerd(ctx context.Context, image, address, namespace string) error {
+	if namespace == "" {
+		namespace = DefaultContainerdNamespace
+	}
+	return c.saveToCommand(ctx, image, "ctr", "--address", address, "--namespace", namespace, "images", "import", "-")
+}
+
+// PublishToContainersStorage adds an image to the containers/storage store in
+// root, so it can be used by podman and buildah. runRoot is the directory for
+// the transient state of the store.
+//
+// img does not ship containers/storage, the image is streamed to
+// `podman load` which must be in the PATH of the user running img. Since
+// podman runs in the user namespace of img, root and runRoot should be the
+// ones podman uses for the user outside of it, usually
+// ~/.local/share/containers/storage and $XDG_RUNTIME_DIR/containers.
+func (c *Client) PublishToContainersStorage(ctx context.Context, image, root, runRoot string) error {
+	return c.saveToCommand(ctx, image, "podman", "--root", root, "--runroot", runRoot, "--storage-driver", "overlay", "load")
+}
+
+// saveToCommand streams the image as a docker tarball to the standard input
+// of a command.
+func (c *Client) saveToCommand(ctx context.Context, image, name string, args ...string) error {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return fmt.Errorf("publishing %s requires %s: %v", image, name, err)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stderr = &stderr
+	if err := c.saveToCmd(ctx, image, cmd); err != nil {
+		return fmt.Errorf("publishing %s with %s failed: %v: %s", image, name, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// saveToCmd runs cmd with the image as a docker tarball on its standard
+// input.
+func (c *Client) saveToCmd(ctx context.Context, image string, cmd *exec.Cmd) error {
+	pr, pw := io.Pipe()
+	cmd.Stdin = pr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		err := c.SaveImages(ctx, []string{image}, SaveFormatDocker, Compression{}, pw)
+		if err != nil {
+			pw.CloseWithError(err)
+		}
+		errCh <- err
+	}()
+
+	werr := cmd.Wait()
+	// Unblock the save if the command exited without reading all of it.
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err := <-errCh; err != nil && werr == nil {
+		return err
+	}
+	return werr
+}
@@ -9,8 +9,10 @@ import (
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/platforms"
 	"github.com/docker/distribution/reference"
+	"github.com/genuinetools/img/internal/metrics"
 	"github.com/moby/buildkit/source"
 	"github.com/moby/buildkit/util/pull"
+	"github.com/sirupsen/logrus"
 )
 
 // Pull retrieves an image from a remote registry.
@@ -36,6 +38,8 @@ func (c *Client) Pull(ctx context.Context, image string) (*ListedImage, error) {
 		return nil, fmt.Errorf("creating worker opt failed: %v", err)
 	}
 
+	logrus.WithField("image", image).Debug("pulling image")
+
 	puller := &pull.Puller{
 		Snapshotter:  opt.Snapshotter,
 		ContentStore: opt.ContentStore,
@@ -67,5 +71,7 @@ func (c *Client) Pull(ctx context.Context, image string) (*ListedImage, error) {
 	if err != nil {
 		return nil, fmt.Errorf("calculating size of image %s failed: %v", image, err)
 	}
+	metrics.PulledBytesTotal.Add(float64(size))
+
 	return &ListedImage{Image: img, ContentSize: size}, nil
 }
@@ -4,16 +4,33 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/containerd/containerd/platforms"
 	"github.com/docker/distribution/reference"
+	"github.com/genuinetools/img/internal/metrics"
 	"github.com/moby/buildkit/util/push"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
 )
 
 // Push sends an image to a remote registry.
 func (c *Client) Push(ctx context.Context, image string, insecure bool) error {
+	_, err := c.PushCompressed(ctx, image, insecure, Compression{})
+	return err
+}
+
+// PushCompressed sends an image to a remote registry with its layers
+// compressed as requested, and returns the digest of the pushed manifest,
+// which differs from the one in the image store when the layers were
+// recompressed. The image in the image store is left as it is.
+func (c *Client) PushCompressed(ctx context.Context, image string, insecure bool, compression Compression) (digest.Digest, error) {
+	if err := compression.Validate(); err != nil {
+		return "", err
+	}
+
 	// Parse the image name and tag.
 	named, err := reference.ParseNormalizedNamed(image)
 	if err != nil {
-		return fmt.Errorf("parsing image name %q failed: %v", image, err)
+		return "", fmt.Errorf("parsing image name %q failed: %v", image, err)
 	}
 	// Add the latest lag if they did not provide one.
 	named = reference.TagNameOnly(named)
@@ -22,13 +39,35 @@ func (c *Client) Push(ctx context.Context, image string, insecure bool) error {
 	// Create the worker opts.
 	opt, err := c.createWorkerOpt()
 	if err != nil {
-		return fmt.Errorf("creating worker opt failed: %v", err)
+		return "", fmt.Errorf("creating worker opt failed: %v", err)
 	}
 
 	imgObj, err := opt.ImageStore.Get(ctx, image)
 	if err != nil {
-		return fmt.Errorf("getting image %q failed: %v", image, err)
+		return "", fmt.Errorf("getting image %q failed: %v", image, err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"image":  image,
+		"digest": imgObj.Target.Digest,
+	}).Debug("pushing image")
+
+	target := imgObj.Target
+	if rc := newRecompressor(opt.ContentStore, compression); rc != nil {
+		defer rc.cleanup(ctx)
+		if target, err = rc.recompress(ctx, target); err != nil {
+			return "", fmt.Errorf("compressing %s failed: %v", image, err)
+		}
+	}
+
+	if err := push.Push(ctx, opt.SessionManager, opt.ContentStore, target.Digest, image, insecure); err != nil {
+		return "", err
+	}
+
+	// Record the size of the pushed image.
+	if size, err := imgObj.Size(ctx, opt.ContentStore, platforms.Default()); err == nil {
+		metrics.PushedBytesTotal.Add(float64(size))
 	}
 
-	return push.Push(ctx, opt.SessionManager, opt.ContentStore, imgObj.Target.Digest, image, insecure)
+	return target.Digest, nil
 }
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+)
+
+// The types of build cache records, named like the record types of newer
+// versions of buildkit.
+const (
+	// RecordTypeRegular is a record of a build step or of a pulled layer.
+	RecordTypeRegular = "regular"
+	// RecordTypeInternal is a git repository or an http download sources
+	// keep between builds.
+	RecordTypeInternal = "internal"
+	// RecordTypeLocalSource is a local directory sent by a build, such as
+	// its context.
+	RecordTypeLocalSource = "source.local"
+	// RecordTypeGitCheckout is a checkout of a git repository.
+	RecordTypeGitCheckout = "source.git.checkout"
+	// RecordTypeCacheMount is a cache mount of a RUN instruction.
+	RecordTypeCacheMount = "exec.cachemount"
+)
+
+// RecordTypes are the types of build cache records.
+var RecordTypes = []string{RecordTypeRegular, RecordTypeInternal, RecordTypeLocalSource, RecordTypeGitCheckout, RecordTypeCacheMount}
+
+// recordTypeDescriptions are the description prefixes of the records of
+// each type, but the regular ones.
+var recordTypeDescriptions = map[string]string{
+	"shared git repo for ": RecordTypeInternal,
+	"http url ":            RecordTypeInternal,
+	"local source for ":    RecordTypeLocalSource,
+	"git snapshot for ":    RecordTypeGitCheckout,
+	"cached mount ":        RecordTypeCacheMount,
+}
+
+// RecordType returns the type of the build cache record with the
+// description. The vendored buildkit does not store the type, the
+// description it gives each kind of record tells it.
+func RecordType(description string) string {
+	for prefix, typ := range recordTypeDescriptions {
+		if strings.HasPrefix(description, prefix) {
+			return typ
+		}
+	}
+	return RecordTypeRegular
+}
+
+// isInternal returns if a record is kept by a source between builds.
+func isInternal(di *bkclient.UsageInfo) bool {
+	typ := RecordType(di.Description)
+	return typ == RecordTypeInternal || typ == RecordTypeLocalSource
+}
+
+// RecordFilter matches a build cache record.
+type RecordFilter func(*bkclient.UsageInfo) bool
+
+// ParseRecordFilters returns the filter matching the build cache records
+// that match all the key=value filters:
+//
+//	until=<duration>     last used (or created) longer ago than duration
+//	id=<prefix>          the ID starts with prefix
+//	description=<text>   the description contains text
+//	type=<type>          the record is of the type, see RecordTypes
+//	reference=<image>    the snapshot of a layer of the image, or pulled for it
+//
+// Reference filters read the image store, so a client that uses the
+// controller must create it first: the store cannot be opened twice.
+func (c *Client) ParseRecordFilters(ctx context.Context, filters []string) (RecordFilter, error) {
+	now := time.Now()
+	var fns []RecordFilter
+	for _, f := range filters {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("filter %q is not of the form key=value", f)
+		}
+		value := kv[1]
+		switch kv[0] {
+		case "until":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("parsing until filter %q failed: %v", value, err)
+			}
+			before := now.Add(-d)
+			fns = append(fns, func(di *bkclient.UsageInfo) bool {
+				return lastUsed(di).Before(before)
+			})
+		case "id":
+			fns = append(fns, func(di *bkclient.UsageInfo) bool {
+				return strings.HasPrefix(di.ID, value)
+			})
+		case "description":
+			fns = append(fns, func(di *bkclient.UsageInfo) bool {
+				return strings.Contains(di.Description, value)
+			})
+		case "type":
+			if !isRecordType(value) {
+				return nil, fmt.Errorf("unknown record type %q, the types are %s", value, strings.Join(RecordTypes, ", "))
+			}
+			fns = append(fns, func(di *bkclient.UsageInfo) bool {
+				return RecordType(di.Description) == value
+			})
+		case "reference":
+			fn, err := c.referenceFilter(ctx, value)
+			if err != nil {
+				return nil, err
+			}
+			fns = append(fns, fn)
+		case "label":
+			// The records of the vendored buildkit do not store labels.
+			return nil, fmt.Errorf("label filters are not supported: build cache records have no labels")
+		default:
+			return nil, fmt.Errorf("unknown filter %q, the filters are until, id, description, type and reference", kv[0])
+		}
+	}
+	return func(di *bkclient.UsageInfo) bool {
+		for _, fn := range fns {
+			if !fn(di) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// referenceFilter returns the filter matching the records of the layers of
+// an image, whose IDs are the chain IDs of the layers, and the records
+// pulled for it, which may be left when the image was removed.
+func (c *Client) referenceFilter(ctx context.Context, image string) (RecordFilter, error) {
+	name, err := normalizeImageName(image)
+	if err != nil {
+		return nil, err
+	}
+
+	chainIDs := map[string]bool{}
+	is, _, err := c.readImageStores(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if is != nil {
+		_, err := is.Get(ctx, name)
+		switch {
+		case err == nil:
+			inspected, err := c.InspectImage(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			diffIDs := make([]digest.Digest, 0, len(inspected.Layers))
+			for _, l := range inspected.Layers {
+				diffIDs = append(diffIDs, l.DiffID)
+			}
+			for _, id := range identity.ChainIDs(diffIDs) {
+				chainIDs[id.String()] = true
+			}
+		case !errdefs.IsNotFound(err):
+			return nil, fmt.Errorf("getting image %s from image store failed: %v", name, err)
+		}
+	}
+
+	pulled := "pulled from " + name
+	return func(di *bkclient.UsageInfo) bool {
+		return chainIDs[di.ID] || di.Description == pulled || strings.HasPrefix(di.Description, pulled+"@")
+	}, nil
+}
+
+func isRecordType(typ string) bool {
+	for _, t := range RecordTypes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// lastUsed returns when a record was last used, or created if it never was.
+func lastUsed(di *bkclient.UsageInfo) time.Time {
+	if di.LastUsedAt != nil {
+		return *di.LastUsedAt
+	}
+	return di.CreatedAt
+}
@@ -0,0 +1,592 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/identity"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxManifestSize is the size of the largest manifest or index the
+	// registry serves or accepts.
+	maxManifestSize = 4 << 20
+	// registryUploadTimeout is how long a blob upload can be idle before it
+	// is aborted.
+	registryUploadTimeout = 10 * time.Minute
+)
+
+// RegistryOptions are the options of the registry served by RegistryHandler.
+type RegistryOptions struct {
+	// ReadWrite accepts pushes to the registry, which add the images to the
+	// image store.
+	ReadWrite bool
+	// Token is the token clients must pass, as a bearer token or as the
+	// password of basic authentication. No authentication is required if it
+	// is empty.
+	Token string
+}
+
+// RegistryHandler returns an http handler serving the images in the image
+// store with the OCI distribution API, so they can be pulled by other hosts.
+func (c *Client) RegistryHandler(options RegistryOptions) (http.Handler, error) {
+	// Create the worker opts.
+	opt, err := c.createWorkerOpt()
+	if err != nil {
+		return nil, fmt.Errorf("creating worker opt failed: %v", err)
+	}
+
+	return &registry{
+		images:    opt.ImageStore,
+		content:   opt.ContentStore,
+		readWrite: options.ReadWrite,
+		token:     options.Token,
+		uploads:   map[string]*registryUpload{},
+	}, nil
+}
+
+type registry struct {
+	images    images.Store
+	content   content.Store
+	readWrite bool
+	token     string
+
+	mu      sync.Mutex
+	uploads map[string]*registryUpload
+}
+
+// registryUpload is a blob upload in progress.
+type registryUpload struct {
+	ref     string
+	cw      content.Writer
+	updated time.Time
+	// busy is set while a request writes to the upload.
+	busy bool
+}
+
+func (reg *registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(namespaces.WithNamespace(r.Context(), "buildkit"))
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	logrus.WithFields(logrus.Fields{"method": r.Method, "path": r.URL.Path}).Debug("registry request")
+
+	if !reg.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="img"`)
+		registryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case r.URL.Path == "/v2/" || r.URL.Path == "/v2":
+		registryJSON(w, http.StatusOK, struct{}{})
+		return
+	case p == "_catalog":
+		reg.catalog(w, r)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/v2/") {
+		registryError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+		return
+	}
+
+	// The repository name can contain slashes, so split on the last of the
+	// known path elements.
+	for _, elem := range []string{"/manifests/", "/blobs/uploads/", "/blobs/", "/tags/list"} {
+		i := strings.LastIndex(p, elem)
+		if i < 1 {
+			continue
+		}
+		name, ref := p[:i], p[i+len(elem):]
+		switch elem {
+		case "/manifests/":
+			reg.manifest(w, r, name, ref)
+		case "/blobs/uploads/":
+			reg.upload(w, r, name, ref)
+		case "/blobs/":
+			reg.blob(w, r, ref)
+		case "/tags/list":
+			reg.tags(w, r, name)
+		}
+		return
+	}
+
+	registryError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+}
+
+// catalog lists the repositories in the image store.
+func (reg *registry) catalog(w http.ResponseWriter, r *http.Request) {
+	imgs, err := reg.images.List(r.Context())
+	if err != nil {
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+
+	seen := map[string]bool{}
+	repos := []string{}
+	for _, img := range imgs {
+		named, err := reference.ParseNormalizedNamed(img.Name)
+		if err != nil {
+			continue
+		}
+		if name := reference.FamiliarName(named); !seen[name] {
+			seen[name] = true
+			repos = append(repos, name)
+		}
+	}
+	sort.Strings(repos)
+
+	registryJSON(w, http.StatusOK, map[string][]string{"repositories": repos})
+}
+
+// tags lists the tags of a repository.
+func (reg *registry) tags(w http.ResponseWriter, r *http.Request, name string) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		registryError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+		return
+	}
+
+	imgs, err := reg.images.List(r.Context())
+	if err != nil {
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+
+	tags := []string{}
+	for _, img := range imgs {
+		ref, err := reference.ParseNormalizedNamed(img.Name)
+		if err != nil || ref.Name() != named.Name() {
+			continue
+		}
+		if tagged, ok := ref.(reference.Tagged); ok {
+			tags = append(tags, tagged.Tag())
+		}
+	}
+	if len(tags) == 0 {
+		registryError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository "+name+" not found")
+		return
+	}
+	sort.Strings(tags)
+
+	registryJSON(w, http.StatusOK, map[string]interface{}{
+		"name": reference.FamiliarName(named),
+		"tags": tags,
+	})
+}
+
+// authorized returns whether the request passes the token, as a bearer token
+// or as the password of basic authentication.
+func (reg *registry) authorized(r *http.Request) bool {
+	if reg.token == "" {
+		return true
+	}
+	token := ""
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(reg.token)) == 1
+}
+
+// manifest serves or stores the manifest of an image by tag or digest.
+func (reg *registry) manifest(w http.ResponseWriter, r *http.Request, name, ref string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut:
+		reg.putManifest(w, r, name, ref)
+		return
+	default:
+		registryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", r.Method+" is not supported")
+		return
+	}
+
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		registryError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+		return
+	}
+
+	var desc ocispec.Descriptor
+	if dgst, err := digest.Parse(ref); err == nil {
+		desc, err = reg.repositoryManifest(r.Context(), named, dgst)
+		if err != nil {
+			registryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest "+ref+" not found")
+			return
+		}
+	} else {
+		tagged, err := reference.WithTag(named, ref)
+		if err != nil {
+			registryError(w, http.StatusBadRequest, "TAG_INVALID", err.Error())
+			return
+		}
+		img, err := reg.images.Get(r.Context(), tagged.String())
+		if err != nil || !isManifestMediaType(img.Target.MediaType) {
+			registryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest "+name+":"+ref+" not found")
+			return
+		}
+		desc = img.Target
+	}
+
+	w.Header().Set("Content-Type", desc.MediaType)
+	w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+	reg.serveContent(w, r, desc)
+}
+
+// repositoryManifest returns the descriptor of the manifest or index with the
+// digest, if an image of the repository is the manifest or an index listing
+// it. Blobs that are not manifests of the repository are not found, so any
+// blob in the content store cannot be read as a manifest.
+func (reg *registry) repositoryManifest(ctx context.Context, named reference.Named, dgst digest.Digest) (ocispec.Descriptor, error) {
+	imgs, err := reg.images.List(ctx)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	for _, img := range imgs {
+		ref, err := reference.ParseNormalizedNamed(img.Name)
+		if err != nil || ref.Name() != named.Name() || !isManifestMediaType(img.Target.MediaType) {
+			continue
+		}
+		if img.Target.Digest == dgst {
+			return img.Target, nil
+		}
+		if !isIndexMediaType(img.Target.MediaType) || img.Target.Size > maxManifestSize {
+			continue
+		}
+
+		dt, err := content.ReadBlob(ctx, reg.content, img.Target.Digest)
+		if err != nil {
+			continue
+		}
+		var idx ocispec.Index
+		if err := json.Unmarshal(dt, &idx); err != nil {
+			continue
+		}
+		for _, m := range idx.Manifests {
+			if m.Digest == dgst && isManifestMediaType(m.MediaType) {
+				return m, nil
+			}
+		}
+	}
+	return ocispec.Descriptor{}, errdefs.ErrNotFound
+}
+
+// blob serves a blob from the content store.
+func (reg *registry) blob(w http.ResponseWriter, r *http.Request, ref string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		registryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", r.Method+" is not supported")
+		return
+	}
+
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		registryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	info, err := reg.content.Info(r.Context(), dgst)
+	if err != nil {
+		registryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob "+ref+" not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	reg.serveContent(w, r, ocispec.Descriptor{Digest: dgst, Size: info.Size})
+}
+
+func (reg *registry) serveContent(w http.ResponseWriter, r *http.Request, desc ocispec.Descriptor) {
+	if isManifestMediaType(desc.MediaType) && desc.Size > maxManifestSize {
+		registryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest "+desc.Digest.String()+" is larger than the limit")
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(desc.Size, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	ra, err := reg.content.ReaderAt(r.Context(), desc.Digest)
+	if err != nil {
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	defer ra.Close()
+
+	if _, err := io.Copy(w, content.NewReader(ra)); err != nil {
+		logrus.Debugf("serving %s failed: %v", desc.Digest, err)
+	}
+}
+
+// upload handles the blob upload requests of a push.
+func (reg *registry) upload(w http.ResponseWriter, r *http.Request, name, id string) {
+	if !reg.readWrite {
+		registryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the registry is read-only")
+		return
+	}
+
+	reg.evictUploads(r.Context(), time.Now())
+
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		id = identity.NewID()
+		ref := "registry-upload-" + id
+		cw, err := reg.content.Writer(r.Context(), ref, 0, "")
+		if err != nil {
+			registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+			return
+		}
+		reg.mu.Lock()
+		reg.uploads[id] = &registryUpload{ref: ref, cw: cw, updated: time.Now()}
+		reg.mu.Unlock()
+
+		// Monolithic uploads pass the digest with the first request.
+		if dgst := r.URL.Query().Get("digest"); dgst != "" {
+			reg.finishUpload(w, r, name, id, dgst)
+			return
+		}
+
+		w.Header().Set("Location", "/v2/"+name+"/blobs/uploads/"+id)
+		w.Header().Set("Range", "0-0")
+		w.Header().Set("Docker-Upload-UUID", id)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPatch:
+		upload, ok := reg.getUpload(id)
+		if !ok {
+			registryError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload "+id+" not found")
+			return
+		}
+		defer reg.putUpload(upload)
+		if _, err := io.Copy(upload.cw, r.Body); err != nil {
+			registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+			return
+		}
+		status, err := upload.cw.Status()
+		if err != nil {
+			registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+			return
+		}
+		w.Header().Set("Location", "/v2/"+name+"/blobs/uploads/"+id)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", status.Offset-1))
+		w.Header().Set("Docker-Upload-UUID", id)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut:
+		reg.finishUpload(w, r, name, id, r.URL.Query().Get("digest"))
+	default:
+		registryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", r.Method+" is not supported")
+	}
+}
+
+// finishUpload writes the rest of the blob in the request body and commits
+// it to the content store.
+func (reg *registry) finishUpload(w http.ResponseWriter, r *http.Request, name, id, ref string) {
+	upload, ok := reg.getUpload(id)
+	if !ok {
+		registryError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload "+id+" not found")
+		return
+	}
+	reg.mu.Lock()
+	delete(reg.uploads, id)
+	reg.mu.Unlock()
+	cw := upload.cw
+	defer cw.Close()
+
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		registryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	if _, err := io.Copy(cw, r.Body); err != nil {
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	if err := cw.Commit(r.Context(), 0, dgst); err != nil && !errdefs.IsAlreadyExists(err) {
+		registryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+
+	w.Header().Set("Location", "/v2/"+name+"/blobs/"+dgst.String())
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// getUpload returns the upload with the id and marks it busy until it is
+// put back with putUpload. An upload already busy is not returned, its writer
+// cannot be written to by two requests at once.
+func (reg *registry) getUpload(id string) (*registryUpload, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	upload, ok := reg.uploads[id]
+	if !ok || upload.busy {
+		return nil, false
+	}
+	upload.busy = true
+	return upload, true
+}
+
+func (reg *registry) putUpload(upload *registryUpload) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	upload.busy = false
+	upload.updated = time.Now()
+}
+
+// evictUploads aborts the uploads idle for longer than registryUploadTimeout,
+// so abandoned uploads do not keep their writers open.
+func (reg *registry) evictUploads(ctx context.Context, now time.Time) {
+	reg.mu.Lock()
+	var expired []*registryUpload
+	for id, upload := range reg.uploads {
+		if !upload.busy && now.Sub(upload.updated) > registryUploadTimeout {
+			delete(reg.uploads, id)
+			expired = append(expired, upload)
+		}
+	}
+	reg.mu.Unlock()
+
+	for _, upload := range expired {
+		upload.cw.Close()
+		if err := reg.content.Abort(ctx, upload.ref); err != nil && !errdefs.IsNotFound(err) {
+			logrus.Debugf("aborting upload %s failed: %v", upload.ref, err)
+		}
+	}
+}
+
+// putManifest stores a pushed manifest and tags the image with the ref.
+func (reg *registry) putManifest(w http.ResponseWriter, r *http.Request, name, ref string) {
+	if !reg.readWrite {
+		registryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the registry is read-only")
+		return
+	}
+
+	dt, err := readAllLimited(r.Body, maxManifestSize)
+	if err != nil {
+		registryError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+		return
+	}
+	desc := ocispec.Descriptor{
+		MediaType: r.Header.Get("Content-Type"),
+		Digest:    digest.FromBytes(dt),
+		Size:      int64(len(dt)),
+	}
+	if desc.MediaType == "" {
+		desc.MediaType = detectManifestMediaType(dt)
+	}
+	if !isManifestMediaType(desc.MediaType) {
+		registryError(w, http.StatusBadRequest, "MANIFEST_INVALID", desc.MediaType+" is not the media type of a manifest")
+		return
+	}
+
+	if err := content.WriteBlob(r.Context(), reg.content, "registry-manifest-"+desc.Digest.String(), bytes.NewReader(dt), desc.Size, desc.Digest); err != nil {
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+
+	// Label the blobs the manifest references so they are not garbage
+	// collected.
+	handler := images.SetChildrenLabels(reg.content, images.FilterPlatforms(images.ChildrenHandler(reg.content), platforms.Default()))
+	if err := images.Walk(r.Context(), handler, desc); err != nil {
+		registryError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", err.Error())
+		return
+	}
+
+	// Manifests pushed by digest are only referenced by an index, only tags
+	// create images.
+	if _, err := digest.Parse(ref); err != nil {
+		named, err := reference.ParseNormalizedNamed(name + ":" + ref)
+		if err != nil {
+			registryError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+			return
+		}
+		img := images.Image{Name: named.String(), Target: desc}
+		if _, err := reg.images.Create(r.Context(), img); err != nil {
+			if !errdefs.IsAlreadyExists(err) {
+				registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+				return
+			}
+			if _, err := reg.images.Update(r.Context(), img); err != nil {
+				registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Location", "/v2/"+name+"/manifests/"+desc.Digest.String())
+	w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// isManifestMediaType returns whether the media type is the one of a manifest
+// or an index.
+func isManifestMediaType(mediaType string) bool {
+	switch mediaType {
+	case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+		return true
+	}
+	return isIndexMediaType(mediaType)
+}
+
+func isIndexMediaType(mediaType string) bool {
+	return mediaType == images.MediaTypeDockerSchema2ManifestList || mediaType == ocispec.MediaTypeImageIndex
+}
+
+// detectManifestMediaType returns the media type of a manifest or index from
+// its mediaType field, falling back to the OCI types.
+func detectManifestMediaType(dt []byte) string {
+	var m struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(dt, &m); err == nil && m.MediaType != "" {
+		return m.MediaType
+	}
+	if len(m.Manifests) > 0 {
+		return ocispec.MediaTypeImageIndex
+	}
+	return ocispec.MediaTypeImageManifest
+}
+
+func readAllLimited(r io.Reader, limit int64) ([]byte, error) {
+	dt, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(dt)) > limit {
+		return nil, fmt.Errorf("manifest is larger than %d bytes", limit)
+	}
+	return dt, nil
+}
+
+func registryJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// registryError writes an error in the format of the distribution API.
+func registryError(w http.ResponseWriter, code int, errCode, msg string) {
+	registryJSON(w, code, map[string]interface{}{
+		"errors": []map[string]string{{"code": errCode, "message": msg}},
+	})
+}
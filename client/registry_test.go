@@ -0,0 +1,294 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/containerd/containerd/content/local"
+	ctdmetadata "github.com/containerd/containerd/metadata"
+	"github.com/containerd/containerd/namespaces"
+	ctdsnapshot "github.com/containerd/containerd/snapshots"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testRegistry returns a registry backed by stores in a temporary
+// directory, and a function removing them.
+func testRegistry(t *testing.T, readWrite bool) (*registry, func()) {
+	dir, err := ioutil.TempDir("", "img-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := local.NewStore(filepath.Join(dir, "content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "containerdmeta.db"), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdb := ctdmetadata.NewDB(db, cs, map[string]ctdsnapshot.Snapshotter{})
+	if err := mdb.Init(namespaces.WithNamespace(context.Background(), "buildkit")); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := &registry{
+		images:    ctdmetadata.NewImageStore(mdb),
+		content:   mdb.ContentStore(),
+		readWrite: readWrite,
+		uploads:   map[string]*registryUpload{},
+	}
+	return reg, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// registryRequest sends a request to the registry and returns the response.
+func registryRequest(reg *registry, method, url string, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest(method, url, bytes.NewReader(body)))
+	return w
+}
+
+// pushBlob uploads a blob to the registry in a single request.
+func pushBlob(t *testing.T, reg *registry, name string, dt []byte) ocispec.Descriptor {
+	dgst := digest.FromBytes(dt)
+	w := registryRequest(reg, http.MethodPost, "/v2/"+name+"/blobs/uploads/?digest="+dgst.String(), dt)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d uploading a blob, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	return ocispec.Descriptor{Digest: dgst, Size: int64(len(dt))}
+}
+
+func TestRegistry(t *testing.T) {
+	reg, cleanup := testRegistry(t, true)
+	defer cleanup()
+
+	config := pushBlob(t, reg, "jess/img", []byte(`{"architecture":"amd64","os":"linux"}`))
+	config.MediaType = ocispec.MediaTypeImageConfig
+	layer := pushBlob(t, reg, "jess/img", []byte("layer"))
+	layer.MediaType = ocispec.MediaTypeImageLayer
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Config: config,
+		Layers: []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest = append([]byte(`{"schemaVersion":2,"mediaType":"`+ocispec.MediaTypeImageManifest+`",`), manifest[1:]...)
+
+	w := registryRequest(reg, http.MethodPut, "/v2/jess/img/manifests/latest", manifest)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d pushing a manifest, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	w = registryRequest(reg, http.MethodGet, "/v2/_catalog", nil)
+	if !strings.Contains(w.Body.String(), `"repositories":["jess/img"]`) {
+		t.Fatalf("expected the repository in the catalog, got: %s", w.Body.String())
+	}
+
+	w = registryRequest(reg, http.MethodGet, "/v2/jess/img/tags/list", nil)
+	if !strings.Contains(w.Body.String(), `"tags":["latest"]`) {
+		t.Fatalf("expected the tag in the tags list, got: %s", w.Body.String())
+	}
+
+	w = registryRequest(reg, http.MethodGet, "/v2/jess/img/manifests/latest", nil)
+	if w.Code != http.StatusOK || w.Body.String() != string(manifest) {
+		t.Fatalf("expected the manifest, got %d: %s", w.Code, w.Body.String())
+	}
+	if dgst := w.Header().Get("Docker-Content-Digest"); dgst != digest.FromBytes(manifest).String() {
+		t.Fatalf("expected the digest of the manifest, got %s", dgst)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != ocispec.MediaTypeImageManifest {
+		t.Fatalf("expected the media type of the manifest, got %s", ct)
+	}
+
+	// Manifests are found by digest in their repository only, and other
+	// blobs are not manifests.
+	w = registryRequest(reg, http.MethodGet, "/v2/jess/img/manifests/"+digest.FromBytes(manifest).String(), nil)
+	if w.Code != http.StatusOK || w.Body.String() != string(manifest) {
+		t.Fatalf("expected the manifest by digest, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, url := range []string{
+		"/v2/jess/other/manifests/" + digest.FromBytes(manifest).String(),
+		"/v2/jess/img/manifests/" + layer.Digest.String(),
+		"/v2/jess/img/manifests/" + config.Digest.String(),
+	} {
+		if w := registryRequest(reg, http.MethodGet, url, nil); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "MANIFEST_UNKNOWN") {
+			t.Fatalf("expected GET %s to be unknown, got %d: %s", url, w.Code, w.Body.String())
+		}
+	}
+
+	w = registryRequest(reg, http.MethodHead, "/v2/jess/img/blobs/"+layer.Digest.String(), nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != "5" || w.Body.Len() != 0 {
+		t.Fatalf("expected the size of the blob without a body, got %d: %v", w.Code, w.Header())
+	}
+
+	w = registryRequest(reg, http.MethodGet, "/v2/jess/img/blobs/"+layer.Digest.String(), nil)
+	if w.Body.String() != "layer" {
+		t.Fatalf("expected the blob, got: %s", w.Body.String())
+	}
+
+	tests := []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{http.MethodGet, "/v2/jess/img/manifests/nope", http.StatusNotFound},
+		{http.MethodGet, "/v2/jess/nope/tags/list", http.StatusNotFound},
+		{http.MethodGet, "/v2/jess/img/blobs/" + digest.FromString("nope").String(), http.StatusNotFound},
+		{http.MethodGet, "/v2/jess/img/blobs/nope", http.StatusBadRequest},
+		{http.MethodDelete, "/v2/jess/img/manifests/latest", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/nope", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := registryRequest(reg, tt.method, tt.url, nil); w.Code != tt.code {
+			t.Fatalf("expected status %d for %s %s, got %d: %s", tt.code, tt.method, tt.url, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRegistryReadOnly(t *testing.T) {
+	reg, cleanup := testRegistry(t, false)
+	defer cleanup()
+
+	for _, url := range []string{"/v2/jess/img/blobs/uploads/", "/v2/jess/img/manifests/latest"} {
+		method := http.MethodPost
+		if strings.Contains(url, "manifests") {
+			method = http.MethodPut
+		}
+		w := registryRequest(reg, method, url, []byte("{}"))
+		if w.Code != http.StatusMethodNotAllowed || !strings.Contains(w.Body.String(), "the registry is read-only") {
+			t.Fatalf("expected %s %s to be rejected, got %d: %s", method, url, w.Code, w.Body.String())
+		}
+	}
+
+	w := registryRequest(reg, http.MethodGet, "/v2/", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Docker-Distribution-API-Version") != "registry/2.0" {
+		t.Fatalf("expected the API version check to succeed, got %d: %v", w.Code, w.Header())
+	}
+}
+
+func TestRegistryIndex(t *testing.T) {
+	reg, cleanup := testRegistry(t, true)
+	defer cleanup()
+
+	config := pushBlob(t, reg, "jess/img", []byte(`{"architecture":"amd64","os":"linux"}`))
+	config.MediaType = ocispec.MediaTypeImageConfig
+	manifest, err := json.Marshal(ocispec.Manifest{Config: config, Layers: []ocispec.Descriptor{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdgst := digest.FromBytes(manifest)
+	if w := registryRequest(reg, http.MethodPut, "/v2/jess/img/manifests/"+mdgst.String(), manifest); w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d pushing a manifest by digest, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	// A manifest pushed by digest is not in an image until an index lists
+	// it.
+	if w := registryRequest(reg, http.MethodGet, "/v2/jess/img/manifests/"+mdgst.String(), nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected a manifest of no image to be unknown, got %d: %s", w.Code, w.Body.String())
+	}
+
+	index, err := json.Marshal(ocispec.Index{Manifests: []ocispec.Descriptor{{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    mdgst,
+		Size:      int64(len(manifest)),
+		Platform:  &ocispec.Platform{OS: "linux", Architecture: "amd64"},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPut, "/v2/jess/img/manifests/latest", bytes.NewReader(index))
+	req.Header.Set("Content-Type", ocispec.MediaTypeImageIndex)
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d pushing an index, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	w = registryRequest(reg, http.MethodGet, "/v2/jess/img/manifests/"+mdgst.String(), nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != ocispec.MediaTypeImageManifest {
+		t.Fatalf("expected the manifest listed by the index, got %d: %v", w.Code, w.Header())
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/v2/jess/img/manifests/blob", bytes.NewReader([]byte("{}")))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "MANIFEST_INVALID") {
+		t.Fatalf("expected a blob pushed as a manifest to be rejected, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRegistryToken(t *testing.T) {
+	reg, cleanup := testRegistry(t, true)
+	defer cleanup()
+	reg.token = "secret"
+
+	w := registryRequest(reg, http.MethodPost, "/v2/jess/img/blobs/uploads/", nil)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Basic realm="img"` {
+		t.Fatalf("expected a push without the token to be unauthorized, got %d: %v", w.Code, w.Header())
+	}
+
+	tests := []func(r *http.Request){
+		func(r *http.Request) { r.SetBasicAuth("jess", "secret") },
+		func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") },
+	}
+	for _, auth := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		auth(r)
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected the token to be accepted, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	r.SetBasicAuth("jess", "nope")
+	w = httptest.NewRecorder()
+	reg.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a wrong token to be unauthorized, got %d", w.Code)
+	}
+}
+
+func TestRegistryEvictUploads(t *testing.T) {
+	reg, cleanup := testRegistry(t, true)
+	defer cleanup()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+
+	w := registryRequest(reg, http.MethodPost, "/v2/jess/img/blobs/uploads/", nil)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d starting an upload, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	location := w.Header().Get("Location")
+	if w := registryRequest(reg, http.MethodPatch, location, []byte("layer")); w.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d uploading a chunk, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+
+	// Uploads in use are kept.
+	reg.evictUploads(ctx, time.Now())
+	if statuses, err := reg.content.ListStatuses(ctx); err != nil || len(statuses) != 1 {
+		t.Fatalf("expected the upload to be kept, got %v: %v", statuses, err)
+	}
+
+	reg.evictUploads(ctx, time.Now().Add(registryUploadTimeout+time.Second))
+	if w := registryRequest(reg, http.MethodPatch, location, []byte("layer")); w.Code != http.StatusNotFound {
+		t.Fatalf("expected the idle upload to be gone, got %d: %s", w.Code, w.Body.String())
+	}
+	if statuses, err := reg.content.ListStatuses(ctx); err != nil || len(statuses) != 0 {
+		t.Fatalf("expected the idle upload to be aborted, got %v: %v", statuses, err)
+	}
+}
@@ -0,0 +1,241 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	controlapi "github.com/moby/buildkit/api/services/control"
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/auth/authprovider"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// DefaultRemoteSocket is the BuildKit socket used on ssh:// remote builders
+// when the address has no path.
+const DefaultRemoteSocket = "/run/buildkit/buildkitd.sock"
+
+// RemoteBuilder is a BuildKit daemon on another machine, such as `img daemon`
+// or buildkitd, that runs builds instead of the local state. The build
+// context is sent from the local machine and the registry credentials of the
+// local user are used.
+type RemoteBuilder struct {
+	// Address is the address of the daemon, one of
+	// ssh://[USER@]HOST[:PORT][/SOCKET], tcp://HOST:PORT or unix://SOCKET.
+	Address string
+	// TLSCACert, TLSCert and TLSKey are the paths of the certificates to
+	// connect to a tcp:// address with mutual TLS.
+	TLSCACert string
+	TLSCert   string
+	TLSKey    string
+	// TLSServerName is the name of the server to verify the certificate
+	// against, it defaults to the host of the address.
+	TLSServerName string
+}
+
+// Build builds an image from a Dockerfile on the remote builder. The image
+// is stored on the remote builder, set opt.Push to push it to its registry.
+// The status updates are sent on ch like with Client.Build.
+func (b RemoteBuilder) Build(ctx context.Context, opt BuildOpt, ch chan *controlapi.StatusResponse) (*controlapi.SolveResponse, error) {
+	if ch == nil {
+		ch = make(chan *controlapi.StatusResponse)
+		go func() {
+			for range ch {
+			}
+		}()
+	}
+
+	exporterAttrs, frontendAttrs, localDirs, err := opt.solveAttrs()
+	if err != nil {
+		close(ch)
+		return nil, err
+	}
+	cache := opt.cacheOptions()
+
+	c, cleanup, err := b.connect(ctx)
+	if err != nil {
+		close(ch)
+		return nil, err
+	}
+	defer cleanup()
+	defer c.Close()
+
+	statusCh := make(chan *bkclient.SolveStatus)
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		defer close(ch)
+		for s := range statusCh {
+			ch <- statusResponse(s)
+		}
+		return nil
+	})
+
+	var resp *controlapi.SolveResponse
+	eg.Go(func() error {
+		res, err := c.Solve(ctx, nil, bkclient.SolveOpt{
+			Exporter:         bkclient.ExporterImage,
+			ExporterAttrs:    exporterAttrs,
+			LocalDirs:        localDirs,
+			Frontend:         "dockerfile.v0",
+			FrontendAttrs:    frontendAttrs,
+			ExportCache:      cache.ExportRef,
+			ExportCacheAttrs: cache.ExportAttrs,
+			ImportCache:      cache.ImportRefs,
+			Session:          []session.Attachable{authprovider.NewDockerAuthProvider()},
+		}, statusCh)
+		if err != nil {
+			return err
+		}
+		resp = &controlapi.SolveResponse{ExporterResponse: res.ExporterResponse}
+		return nil
+	})
+
+	return resp, eg.Wait()
+}
+
+// connect returns a client for the remote builder and a function to clean up
+// the connection once the client is closed.
+func (b RemoteBuilder) connect(ctx context.Context) (*bkclient.Client, func(), error) {
+	u, err := url.Parse(b.Address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing builder address %q failed: %v", b.Address, err)
+	}
+
+	cleanup := func() {}
+	address := b.Address
+	var opts []bkclient.ClientOpt
+	switch u.Scheme {
+	case "ssh":
+		address, cleanup, err = forwardSSH(ctx, u)
+		if err != nil {
+			return nil, nil, err
+		}
+	case "tcp":
+		if b.TLSCACert != "" {
+			serverName := b.TLSServerName
+			if serverName == "" {
+				serverName = u.Hostname()
+			}
+			opts = append(opts, bkclient.WithCredentials(serverName, b.TLSCACert, b.TLSCert, b.TLSKey))
+		}
+	case "unix":
+	default:
+		return nil, nil, fmt.Errorf("%s is not a supported builder protocol (ssh, tcp, unix)", u.Scheme)
+	}
+
+	c, err := bkclient.New(address, opts...)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("connecting to builder %s failed: %v", b.Address, err)
+	}
+	return c, cleanup, nil
+}
+
+// forwardSSH forwards a local unix socket to the BuildKit socket on the host
+// with ssh, so the user's ssh configuration and agent are used to
+// authenticate. It returns the address of the local socket.
+func forwardSSH(ctx context.Context, u *url.URL) (string, func(), error) {
+	sshPath, err := exec.LookPath("ssh")
+	if err != nil {
+		return "", nil, fmt.Errorf("ssh:// builders require ssh: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "img-builder-")
+	if err != nil {
+		return "", nil, err
+	}
+	local := filepath.Join(dir, "buildkitd.sock")
+	remote := u.Path
+	if remote == "" {
+		remote = DefaultRemoteSocket
+	}
+
+	host := u.Hostname()
+	if u.User != nil {
+		host = u.User.Username() + "@" + host
+	}
+	args := []string{"-nNT", "-o", "ExitOnForwardFailure=yes", "-L", local + ":" + remote}
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, host)
+
+	cmd := exec.CommandContext(ctx, sshPath, args...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, fmt.Errorf("starting ssh failed: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	cleanup := func() {
+		cmd.Process.Kill()
+		<-exited
+		os.RemoveAll(dir)
+	}
+
+	// Wait for ssh to create the local socket.
+	logrus.Debugf("forwarding %s to %s:%s", local, host, remote)
+	for {
+		if _, err := os.Stat(local); err == nil {
+			return "unix://" + local, cleanup, nil
+		}
+		select {
+		case err := <-exited:
+			exited <- err
+			cleanup()
+			return "", nil, fmt.Errorf("forwarding the BuildKit socket with ssh to %s failed: %v", host, err)
+		case <-ctx.Done():
+			cleanup()
+			return "", nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// statusResponse converts the status of a BuildKit client solve to a status
+// response of the controller, so remote builds are displayed like local ones.
+func statusResponse(s *bkclient.SolveStatus) *controlapi.StatusResponse {
+	resp := &controlapi.StatusResponse{}
+	for _, v := range s.Vertexes {
+		resp.Vertexes = append(resp.Vertexes, &controlapi.Vertex{
+			Digest:    v.Digest,
+			Inputs:    v.Inputs,
+			Name:      v.Name,
+			Started:   v.Started,
+			Completed: v.Completed,
+			Error:     v.Error,
+			Cached:    v.Cached,
+		})
+	}
+	for _, v := range s.Statuses {
+		resp.Statuses = append(resp.Statuses, &controlapi.VertexStatus{
+			ID:        v.ID,
+			Vertex:    v.Vertex,
+			Name:      v.Name,
+			Total:     v.Total,
+			Current:   v.Current,
+			Timestamp: v.Timestamp,
+			Started:   v.Started,
+			Completed: v.Completed,
+		})
+	}
+	for _, v := range s.Logs {
+		resp.Logs = append(resp.Logs, &controlapi.VertexLog{
+			Vertex:    v.Vertex,
+			Stream:    int64(v.Stream),
+			Msg:       v.Data,
+			Timestamp: v.Timestamp,
+		})
+	}
+	return resp
+}
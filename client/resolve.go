@@ -0,0 +1,21 @@
+package client
+
+import (
+	"context"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ResolveImageConfig returns the digest and config of an image reference, it
+// implements llb.ImageMetaResolver so the client can be used when converting
+// Dockerfiles to LLB.
+func (c *Client) ResolveImageConfig(ctx context.Context, ref string) (digest.Digest, []byte, error) {
+	if c.controller == nil {
+		// Create the controller.
+		if err := c.createController(); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return c.worker.ResolveImageConfig(ctx, ref)
+}
@@ -1,25 +1,51 @@
 package client
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
-	"github.com/docker/distribution/reference"
-	"github.com/moby/buildkit/util/dockerexporter"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-// SaveImage exports an image as a tarball which can then be imported by docker.
-func (c *Client) SaveImage(ctx context.Context, image string, writer io.WriteCloser) error {
-	// Parse the image name and tag.
-	named, err := reference.ParseNormalizedNamed(image)
-	if err != nil {
-		return fmt.Errorf("parsing image name %q failed: %v", image, err)
+// The formats of the tarballs SaveImages writes.
+const (
+	// SaveFormatDocker is a tarball docker load can import, an OCI image
+	// layout with the manifest.json of a docker archive.
+	SaveFormatDocker = "docker"
+	// SaveFormatOCI is a tarball with an OCI image layout, the images
+	// named with the ref name annotation in its index.
+	SaveFormatOCI = "oci"
+)
+
+// SaveFormats are the formats SaveImages can write.
+var SaveFormats = []string{SaveFormatDocker, SaveFormatOCI}
+
+// SaveImages exports images as a tarball in the given format, with their
+// layers compressed as requested. The blobs the images share are saved once.
+func (c *Client) SaveImages(ctx context.Context, imgs []string, format string, compression Compression, writer io.WriteCloser) error {
+	switch format {
+	case SaveFormatDocker, SaveFormatOCI:
+	default:
+		return fmt.Errorf("unknown save format %q, must be one of %s", format, strings.Join(SaveFormats, ", "))
+	}
+	if err := compression.Validate(); err != nil {
+		return err
 	}
-	// Add the latest lag if they did not provide one.
-	named = reference.TagNameOnly(named)
-	image = named.String()
 
 	// Create the worker opts.
 	opt, err := c.createWorkerOpt()
@@ -31,17 +57,288 @@ func (c *Client) SaveImage(ctx context.Context, image string, writer io.WriteClo
 		return errors.New("image store is nil")
 	}
 
-	img, err := opt.ImageStore.Get(ctx, image)
+	rc := newRecompressor(opt.ContentStore, compression)
+	if rc != nil {
+		defer rc.cleanup(ctx)
+	}
+	layout, err := newSaveLayout(ctx, opt.ContentStore, opt.ImageStore, imgs, rc)
 	if err != nil {
-		return fmt.Errorf("getting image %s from image store failed: %v", image, err)
+		return err
+	}
+	if format == SaveFormatOCI {
+		layout.dockerManifest = nil
 	}
 
-	exporter := &dockerexporter.DockerExporter{
-		Name: img.Name,
+	tw := tar.NewWriter(writer)
+	if err := layout.write(ctx, opt.ContentStore, func(name string, size int64, r io.Reader) error {
+		mode := int64(0444)
+		typ := byte(tar.TypeReg)
+		if r == nil {
+			mode, typ = 0755, tar.TypeDir
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: mode, Size: size, Typeflag: typ}); err != nil {
+			return err
+		}
+		if r == nil {
+			return nil
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	}); err != nil {
+		return err
 	}
-	if err := exporter.Export(ctx, opt.ContentStore, img.Target, writer); err != nil {
-		return fmt.Errorf("exporting image %s failed: %v", image, err)
+	if err := tw.Close(); err != nil {
+		return err
 	}
 
 	return writer.Close()
 }
+
+// SaveImagesToDir writes images to a directory with an OCI image layout.
+// The images are added to the layout already in the directory, replacing the
+// images with the same names, and the blobs already in it are not written
+// again.
+func (c *Client) SaveImagesToDir(ctx context.Context, imgs []string, dir string, compression Compression) error {
+	if err := compression.Validate(); err != nil {
+		return err
+	}
+
+	// Create the worker opts.
+	opt, err := c.createWorkerOpt()
+	if err != nil {
+		return fmt.Errorf("creating worker opt failed: %v", err)
+	}
+
+	rc := newRecompressor(opt.ContentStore, compression)
+	if rc != nil {
+		defer rc.cleanup(ctx)
+	}
+	layout, err := newSaveLayout(ctx, opt.ContentStore, opt.ImageStore, imgs, rc)
+	if err != nil {
+		return err
+	}
+	layout.dockerManifest = nil
+
+	// Keep the images of the layout in the directory.
+	dt, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var index ocispec.Index
+		if err := json.Unmarshal(dt, &index); err != nil {
+			return fmt.Errorf("parsing index.json of %s failed: %v", dir, err)
+		}
+		saved := map[string]bool{}
+		for _, m := range layout.index.Manifests {
+			saved[m.Annotations[ocispec.AnnotationRefName]] = true
+		}
+		var manifests []ocispec.Descriptor
+		for _, m := range index.Manifests {
+			if ref := m.Annotations[ocispec.AnnotationRefName]; ref == "" || !saved[ref] {
+				manifests = append(manifests, m)
+			}
+		}
+		layout.index.Manifests = append(manifests, layout.index.Manifests...)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return layout.write(ctx, opt.ContentStore, func(name string, size int64, r io.Reader) error {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if r == nil {
+			return os.MkdirAll(p, 0755)
+		}
+		if strings.HasPrefix(name, "blobs/") {
+			if fi, err := os.Stat(p); err == nil && fi.Size() == size {
+				return nil
+			}
+		}
+		// Write the file next to it and rename it, so the layout is
+		// never left with a partial file.
+		f, err := ioutil.TempFile(filepath.Dir(p), ".img-save-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := os.Chmod(f.Name(), 0644); err != nil {
+			return err
+		}
+		return os.Rename(f.Name(), p)
+	})
+}
+
+// saveLayout is an OCI image layout of images to save, with the manifest.json
+// of a docker archive for them.
+type saveLayout struct {
+	index          ocispec.Index
+	dockerManifest []dockerArchiveManifest
+	// blobs are the blobs of the images, each once.
+	blobs []ocispec.Descriptor
+}
+
+// newSaveLayout returns the layout of images of the image store. Like docker
+// archives, the layout has the manifest of each image for the current
+// platform, so the index only references what is saved. The layers are
+// compressed by rc unless it is nil.
+func newSaveLayout(ctx context.Context, cs content.Provider, is images.Store, imgs []string, rc *recompressor) (*saveLayout, error) {
+	layout := &saveLayout{
+		index:          ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}},
+		dockerManifest: []dockerArchiveManifest{},
+	}
+	seen := map[digest.Digest]bool{}
+	configs := map[digest.Digest]int{}
+	for _, image := range imgs {
+		img, err := getImage(ctx, is, image)
+		if err != nil {
+			return nil, err
+		}
+		target, err := platformManifest(ctx, cs, img.Target)
+		if err != nil {
+			return nil, fmt.Errorf("getting the manifest of %s failed: %v", img.Name, err)
+		}
+		if rc != nil {
+			if target, err = rc.recompress(ctx, target); err != nil {
+				return nil, fmt.Errorf("compressing %s failed: %v", img.Name, err)
+			}
+		}
+		dt, err := content.ReadBlob(ctx, cs, target.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("reading manifest %s failed: %v", target.Digest, err)
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(dt, &manifest); err != nil {
+			return nil, fmt.Errorf("parsing manifest %s failed: %v", target.Digest, err)
+		}
+
+		for _, desc := range append([]ocispec.Descriptor{target, manifest.Config}, manifest.Layers...) {
+			if !seen[desc.Digest] {
+				seen[desc.Digest] = true
+				layout.blobs = append(layout.blobs, desc)
+			}
+		}
+
+		target.Annotations = map[string]string{ocispec.AnnotationRefName: img.Name}
+		layout.index.Manifests = append(layout.index.Manifests, target)
+
+		// The images with the same config are one image of the docker
+		// archive with several tags.
+		if i, ok := configs[manifest.Config.Digest]; ok {
+			layout.dockerManifest[i].RepoTags = append(layout.dockerManifest[i].RepoTags, img.Name)
+			continue
+		}
+		m := dockerArchiveManifest{
+			Config:   blobPath(manifest.Config.Digest),
+			RepoTags: []string{img.Name},
+		}
+		for _, l := range manifest.Layers {
+			m.Layers = append(m.Layers, blobPath(l.Digest))
+		}
+		configs[manifest.Config.Digest] = len(layout.dockerManifest)
+		layout.dockerManifest = append(layout.dockerManifest, m)
+	}
+	return layout, nil
+}
+
+// write writes the files of the layout with writeFile, which creates a
+// directory when r is nil.
+func (l *saveLayout) write(ctx context.Context, cs content.Provider, writeFile func(name string, size int64, r io.Reader) error) error {
+	writeJSONFile := func(name string, v interface{}) error {
+		dt, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return writeFile(name, int64(len(dt)), bytes.NewReader(dt))
+	}
+
+	if err := writeJSONFile(ocispec.ImageLayoutFile, ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion}); err != nil {
+		return err
+	}
+	if err := writeJSONFile("index.json", l.index); err != nil {
+		return err
+	}
+	if l.dockerManifest != nil {
+		if err := writeJSONFile("manifest.json", l.dockerManifest); err != nil {
+			return err
+		}
+	}
+
+	dirs := map[string]bool{}
+	for _, desc := range l.blobs {
+		dir := path.Dir(blobPath(desc.Digest))
+		if !dirs[dir] {
+			for _, d := range []string{"blobs", dir} {
+				if !dirs[d] {
+					dirs[d] = true
+					if err := writeFile(d+"/", 0, nil); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		ra, err := cs.ReaderAt(ctx, desc.Digest)
+		if err != nil {
+			return fmt.Errorf("reading blob %s failed: %v", desc.Digest, err)
+		}
+		// Verify the digest of the blob while it is written, unless
+		// writeFile skips it.
+		verifier := desc.Digest.Verifier()
+		r := &io.LimitedReader{R: io.TeeReader(content.NewReader(ra), verifier), N: desc.Size}
+		err = writeFile(blobPath(desc.Digest), desc.Size, r)
+		ra.Close()
+		if err != nil {
+			return fmt.Errorf("writing blob %s failed: %v", desc.Digest, err)
+		}
+		if r.N == 0 && !verifier.Verified() {
+			return fmt.Errorf("blob %s does not match its digest", desc.Digest)
+		}
+	}
+	return nil
+}
+
+// blobPath returns the path of a blob in an OCI image layout.
+func blobPath(dgst digest.Digest) string {
+	return path.Join("blobs", dgst.Algorithm().String(), dgst.Hex())
+}
+
+// platformManifest returns the manifest for the default platform of an index,
+// such as the index of an image with attestations, or the descriptor itself
+// when it is not an index.
+func platformManifest(ctx context.Context, provider content.Provider, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	return manifestForPlatform(ctx, provider, desc, platforms.DefaultSpec())
+}
+
+// manifestForPlatform returns the first manifest for the platform of an
+// index, or the descriptor itself when it is not an index.
+func manifestForPlatform(ctx context.Context, provider content.Provider, desc ocispec.Descriptor, platform ocispec.Platform) (ocispec.Descriptor, error) {
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+	default:
+		return desc, nil
+	}
+
+	dt, err := content.ReadBlob(ctx, provider, desc.Digest)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(dt, &index); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	matcher := platforms.NewMatcher(platform)
+	for _, m := range index.Manifests {
+		if m.Platform == nil || matcher.Match(*m.Platform) {
+			return manifestForPlatform(ctx, provider, m, platform)
+		}
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("index %s has no manifest for platform %s", desc.Digest, platforms.Format(platform))
+}
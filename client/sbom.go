@@ -0,0 +1,226 @@
+package client
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Package is a package installed in an image by its package manager.
+type Package struct {
+	// Type is the package manager, apk or deb.
+	Type    string
+	Name    string
+	Version string
+	Arch    string
+	License string
+	// Source is the package the package was built from, if it differs.
+	Source string
+}
+
+// OSRelease identifies the distribution of an image, from its os-release
+// file.
+type OSRelease struct {
+	ID        string
+	VersionID string
+	Name      string
+}
+
+// The package databases read by ImagePackages.
+const (
+	apkInstalled  = "lib/apk/db/installed"
+	dpkgStatus    = "var/lib/dpkg/status"
+	dpkgStatusDir = "var/lib/dpkg/status.d"
+)
+
+// ImagePackages returns the distribution of an image and the packages
+// installed in it by apk or dpkg, read from the package databases in the
+// filesystem its layers make up. Only the image for the default platform is
+// read.
+func (c *Client) ImagePackages(ctx context.Context, image string) (OSRelease, []Package, error) {
+	opt, err := c.createWorkerOpt()
+	if err != nil {
+		return OSRelease{}, nil, fmt.Errorf("creating worker opt failed: %v", err)
+	}
+	cs := opt.ContentStore
+
+	img, err := getImage(ctx, opt.ImageStore, image)
+	if err != nil {
+		return OSRelease{}, nil, err
+	}
+	manifest, _, _, err := readImage(ctx, cs, img.Target)
+	if err != nil {
+		return OSRelease{}, nil, fmt.Errorf("reading image %s failed: %v", img.Name, err)
+	}
+
+	// The files as they are in the filesystem, the whiteouts of a layer
+	// remove the files of the layers below.
+	files := map[string][]byte{}
+	for _, l := range manifest.Layers {
+		var (
+			removed []string
+			added   = map[string][]byte{}
+		)
+		if err := walkLayer(ctx, cs, l, func(hdr *tar.Header, r io.Reader) error {
+			name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+			switch base := path.Base(name); {
+			case base == ".wh..wh..opq":
+				removed = append(removed, path.Dir(name)+"/")
+			case strings.HasPrefix(base, ".wh."):
+				name = path.Join(path.Dir(name), strings.TrimPrefix(base, ".wh."))
+				removed = append(removed, name, name+"/")
+			case hdr.Typeflag == tar.TypeReg && isPackageFile(name):
+				dt, err := ioutil.ReadAll(r)
+				if err != nil {
+					return err
+				}
+				added[name] = dt
+			default:
+				// Anything else replaces a file the same way.
+				removed = append(removed, name)
+			}
+			return nil
+		}); err != nil {
+			return OSRelease{}, nil, fmt.Errorf("reading layer %s failed: %v", l.Digest, err)
+		}
+		for _, prefix := range removed {
+			for name := range files {
+				if name == prefix || (strings.HasSuffix(prefix, "/") && strings.HasPrefix(name, prefix)) {
+					delete(files, name)
+				}
+			}
+		}
+		for name, dt := range added {
+			files[name] = dt
+		}
+	}
+
+	release := parseOSRelease(files["usr/lib/os-release"])
+	if dt, ok := files["etc/os-release"]; ok {
+		release = parseOSRelease(dt)
+	}
+
+	var pkgs []Package
+	for _, p := range parseParagraphs(files[apkInstalled]) {
+		pkgs = append(pkgs, Package{
+			Type:    "apk",
+			Name:    p["P"],
+			Version: p["V"],
+			Arch:    p["A"],
+			License: p["L"],
+			Source:  sourceIfDifferent(p["o"], p["P"]),
+		})
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if name == dpkgStatus || (path.Dir(name) == dpkgStatusDir && !strings.HasSuffix(name, ".md5sums")) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, p := range parseParagraphs(files[name]) {
+			// The status file keeps removed packages with their config
+			// files, distroless status.d files have no status.
+			if status, ok := p["Status"]; ok && !strings.HasSuffix(status, " installed") {
+				continue
+			}
+			// The source may have its version in parentheses.
+			var source string
+			if f := strings.Fields(p["Source"]); len(f) > 0 {
+				source = f[0]
+			}
+			pkgs = append(pkgs, Package{
+				Type:    "deb",
+				Name:    p["Package"],
+				Version: p["Version"],
+				Arch:    p["Architecture"],
+				Source:  sourceIfDifferent(source, p["Package"]),
+			})
+		}
+	}
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		if pkgs[i].Type != pkgs[j].Type {
+			return pkgs[i].Type < pkgs[j].Type
+		}
+		return pkgs[i].Name < pkgs[j].Name
+	})
+	return release, pkgs, nil
+}
+
+// isPackageFile returns whether ImagePackages reads a file.
+func isPackageFile(name string) bool {
+	switch name {
+	case apkInstalled, dpkgStatus, "etc/os-release", "usr/lib/os-release":
+		return true
+	}
+	return path.Dir(name) == dpkgStatusDir
+}
+
+func sourceIfDifferent(source, name string) string {
+	if source == name {
+		return ""
+	}
+	return source
+}
+
+// parseParagraphs parses the paragraphs of KEY:VALUE lines, separated by
+// empty lines, of a package database. The continuation lines of multi-line
+// values, starting with a space, are skipped.
+func parseParagraphs(dt []byte) []map[string]string {
+	var (
+		paragraphs []map[string]string
+		p          map[string]string
+	)
+	s := bufio.NewScanner(bytes.NewReader(dt))
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		if strings.TrimSpace(line) == "" {
+			p = nil
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 1 {
+			continue
+		}
+		if p == nil {
+			p = map[string]string{}
+			paragraphs = append(paragraphs, p)
+		}
+		p[line[:i]] = strings.TrimSpace(line[i+1:])
+	}
+	return paragraphs
+}
+
+// parseOSRelease parses an os-release file.
+func parseOSRelease(dt []byte) OSRelease {
+	var r OSRelease
+	s := bufio.NewScanner(bytes.NewReader(dt))
+	for s.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(s.Text()), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := strings.Trim(kv[1], `"'`)
+		switch kv[0] {
+		case "ID":
+			r.ID = v
+		case "VERSION_ID":
+			r.VersionID = v
+		case "PRETTY_NAME":
+			r.Name = v
+		}
+	}
+	return r
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestImagePackages(t *testing.T) {
+	c, cleanup := testWorkerClient(t, testImage{
+		name:   "docker.io/library/sbomtest:latest",
+		config: ocispec.Image{OS: "linux", Architecture: runtime.GOARCH},
+		layers: []map[string]string{
+			{
+				"usr/lib/os-release": "ID=debian\nVERSION_ID=\"11\"\nPRETTY_NAME=\"Debian GNU/Linux 11 (bullseye)\"\n",
+				"var/lib/dpkg/status": `Package: libc6
+Status: install ok installed
+Architecture: amd64
+Source: glibc (2.31-13)
+Version: 2.31-13+deb11u5
+Description: GNU C Library: Shared libraries
+ Contains the standard libraries that are used by nearly all programs on
+ the system.
+
+Package: oldpkg
+Status: deinstall ok config-files
+Architecture: all
+Version: 1.0
+
+Package: base-files
+Status: install ok installed
+Architecture: amd64
+Version: 11.1+deb11u7
+`,
+				"var/lib/dpkg/status.d/tzdata":         "Package: tzdata\nVersion: 2021a-1\nArchitecture: all\n",
+				"var/lib/dpkg/status.d/tzdata.md5sums": "d41d8cd98f00b204e9800998ecf8427e  usr/share/zoneinfo/UTC\n",
+				"var/lib/dpkg/status.d/removed":        "Package: removed\nVersion: 1\nArchitecture: all\n",
+			},
+			{
+				// The os-release of /etc wins over that of /usr/lib.
+				"etc/os-release": "ID=alpine\nVERSION_ID=3.18.4\nPRETTY_NAME=\"Alpine Linux v3.18\"\n",
+				// A whiteout removes a package database of the layer
+				// below.
+				"var/lib/dpkg/status.d/.wh.removed": "",
+				"lib/apk/db/installed": `C:Q1abc=
+P:musl
+V:1.2.4-r2
+A:x86_64
+L:MIT
+o:musl
+
+P:busybox-binsh
+V:1.36.1-r5
+A:x86_64
+L:GPL-2.0-only
+o:busybox
+`,
+			},
+		},
+	})
+	defer cleanup()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+
+	release, pkgs, err := c.ImagePackages(ctx, "docker.io/library/sbomtest:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (OSRelease{ID: "alpine", VersionID: "3.18.4", Name: "Alpine Linux v3.18"}); release != expected {
+		t.Fatalf("expected the release %+v, got %+v", expected, release)
+	}
+	expected := []Package{
+		{Type: "apk", Name: "busybox-binsh", Version: "1.36.1-r5", Arch: "x86_64", License: "GPL-2.0-only", Source: "busybox"},
+		{Type: "apk", Name: "musl", Version: "1.2.4-r2", Arch: "x86_64", License: "MIT"},
+		{Type: "deb", Name: "base-files", Version: "11.1+deb11u7", Arch: "amd64"},
+		{Type: "deb", Name: "libc6", Version: "2.31-13+deb11u5", Arch: "amd64", Source: "glibc"},
+		{Type: "deb", Name: "tzdata", Version: "2021a-1", Arch: "all"},
+	}
+	if !reflect.DeepEqual(pkgs, expected) {
+		t.Fatalf("expected the packages %+v, got %+v", expected, pkgs)
+	}
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containerd/containerd/namespaces"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"google.golang.org/grpc"
+)
+
+// ServeHooks are called by Serve around the requests it handles, for example
+// to report builds. Each hook is called when a request starts and returns the
+// function to call with its result.
+type ServeHooks struct {
+	Solve func(req *controlapi.SolveRequest) func(*controlapi.SolveResponse, error)
+	Prune func(req *controlapi.PruneRequest) func(error)
+}
+
+// Serve serves the BuildKit control API on the listener until the context
+// is cancelled, so BuildKit clients such as buildctl can use the controller.
+// hooks may be nil.
+func (c *Client) Serve(ctx context.Context, l net.Listener, hooks *ServeHooks) error {
+	if c.controller == nil {
+		// Create the controller.
+		if err := c.createController(); err != nil {
+			return err
+		}
+	}
+
+	if hooks == nil {
+		hooks = &ServeHooks{}
+	}
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(hooks.unaryInterceptor),
+		grpc.StreamInterceptor(hooks.streamInterceptor),
+	)
+	if err := c.controller.Register(server); err != nil {
+		return fmt.Errorf("registering controller failed: %v", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+
+	if err := server.Serve(l); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("serving control API failed: %v", err)
+	}
+	return nil
+}
+
+// The controller expects the containerd namespace to be set on the context of
+// every request, the same way the commands set it.
+func (h *ServeHooks) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx = namespaces.WithNamespace(ctx, "buildkit")
+	solveReq, ok := req.(*controlapi.SolveRequest)
+	if !ok || h.Solve == nil {
+		return handler(ctx, req)
+	}
+
+	done := h.Solve(solveReq)
+	resp, err := handler(ctx, req)
+	solveResp, _ := resp.(*controlapi.SolveResponse)
+	done(solveResp, err)
+	return resp, err
+}
+
+func (h *ServeHooks) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	nss := &namespacedServerStream{
+		ServerStream: ss,
+		ctx:          namespaces.WithNamespace(ss.Context(), "buildkit"),
+	}
+	if !strings.HasSuffix(info.FullMethod, "/Prune") || h.Prune == nil {
+		return handler(srv, nss)
+	}
+
+	// The request is only known once the handler receives it.
+	nss.onRecv = func(m interface{}) {
+		if req, ok := m.(*controlapi.PruneRequest); ok && nss.done == nil {
+			nss.done = h.Prune(req)
+		}
+	}
+	err := handler(srv, nss)
+	if nss.done != nil {
+		nss.done(err)
+	}
+	return err
+}
+
+type namespacedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+
+	onRecv func(m interface{})
+	done   func(error)
+}
+
+func (s *namespacedServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil && s.onRecv != nil {
+		s.onRecv(m)
+	}
+	return err
+}
+
+func (s *namespacedServerStream) Context() context.Context {
+	return s.ctx
+}
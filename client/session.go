@@ -8,9 +8,12 @@ import (
 	"github.com/moby/buildkit/session/filesync"
 	"github.com/moby/buildkit/session/testutil"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
 )
 
 func (c *Client) getSessionManager() (*session.Manager, error) {
+	c.smu.Lock()
+	defer c.smu.Unlock()
 	if c.sessionManager == nil {
 		var err error
 		c.sessionManager, err = session.NewManager()
@@ -24,6 +27,12 @@ func (c *Client) getSessionManager() (*session.Manager, error) {
 // Session creates the session manager and returns the session and it's
 // dialer.
 func (c *Client) Session(ctx context.Context) (*session.Session, session.Dialer, error) {
+	return c.SessionWithLocalDirs(ctx, c.localDirs)
+}
+
+// SessionWithLocalDirs returns a session and it's dialer that syncs the
+// given local dirs instead of the ones the client was created with.
+func (c *Client) SessionWithLocalDirs(ctx context.Context, localDirs map[string]string) (*session.Session, session.Dialer, error) {
 	m, err := c.getSessionManager()
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "failed to create session manager")
@@ -33,8 +42,8 @@ func (c *Client) Session(ctx context.Context) (*session.Session, session.Dialer,
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "failed to create session")
 	}
-	syncedDirs := make([]filesync.SyncedDir, 0, len(c.localDirs))
-	for name, d := range c.localDirs {
+	syncedDirs := make([]filesync.SyncedDir, 0, len(localDirs))
+	for name, d := range localDirs {
 		syncedDirs = append(syncedDirs, filesync.SyncedDir{Name: name, Dir: d})
 	}
 	s.Allow(filesync.NewFSSyncProvider(syncedDirs))
@@ -42,6 +51,28 @@ func (c *Client) Session(ctx context.Context) (*session.Session, session.Dialer,
 	return s, sessionDialer(s, m), err
 }
 
+// WithSession runs fn with a session syncing the given local dirs and
+// providing the registry credentials of the user. The context passed to fn
+// holds the session, its ID is passed to reference the session in solve
+// requests.
+func (c *Client) WithSession(ctx context.Context, localDirs map[string]string, fn func(ctx context.Context, sessionID string) error) error {
+	sess, sessDialer, err := c.SessionWithLocalDirs(ctx, localDirs)
+	if err != nil {
+		return err
+	}
+	ctx = session.NewContext(ctx, sess.ID())
+	eg, ctx := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		return sess.Run(ctx, sessDialer)
+	})
+	eg.Go(func() error {
+		defer sess.Close()
+		return fn(ctx, sess.ID())
+	})
+	return eg.Wait()
+}
+
 func sessionDialer(s *session.Session, m *session.Manager) session.Dialer {
 	// FIXME: rename testutil
 	return session.Dialer(testutil.TestStream(testutil.Handler(m.HandleConn)))
@@ -11,15 +11,17 @@ import (
 )
 
 // Solve calls Solve on the controller.
-func (c *Client) Solve(ctx context.Context, req *controlapi.SolveRequest, ch chan *controlapi.StatusResponse) error {
+func (c *Client) Solve(ctx context.Context, req *controlapi.SolveRequest, ch chan *controlapi.StatusResponse) (*controlapi.SolveResponse, error) {
 	defer close(ch)
 	if c.controller == nil {
 		// Create the controller.
 		if err := c.createController(); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
+	var resp *controlapi.SolveResponse
+
 	statusCtx, cancelStatus := context.WithCancel(context.Background())
 	eg, ctx := errgroup.WithContext(ctx)
 	eg.Go(func() error {
@@ -29,7 +31,8 @@ func (c *Client) Solve(ctx context.Context, req *controlapi.SolveRequest, ch cha
 				cancelStatus()
 			}()
 		}()
-		_, err := c.controller.Solve(ctx, req)
+		var err error
+		resp, err = c.controller.Solve(ctx, req)
 		if err != nil {
 			return errors.Wrap(err, "failed to solve")
 		}
@@ -45,7 +48,10 @@ func (c *Client) Solve(ctx context.Context, req *controlapi.SolveRequest, ch cha
 			Ref: req.Ref,
 		}, srv)
 	})
-	return eg.Wait()
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return resp, nil
 }
 
 type controlStatusServer struct {
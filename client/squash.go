@@ -0,0 +1,186 @@
+package client
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// SquashImage rewrites an image with the files of all its layers merged
+// into a single layer, the files removed by a layer are left out. The
+// history entries are kept as empty layers, followed by an entry for the
+// squashed layer. Only the image for the default platform is rewritten.
+func (c *Client) SquashImage(ctx context.Context, image string) (images.Image, error) {
+	opt, err := c.createWorkerOpt()
+	if err != nil {
+		return images.Image{}, fmt.Errorf("creating worker opt failed: %v", err)
+	}
+	cs := opt.ContentStore
+
+	img, err := getImage(ctx, opt.ImageStore, image)
+	if err != nil {
+		return images.Image{}, err
+	}
+	manifest, config, _, err := readImage(ctx, cs, img.Target)
+	if err != nil {
+		return images.Image{}, fmt.Errorf("reading image %s failed: %v", img.Name, err)
+	}
+	if len(manifest.Layers) < 2 {
+		return img, nil
+	}
+
+	layer, diffID, err := squashLayers(ctx, cs, manifest.Layers)
+	if err != nil {
+		return images.Image{}, fmt.Errorf("squashing the layers of %s failed: %v", img.Name, err)
+	}
+	var (
+		layers  []ocispec.Descriptor
+		diffIDs []digest.Digest
+	)
+	// Layers removing all the files they add squash to nothing.
+	if diffID != "" {
+		layers, diffIDs = []ocispec.Descriptor{layer}, []digest.Digest{diffID}
+	}
+
+	for i := range config.history {
+		config.history[i].EmptyLayer = true
+	}
+	config.history = append(config.history, ocispec.History{
+		Created:    config.created(),
+		CreatedBy:  "img build -squash",
+		Comment:    fmt.Sprintf("squashed %d layers", len(manifest.Layers)),
+		EmptyLayer: len(layers) == 0,
+	})
+	if manifest.Config, err = config.write(ctx, cs, diffIDs, nil, len(layers)); err != nil {
+		return images.Image{}, err
+	}
+	manifest.Layers = layers
+	if img.Target, err = writeManifest(ctx, cs, manifest); err != nil {
+		return images.Image{}, err
+	}
+	img.CreatedAt = time.Now()
+	if err := putImage(ctx, opt.ImageStore, img); err != nil {
+		return images.Image{}, err
+	}
+	return img, nil
+}
+
+// squashLayers writes a layer with the files the layers create when they are
+// applied in order.
+func squashLayers(ctx context.Context, cs content.Store, layers []ocispec.Descriptor) (ocispec.Descriptor, digest.Digest, error) {
+	return writeLayer(ctx, cs, layers[len(layers)-1].MediaType, func(tw *tar.Writer) (int, error) {
+		return flattenLayers(ctx, cs, layers, tw, nil)
+	})
+}
+
+// flattenLayers writes the files the layers create when they are applied in
+// order to tw, and returns the number of entries written. The layers are read
+// twice: first to find the layer each remaining file comes from, then to copy
+// the files from it. The directories are written first, so they exist before
+// the files of lower layers in them. The headers are changed by fix unless it
+// is nil.
+func flattenLayers(ctx context.Context, cs content.Store, layers []ocispec.Descriptor, tw *tar.Writer, fix func(*tar.Header) error) (int, error) {
+	writeHeader := func(hdr *tar.Header) error {
+		if fix != nil {
+			if err := fix(hdr); err != nil {
+				return err
+			}
+		}
+		return tw.WriteHeader(hdr)
+	}
+
+	var (
+		// from is the index of the layer each file comes from.
+		from = map[string]int{}
+		dirs = map[string]*tar.Header{}
+	)
+	remove := func(name string, self bool) {
+		for f := range from {
+			if (self && f == name) || strings.HasPrefix(f, name+"/") {
+				delete(from, f)
+				delete(dirs, f)
+			}
+		}
+	}
+	for i, l := range layers {
+		// The whiteouts of a layer only remove the files of the layers
+		// below, whatever their order in the tarball.
+		var (
+			whiteouts []string
+			opaques   []string
+			headers   []*tar.Header
+		)
+		if err := walkLayer(ctx, cs, l, func(hdr *tar.Header, _ io.Reader) error {
+			name := path.Clean(hdr.Name)
+			switch base := path.Base(name); {
+			case base == ".wh..wh..opq":
+				opaques = append(opaques, path.Dir(name))
+			case strings.HasPrefix(base, ".wh."):
+				whiteouts = append(whiteouts, path.Join(path.Dir(name), strings.TrimPrefix(base, ".wh.")))
+			default:
+				headers = append(headers, hdr)
+			}
+			return nil
+		}); err != nil {
+			return 0, fmt.Errorf("reading layer %s failed: %v", l.Digest, err)
+		}
+		for _, name := range whiteouts {
+			remove(name, true)
+		}
+		for _, name := range opaques {
+			remove(name, false)
+		}
+		for _, hdr := range headers {
+			name := path.Clean(hdr.Name)
+			if hdr.Typeflag == tar.TypeDir {
+				dirs[name] = hdr
+			} else if _, ok := dirs[name]; ok {
+				// A file replaces a directory with everything in it.
+				remove(name, false)
+				delete(dirs, name)
+			}
+			from[name] = i
+		}
+	}
+
+	names := make([]string, 0, len(dirs))
+	for name := range dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := 0
+	for _, name := range names {
+		if err := writeHeader(dirs[name]); err != nil {
+			return entries, err
+		}
+		entries++
+	}
+	for i, l := range layers {
+		if err := walkLayer(ctx, cs, l, func(hdr *tar.Header, r io.Reader) error {
+			name := path.Clean(hdr.Name)
+			if j, ok := from[name]; !ok || j != i || hdr.Typeflag == tar.TypeDir {
+				return nil
+			}
+			entries++
+			if err := writeHeader(hdr); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, r)
+			return err
+		}); err != nil {
+			return entries, fmt.Errorf("reading layer %s failed: %v", l.Digest, err)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestSquashImage(t *testing.T) {
+	created := time.Unix(100, 0).UTC()
+	c, cleanup := testWorkerClient(t, testImage{
+		name: "docker.io/library/squashtest:latest",
+		config: ocispec.Image{
+			Created:      &created,
+			OS:           "linux",
+			Architecture: runtime.GOARCH,
+			History: []ocispec.History{
+				{Created: &created, CreatedBy: "COPY etc /etc"},
+				{Created: &created, CreatedBy: "RUN rm /etc/a"},
+				{Created: &created, CreatedBy: "ENV A=b", EmptyLayer: true},
+				{Created: &created, CreatedBy: "COPY bin /bin"},
+			},
+		},
+		layers: []map[string]string{
+			{"etc/": "", "etc/a": "a", "etc/b": "b"},
+			// A whiteout removes a file of the layer below.
+			{"etc/.wh.a": "", "etc/c": "c"},
+			{"bin/": "", "bin/sh": "sh", "etc/b": "b2"},
+		},
+	})
+	defer cleanup()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+	cs := c.workerOpt.ContentStore
+
+	img, err := c.SquashImage(ctx, "docker.io/library/squashtest:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, config, diffIDs, err := readImage(ctx, cs, img.Target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 1 || len(diffIDs) != 1 {
+		t.Fatalf("expected a single layer, got %d with %d diff IDs", len(manifest.Layers), len(diffIDs))
+	}
+
+	// The layer has the files left once the layers are applied, and its
+	// diff ID is the digest of its tarball.
+	layer := manifest.Layers[0]
+	files := map[string]string{}
+	if err := walkLayer(ctx, cs, layer, func(hdr *tar.Header, r io.Reader) error {
+		dt, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		files[strings.TrimSuffix(hdr.Name, "/")] = string(dt)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"bin": "", "bin/sh": "sh", "etc": "", "etc/b": "b2", "etc/c": "c"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("expected the files %v in the squashed layer, got %v", expected, files)
+	}
+	ra, err := cs.ReaderAt(ctx, layer.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ra.Close()
+	ds, err := decompressLayer(ctx, content.NewReader(ra), CompressionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	diffID, err := digest.SHA256.FromReader(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffIDs[0] != diffID {
+		t.Fatalf("expected the diff ID %s of the squashed layer, got %s", diffID, diffIDs[0])
+	}
+
+	// The history entries are kept as empty layers, followed by the entry
+	// of the squashed layer.
+	if len(config.history) != 5 {
+		t.Fatalf("expected 5 history entries, got %d", len(config.history))
+	}
+	for _, h := range config.history[:4] {
+		if !h.EmptyLayer {
+			t.Fatalf("expected the history entry %q to be an empty layer", h.CreatedBy)
+		}
+	}
+	if h := config.history[4]; h.EmptyLayer || h.CreatedBy != "img build -squash" || h.Comment != "squashed 3 layers" {
+		t.Fatalf("expected the last history entry to create the squashed layer, got %+v", h)
+	}
+}
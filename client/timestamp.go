@@ -0,0 +1,104 @@
+package client
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ClampImageTimestamps rewrites an image so no time in it is later than
+// epoch, for builds to produce the same image from the same inputs. The
+// modification, access and change times of the files in its layers are
+// clamped, and the image and its history are created at epoch. Layers
+// without later times, like those of most base images, are kept as they
+// are. Only the image for the default platform is rewritten.
+func (c *Client) ClampImageTimestamps(ctx context.Context, image string, epoch time.Time) (images.Image, error) {
+	opt, err := c.createWorkerOpt()
+	if err != nil {
+		return images.Image{}, fmt.Errorf("creating worker opt failed: %v", err)
+	}
+	cs := opt.ContentStore
+
+	img, err := getImage(ctx, opt.ImageStore, image)
+	if err != nil {
+		return images.Image{}, err
+	}
+	manifest, config, diffIDs, err := readImage(ctx, cs, img.Target)
+	if err != nil {
+		return images.Image{}, fmt.Errorf("reading image %s failed: %v", img.Name, err)
+	}
+
+	epoch = epoch.UTC()
+	clamp := func(t *time.Time) bool {
+		if t.After(epoch) {
+			*t = epoch
+			return true
+		}
+		return false
+	}
+
+	var (
+		layers []ocispec.Descriptor
+		ids    []digest.Digest
+	)
+	for i, l := range manifest.Layers {
+		later := false
+		if err := walkLayer(ctx, cs, l, func(hdr *tar.Header, _ io.Reader) error {
+			later = later || hdr.ModTime.After(epoch) || hdr.AccessTime.After(epoch) || hdr.ChangeTime.After(epoch)
+			return nil
+		}); err != nil {
+			return images.Image{}, fmt.Errorf("reading layer %s failed: %v", l.Digest, err)
+		}
+		if !later {
+			layers = append(layers, l)
+			ids = append(ids, diffIDs[i])
+			continue
+		}
+
+		nl, id, err := rewriteLayer(ctx, cs, l, func(hdr *tar.Header) bool {
+			clamp(&hdr.ModTime)
+			clamp(&hdr.AccessTime)
+			clamp(&hdr.ChangeTime)
+			// Only keep the clamped times of the header fields.
+			for _, k := range []string{"mtime", "atime", "ctime"} {
+				delete(hdr.PAXRecords, k)
+			}
+			return true
+		})
+		if err != nil {
+			return images.Image{}, fmt.Errorf("rewriting layer %s failed: %v", l.Digest, err)
+		}
+		layers = append(layers, nl)
+		ids = append(ids, id)
+	}
+
+	created, err := json.Marshal(epoch)
+	if err != nil {
+		return images.Image{}, err
+	}
+	config.fields["created"] = created
+	for i := range config.history {
+		if config.history[i].Created != nil {
+			clamp(config.history[i].Created)
+		}
+	}
+	if manifest.Config, err = config.write(ctx, cs, ids, nil, len(layers)); err != nil {
+		return images.Image{}, err
+	}
+	manifest.Layers = layers
+	if img.Target, err = writeManifest(ctx, cs, manifest); err != nil {
+		return images.Image{}, err
+	}
+	img.CreatedAt = time.Now()
+	if err := putImage(ctx, opt.ImageStore, img); err != nil {
+		return images.Image{}, err
+	}
+	return img, nil
+}
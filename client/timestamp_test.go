@@ -0,0 +1,112 @@
+package client
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestClampImageTimestamps(t *testing.T) {
+	// The same build run twice, at different times.
+	build := func(name string, at time.Time) testImage {
+		return testImage{
+			name: name,
+			config: ocispec.Image{
+				Created:      &at,
+				OS:           "linux",
+				Architecture: runtime.GOARCH,
+				History: []ocispec.History{
+					{Created: &at, CreatedBy: "COPY etc /etc"},
+					{Created: &at, CreatedBy: "COPY app /app"},
+				},
+			},
+			layers: []map[string]string{
+				{"etc/": "", "etc/os-release": "ID=test\n"},
+				{"app": "app"},
+			},
+			modTime: at,
+		}
+	}
+	first, second := time.Unix(2000, 0).UTC(), time.Unix(3000, 0).UTC()
+	c, cleanup := testWorkerClient(t,
+		build("docker.io/library/first:latest", first),
+		build("docker.io/library/second:latest", second),
+	)
+	defer cleanup()
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+	cs := c.workerOpt.ContentStore
+
+	epoch := time.Unix(1000, 0).UTC()
+	img1, err := c.ClampImageTimestamps(ctx, "docker.io/library/first:latest", epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img2, err := c.ClampImageTimestamps(ctx, "docker.io/library/second:latest", epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img1.Target.Digest != img2.Target.Digest {
+		t.Fatalf("expected both builds to have the same manifest, got %s and %s", img1.Target.Digest, img2.Target.Digest)
+	}
+
+	manifest1, config, diffIDs, err := readImage(ctx, cs, img1.Target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest2, _, _, err := readImage(ctx, cs, img2.Target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest1.Layers) != 2 || len(diffIDs) != 2 {
+		t.Fatalf("expected 2 layers, got %d with %d diff IDs", len(manifest1.Layers), len(diffIDs))
+	}
+	for i, l := range manifest1.Layers {
+		if l.Digest != manifest2.Layers[i].Digest {
+			t.Fatalf("expected the layer %d of both builds to be the same, got %s and %s", i, l.Digest, manifest2.Layers[i].Digest)
+		}
+		// The files are clamped to the epoch.
+		if err := walkLayer(ctx, cs, l, func(hdr *tar.Header, _ io.Reader) error {
+			if !hdr.ModTime.Equal(epoch) {
+				t.Fatalf("expected %s to be modified at %s, got %s", hdr.Name, epoch, hdr.ModTime)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(config.fields["created"]) != `"1970-01-01T00:16:40Z"` {
+		t.Fatalf("expected the image to be created at %s, got %s", epoch, config.fields["created"])
+	}
+	for _, h := range config.history {
+		if !h.Created.Equal(epoch) {
+			t.Fatalf("expected the history of %q to be created at %s, got %s", h.CreatedBy, epoch, h.Created)
+		}
+	}
+
+	// The layers without later times are kept as they are.
+	later := time.Unix(5000, 0)
+	img, err := c.ClampImageTimestamps(ctx, "docker.io/library/first:latest", later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, _, _, err := readImage(ctx, cs, img.Target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var layers []digest.Digest
+	for i, l := range manifest.Layers {
+		if l.Digest != manifest1.Layers[i].Digest {
+			layers = append(layers, l.Digest)
+		}
+	}
+	if len(layers) != 0 {
+		t.Fatalf("expected the clamped layers to be kept, got the new layers %v", layers)
+	}
+}
@@ -0,0 +1,213 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/diff/apply"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/mount"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// unpackJobs is how many layers of a pulled image are decompressed
+// concurrently.
+var unpackJobs = runtime.NumCPU()
+
+// SetUnpackJobs sets how many layers of a pulled image are decompressed
+// concurrently, 1 decompresses every layer as it is applied. It must be
+// called before the client is used.
+func SetUnpackJobs(n int) {
+	if n < 1 {
+		n = 1
+	}
+	unpackJobs = n
+}
+
+// parallelApplier applies the layers of pulled images in order, like the
+// applier it wraps, but decompresses the layers after the one being applied
+// in the background. The layers have to be applied one on top of the other,
+// decompressing them is what can be done concurrently.
+type parallelApplier struct {
+	diff.Applier
+	store content.Store
+	dir   string
+	sem   chan struct{}
+
+	mu     sync.Mutex
+	layers map[digest.Digest]*decompressedLayer
+}
+
+// decompressedLayer is a layer decompressed to a file, done is closed once
+// the file is written.
+type decompressedLayer struct {
+	path string
+	done chan struct{}
+	err  error
+}
+
+// newParallelApplier returns an applier decompressing layers into dir,
+// removing the files an earlier process left behind.
+func newParallelApplier(store content.Store, applier diff.Applier, dir string, jobs int) (diff.Applier, error) {
+	if jobs < 2 {
+		return applier, nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &parallelApplier{
+		Applier: applier,
+		store:   store,
+		dir:     dir,
+		sem:     make(chan struct{}, jobs),
+		layers:  map[digest.Digest]*decompressedLayer{},
+	}, nil
+}
+
+func (a *parallelApplier) Apply(ctx context.Context, desc ocispec.Descriptor, mounts []mount.Mount) (ocispec.Descriptor, error) {
+	if compressed, err := images.IsCompressedDiff(ctx, desc.MediaType); err != nil || !compressed {
+		return a.Applier.Apply(ctx, desc, mounts)
+	}
+
+	a.prefetch(ctx, desc)
+
+	a.mu.Lock()
+	l, ok := a.layers[desc.Digest]
+	delete(a.layers, desc.Digest)
+	a.mu.Unlock()
+	if !ok {
+		return a.Applier.Apply(ctx, desc, mounts)
+	}
+	defer os.Remove(l.path)
+
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		return ocispec.Descriptor{}, ctx.Err()
+	}
+	if l.err != nil {
+		logrus.WithError(l.err).WithField("digest", desc.Digest).Debug("decompressing layer in the background failed")
+		return a.Applier.Apply(ctx, desc, mounts)
+	}
+
+	// Apply the decompressed layer, reading it from the file instead of the
+	// content store.
+	uncompressed := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: desc.Digest}
+	return apply.NewFileSystemApplier(fileProvider(l.path)).Apply(ctx, uncompressed, mounts)
+}
+
+// prefetch starts decompressing the layers the image of the layer being
+// applied has after it. The manifests of a pulled image are found through
+// the garbage collection labels the puller sets on its layers.
+func (a *parallelApplier) prefetch(ctx context.Context, desc ocispec.Descriptor) {
+	info, err := a.store.Info(ctx, desc.Digest)
+	if err != nil {
+		return
+	}
+	for _, v := range info.Labels {
+		dgst, err := digest.Parse(v)
+		if err != nil {
+			continue
+		}
+		b, err := content.ReadBlob(ctx, a.store, dgst)
+		if err != nil {
+			continue
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(b, &manifest); err != nil || len(manifest.Layers) == 0 {
+			continue
+		}
+		after := false
+		for _, l := range manifest.Layers {
+			if after {
+				a.decompress(l)
+			}
+			after = after || l.Digest == desc.Digest
+		}
+	}
+}
+
+// decompress starts decompressing a layer to a file unless it already is.
+func (a *parallelApplier) decompress(desc ocispec.Descriptor) {
+	if compressed, err := images.IsCompressedDiff(context.TODO(), desc.MediaType); err != nil || !compressed {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.layers[desc.Digest]; ok {
+		return
+	}
+	l := &decompressedLayer{
+		path: filepath.Join(a.dir, desc.Digest.Hex()),
+		done: make(chan struct{}),
+	}
+	a.layers[desc.Digest] = l
+
+	go func() {
+		defer close(l.done)
+		a.sem <- struct{}{}
+		defer func() { <-a.sem }()
+		l.err = a.decompressTo(desc, l.path)
+	}()
+}
+
+func (a *parallelApplier) decompressTo(desc ocispec.Descriptor, path string) error {
+	ra, err := a.store.ReaderAt(context.TODO(), desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+
+	ds, err := compression.DecompressStream(content.NewReader(ra))
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, ds); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// fileProvider provides the content of a file for any digest.
+type fileProvider string
+
+func (p fileProvider) ReaderAt(ctx context.Context, dgst digest.Digest) (content.ReaderAt, error) {
+	f, err := os.Open(string(p))
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileReaderAt{File: f, size: fi.Size()}, nil
+}
+
+type fileReaderAt struct {
+	*os.File
+	size int64
+}
+
+func (r *fileReaderAt) Size() int64 { return r.size }
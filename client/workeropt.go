@@ -9,14 +9,13 @@ import (
 	"github.com/boltdb/bolt"
 	"github.com/containerd/containerd/content/local"
 	"github.com/containerd/containerd/diff/apply"
-	"github.com/containerd/containerd/diff/walking"
 	ctdmetadata "github.com/containerd/containerd/metadata"
 	ctdsnapshot "github.com/containerd/containerd/snapshots"
-	"github.com/containerd/containerd/snapshots/native"
 	"github.com/containerd/containerd/snapshots/overlay"
+	"github.com/genuinetools/img/internal/metrics"
+	"github.com/genuinetools/img/internal/native"
 	"github.com/genuinetools/img/types"
 	"github.com/moby/buildkit/cache/metadata"
-	"github.com/moby/buildkit/executor/runcexecutor"
 	containerdsnapshot "github.com/moby/buildkit/snapshot/containerd"
 	"github.com/moby/buildkit/util/throttle"
 	"github.com/moby/buildkit/worker/base"
@@ -24,8 +23,30 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// createWorkerOpt creates a base.WorkerOpt to be used for a new worker.
-func (c *Client) createWorkerOpt() (opt base.WorkerOpt, err error) {
+// createWorkerOpt returns the base.WorkerOpt for the client, creating it on
+// first use. The stores it holds lock their databases, so they are shared by
+// everything the client does.
+func (c *Client) createWorkerOpt() (base.WorkerOpt, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.workerOpt != nil {
+		return *c.workerOpt, nil
+	}
+
+	if err := c.lockState(context.TODO()); err != nil {
+		return base.WorkerOpt{}, err
+	}
+
+	opt, err := c.newWorkerOpt()
+	if err != nil {
+		return opt, err
+	}
+	c.workerOpt = &opt
+	return opt, nil
+}
+
+// newWorkerOpt creates a base.WorkerOpt to be used for a new worker.
+func (c *Client) newWorkerOpt() (opt base.WorkerOpt, err error) {
 	sm, err := c.getSessionManager()
 	if err != nil {
 		return opt, err
@@ -57,11 +78,7 @@ func (c *Client) createWorkerOpt() (opt base.WorkerOpt, err error) {
 		return opt, fmt.Errorf("creating %s snapshotter failed: %v", c.backend, err)
 	}
 
-	exeOpt := runcexecutor.Opt{
-		Root:     filepath.Join(c.root, "executor"),
-		Rootless: unprivileged,
-	}
-	exe, err := runcexecutor.New(exeOpt)
+	exe, err := newRuncExecutor(filepath.Join(c.root, "executor"), unprivileged, c.execOpt)
 	if err != nil {
 		return opt, err
 	}
@@ -89,10 +106,16 @@ func (c *Client) createWorkerOpt() (opt base.WorkerOpt, err error) {
 	// Create the image store.
 	imageStore := ctdmetadata.NewImageStore(mdb)
 
-	// Create the garbage collector.
+	// Create the garbage collector. Removals schedule a throttled collection,
+	// prune collects right away so the space is freed before img exits.
+	c.collectGarbage = func(ctx context.Context) error {
+		_, err := mdb.GarbageCollect(ctx)
+		metrics.GCRunsTotal.WithLabelValues(metrics.Result(err)).Inc()
+		return err
+	}
 	throttledGC := throttle.Throttle(time.Second, func() {
-		if _, err := mdb.GarbageCollect(context.TODO()); err != nil {
-			logrus.Errorf("GC error: %+v", err)
+		if err := c.collectGarbage(context.TODO()); err != nil {
+			logrus.WithError(err).Error("garbage collection failed")
 		}
 	})
 
@@ -108,6 +131,11 @@ func (c *Client) createWorkerOpt() (opt base.WorkerOpt, err error) {
 		return opt, err
 	}
 
+	applier, err := newParallelApplier(contentStore, apply.NewFileSystemApplier(contentStore), filepath.Join(c.root, "unpack"), unpackJobs)
+	if err != nil {
+		return opt, err
+	}
+
 	xlabels := base.Labels("oci", c.backend)
 
 	opt = base.WorkerOpt{
@@ -118,8 +146,8 @@ func (c *Client) createWorkerOpt() (opt base.WorkerOpt, err error) {
 		Executor:       exe,
 		Snapshotter:    containerdsnapshot.NewSnapshotter(mdb.Snapshotter(c.backend), contentStore, md, "buildkit", gc),
 		ContentStore:   contentStore,
-		Applier:        apply.NewFileSystemApplier(contentStore),
-		Differ:         walking.NewWalkingDiff(contentStore),
+		Applier:        applier,
+		Differ:         newCachingDiff(uploadingStore{contentStore}),
 		ImageStore:     imageStore,
 	}
 
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/genuinetools/img/client"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/util/appcontext"
+)
+
+const cloneShortHelp = `Create TARGET_IMAGE sharing the layers of SOURCE_IMAGE, with changes to its config.`
+
+const cloneLongHelp = `Create TARGET_IMAGE sharing the layers of SOURCE_IMAGE, with changes to its config.
+
+Only a new config and manifest are written, so variants of an image, such as
+one per environment, can be derived from a single build in milliseconds.
+Without changes the clone is the same as a tag.`
+
+func (cmd *cloneCommand) Name() string       { return "clone" }
+func (cmd *cloneCommand) Args() string       { return "[OPTIONS] SOURCE_IMAGE[:TAG] TARGET_IMAGE[:TAG]" }
+func (cmd *cloneCommand) ShortHelp() string  { return cloneShortHelp }
+func (cmd *cloneCommand) LongHelp() string   { return cloneLongHelp }
+func (cmd *cloneCommand) Hidden() bool       { return false }
+func (cmd *cloneCommand) DoReexec() bool     { return true }
+func (cmd *cloneCommand) RequiresRunc() bool { return false }
+
+func (cmd *cloneCommand) Register(fs *flag.FlagSet) {
+	fs.Var(&cmd.labels, "label", "Set a label on the image as KEY=VALUE, can be repeated")
+	fs.Var(&cmd.env, "env", "Set an environment variable of the image as KEY=VALUE, can be repeated")
+	fs.StringVar(&cmd.user, "user", "", "Set the user the image runs as")
+	fs.StringVar(&cmd.workdir, "workdir", "", "Set the working directory of the image")
+}
+
+type cloneCommand struct {
+	labels  stringSlice
+	env     stringSlice
+	user    string
+	workdir string
+}
+
+func (cmd *cloneCommand) Run(args []string) (err error) {
+	if len(args) < 2 {
+		return errors.New("must pass an image to clone and a target")
+	}
+
+	opt := client.CloneOpt{
+		Labels:     map[string]string{},
+		User:       cmd.user,
+		WorkingDir: cmd.workdir,
+	}
+	for _, l := range cmd.labels {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid label value %s", l)
+		}
+		opt.Labels[kv[0]] = kv[1]
+	}
+	for _, e := range cmd.env {
+		if !strings.Contains(e, "=") {
+			return fmt.Errorf("invalid env value %s", e)
+		}
+		opt.Env = append(opt.Env, e)
+	}
+
+	// Create the context.
+	ctx := appcontext.Context()
+	id := identity.NewID()
+	ctx = session.NewContext(ctx, id)
+	ctx = namespaces.WithNamespace(ctx, "buildkit")
+
+	// Create the client.
+	c, err := client.New(stateDir, backend, stateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	img, err := c.CloneImage(ctx, args[0], args[1], opt)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully cloned %s as %s (%s)\n", args[0], img.Name, img.Target.Digest)
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCloneErrors(t *testing.T) {
+	tests := []struct {
+		cmd  *cloneCommand
+		args []string
+		err  string
+	}{
+		{cmd: &cloneCommand{}, args: []string{"busybox"}, err: "must pass an image to clone and a target"},
+		{cmd: &cloneCommand{labels: stringSlice{"team"}}, args: []string{"busybox", "clonetest"}, err: "invalid label value team"},
+		{cmd: &cloneCommand{env: stringSlice{"MODE"}}, args: []string{"busybox", "clonetest"}, err: "invalid env value MODE"},
+	}
+	for _, tt := range tests {
+		if err := tt.cmd.Run(tt.args); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("expected %q, got: %v", tt.err, err)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+const completionShortHelp = `Output shell completion code for the specified shell.`
+
+var completionLongHelp = completionShortHelp + fmt.Sprintf(`
+Supported shells are: %s.
+
+To load completions in the current bash shell:
+
+  $ source <(img completion bash)
+
+For zsh and fish the output can be written to a file in the completion path:
+
+  $ img completion zsh > "${fpath[1]}/_img"
+  $ img completion fish > ~/.config/fish/completions/img.fish
+
+For powershell add the output to your profile:
+
+  PS> img completion powershell >> $PROFILE`, strings.Join(validShells, ", "))
+
+var validShells = []string{"bash", "zsh", "fish", "powershell"}
+
+func (cmd *completionCommand) Name() string       { return "completion" }
+func (cmd *completionCommand) Args() string       { return "SHELL" }
+func (cmd *completionCommand) ShortHelp() string  { return completionShortHelp }
+func (cmd *completionCommand) LongHelp() string   { return completionLongHelp }
+func (cmd *completionCommand) Hidden() bool       { return false }
+func (cmd *completionCommand) DoReexec() bool     { return false }
+func (cmd *completionCommand) RequiresRunc() bool { return false }
+
+func (cmd *completionCommand) Register(fs *flag.FlagSet) {}
+
+type completionCommand struct{}
+
+// completionArgs defines what a command completes its positional arguments
+// with.
+type completionArgs string
+
+const (
+	completeFiles  completionArgs = "files"
+	completeImages completionArgs = "images"
+	completeShells completionArgs = "shells"
+	completeNone   completionArgs = "none"
+)
+
+// completionData is the information passed to the completion templates.
+type completionData struct {
+	Commands      []completionEntry
+	ImageCommands []string
+	Shells        []string
+}
+
+// completionEntry holds the completion information for a single command.
+type completionEntry struct {
+	Name        string
+	Description string
+	Flags       []completionFlag
+	Args        completionArgs
+}
+
+// completionFlag holds the completion information for a single flag.
+type completionFlag struct {
+	Name  string
+	Usage string
+}
+
+func (cmd *completionCommand) Run(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("must pass a shell to generate completion for (%s)", strings.Join(validShells, ", "))
+	}
+
+	var tmpl string
+	switch args[0] {
+	case "bash":
+		tmpl = bashCompletionTemplate
+	case "zsh":
+		tmpl = zshCompletionTemplate
+	case "fish":
+		tmpl = fishCompletionTemplate
+	case "powershell":
+		tmpl = powershellCompletionTemplate
+	default:
+		return fmt.Errorf("%s is not a supported shell (%s)", args[0], strings.Join(validShells, ", "))
+	}
+
+	t, err := template.New(args[0]).Funcs(template.FuncMap{
+		"join":  strings.Join,
+		"quote": shellQuote,
+		"zsh":   zshEscape,
+	}).Parse(tmpl)
+	if err != nil {
+		return fmt.Errorf("parsing %s completion template failed: %v", args[0], err)
+	}
+
+	data := completionData{
+		Commands: completionEntries(),
+		Shells:   validShells,
+	}
+	for _, entry := range data.Commands {
+		if entry.Args == completeImages {
+			data.ImageCommands = append(data.ImageCommands, entry.Name)
+		}
+	}
+
+	return t.Execute(os.Stdout, data)
+}
+
+// completionEntries generates the completion information from the command
+// definitions.
+func completionEntries() []completionEntry {
+	entries := []completionEntry{}
+	for _, c := range commands {
+		if c.Hidden() {
+			continue
+		}
+
+		entry := completionEntry{
+			Name:        c.Name(),
+			Description: c.ShortHelp(),
+			Args:        argsCompletion(c),
+		}
+
+		// Build the same flag set the command would be run with so global
+		// flags are included.
+		fs := newFlagSet(c)
+		fs.VisitAll(func(f *flag.Flag) {
+			entry.Flags = append(entry.Flags, completionFlag{Name: f.Name, Usage: f.Usage})
+		})
+
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	return entries
+}
+
+// argsCompletion determines what the positional arguments of a command should
+// be completed with from its usage string.
+func argsCompletion(c command) completionArgs {
+	args := c.Args()
+	switch {
+	case c.Name() == "completion":
+		return completeShells
+	case strings.Contains(args, "IMAGE"), strings.HasSuffix(args, "NAME[:TAG]"):
+		return completeImages
+	case strings.Contains(args, "PATH"):
+		return completeFiles
+	}
+	return completeNone
+}
+
+// shellQuote quotes a string with single quotes for use in a shell script.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// zshEscape escapes the characters that have meaning in zsh completion
+// descriptions.
+func zshEscape(s string) string {
+	return strings.Replace(strings.Replace(s, "'", `'\''`, -1), ":", `\:`, -1)
+}
+
+const bashCompletionTemplate = `# bash completion for img
+
+__img_images() {
+	img ls 2>/dev/null | awk 'NR>1 {print $1}'
+}
+
+_img() {
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+
+	if [ "$COMP_CWORD" -eq 1 ]; then
+		COMPREPLY=( $(compgen -W "{{range .Commands}}{{.Name}} {{end}}" -- "$cur") )
+		return
+	fi
+
+	case "${COMP_WORDS[1]}" in
+{{- range .Commands}}
+	{{.Name}})
+		if [[ "$cur" == -* ]]; then
+			COMPREPLY=( $(compgen -W "{{range .Flags}}-{{.Name}} {{end}}" -- "$cur") )
+			return
+		fi
+{{- if eq .Args "images"}}
+		COMPREPLY=( $(compgen -W "$(__img_images)" -- "$cur") )
+{{- else if eq .Args "shells"}}
+		COMPREPLY=( $(compgen -W "{{join $.Shells " "}}" -- "$cur") )
+{{- else if eq .Args "files"}}
+		COMPREPLY=( $(compgen -f -- "$cur") )
+{{- end}}
+		;;
+{{- end}}
+	esac
+}
+
+complete -F _img img
+`
+
+const zshCompletionTemplate = `#compdef img
+
+__img_images() {
+	img ls 2>/dev/null | awk 'NR>1 {print $1}'
+}
+
+_img() {
+	local -a commands
+	commands=(
+{{- range .Commands}}
+		'{{zsh .Name}}:{{zsh .Description}}'
+{{- end}}
+	)
+
+	if (( CURRENT == 2 )); then
+		_describe -t commands 'img command' commands
+		return
+	fi
+
+	case "${words[2]}" in
+{{- range .Commands}}
+	{{.Name}})
+		if [[ "${words[CURRENT]}" == -* ]]; then
+			local -a flags
+			flags=(
+{{- range .Flags}}
+				'-{{zsh .Name}}:{{zsh .Usage}}'
+{{- end}}
+			)
+			_describe -t flags 'flag' flags
+			return
+		fi
+{{- if eq .Args "images"}}
+		compadd -- $(__img_images)
+{{- else if eq .Args "shells"}}
+		compadd -- {{join $.Shells " "}}
+{{- else if eq .Args "files"}}
+		_files
+{{- end}}
+		;;
+{{- end}}
+	esac
+}
+
+compdef _img img
+`
+
+const fishCompletionTemplate = `# fish completion for img
+
+function __img_images
+	img ls 2>/dev/null | awk 'NR>1 {print $1}'
+end
+
+complete -c img -f
+{{- range .Commands}}
+{{- $name := .Name}}
+
+complete -c img -n '__fish_use_subcommand' -a {{.Name}} -d {{quote .Description}}
+{{- range .Flags}}
+complete -c img -n '__fish_seen_subcommand_from {{$name}}' -o {{.Name}} -d {{quote .Usage}}
+{{- end}}
+{{- if eq .Args "images"}}
+complete -c img -n '__fish_seen_subcommand_from {{.Name}}' -a '(__img_images)'
+{{- else if eq .Args "shells"}}
+complete -c img -n '__fish_seen_subcommand_from {{.Name}}' -a '{{join $.Shells " "}}'
+{{- else if eq .Args "files"}}
+complete -c img -n '__fish_seen_subcommand_from {{.Name}}' -F
+{{- end}}
+{{- end}}
+`
+
+const powershellCompletionTemplate = `# powershell completion for img
+
+Register-ArgumentCompleter -Native -CommandName img -ScriptBlock {
+	param($wordToComplete, $commandAst, $cursorPosition)
+
+	$flags = @{
+{{- range .Commands}}
+		'{{.Name}}' = @({{range $i, $f := .Flags}}{{if $i}}, {{end}}'-{{$f.Name}}'{{end}})
+{{- end}}
+	}
+	$imageCommands = @({{range $i, $c := .ImageCommands}}{{if $i}}, {{end}}'{{$c}}'{{end}})
+	$shells = @({{range $i, $s := .Shells}}{{if $i}}, {{end}}'{{$s}}'{{end}})
+
+	$elements = @($commandAst.CommandElements | ForEach-Object { $_.ToString() })
+	if ($elements.Count -lt 2 -or ($elements.Count -eq 2 -and $wordToComplete -ne '')) {
+		$candidates = $flags.Keys
+	} elseif ($wordToComplete.StartsWith('-')) {
+		$candidates = $flags[$elements[1]]
+	} elseif ($imageCommands -contains $elements[1]) {
+		$candidates = img ls 2>$null | Select-Object -Skip 1 | ForEach-Object { ($_ -split '\s+')[0] }
+	} elseif ($elements[1] -eq 'completion') {
+		$candidates = $shells
+	} else {
+		return
+	}
+
+	$candidates | Where-Object { $_ -like "$wordToComplete*" } | Sort-Object | ForEach-Object {
+		[System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+	}
+}
+`
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompletionEntries(t *testing.T) {
+	defer func(c []command) { commands = c }(commands)
+	commands = []command{
+		&pushCommand{},
+		&completionCommand{},
+		&buildCommand{},
+	}
+
+	entries := completionEntries()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+
+	expected := []struct {
+		name string
+		args completionArgs
+	}{
+		{"build", completeFiles},
+		{"completion", completeShells},
+		{"push", completeImages},
+	}
+	for i, e := range expected {
+		if entries[i].Name != e.name {
+			t.Fatalf("expected entry %d to be %s, got %s", i, e.name, entries[i].Name)
+		}
+		if entries[i].Args != e.args {
+			t.Fatalf("expected %s to complete %s, got %s", e.name, e.args, entries[i].Args)
+		}
+	}
+
+	// The command flags and the global flags are both completed.
+	flags := map[string]bool{}
+	for _, f := range entries[0].Flags {
+		flags[f.Name] = true
+	}
+	for _, name := range []string{"t", "f", "state", "backend"} {
+		if !flags[name] {
+			t.Fatalf("expected build to complete the -%s flag, got %v", name, entries[0].Flags)
+		}
+	}
+}
+
+func TestCompletionEscaping(t *testing.T) {
+	if got := shellQuote("it's"); got != `'it'\''s'` {
+		t.Fatalf("expected the single quote to be escaped, got %s", got)
+	}
+	if got := zshEscape("tag: it's"); got != `tag\: it'\''s` {
+		t.Fatalf("expected the colon and single quote to be escaped, got %s", got)
+	}
+}
+
+func TestCompletionErrors(t *testing.T) {
+	cmd := &completionCommand{}
+
+	err := cmd.Run(nil)
+	if err == nil || !strings.Contains(err.Error(), "must pass a shell") {
+		t.Fatalf("expected a missing shell error, got: %v", err)
+	}
+
+	err = cmd.Run([]string{"tcsh"})
+	if err == nil || !strings.Contains(err.Error(), "tcsh is not a supported shell") {
+		t.Fatalf("expected an unsupported shell error, got: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/genuinetools/img/client"
+	"github.com/moby/buildkit/util/appcontext"
+)
+
+const composeShortHelp = `Build or push the services of a compose project.`
+
+var composeLongHelp = composeShortHelp + `
+Builds the services with a build section in compose.yaml or
+docker-compose.yml, after the services they depend on, or pushes their
+images. Only the named services are built or pushed if any are given.
+
+  $ img compose build
+  $ img compose -profile debug build web
+  $ img compose push`
+
+func (cmd *composeCommand) Name() string       { return "compose" }
+func (cmd *composeCommand) Args() string       { return "[OPTIONS] build|push [SERVICE...]" }
+func (cmd *composeCommand) ShortHelp() string  { return composeShortHelp }
+func (cmd *composeCommand) LongHelp() string   { return composeLongHelp }
+func (cmd *composeCommand) Hidden() bool       { return false }
+func (cmd *composeCommand) DoReexec() bool     { return true }
+func (cmd *composeCommand) RequiresRunc() bool { return true }
+
+func (cmd *composeCommand) Register(fs *flag.FlagSet) {
+	fs.Var(&cmd.files, "f", "Compose file, can be repeated to override services (default is compose.yaml or docker-compose.yml, or $COMPOSE_FILE)")
+	fs.StringVar(&cmd.project, "p", "", "Project name, used to name the images of services without an image (default is $COMPOSE_PROJECT_NAME, the name in the compose file or the directory name)")
+	fs.Var(&cmd.profiles, "profile", "Enable the services of a profile, can be repeated (default is $COMPOSE_PROFILES)")
+	fs.StringVar(&cmd.envFile, "env-file", "", "File with the variables to substitute (default is the .env file in the project directory)")
+	fs.BoolVar(&cmd.push, "push", false, "Push the image of every service once it is built, before the services depending on it are built")
+	fs.BoolVar(&cmd.insecure, "insecure-registry", false, "Push to insecure registry")
+}
+
+type composeCommand struct {
+	files    stringSlice
+	project  string
+	profiles stringSlice
+	envFile  string
+	push     bool
+	insecure bool
+}
+
+func (cmd *composeCommand) Run(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("must pass build or push")
+	}
+
+	p, err := loadComposeProject(composeOptions{
+		files:    cmd.files,
+		name:     cmd.project,
+		profiles: cmd.profiles,
+		envFile:  cmd.envFile,
+	})
+	if err != nil {
+		return err
+	}
+
+	services, err := p.buildOrder(args[1:])
+	if err != nil {
+		return err
+	}
+
+	// The services share one client, the state can only be opened once.
+	c, err := client.New(stateDir, backend, stateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	switch args[0] {
+	case "build":
+		// The containers of the build steps are set up by the shared
+		// client, so the services must agree on them.
+		opt, err := composeExecOpt(services)
+		if err != nil {
+			return err
+		}
+		if err := c.SetExecOpt(opt); err != nil {
+			return err
+		}
+		defer applyGCPolicy(c)
+		for _, s := range services {
+			b := &buildCommand{
+				tag:               s.Image,
+				dockerfilePath:    s.Build.Dockerfile,
+				target:            s.Build.Target,
+				buildArgs:         stringSlice(s.Build.Args),
+				labels:            stringSlice(s.Build.Labels),
+				buildContexts:     stringSlice(s.Build.AdditionalContexts),
+				noCache:           s.Build.NoCache,
+				proxyEnv:          true,
+				cacheFrom:         stringSlice(s.Build.CacheFrom),
+				cacheTo:           s.Build.CacheTo,
+				push:              cmd.push,
+				progress:          progressAuto,
+				timestamp:         os.Getenv("SOURCE_DATE_EPOCH"),
+				containersRunRoot: defaultContainersRunRoot(),
+				client:            c,
+			}
+			if err := b.Run([]string{s.Build.Context}); err != nil {
+				return fmt.Errorf("building service %s failed: %v", s.Name, err)
+			}
+			ctx := namespaces.WithNamespace(appcontext.Context(), "buildkit")
+			for _, tag := range s.Build.Tags {
+				if err := c.TagImage(ctx, s.Image, tag); err != nil {
+					return fmt.Errorf("tagging service %s failed: %v", s.Name, err)
+				}
+				if cmd.push {
+					if err := pushWithSession(ctx, c, tag, cmd.insecure); err != nil {
+						return fmt.Errorf("pushing service %s failed: %v", s.Name, err)
+					}
+				}
+			}
+		}
+		return nil
+	case "push":
+		for _, s := range services {
+			push := &pushCommand{insecure: cmd.insecure, client: c}
+			if err := push.Run([]string{s.Image}); err != nil {
+				return fmt.Errorf("pushing service %s failed: %v", s.Name, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown compose command %q, must be build or push", args[0])
+}
+
+// composeExecOpt returns the settings of the containers running the build
+// steps of the services, from the network and extra_hosts of their build
+// sections.
+func composeExecOpt(services []composeService) (client.ExecOpt, error) {
+	var opt client.ExecOpt
+	for i, s := range services {
+		network := s.Build.Network
+		if network == "default" {
+			network = client.NetworkHost
+		}
+		if i > 0 && (network != opt.Network || strings.Join(s.Build.ExtraHosts, ",") != strings.Join(opt.ExtraHosts, ",")) {
+			return opt, fmt.Errorf("services %s and %s set a different network or extra_hosts, build them separately", services[0].Name, s.Name)
+		}
+		opt = client.ExecOpt{Network: network, ExtraHosts: s.Build.ExtraHosts}
+	}
+	return opt, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadComposeProject(t *testing.T) {
+	dir := withFiles(t, map[string]string{
+		"compose.yaml": `name: Compose_Test
+services:
+  web:
+    build:
+      context: ./web
+      dockerfile: web.Dockerfile
+      args:
+        VERSION: ${VERSION}
+        UNSET:
+    image: composetest/web:${VERSION}
+    depends_on: [base]
+  base:
+    build: ./base
+  debug:
+    build: ./base
+    image: composetest/debug
+    profiles: [debug]
+  db:
+    image: postgres:10
+`,
+		"compose.override.yaml": `services:
+  web:
+    build:
+      target: release
+`,
+		".env": "VERSION=1.2\n",
+	})
+	defer os.RemoveAll(dir)
+
+	p, err := loadComposeProject(composeOptions{
+		files: []string{filepath.Join(dir, "compose.yaml"), filepath.Join(dir, "compose.override.yaml")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Name != "compose_test" {
+		t.Fatalf("expected the normalized project name, got %s", p.Name)
+	}
+
+	web := p.Services["web"]
+	if web.Image != "composetest/web:1.2" {
+		t.Fatalf("expected the variable to be substituted in the image, got %s", web.Image)
+	}
+	if web.Build.Context != filepath.Join(dir, "web") || web.Build.Dockerfile != filepath.Join(dir, "web", "web.Dockerfile") {
+		t.Fatalf("expected the paths to be relative to the project, got %s and %s", web.Build.Context, web.Build.Dockerfile)
+	}
+	if web.Build.Target != "release" {
+		t.Fatalf("expected the override file to set the target, got %q", web.Build.Target)
+	}
+	if strings.Join(web.Build.Args, ",") != "VERSION=1.2" {
+		t.Fatalf("expected the args without the unset one, got %v", web.Build.Args)
+	}
+	if p.Services["base"].Image != "compose_test-base" {
+		t.Fatalf("expected the image to be named after the project, got %s", p.Services["base"].Image)
+	}
+
+	// The dependencies are built first and services of inactive profiles or
+	// without a build section are skipped.
+	order, err := p.buildOrder(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range order {
+		names = append(names, s.Name)
+	}
+	if strings.Join(names, ",") != "base,web" {
+		t.Fatalf("expected base to be built before web, got %v", names)
+	}
+
+	p.Profiles = []string{"debug"}
+	if order, _ = p.buildOrder(nil); len(order) != 3 {
+		t.Fatalf("expected the service of the debug profile to be built, got %d services", len(order))
+	}
+}
+
+func TestComposeErrors(t *testing.T) {
+	dir := withFiles(t, map[string]string{
+		"compose.yaml": `services:
+  a:
+    build: .
+    depends_on: [b]
+  b:
+    build: .
+    depends_on: [a]
+  c:
+    image: postgres:10
+`,
+		"bad.yaml":      "services:\n  a:\n    build: .\n   image: x\n",
+		"required.yaml": "services:\n  a:\n    image: ${IMG_COMPOSE_TEST_UNSET?must be set}\n",
+	})
+	defer os.RemoveAll(dir)
+
+	p, err := loadComposeProject(composeOptions{files: []string{filepath.Join(dir, "compose.yaml")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"a": "services depend on each other: a -> b -> a",
+		"c": "service c has no build section",
+		"d": "no such service d",
+	}
+	for name, expected := range tests {
+		if _, err := p.buildOrder([]string{name}); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected %q building %s, got: %v", expected, name, err)
+		}
+	}
+
+	files := map[string]string{
+		"bad.yaml":      "parsing compose file",
+		"required.yaml": "required variable IMG_COMPOSE_TEST_UNSET: must be set",
+		"missing.yaml":  "reading compose file failed",
+	}
+	for file, expected := range files {
+		if _, err := loadComposeProject(composeOptions{files: []string{filepath.Join(dir, file)}}); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected %q loading %s, got: %v", expected, file, err)
+		}
+	}
+
+	if err := (&composeCommand{}).Run(nil); err == nil || !strings.Contains(err.Error(), "must pass build or push") {
+		t.Fatalf("expected a missing command error, got: %v", err)
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	env := map[string]string{"SET": "value", "EMPTY": ""}
+
+	tests := map[string]string{
+		"$SET and ${SET}":   "value and value",
+		"$$SET":             "$SET",
+		"${UNSET:-default}": "default",
+		"${EMPTY:-default}": "default",
+		"${EMPTY-default}":  "",
+		"${SET:+other}":     "other",
+		"${UNSET+other}":    "",
+		"${UNSET:-$SET}":    "value",
+		"price: 5$":         "price: 5$",
+	}
+	for s, expected := range tests {
+		got, err := interpolate(s, env)
+		if err != nil {
+			t.Fatalf("interpolating %q failed: %v", s, err)
+		}
+		if got != expected {
+			t.Fatalf("expected %q for %q, got %q", expected, s, got)
+		}
+	}
+
+	for s, expected := range map[string]string{
+		"${UNSET?}":  "required variable UNSET: is not set",
+		"${SET":      "unterminated variable",
+		"${SET!x}":   "invalid variable ${SET!x}",
+		"${-x}":      "invalid variable ${-x}",
+		"${EMPTY:?}": "required variable EMPTY",
+	} {
+		if _, err := interpolate(s, env); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected %q for %q, got: %v", expected, s, err)
+		}
+	}
+}
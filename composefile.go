@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/genuinetools/img/internal/yaml"
+)
+
+// defaultComposeFiles are the compose files looked for in the current
+// directory, in order.
+var defaultComposeFiles = []string{"compose.yaml", "compose.yml", "docker-compose.yml", "docker-compose.yaml"}
+
+// composeProject is the part of a compose project img builds.
+type composeProject struct {
+	Name     string
+	Dir      string
+	Services map[string]composeService
+	// Profiles are the active profiles.
+	Profiles []string
+}
+
+type composeService struct {
+	Name      string
+	Image     string
+	Build     *composeBuild
+	DependsOn []string
+	Profiles  []string
+}
+
+type composeBuild struct {
+	Context    string
+	Dockerfile string
+	Target     string
+	Args       []string
+	// Tags are the images to tag the image with as well.
+	Tags               []string
+	Labels             []string
+	Network            string
+	ExtraHosts         []string
+	AdditionalContexts []string
+	NoCache            bool
+	CacheFrom          []string
+	CacheTo            string
+}
+
+// composeOptions selects the compose files and the project in them.
+type composeOptions struct {
+	files    []string
+	name     string
+	profiles []string
+	envFile  string
+}
+
+// loadComposeProject loads the compose files, later files override the
+// services of earlier ones. Variables are substituted from the environment
+// and the .env file in the project directory.
+func loadComposeProject(opts composeOptions) (*composeProject, error) {
+	files := opts.files
+	if len(files) == 0 && os.Getenv("COMPOSE_FILE") != "" {
+		files = strings.Split(os.Getenv("COMPOSE_FILE"), string(os.PathListSeparator))
+	}
+	if len(files) == 0 {
+		for _, f := range defaultComposeFiles {
+			if _, err := os.Stat(f); err == nil {
+				files = []string{f}
+				break
+			}
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no compose file found, looked for %s", strings.Join(defaultComposeFiles, ", "))
+		}
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(files[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	envFile := opts.envFile
+	if envFile == "" {
+		envFile = filepath.Join(dir, ".env")
+		if _, err := os.Stat(envFile); os.IsNotExist(err) {
+			envFile = ""
+		}
+	}
+	env, err := composeEnv(envFile)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := map[string]interface{}{}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading compose file failed: %v", err)
+		}
+		v, err := yaml.Parse(b)
+		if err != nil {
+			return nil, fmt.Errorf("parsing compose file %s failed: %v", f, err)
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("parsing compose file %s failed: not a mapping", f)
+		}
+		if v, err = interpolateValue(m, env); err != nil {
+			return nil, fmt.Errorf("substituting variables in %s failed: %v", f, err)
+		}
+		mergeComposeValues(doc, v.(map[string]interface{}))
+	}
+
+	p := &composeProject{Dir: dir, Services: map[string]composeService{}}
+	p.Name = opts.name
+	if p.Name == "" {
+		p.Name = os.Getenv("COMPOSE_PROJECT_NAME")
+	}
+	if p.Name == "" {
+		p.Name, _ = doc["name"].(string)
+	}
+	if p.Name == "" {
+		p.Name = filepath.Base(dir)
+	}
+	p.Name = normalizeProjectName(p.Name)
+
+	services, _ := doc["services"].(map[string]interface{})
+	if len(services) == 0 {
+		return nil, fmt.Errorf("no services in %s", strings.Join(files, ", "))
+	}
+	for name, v := range services {
+		s, err := p.service(name, v, env)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %v", name, err)
+		}
+		p.Services[name] = s
+	}
+
+	p.Profiles = opts.profiles
+	if len(p.Profiles) == 0 && os.Getenv("COMPOSE_PROFILES") != "" {
+		p.Profiles = strings.Split(os.Getenv("COMPOSE_PROFILES"), ",")
+	}
+
+	return p, nil
+}
+
+func (p *composeProject) service(name string, v interface{}, env map[string]string) (composeService, error) {
+	s := composeService{Name: name}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		if v == nil {
+			return s, nil
+		}
+		return s, fmt.Errorf("must be a mapping")
+	}
+
+	s.Image, _ = m["image"].(string)
+	s.Profiles = composeStrings(m["profiles"])
+
+	switch deps := m["depends_on"].(type) {
+	case map[string]interface{}:
+		for dep := range deps {
+			s.DependsOn = append(s.DependsOn, dep)
+		}
+		sort.Strings(s.DependsOn)
+	default:
+		s.DependsOn = composeStrings(deps)
+	}
+
+	switch b := m["build"].(type) {
+	case nil:
+	case string:
+		s.Build = &composeBuild{Context: b}
+	case map[string]interface{}:
+		s.Build = &composeBuild{}
+		s.Build.Context, _ = b["context"].(string)
+		s.Build.Dockerfile, _ = b["dockerfile"].(string)
+		s.Build.Target, _ = b["target"].(string)
+		args, err := composeArgs(b["args"], env)
+		if err != nil {
+			return s, err
+		}
+		s.Build.Args = args
+		if s.Build.Labels, err = composeKeyValues(b["labels"], "=", "labels"); err != nil {
+			return s, err
+		}
+		if s.Build.ExtraHosts, err = composeKeyValues(b["extra_hosts"], ":", "extra_hosts"); err != nil {
+			return s, err
+		}
+		if s.Build.AdditionalContexts, err = composeKeyValues(b["additional_contexts"], "=", "additional_contexts"); err != nil {
+			return s, err
+		}
+		s.Build.Tags = composeStrings(b["tags"])
+		s.Build.Network, _ = b["network"].(string)
+		s.Build.NoCache, _ = b["no_cache"].(bool)
+		s.Build.CacheFrom = composeStrings(b["cache_from"])
+		switch cacheTo := composeStrings(b["cache_to"]); len(cacheTo) {
+		case 0:
+		case 1:
+			s.Build.CacheTo = cacheTo[0]
+		default:
+			return s, fmt.Errorf("only one cache_to can be set")
+		}
+	default:
+		return s, fmt.Errorf("build must be a path or a mapping")
+	}
+
+	if s.Build != nil {
+		if s.Build.Context == "" {
+			s.Build.Context = "."
+		}
+		if !filepath.IsAbs(s.Build.Context) {
+			s.Build.Context = filepath.Join(p.Dir, s.Build.Context)
+		}
+		if s.Build.Dockerfile != "" && !filepath.IsAbs(s.Build.Dockerfile) {
+			s.Build.Dockerfile = filepath.Join(s.Build.Context, s.Build.Dockerfile)
+		}
+		if s.Image == "" {
+			s.Image = p.Name + "-" + name
+		}
+	}
+	return s, nil
+}
+
+// enabled reports whether the service is enabled with the active profiles.
+func (s composeService) enabled(profiles []string) bool {
+	if len(s.Profiles) == 0 {
+		return true
+	}
+	for _, p := range s.Profiles {
+		for _, active := range profiles {
+			if p == active || active == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// buildOrder returns the services to build, the named ones or every service
+// with a build section enabled by the active profiles, ordered so services
+// are built after the services they depend on. Naming a service enables it
+// whatever its profiles.
+func (p *composeProject) buildOrder(names []string) ([]composeService, error) {
+	if len(names) == 0 {
+		for name, s := range p.Services {
+			if s.Build != nil && s.enabled(p.Profiles) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}
+
+	selected := map[string]bool{}
+	for _, name := range names {
+		s, ok := p.Services[name]
+		if !ok {
+			return nil, fmt.Errorf("no such service %s", name)
+		}
+		if s.Build == nil {
+			return nil, fmt.Errorf("service %s has no build section", name)
+		}
+		selected[name] = true
+	}
+
+	var (
+		order []composeService
+		state = map[string]int{} // 1 while visiting, 2 once done
+		visit func(name string, path []string) error
+	)
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("services depend on each other: %s", strings.Join(append(path, name), " -> "))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		s := p.Services[name]
+		for _, dep := range s.DependsOn {
+			if _, ok := p.Services[dep]; !ok {
+				return fmt.Errorf("service %s depends on undefined service %s", name, dep)
+			}
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		if selected[name] {
+			order = append(order, s)
+		}
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// composeStrings returns a list of strings from a sequence or a string.
+func composeStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var s []string
+		for _, item := range v {
+			if str, ok := item.(string); ok {
+				s = append(s, str)
+			}
+		}
+		return s
+	}
+	return nil
+}
+
+// composeArgs returns the build args in the KEY=VALUE format from a mapping
+// or a sequence. Args without a value take it from the environment and are
+// left out if it is not set.
+func composeArgs(v interface{}, env map[string]string) ([]string, error) {
+	var args []string
+	switch v := v.(type) {
+	case nil:
+	case map[string]interface{}:
+		for k, val := range v {
+			switch val := val.(type) {
+			case nil:
+				if e, ok := env[k]; ok {
+					args = append(args, k+"="+e)
+				}
+			case string:
+				args = append(args, k+"="+val)
+			default:
+				return nil, fmt.Errorf("build arg %s must be a string", k)
+			}
+		}
+	case []interface{}:
+		for _, item := range composeStrings(v) {
+			if strings.Contains(item, "=") {
+				args = append(args, item)
+			} else if e, ok := env[item]; ok {
+				args = append(args, item+"="+e)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("build args must be a mapping or a list")
+	}
+	sort.Strings(args)
+	return args, nil
+}
+
+// composeKeyValues returns the entries of a mapping in the KEY<sep>VALUE
+// format, or the entries of a sequence already in the format. Compose also
+// allows KEY=VALUE entries in a sequence of extra hosts.
+func composeKeyValues(v interface{}, sep, name string) ([]string, error) {
+	var kvs []string
+	switch v := v.(type) {
+	case nil:
+	case map[string]interface{}:
+		for k, val := range v {
+			kvs = append(kvs, k+sep+fmt.Sprint(val))
+		}
+	case []interface{}:
+		for _, item := range composeStrings(v) {
+			if sep != "=" && !strings.Contains(item, sep) {
+				item = strings.Replace(item, "=", sep, 1)
+			}
+			kvs = append(kvs, item)
+		}
+	default:
+		return nil, fmt.Errorf("build %s must be a mapping or a list", name)
+	}
+	sort.Strings(kvs)
+	return kvs, nil
+}
+
+// mergeComposeValues merges the mapping src into dst, mappings are merged
+// and every other value is replaced.
+func mergeComposeValues(dst, src map[string]interface{}) {
+	for k, v := range src {
+		sm, ok := v.(map[string]interface{})
+		dm, dok := dst[k].(map[string]interface{})
+		if ok && dok {
+			mergeComposeValues(dm, sm)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// composeEnv returns the variables for substitution, the environment takes
+// precedence over the env file.
+func composeEnv(envFile string) (map[string]string, error) {
+	env := map[string]string{}
+	if envFile != "" {
+		var err error
+		if env, err = readEnvFile(envFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return env, nil
+}
+
+// readEnvFile reads the KEY=VALUE lines of a dotenv file. Empty lines and
+// comments are skipped, the lines can start with export and the values can
+// be quoted.
+func readEnvFile(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("opening env file failed: %v", err)
+	}
+	defer f.Close()
+
+	env := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(line, "export "), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid line %q in env file %s", line, file)
+		}
+		v := strings.TrimSpace(kv[1])
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		env[strings.TrimSpace(kv[0])] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading env file failed: %v", err)
+	}
+	return env, nil
+}
+
+// interpolateValue substitutes the variables in every string of a parsed
+// compose file.
+func interpolateValue(v interface{}, env map[string]string) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return interpolate(v, env)
+	case map[string]interface{}:
+		for k, item := range v {
+			s, err := interpolateValue(item, env)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = s
+		}
+	case []interface{}:
+		for i, item := range v {
+			s, err := interpolateValue(item, env)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = s
+		}
+	}
+	return v, nil
+}
+
+var varNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*`)
+
+// interpolate substitutes $VAR and ${VAR} in s, with the ${VAR:-default},
+// ${VAR-default}, ${VAR:?error}, ${VAR?error}, ${VAR:+replacement} and
+// ${VAR+replacement} forms. $$ is a literal $.
+func interpolate(s string, env map[string]string) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+		switch {
+		case s[i+1] == '$':
+			out.WriteByte('$')
+			i++
+		case s[i+1] == '{':
+			end, depth := -1, 0
+			for j := i + 2; j < len(s) && end < 0; j++ {
+				switch s[j] {
+				case '{':
+					depth++
+				case '}':
+					if depth == 0 {
+						end = j
+					}
+					depth--
+				}
+			}
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable in %q", s)
+			}
+			v, err := substitute(s[i+2:end], env)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(v)
+			i = end
+		default:
+			name := varNameRe.FindString(s[i+1:])
+			if name == "" {
+				out.WriteByte('$')
+				continue
+			}
+			out.WriteString(env[name])
+			i += len(name)
+		}
+	}
+	return out.String(), nil
+}
+
+// substitute returns the value of the braced variable expression expr.
+func substitute(expr string, env map[string]string) (string, error) {
+	name := varNameRe.FindString(expr)
+	if name == "" {
+		return "", fmt.Errorf("invalid variable ${%s}", expr)
+	}
+	op := expr[len(name):]
+	value, set := env[name]
+	if op == "" {
+		return value, nil
+	}
+
+	// With a colon the operators treat empty variables as unset.
+	colon := strings.HasPrefix(op, ":")
+	op = strings.TrimPrefix(op, ":")
+	if colon && value == "" {
+		set = false
+	}
+	if op == "" {
+		return "", fmt.Errorf("invalid variable ${%s}", expr)
+	}
+	word, err := interpolate(op[1:], env)
+	if err != nil {
+		return "", err
+	}
+
+	switch op[0] {
+	case '-':
+		if !set {
+			return word, nil
+		}
+	case '?':
+		if !set {
+			if word == "" {
+				word = "is not set"
+			}
+			return "", fmt.Errorf("required variable %s: %s", name, word)
+		}
+	case '+':
+		if set {
+			return word, nil
+		}
+		return "", nil
+	default:
+		return "", fmt.Errorf("invalid variable ${%s}", expr)
+	}
+	return value, nil
+}
+
+// normalizeProjectName lowercases the project name and removes the
+// characters that are not allowed in image names.
+func normalizeProjectName(name string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' {
+			b.WriteRune(c)
+		}
+	}
+	return strings.TrimLeft(b.String(), "_-")
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/genuinetools/img/client"
+)
+
+// compressionOptions holds the flags for recompressing the layers of the
+// images push and save send.
+type compressionOptions struct {
+	client.Compression
+}
+
+func (o *compressionOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.Type, "compression", "", fmt.Sprintf("Compress the layers with (%s), instead of keeping their compression", strings.Join(client.Compressions, ", ")))
+	fs.IntVar(&o.Level, "compression-level", 0, "Compression level of the layers, 0 for the default level of the compression")
+}
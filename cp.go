@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/genuinetools/img/client"
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/sirupsen/logrus"
+)
+
+const cpHelp = `Copy an image from a registry to another.`
+
+func (cmd *cpCommand) Name() string       { return "cp" }
+func (cmd *cpCommand) Args() string       { return "[OPTIONS] SOURCE_IMAGE[:TAG|@DIGEST] TARGET_IMAGE[:TAG]" }
+func (cmd *cpCommand) ShortHelp() string  { return cpHelp }
+func (cmd *cpCommand) LongHelp() string   { return cpHelp }
+func (cmd *cpCommand) Hidden() bool       { return false }
+func (cmd *cpCommand) DoReexec() bool     { return true }
+func (cmd *cpCommand) RequiresRunc() bool { return false }
+
+func (cmd *cpCommand) Register(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.insecure, "insecure-registry", false, "Use plain HTTP to talk to the registries")
+	fs.BoolVar(&cmd.quiet, "q", false, "Suppress verbose output and print the digest on success")
+	fs.StringVar(&cmd.progress, "progress", progressAuto, fmt.Sprintf("Set the type of progress output (%s)", strings.Join(progressModes, ", ")))
+}
+
+type cpCommand struct {
+	insecure bool
+	quiet    bool
+	progress string
+}
+
+func (cmd *cpCommand) Run(args []string) (err error) {
+	if len(args) < 2 {
+		return fmt.Errorf("must pass a source and target image to copy")
+	}
+	if err := validateProgressMode(cmd.progress); err != nil {
+		return err
+	}
+	src, dst := args[0], args[1]
+
+	// Create the client.
+	c, err := client.New(stateDir, backend, stateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if !cmd.quiet && cmd.progress != progressJSON {
+		logrus.Infof("Copying %s to %s...", src, dst)
+	}
+
+	// Create the context.
+	ctx := appcontext.Context()
+	ctx = namespaces.WithNamespace(ctx, "buildkit")
+
+	var progressDone func(error) error
+	if !cmd.quiet {
+		ctx, progressDone = registryProgress(ctx, "copying "+src, cmd.progress)
+	}
+	var digest string
+	err = c.WithSession(ctx, nil, func(ctx context.Context, _ string) error {
+		desc, err := c.CopyImage(ctx, src, dst, cmd.insecure)
+		digest = desc.Digest.String()
+		return err
+	})
+	if progressDone != nil {
+		err = progressDone(err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if cmd.quiet {
+		fmt.Println(digest)
+		return nil
+	}
+	if cmd.progress == progressJSON {
+		newProgressEventWriter(os.Stdout).result(dst, digest)
+		return nil
+	}
+	fmt.Printf("Successfully copied %s to %s: %s\n", src, dst, digest)
+
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCpErrors(t *testing.T) {
+	tests := []struct {
+		cmd  *cpCommand
+		args []string
+		err  string
+	}{
+		{cmd: &cpCommand{progress: progressAuto}, args: []string{"busybox"}, err: "must pass a source and target image to copy"},
+		{cmd: &cpCommand{progress: "fancy"}, args: []string{"busybox", "r.j3ss.co/busybox"}, err: "invalid progress mode fancy"},
+	}
+	for _, tt := range tests {
+		if err := tt.cmd.Run(tt.args); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("expected %q, got: %v", tt.err, err)
+		}
+	}
+}
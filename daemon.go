@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/genuinetools/img/client"
+	"github.com/genuinetools/img/internal/metrics"
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/sirupsen/logrus"
+)
+
+const daemonShortHelp = `Run img as a daemon serving the BuildKit API.`
+
+var daemonLongHelp = daemonShortHelp + `
+The BuildKit control API is served on a unix socket (or TCP address) so
+BuildKit clients such as buildctl can build with img, reusing its state and
+cache across invocations. A TCP address needs -tls-cert, -tls-key and
+-tls-ca, clients must present a certificate signed by the CA. The same goes
+for the Docker Engine API of -docker-addr. The HTTP build API of -http-addr
+is served with the certificate too, it only goes without TLS on a loopback
+address:
+
+  $ img daemon -addr unix:///tmp/img.sock
+  $ buildctl --addr unix:///tmp/img.sock build --frontend dockerfile.v0 \
+      --local context=. --local dockerfile=.`
+
+func (cmd *daemonCommand) Name() string       { return "daemon" }
+func (cmd *daemonCommand) Args() string       { return "[OPTIONS]" }
+func (cmd *daemonCommand) ShortHelp() string  { return daemonShortHelp }
+func (cmd *daemonCommand) LongHelp() string   { return daemonLongHelp }
+func (cmd *daemonCommand) Hidden() bool       { return false }
+func (cmd *daemonCommand) DoReexec() bool     { return true }
+func (cmd *daemonCommand) RequiresRunc() bool { return true }
+
+func (cmd *daemonCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.addr, "addr", defaultDaemonAddr(), "Address to serve the BuildKit API on (unix:// or tcp://)")
+	fs.StringVar(&cmd.tlsCert, "tls-cert", "", "Certificate to serve the BuildKit and Docker Engine APIs on tcp:// addresses, and the HTTP build API, with")
+	fs.StringVar(&cmd.tlsKey, "tls-key", "", "Key of the certificate to serve the BuildKit and Docker Engine APIs on tcp:// addresses, and the HTTP build API, with")
+	fs.StringVar(&cmd.tlsCA, "tls-ca", "", "CA certificate to verify the clients of the BuildKit and Docker Engine APIs on tcp:// addresses with")
+	fs.StringVar(&cmd.debugAddr, "debug-addr", "", "Loopback address to serve the Prometheus metrics and the pprof profiles on, e.g. localhost:6060")
+	fs.StringVar(&cmd.httpAddr, "http-addr", "", "Address to serve the HTTP build API on, e.g. localhost:8080")
+	fs.StringVar(&cmd.dockerAddr, "docker-addr", "", "Address to serve the Docker Engine API shim on (unix:// or tcp://)")
+	fs.StringVar(&cmd.httpToken, "http-token", os.Getenv("IMG_API_TOKEN"), "Token clients of the HTTP build API must pass as a bearer token (default is $IMG_API_TOKEN)")
+	fs.StringVar(&cmd.httpUsers, "http-users", "", "File with a USER TOKEN line for each user of the HTTP build API")
+	fs.Var(&cmd.webhooks, "webhook", "URL to POST the lifecycle events of the daemon to as CloudEvents, can be repeated")
+	fs.StringVar(&cmd.webhookSecret, "webhook-secret", os.Getenv("IMG_WEBHOOK_SECRET"), "Secret to sign the webhook requests with, the HMAC-SHA256 is sent in the X-Img-Signature-256 header (default is $IMG_WEBHOOK_SECRET)")
+	fs.IntVar(&cmd.maxBuilds, "max-builds", runtime.NumCPU(), "Maximum number of HTTP API builds to run at once")
+	fs.IntVar(&cmd.maxBuildsPerUser, "max-builds-per-user", 1, "Maximum number of HTTP API builds to run at once for a user, 0 for no limit")
+}
+
+type daemonCommand struct {
+	addr       string
+	tlsCert    string
+	tlsKey     string
+	tlsCA      string
+	debugAddr  string
+	httpAddr   string
+	httpToken  string
+	httpUsers  string
+	dockerAddr string
+
+	maxBuilds        int
+	maxBuildsPerUser int
+
+	webhooks      stringSlice
+	webhookSecret string
+}
+
+func (cmd *daemonCommand) Run(args []string) error {
+	// The debug endpoints have no authentication.
+	if cmd.debugAddr != "" && !isLoopbackAddr(cmd.debugAddr) {
+		return fmt.Errorf("the debug endpoints are not authenticated, serve them on a loopback address instead of %s", cmd.debugAddr)
+	}
+
+	var users map[string]string
+	if cmd.httpAddr != "" {
+		var err error
+		users, err = cmd.apiUsers()
+		if err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			return errors.New("the HTTP build API requires a token, pass one with -http-token or -http-users")
+		}
+	}
+
+	l, err := cmd.listenTLS("BuildKit", cmd.addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	var httpListener net.Listener
+	if cmd.httpAddr != "" {
+		httpListener, err = cmd.listenHTTP(cmd.httpAddr)
+		if err != nil {
+			return err
+		}
+		defer httpListener.Close()
+	}
+
+	var dockerListener net.Listener
+	if cmd.dockerAddr != "" {
+		dockerListener, err = cmd.listenTLS("Docker Engine", cmd.dockerAddr)
+		if err != nil {
+			return err
+		}
+		defer dockerListener.Close()
+	}
+
+	// Create the client.
+	c, err := client.New(stateDir, backend, stateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if cmd.debugAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(cmd.debugAddr, debugHandler()); err != nil {
+				logrus.Errorf("serving debug endpoints on %s failed: %v", cmd.debugAddr, err)
+			}
+		}()
+	}
+
+	// Create the context.
+	ctx := appcontext.Context()
+	ctx = namespaces.WithNamespace(ctx, "buildkit")
+
+	hooks := newWebhooks(cmd.webhooks, cmd.webhookSecret, "img/"+hostname())
+
+	if httpListener != nil {
+		api := newAPIServer(ctx, c, users, cmd.maxBuilds, cmd.maxBuildsPerUser)
+		api.webhooks = hooks
+		go func() {
+			logrus.Infof("Serving HTTP build API on %s", cmd.httpAddr)
+			if err := http.Serve(httpListener, api.Handler()); err != nil && ctx.Err() == nil {
+				logrus.Errorf("serving HTTP build API on %s failed: %v", cmd.httpAddr, err)
+			}
+		}()
+	}
+
+	if dockerListener != nil {
+		go func() {
+			logrus.Infof("Serving Docker Engine API on %s", cmd.dockerAddr)
+			if err := http.Serve(dockerListener, &dockerAPIServer{client: c, webhooks: hooks}); err != nil && ctx.Err() == nil {
+				logrus.Errorf("serving Docker Engine API on %s failed: %v", cmd.dockerAddr, err)
+			}
+		}()
+	}
+
+	logrus.Infof("Serving BuildKit API on %s", cmd.addr)
+	return c.Serve(ctx, l, hooks.serveHooks())
+}
+
+// debugHandler serves the Prometheus metrics and the pprof profiles. The
+// command line is not served, it can hold the tokens and secrets passed as
+// flags.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// listenTLS returns the listener of the BuildKit or the Docker Engine API.
+// The APIs have no authentication of their own, so on a TCP address they are
+// only served with mutual TLS.
+func (cmd *daemonCommand) listenTLS(api, addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "tcp://") {
+		return listen(addr)
+	}
+	if cmd.tlsCert == "" || cmd.tlsKey == "" || cmd.tlsCA == "" {
+		return nil, fmt.Errorf("serving the %s API on %s requires TLS, pass -tls-cert, -tls-key and -tls-ca", api, addr)
+	}
+
+	config, err := serverTLSConfig(cmd.tlsCert, cmd.tlsKey, cmd.tlsCA)
+	if err != nil {
+		return nil, err
+	}
+	l, err := listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, config), nil
+}
+
+// listenHTTP returns the listener of the HTTP build API. Its clients send
+// their tokens in every request, so the API is served with TLS when a
+// certificate is passed, and without TLS only on a loopback address.
+func (cmd *daemonCommand) listenHTTP(addr string) (net.Listener, error) {
+	if cmd.tlsCert == "" || cmd.tlsKey == "" {
+		if !isLoopbackAddr(addr) {
+			return nil, fmt.Errorf("serving the HTTP build API on %s requires TLS, pass -tls-cert and -tls-key or serve on a loopback address", addr)
+		}
+		return listen("tcp://" + addr)
+	}
+
+	cert, err := tls.LoadX509KeyPair(cmd.tlsCert, cmd.tlsKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate failed: %v", err)
+	}
+	l, err := listen("tcp://" + addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}), nil
+}
+
+// serverTLSConfig returns the TLS configuration of a server with the
+// certificate, requiring clients to present a certificate signed by the CA.
+func serverTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate failed: %v", err)
+	}
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading TLS CA certificate failed: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("%s has no PEM encoded certificates", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+		// The BuildKit API is gRPC, which runs over HTTP/2.
+		NextProtos: []string{"h2", "http/1.1"},
+	}, nil
+}
+
+// apiUsers returns the users of the HTTP build API by their tokens. The
+// -http-token is for the "default" user.
+func (cmd *daemonCommand) apiUsers() (map[string]string, error) {
+	users := map[string]string{}
+	if cmd.httpToken != "" {
+		users[cmd.httpToken] = "default"
+	}
+	if cmd.httpUsers == "" {
+		return users, nil
+	}
+
+	f, err := os.Open(cmd.httpUsers)
+	if err != nil {
+		return nil, fmt.Errorf("opening HTTP API users file failed: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a USER TOKEN line", cmd.httpUsers, n)
+		}
+		users[fields[1]] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading HTTP API users file failed: %v", err)
+	}
+	return users, nil
+}
+
+// hostname returns the name of the host the daemon runs on, for the source
+// of its events.
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
+
+// defaultDaemonAddr returns the socket in the runtime directory of the user,
+// falling back to the state directory.
+func defaultDaemonAddr() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = defaultStateDirectory
+	}
+	return "unix://" + filepath.Join(dir, "img", "img.sock")
+}
+
+// listen returns a listener for a unix:// or tcp:// address.
+func listen(addr string) (net.Listener, error) {
+	parts := strings.SplitN(addr, "://", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("address %q must be in the form unix://PATH or tcp://HOST:PORT", addr)
+	}
+
+	switch parts[0] {
+	case "unix":
+		if err := os.MkdirAll(filepath.Dir(parts[1]), 0700); err != nil {
+			return nil, err
+		}
+		// Remove the socket left over by a daemon that did not shut down
+		// cleanly.
+		if err := os.Remove(parts[1]); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("removing stale socket %s failed: %v", parts[1], err)
+		}
+	case "tcp":
+	default:
+		return nil, fmt.Errorf("%s is not a supported address protocol (unix, tcp)", parts[0])
+	}
+
+	l, err := net.Listen(parts[0], parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s failed: %v", addr, err)
+	}
+	return l, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "img-daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A stale socket is replaced and missing directories are created.
+	sock := filepath.Join(dir, "run", "img.sock")
+	if err := os.MkdirAll(filepath.Dir(sock), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(sock, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	l, err := listen("unix://" + sock)
+	if err != nil {
+		t.Fatalf("listening on a unix socket failed: %v", err)
+	}
+	l.Close()
+
+	l, err = listen("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening on a tcp address failed: %v", err)
+	}
+	l.Close()
+
+	tests := map[string]string{
+		"/tmp/img.sock":      "must be in the form unix://PATH or tcp://HOST:PORT",
+		"udp://0.0.0.0:1234": "udp is not a supported address protocol",
+	}
+	for addr, expected := range tests {
+		if _, err := listen(addr); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected %q listening on %s, got: %v", expected, addr, err)
+		}
+	}
+}
+
+func TestDefaultDaemonAddr(t *testing.T) {
+	defer os.Setenv("XDG_RUNTIME_DIR", os.Getenv("XDG_RUNTIME_DIR"))
+
+	os.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	if addr := defaultDaemonAddr(); addr != "unix:///run/user/1000/img/img.sock" {
+		t.Fatalf("expected the socket in the runtime directory, got %s", addr)
+	}
+
+	os.Setenv("XDG_RUNTIME_DIR", "")
+	if addr := defaultDaemonAddr(); addr != "unix://"+filepath.Join(defaultStateDirectory, "img", "img.sock") {
+		t.Fatalf("expected the socket in the state directory, got %s", addr)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and
+// its key to the directory. The certificate is its own CA and is valid for
+// servers and clients.
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "img"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestListenTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "img-daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := &daemonCommand{}
+	if _, err := cmd.listenTLS("Docker Engine", "tcp://127.0.0.1:0"); err == nil || !strings.Contains(err.Error(), "serving the Docker Engine API on tcp://127.0.0.1:0 requires TLS, pass -tls-cert, -tls-key and -tls-ca") {
+		t.Fatalf("expected tcp without TLS to fail, got: %v", err)
+	}
+
+	certFile, keyFile := writeTestCertificate(t, dir)
+	cmd.tlsCert, cmd.tlsKey, cmd.tlsCA = certFile, keyFile, keyFile
+	if _, err := cmd.listenTLS("BuildKit", "tcp://127.0.0.1:0"); err == nil || !strings.Contains(err.Error(), "has no PEM encoded certificates") {
+		t.Fatalf("expected an invalid CA to fail, got: %v", err)
+	}
+
+	cmd.tlsCA = certFile
+	l, err := cmd.listenTLS("BuildKit", "tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	handshake := func(certs []tls.Certificate) error {
+		errCh := make(chan error, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			defer conn.Close()
+			errCh <- conn.(*tls.Conn).Handshake()
+		}()
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{Certificates: certs, InsecureSkipVerify: true})
+		if err == nil {
+			conn.Close()
+		}
+		return <-errCh
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake([]tls.Certificate{cert}); err != nil {
+		t.Fatalf("expected a client with a certificate signed by the CA to connect, got: %v", err)
+	}
+	if err := handshake(nil); err == nil {
+		t.Fatal("expected a client without a certificate to be rejected")
+	}
+}
+
+func TestListenHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "img-daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := &daemonCommand{}
+	if _, err := cmd.listenHTTP("0.0.0.0:0"); err == nil || !strings.Contains(err.Error(), "serving the HTTP build API on 0.0.0.0:0 requires TLS") {
+		t.Fatalf("expected a non-loopback address without TLS to fail, got: %v", err)
+	}
+	l, err := cmd.listenHTTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected a loopback address to be served without TLS, got: %v", err)
+	}
+	l.Close()
+
+	cmd.tlsCert, cmd.tlsKey = writeTestCertificate(t, dir)
+	l, err = cmd.listenHTTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	// Clients do not need a certificate, they authenticate with tokens.
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + l.Addr().String() + "/v1/builds")
+	if err != nil {
+		t.Fatalf("expected the API to be served with TLS, got: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTeapot {
+		t.Fatalf("expected the handler to serve the request, got %s", resp.Status)
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	err := (&daemonCommand{debugAddr: "0.0.0.0:6060"}).Run(nil)
+	if err == nil || !strings.Contains(err.Error(), "serve them on a loopback address instead of 0.0.0.0:6060") {
+		t.Fatalf("expected a non-loopback debug address to fail, got: %v", err)
+	}
+
+	tests := map[string]int{
+		"/debug/pprof/":        http.StatusOK,
+		"/debug/pprof/cmdline": http.StatusNotFound,
+	}
+	for path, code := range tests {
+		w := httptest.NewRecorder()
+		debugHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != code {
+			t.Fatalf("expected status %d for %s, got %d", code, path, w.Code)
+		}
+	}
+}
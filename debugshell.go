@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/docker/docker/builder/dockerignore"
+	"github.com/genuinetools/img/client"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerfile2llb"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/util/appcontext"
+	"golang.org/x/sync/errgroup"
+)
+
+// runDebugShell starts an interactive shell in the root filesystem the failed
+// RUN step of a build ran in, with the same environment, working directory
+// and user as the step.
+func (cmd *buildCommand) runDebugShell(c *client.Client, frontendAttrs map[string]string, failedSessionID string, step buildStep) error {
+	dt, err := ioutil.ReadFile(cmd.dockerfilePath)
+	if err != nil {
+		return fmt.Errorf("reading dockerfile failed: %v", err)
+	}
+
+	excludes, err := readDockerignore(cmd.contextDir)
+	if err != nil {
+		return err
+	}
+
+	// Create the context.
+	ctx := appcontext.Context()
+	sess, sessDialer, err := c.SessionWithLocalDirs(ctx, cmd.getLocalDirs())
+	if err != nil {
+		return err
+	}
+	ctx = session.NewContext(ctx, sess.ID())
+	ctx = namespaces.WithNamespace(ctx, "buildkit")
+
+	// Convert the Dockerfile the same way the frontend did for the failed
+	// build to find the failed step, then again for the new session since the
+	// session is part of the definition of the local sources.
+	convertOpt := dockerfile2llb.ConvertOpt{
+		Target:       cmd.target,
+		MetaResolver: c,
+		BuildArgs:    filterFrontendAttrs(frontendAttrs, "build-arg:"),
+		Labels:       filterFrontendAttrs(frontendAttrs, "label:"),
+		SessionID:    failedSessionID,
+		Excludes:     excludes,
+	}
+	failedDef, err := dockerfileDefinition(ctx, dt, convertOpt)
+	if err != nil {
+		return err
+	}
+	index, err := client.FindExecOp(failedDef, step.Digest, step.Name)
+	if err != nil {
+		return err
+	}
+
+	convertOpt.SessionID = sess.ID()
+	def, err := dockerfileDefinition(ctx, dt, convertOpt)
+	if err != nil {
+		return err
+	}
+	shellDef, meta, err := client.DebugShellDefinition(def, index)
+	if err != nil {
+		return err
+	}
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("marshaling debug shell meta failed: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Starting a debug shell in the environment of the failed step %q, exit the shell to finish.\n", step.Name)
+
+	eg, ctx := errgroup.WithContext(ctx)
+	ch := make(chan *controlapi.StatusResponse)
+	eg.Go(func() error {
+		return sess.Run(ctx, sessDialer)
+	})
+	eg.Go(func() error {
+		defer sess.Close()
+		_, err := c.Solve(ctx, &controlapi.SolveRequest{
+			Ref:           identity.NewID(),
+			Session:       sess.ID(),
+			Definition:    shellDef,
+			Exporter:      client.DebugShellExporter,
+			ExporterAttrs: map[string]string{client.DebugShellMetaAttr: string(metaJSON)},
+		}, ch)
+		return err
+	})
+	eg.Go(func() error {
+		return discardProgress(ch)
+	})
+	return eg.Wait()
+}
+
+// dockerfileDefinition converts a Dockerfile to its LLB definition.
+func dockerfileDefinition(ctx context.Context, dt []byte, opt dockerfile2llb.ConvertOpt) (*pb.Definition, error) {
+	st, _, err := dockerfile2llb.Dockerfile2LLB(ctx, dt, opt)
+	if err != nil {
+		return nil, fmt.Errorf("converting dockerfile to llb failed: %v", err)
+	}
+
+	def, err := st.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("marshaling llb failed: %v", err)
+	}
+
+	return def.ToPB(), nil
+}
+
+// readDockerignore returns the exclude patterns from the .dockerignore file in
+// the context directory, if there is one.
+func readDockerignore(contextDir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(contextDir, ".dockerignore"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	excludes, err := dockerignore.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing .dockerignore failed: %v", err)
+	}
+	return excludes, nil
+}
+
+// filterFrontendAttrs returns the frontend attributes with the given prefix,
+// with the prefix removed from the keys.
+func filterFrontendAttrs(attrs map[string]string, prefix string) map[string]string {
+	m := map[string]string{}
+	for k, v := range attrs {
+		if strings.HasPrefix(k, prefix) {
+			m[strings.TrimPrefix(k, prefix)] = v
+		}
+	}
+	return m
+}
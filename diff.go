@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/namespaces"
+	units "github.com/docker/go-units"
+	"github.com/genuinetools/img/client"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/util/appcontext"
+)
+
+const diffShortHelp = `Show the layers and files that differ between two images.`
+
+var diffLongHelp = diffShortHelp + `
+Files are marked A when only the second image has them, D when only the first
+one has them and C when their content, type, mode or owner changed.`
+
+func (cmd *diffCommand) Name() string       { return "diff" }
+func (cmd *diffCommand) Args() string       { return "[OPTIONS] IMAGE IMAGE" }
+func (cmd *diffCommand) ShortHelp() string  { return diffShortHelp }
+func (cmd *diffCommand) LongHelp() string   { return diffLongHelp }
+func (cmd *diffCommand) Hidden() bool       { return false }
+func (cmd *diffCommand) DoReexec() bool     { return true }
+func (cmd *diffCommand) RequiresRunc() bool { return false }
+
+func (cmd *diffCommand) Register(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.noTrunc, "no-trunc", false, "Don't truncate the output")
+}
+
+type diffCommand struct {
+	noTrunc bool
+}
+
+func (cmd *diffCommand) Run(args []string) (err error) {
+	if len(args) != 2 {
+		return fmt.Errorf("must pass the two images to compare")
+	}
+
+	// Create the context.
+	ctx := appcontext.Context()
+	id := identity.NewID()
+	ctx = session.NewContext(ctx, id)
+	ctx = namespaces.WithNamespace(ctx, "buildkit")
+
+	// Create the client.
+	c, err := client.New(stateDir, backend, stateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	d, err := c.DiffImages(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, '\t', 0)
+
+	fmt.Fprintln(tw, "LAYER\tSIZE\tIMAGE")
+	for _, layers := range []struct {
+		image  string
+		layers []client.InspectedLayer
+	}{
+		{"both", d.SharedLayers},
+		{d.From.Name, d.RemovedLayers},
+		{d.To.Name, d.AddedLayers},
+	} {
+		for _, l := range layers.layers {
+			layer := l.Digest.String()
+			if !cmd.noTrunc {
+				layer = l.Digest.Encoded()[0:12]
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", layer, units.BytesSize(float64(l.Size)), layers.image)
+		}
+	}
+
+	tw.Flush()
+
+	if len(d.Changes) > 0 {
+		fmt.Println()
+		fmt.Fprintln(tw, "CHANGE\tPATH\tSIZE")
+		for _, change := range d.Changes {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", change.Kind, change.Path, sizeDelta(change.ToSize-change.FromSize))
+		}
+		tw.Flush()
+	}
+
+	fmt.Printf("\n%s: %s, %s: %s (%s)\n",
+		d.From.Name, units.BytesSize(float64(d.From.Size)),
+		d.To.Name, units.BytesSize(float64(d.To.Size)),
+		sizeDelta(d.To.Size-d.From.Size),
+	)
+
+	return nil
+}
+
+// sizeDelta formats a size difference with its sign.
+func sizeDelta(delta int64) string {
+	switch {
+	case delta > 0:
+		return "+" + units.BytesSize(float64(delta))
+	case delta < 0:
+		return "-" + units.BytesSize(float64(-delta))
+	}
+	return "0B"
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSizeDelta(t *testing.T) {
+	tests := map[int64]string{
+		0:     "0B",
+		2048:  "+2KiB",
+		-2048: "-2KiB",
+	}
+	for delta, expected := range tests {
+		if got := sizeDelta(delta); got != expected {
+			t.Fatalf("expected %s for %d, got %s", expected, delta, got)
+		}
+	}
+}
+
+func TestDiffErrors(t *testing.T) {
+	if err := (&diffCommand{}).Run([]string{"busybox"}); err == nil || !strings.Contains(err.Error(), "must pass the two images to compare") {
+		t.Fatalf("expected a missing image error, got: %v", err)
+	}
+}
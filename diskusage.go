@@ -1,15 +1,20 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"text/tabwriter"
+	"text/template"
+	"time"
 
 	"github.com/containerd/containerd/namespaces"
 	units "github.com/docker/go-units"
 	"github.com/genuinetools/img/client"
 	controlapi "github.com/moby/buildkit/api/services/control"
+	bkclient "github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/identity"
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/util/appcontext"
@@ -30,10 +35,40 @@ func (cmd *diskUsageCommand) RequiresRunc() bool { return false }
 
 func (cmd *diskUsageCommand) Register(fs *flag.FlagSet) {
 	fs.StringVar(&cmd.filter, "f", "", "Filter output based on conditions provided (snapshot ID supported)")
+	fs.Var(&cmd.filters, "filter", "Only show the records matching the filter, as KEY=VALUE (can be repeated)")
+	fs.StringVar(&cmd.format, "format", "", "Print the usage as json, or each record with the given Go template, e.g. '{{.ID}} {{.Size}}'")
 }
 
 type diskUsageCommand struct {
-	filter string
+	filter  string
+	filters stringSlice
+	format  string
+}
+
+// diskUsage is the usage of the build cache printed by -format json.
+type diskUsage struct {
+	Records     []diskUsageRecord `json:"records"`
+	Reclaimable int64             `json:"reclaimable"`
+	// Shared is the size of the records other records are built on, Private
+	// the size of the others.
+	Shared  int64 `json:"shared"`
+	Private int64 `json:"private"`
+	Total   int64 `json:"total"`
+}
+
+// diskUsageRecord is the usage of a build cache record.
+type diskUsageRecord struct {
+	ID          string     `json:"id"`
+	Parent      string     `json:"parent,omitempty"`
+	Description string     `json:"description"`
+	Type        string     `json:"type"`
+	Mutable     bool       `json:"mutable"`
+	InUse       bool       `json:"inUse"`
+	Shared      bool       `json:"shared"`
+	Size        int64      `json:"size"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	LastUsedAt  *time.Time `json:"lastUsedAt,omitempty"`
+	UsageCount  int64      `json:"usageCount"`
 }
 
 func (cmd *diskUsageCommand) Run(args []string) (err error) {
@@ -44,25 +79,69 @@ func (cmd *diskUsageCommand) Run(args []string) (err error) {
 	ctx = namespaces.WithNamespace(ctx, "buildkit")
 
 	// Create the client.
-	c, err := client.New(stateDir, backend, nil)
+	c, err := client.New(stateDir, backend, stateLock, nil)
 	if err != nil {
 		return err
 	}
 	defer c.Close()
 
-	resp, err := c.DiskUsage(ctx, &controlapi.DiskUsageRequest{Filter: cmd.filter})
+	var tmpl *template.Template
+	if cmd.format != "" && cmd.format != "json" {
+		tmpl, err = template.New("format").Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				dt, err := json.Marshal(v)
+				return string(dt), err
+			},
+			"size": func(n int64) string {
+				return units.BytesSize(float64(n))
+			},
+		}).Parse(cmd.format)
+		if err != nil {
+			return fmt.Errorf("parsing format template failed: %v", err)
+		}
+	}
+
+	// Get every record, the records built on a record tell if it is shared.
+	resp, err := c.DiskUsage(ctx, &controlapi.DiskUsageRequest{})
+	if err != nil {
+		return err
+	}
+	match, err := c.ParseRecordFilters(ctx, cmd.filters)
 	if err != nil {
 		return err
 	}
+	usage := newDiskUsage(resp.Record, func(di *controlapi.UsageRecord) bool {
+		return strings.HasPrefix(di.ID, cmd.filter) && match(&bkclient.UsageInfo{
+			ID:          di.ID,
+			Description: di.Description,
+			CreatedAt:   di.CreatedAt,
+			LastUsedAt:  di.LastUsedAt,
+		})
+	})
+
+	if cmd.format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		return enc.Encode(usage)
+	}
+	if tmpl != nil {
+		for _, r := range usage.Records {
+			if err := tmpl.Execute(os.Stdout, r); err != nil {
+				return fmt.Errorf("executing format template failed: %v", err)
+			}
+			fmt.Println()
+		}
+		return nil
+	}
 
 	tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, '\t', 0)
 
 	if debug {
-		printDebug(tw, resp.Record)
+		printDebug(tw, usage.Records)
 	} else {
 		fmt.Fprintln(tw, "ID\tRECLAIMABLE\tSIZE\tDESCRIPTION")
 
-		for _, di := range resp.Record {
+		for _, di := range usage.Records {
 			id := di.ID
 			if di.Mutable {
 				id += "*"
@@ -71,44 +150,82 @@ func (cmd *diskUsageCommand) Run(args []string) (err error) {
 			if len(desc) > 50 {
 				desc = desc[0:50] + "..."
 			}
-			fmt.Fprintf(tw, "%s\t%t\t%s\t%s\n", id, !di.InUse, units.BytesSize(float64(di.Size_)), desc)
+			fmt.Fprintf(tw, "%s\t%t\t%s\t%s\n", id, !di.InUse, units.BytesSize(float64(di.Size)), desc)
 		}
 
 		tw.Flush()
 	}
 
-	if cmd.filter == "" {
-		total := int64(0)
-		reclaimable := int64(0)
-
-		for _, di := range resp.Record {
-			if di.Size_ > 0 {
-				total += di.Size_
-				if !di.InUse {
-					reclaimable += di.Size_
-				}
-			}
-		}
-
+	if cmd.filter == "" && len(cmd.filters) == 0 {
 		tw = tabwriter.NewWriter(os.Stdout, 1, 8, 1, '\t', 0)
-		fmt.Fprintf(tw, "Reclaimable:\t%s\n", units.BytesSize(float64(reclaimable)))
-		fmt.Fprintf(tw, "Total:\t%s\n", units.BytesSize(float64(total)))
+		fmt.Fprintf(tw, "Reclaimable:\t%s\n", units.BytesSize(float64(usage.Reclaimable)))
+		fmt.Fprintf(tw, "Shared:\t%s\n", units.BytesSize(float64(usage.Shared)))
+		fmt.Fprintf(tw, "Private:\t%s\n", units.BytesSize(float64(usage.Private)))
+		fmt.Fprintf(tw, "Total:\t%s\n", units.BytesSize(float64(usage.Total)))
 		tw.Flush()
 	}
 
 	return nil
 }
 
-func printDebug(tw *tabwriter.Writer, du []*controlapi.UsageRecord) {
+// newDiskUsage returns the usage of the records that match, a record is
+// shared when other records are built on it.
+func newDiskUsage(records []*controlapi.UsageRecord, match func(*controlapi.UsageRecord) bool) diskUsage {
+	parents := map[string]bool{}
+	for _, di := range records {
+		if di.Parent != "" {
+			parents[di.Parent] = true
+		}
+	}
+
+	usage := diskUsage{Records: []diskUsageRecord{}}
+	for _, di := range records {
+		if !match(di) {
+			continue
+		}
+		r := diskUsageRecord{
+			ID:          di.ID,
+			Parent:      di.Parent,
+			Description: di.Description,
+			Type:        client.RecordType(di.Description),
+			Mutable:     di.Mutable,
+			InUse:       di.InUse,
+			Shared:      parents[di.ID],
+			Size:        di.Size_,
+			CreatedAt:   di.CreatedAt,
+			LastUsedAt:  di.LastUsedAt,
+			UsageCount:  di.UsageCount,
+		}
+		usage.Records = append(usage.Records, r)
+
+		if r.Size <= 0 {
+			continue
+		}
+		usage.Total += r.Size
+		if !r.InUse {
+			usage.Reclaimable += r.Size
+		}
+		if r.Shared {
+			usage.Shared += r.Size
+		} else {
+			usage.Private += r.Size
+		}
+	}
+	return usage
+}
+
+func printDebug(tw *tabwriter.Writer, du []diskUsageRecord) {
 	for _, di := range du {
 		fmt.Fprintf(tw, "%s:\t%v\n", "ID", di.ID)
 		if di.Parent != "" {
 			fmt.Fprintf(tw, "%s:\t%v\n", "Parent", di.Parent)
 		}
 		fmt.Fprintf(tw, "%s:\t%v\n", "Created at", di.CreatedAt)
+		fmt.Fprintf(tw, "%s:\t%v\n", "Type", di.Type)
 		fmt.Fprintf(tw, "%s:\t%v\n", "Mutable", di.Mutable)
 		fmt.Fprintf(tw, "%s:\t%v\n", "Reclaimable", !di.InUse)
-		fmt.Fprintf(tw, "%s:\t%s\n", "Size", units.BytesSize(float64(di.Size_)))
+		fmt.Fprintf(tw, "%s:\t%v\n", "Shared", di.Shared)
+		fmt.Fprintf(tw, "%s:\t%s\n", "Size", units.BytesSize(float64(di.Size)))
 		if di.Description != "" {
 			fmt.Fprintf(tw, "%s:\t%v\n", "Description", di.Description)
 		}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/docker/distribution/reference"
+	"github.com/genuinetools/img/client"
+	"github.com/genuinetools/img/version"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// dockerAPIVersion is the version of the Docker Engine API the shim reports.
+const dockerAPIVersion = "1.37"
+
+// dockerAPIVersionPrefix matches the optional version prefix of Docker
+// Engine API paths, e.g. /v1.37/build.
+var dockerAPIVersionPrefix = regexp.MustCompile(`^/v[0-9.]+`)
+
+// dockerAPIServer serves the subset of the Docker Engine API needed to build,
+// list, push and load images, so tools that only speak the Docker API can use
+// img.
+type dockerAPIServer struct {
+	client *client.Client
+	// webhooks receive the lifecycle events of the builds and pushes.
+	webhooks *webhooks
+}
+
+// ServeHTTP routes the Docker Engine API requests.
+func (s *dockerAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := dockerAPIVersionPrefix.ReplaceAllString(r.URL.Path, "")
+	w.Header().Set("Api-Version", dockerAPIVersion)
+
+	switch {
+	case p == "/_ping":
+		w.Write([]byte("OK"))
+	case p == "/version" && r.Method == http.MethodGet:
+		apiJSON(w, http.StatusOK, map[string]string{
+			"Version":    version.VERSION,
+			"GitCommit":  version.GITCOMMIT,
+			"ApiVersion": dockerAPIVersion,
+			"GoVersion":  runtime.Version(),
+			"Os":         runtime.GOOS,
+			"Arch":       runtime.GOARCH,
+		})
+	case p == "/build" && r.Method == http.MethodPost:
+		s.build(w, r)
+	case p == "/images/json" && r.Method == http.MethodGet:
+		s.listImages(w, r)
+	case p == "/images/load" && r.Method == http.MethodPost:
+		s.loadImages(w, r)
+	case strings.HasPrefix(p, "/images/") && strings.HasSuffix(p, "/push") && r.Method == http.MethodPost:
+		s.pushImage(w, r, strings.TrimSuffix(strings.TrimPrefix(p, "/images/"), "/push"))
+	default:
+		apiError(w, http.StatusNotFound, fmt.Sprintf("%s %s is not supported by img", r.Method, r.URL.Path))
+	}
+}
+
+// build builds the tar archive context in the request body, streaming the
+// progress as Docker JSON messages.
+func (s *dockerAPIServer) build(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	tags := q["t"]
+	if len(tags) == 0 {
+		apiError(w, http.StatusBadRequest, "img requires a tag for the image, pass one with t")
+		return
+	}
+	for i, tag := range tags {
+		named, err := reference.ParseNormalizedNamed(tag)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Sprintf("parsing image name %q failed: %v", tag, err))
+			return
+		}
+		tags[i] = reference.TagNameOnly(named).String()
+	}
+
+	opt := client.BuildOpt{
+		Tag:        tags[0],
+		Dockerfile: q.Get("dockerfile"),
+		Target:     q.Get("target"),
+		BuildArgs:  map[string]string{},
+	}
+	if v := q.Get("buildargs"); v != "" {
+		var buildArgs map[string]*string
+		if err := json.Unmarshal([]byte(v), &buildArgs); err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Sprintf("decoding buildargs failed: %v", err))
+			return
+		}
+		for k, v := range buildArgs {
+			if v != nil {
+				opt.BuildArgs[k] = *v
+			}
+		}
+	}
+
+	var err error
+	opt.ContextDir, err = ioutil.TempDir("", "img-docker-context-")
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, fmt.Sprintf("creating context directory failed: %v", err))
+		return
+	}
+	defer os.RemoveAll(opt.ContextDir)
+	if err := untar(opt.ContextDir, http.MaxBytesReader(w, r.Body, maxAPIContextSize), maxAPIContextSize); err != nil {
+		apiError(w, requestErrorCode(err), fmt.Sprintf("unpacking context failed: %v", err))
+		return
+	}
+
+	out := newDockerMessageWriter(w)
+	ctx := namespaces.WithNamespace(r.Context(), "buildkit")
+	ch := make(chan *controlapi.StatusResponse)
+	statusCh := watchStatus(ch, countSteps(), out.watch)
+	done := make(chan struct{})
+	go func() {
+		discardProgress(statusCh)
+		close(done)
+	}()
+	sendResult := s.webhooks.build("docker", "", tags[0], false)
+	resp, err := s.client.Build(ctx, opt, ch)
+	<-done
+	var dgst string
+	if resp != nil {
+		dgst = resp.ExporterResponse["containerimage.digest"]
+	}
+	sendResult(dgst, err)
+	if err != nil {
+		out.error(err)
+		return
+	}
+
+	// The image exporter only takes one name, tag the image with the rest.
+	for _, tag := range tags[1:] {
+		if err := s.client.TagImage(ctx, tags[0], tag); err != nil {
+			out.error(err)
+			return
+		}
+	}
+
+	out.write(dockerMessage{Aux: map[string]string{"ID": dgst}})
+	out.stream("Successfully built %s\n", dgst)
+	for _, tag := range tags {
+		out.stream("Successfully tagged %s\n", tag)
+	}
+}
+
+// dockerImage is an image in the Docker Engine API image list.
+type dockerImage struct {
+	ID          string            `json:"Id"`
+	ParentID    string            `json:"ParentId"`
+	RepoTags    []string          `json:"RepoTags"`
+	RepoDigests []string          `json:"RepoDigests"`
+	Created     int64             `json:"Created"`
+	Size        int64             `json:"Size"`
+	VirtualSize int64             `json:"VirtualSize"`
+	SharedSize  int64             `json:"SharedSize"`
+	Labels      map[string]string `json:"Labels"`
+	Containers  int64             `json:"Containers"`
+}
+
+// listImages lists the images, images with the same target are listed once
+// with all of their names.
+func (s *dockerAPIServer) listImages(w http.ResponseWriter, r *http.Request) {
+	images, err := s.client.ListImages(namespaces.WithNamespace(r.Context(), "buildkit"))
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	list := []*dockerImage{}
+	byDigest := map[digest.Digest]*dockerImage{}
+	for _, image := range images {
+		if img, ok := byDigest[image.Target.Digest]; ok {
+			img.RepoTags = append(img.RepoTags, image.Name)
+			continue
+		}
+		img := &dockerImage{
+			ID:          image.Target.Digest.String(),
+			RepoTags:    []string{image.Name},
+			RepoDigests: []string{},
+			Created:     image.CreatedAt.Unix(),
+			Size:        image.ContentSize,
+			VirtualSize: image.ContentSize,
+			SharedSize:  -1,
+			Containers:  -1,
+		}
+		byDigest[image.Target.Digest] = img
+		list = append(list, img)
+	}
+
+	apiJSON(w, http.StatusOK, list)
+}
+
+// loadImages loads the images in the tarball in the request body.
+func (s *dockerAPIServer) loadImages(w http.ResponseWriter, r *http.Request) {
+	out := newDockerMessageWriter(w)
+	images, err := s.client.LoadImage(namespaces.WithNamespace(r.Context(), "buildkit"), r.Body, "")
+	if err != nil {
+		out.error(err)
+		return
+	}
+	for _, image := range images {
+		out.stream("Loaded image: %s\n", image.Name)
+	}
+}
+
+// pushImage pushes the image to its registry. The registry credentials are
+// taken from the docker config of the user running img, the X-Registry-Auth
+// header is ignored.
+func (s *dockerAPIServer) pushImage(w http.ResponseWriter, r *http.Request, name string) {
+	image := name
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		image += ":" + tag
+	}
+
+	out := newDockerMessageWriter(w)
+	out.write(dockerMessage{Status: "Pushing " + image})
+
+	// Push needs a session for the registry credentials.
+	ctx := namespaces.WithNamespace(r.Context(), "buildkit")
+	start := time.Now()
+	err := pushWithSession(ctx, s.client, image, false)
+	s.webhooks.push("docker", image, start, err)
+	if err != nil {
+		out.error(err)
+		return
+	}
+	out.write(dockerMessage{Status: "Pushed " + image})
+}
+
+// dockerMessage is a Docker JSON message as streamed by the build, push and
+// load endpoints.
+type dockerMessage struct {
+	Stream      string             `json:"stream,omitempty"`
+	Status      string             `json:"status,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	ErrorDetail *dockerErrorDetail `json:"errorDetail,omitempty"`
+	Aux         map[string]string  `json:"aux,omitempty"`
+}
+
+type dockerErrorDetail struct {
+	Message string `json:"message"`
+}
+
+// dockerMessageWriter streams Docker JSON messages to a response.
+type dockerMessageWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	enc     *json.Encoder
+	started map[digest.Digest]bool
+}
+
+func newDockerMessageWriter(w http.ResponseWriter) *dockerMessageWriter {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &dockerMessageWriter{
+		w:       w,
+		enc:     enc,
+		started: map[digest.Digest]bool{},
+	}
+}
+
+func (d *dockerMessageWriter) write(m dockerMessage) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.enc.Encode(m); err != nil {
+		logrus.Debugf("writing Docker API message failed: %v", err)
+		return
+	}
+	if f, ok := d.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (d *dockerMessageWriter) stream(format string, args ...interface{}) {
+	d.write(dockerMessage{Stream: fmt.Sprintf(format, args...)})
+}
+
+func (d *dockerMessageWriter) error(err error) {
+	d.write(dockerMessage{Error: err.Error(), ErrorDetail: &dockerErrorDetail{Message: err.Error()}})
+}
+
+// watch streams the started steps and their output. It is meant to be used
+// as a watcher with watchStatus.
+func (d *dockerMessageWriter) watch(resp *controlapi.StatusResponse) {
+	for _, v := range resp.Vertexes {
+		if v.Started == nil || d.started[v.Digest] {
+			continue
+		}
+		d.started[v.Digest] = true
+		d.stream("=> %s\n", v.Name)
+	}
+	for _, l := range resp.Logs {
+		d.stream("%s", l.Msg)
+	}
+}
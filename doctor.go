@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd/snapshots/overlay"
+	units "github.com/docker/go-units"
+	"github.com/genuinetools/img/internal/binutils"
+)
+
+const doctorShortHelp = `Check the environment for problems running img.`
+
+var doctorLongHelp = doctorShortHelp + `
+Checks kernel features, the uid/gid mapping setup, the state directory and
+registry connectivity and prints how to fix any problems found.`
+
+func (cmd *doctorCommand) Name() string       { return "doctor" }
+func (cmd *doctorCommand) Args() string       { return "[OPTIONS]" }
+func (cmd *doctorCommand) ShortHelp() string  { return doctorShortHelp }
+func (cmd *doctorCommand) LongHelp() string   { return doctorLongHelp }
+func (cmd *doctorCommand) Hidden() bool       { return false }
+func (cmd *doctorCommand) DoReexec() bool     { return false }
+func (cmd *doctorCommand) RequiresRunc() bool { return false }
+
+func (cmd *doctorCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.registry, "registry", "https://registry-1.docker.io/v2/", "Registry endpoint to check connectivity against")
+}
+
+type doctorCommand struct {
+	registry string
+}
+
+// minSubIDs is the number of subordinate ids needed to map a typical
+// distribution image.
+const minSubIDs = 65536
+
+type checkStatus string
+
+const (
+	checkOK   checkStatus = "ok"
+	checkWarn checkStatus = "warn"
+	checkFail checkStatus = "fail"
+)
+
+// checkResult is the outcome of a single diagnostic check.
+type checkResult struct {
+	status checkStatus
+	detail string
+	fix    string
+}
+
+// diagnostic is a named environment check.
+type diagnostic struct {
+	name  string
+	check func() checkResult
+}
+
+func (cmd *doctorCommand) Run(args []string) error {
+	diagnostics := []diagnostic{
+		{"user namespaces", checkUserNamespaces},
+		{"newuidmap", func() checkResult { return checkBinary("newuidmap") }},
+		{"newgidmap", func() checkResult { return checkBinary("newgidmap") }},
+		{"subuid range", func() checkResult { return checkSubIDs("/etc/subuid") }},
+		{"subgid range", func() checkResult { return checkSubIDs("/etc/subgid") }},
+		{"overlayfs", checkOverlay},
+		{"cgroup v2", checkCgroupV2},
+		{"runc", checkRunc},
+		{"state directory", checkStateDir},
+		{"registry", func() checkResult { return checkRegistry(cmd.registry) }},
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, '\t', 0)
+	fmt.Fprintln(tw, "CHECK\tSTATUS\tDETAIL")
+
+	var fixes []string
+	failed := false
+	for _, d := range diagnostics {
+		r := d.check()
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", d.name, r.status, r.detail)
+		if r.fix != "" && r.status != checkOK {
+			fixes = append(fixes, fmt.Sprintf("%s: %s", d.name, r.fix))
+		}
+		if r.status == checkFail {
+			failed = true
+		}
+	}
+	tw.Flush()
+
+	if len(fixes) > 0 {
+		fmt.Println()
+		fmt.Println("Suggested fixes:")
+		for _, fix := range fixes {
+			fmt.Printf("  - %s\n", fix)
+		}
+	}
+
+	if failed {
+		return errors.New("one or more checks failed")
+	}
+	return nil
+}
+
+func checkUserNamespaces() checkResult {
+	if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+		return checkResult{checkFail, "kernel does not support user namespaces", "use a kernel built with CONFIG_USER_NS"}
+	}
+
+	if v, err := readSysctl("/proc/sys/kernel/unprivileged_userns_clone"); err == nil && v == "0" {
+		return checkResult{checkFail, "unprivileged user namespaces are disabled", "run `sysctl -w kernel.unprivileged_userns_clone=1`"}
+	}
+
+	if v, err := readSysctl("/proc/sys/user/max_user_namespaces"); err == nil && v == "0" {
+		return checkResult{checkFail, "user.max_user_namespaces is 0", "run `sysctl -w user.max_user_namespaces=15000`"}
+	}
+
+	return checkResult{checkOK, "enabled", ""}
+}
+
+func checkBinary(name string) checkResult {
+	p, err := exec.LookPath(name)
+	if err != nil {
+		return checkResult{checkFail, name + " not found in PATH", "install the uidmap package (or shadow-utils) which provides newuidmap and newgidmap"}
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return checkResult{checkFail, err.Error(), ""}
+	}
+	// The binaries need to be setuid or have file capabilities to write the
+	// mappings, we can only easily check for the former.
+	if fi.Mode()&os.ModeSetuid == 0 {
+		return checkResult{checkWarn, p + " is not setuid", "make sure " + p + " is setuid root or has the cap_setuid/cap_setgid file capabilities"}
+	}
+
+	return checkResult{checkOK, p, ""}
+}
+
+func checkSubIDs(file string) checkResult {
+	u, err := user.Current()
+	if err != nil {
+		return checkResult{checkWarn, fmt.Sprintf("looking up current user failed: %v", err), ""}
+	}
+	if u.Uid == "0" {
+		return checkResult{checkOK, "running as root", ""}
+	}
+
+	fix := fmt.Sprintf("add an entry like `%s:100000:%d` to %s", u.Username, minSubIDs, file)
+
+	f, err := os.Open(file)
+	if err != nil {
+		return checkResult{checkFail, err.Error(), fix}
+	}
+	defer f.Close()
+
+	var count int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(parts) != 3 || (parts[0] != u.Username && parts[0] != u.Uid) {
+			continue
+		}
+		n, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		count += n
+	}
+
+	switch {
+	case count == 0:
+		return checkResult{checkFail, "no entries for " + u.Username, fix}
+	case count < minSubIDs:
+		return checkResult{checkWarn, fmt.Sprintf("only %d ids for %s", count, u.Username), fix}
+	}
+	return checkResult{checkOK, fmt.Sprintf("%d ids for %s", count, u.Username), ""}
+}
+
+func checkOverlay() checkResult {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return checkResult{checkWarn, err.Error(), ""}
+	}
+	if err := overlay.Supported(stateDir); err != nil {
+		return checkResult{checkWarn, fmt.Sprintf("not supported on %s: %v", stateDir, err), "the native backend will be used, which is slower; use a kernel with unprivileged overlayfs support (Ubuntu or >= 5.11)"}
+	}
+	return checkResult{checkOK, "supported on " + stateDir, ""}
+}
+
+func checkCgroupV2() checkResult {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		return checkResult{checkWarn, "cgroup v1 (or hybrid) hierarchy", "resource limits for build steps need cgroup v2, boot with systemd.unified_cgroup_hierarchy=1"}
+	}
+	return checkResult{checkOK, "unified hierarchy", ""}
+}
+
+func checkRunc() checkResult {
+	if binutils.RuncBinaryExists() {
+		p, _ := exec.LookPath("runc")
+		return checkResult{checkOK, p, ""}
+	}
+	return checkResult{checkOK, "not installed, the embedded binary will be used", ""}
+}
+
+func checkStateDir() checkResult {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return checkResult{checkFail, err.Error(), "pass a writable directory with -state"}
+	}
+
+	// Make sure we can actually write to it.
+	f, err := ioutil.TempFile(stateDir, ".img-doctor-")
+	if err != nil {
+		return checkResult{checkFail, fmt.Sprintf("%s is not writable: %v", stateDir, err), "fix the permissions of " + stateDir + " or pass another directory with -state"}
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(stateDir, &st); err != nil {
+		return checkResult{checkWarn, err.Error(), ""}
+	}
+	free := int64(st.Bavail) * int64(st.Bsize)
+	detail := fmt.Sprintf("%s (%s free)", filepath.Clean(stateDir), units.BytesSize(float64(free)))
+	if free < 1<<30 {
+		return checkResult{checkWarn, detail, "free up space or remove unused images with `img rm`"}
+	}
+	return checkResult{checkOK, detail, ""}
+}
+
+func checkRegistry(endpoint string) checkResult {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(endpoint)
+	if err != nil {
+		return checkResult{checkFail, err.Error(), "check your network and proxy settings (HTTP_PROXY, HTTPS_PROXY, NO_PROXY)"}
+	}
+	resp.Body.Close()
+
+	// The registry API base returns 401 when authentication is required,
+	// which still means we can reach it.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return checkResult{checkWarn, fmt.Sprintf("%s returned %s", endpoint, resp.Status), ""}
+	}
+	return checkResult{checkOK, "reachable " + endpoint, ""}
+}
+
+func readSysctl(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckRegistry(t *testing.T) {
+	tests := []struct {
+		code   int
+		status checkStatus
+	}{
+		{http.StatusOK, checkOK},
+		{http.StatusUnauthorized, checkOK},
+		{http.StatusNotFound, checkWarn},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.code)
+		}))
+		r := checkRegistry(srv.URL + "/v2/")
+		srv.Close()
+		if r.status != tt.status {
+			t.Fatalf("expected status %s for a %d response, got %s: %s", tt.status, tt.code, r.status, r.detail)
+		}
+	}
+
+	// The server is closed now, the registry cannot be reached.
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	r := checkRegistry(srv.URL + "/v2/")
+	if r.status != checkFail || !strings.Contains(r.fix, "proxy settings") {
+		t.Fatalf("expected the check to fail with a fix, got %s: %s", r.status, r.fix)
+	}
+}
+
+func TestCheckBinary(t *testing.T) {
+	r := checkBinary("img-doctor-does-not-exist")
+	if r.status != checkFail || !strings.Contains(r.detail, "not found in PATH") {
+		t.Fatalf("expected a missing binary to fail, got %s: %s", r.status, r.detail)
+	}
+}
+
+func TestCheckStateDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "img-doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(s string) { stateDir = s }(stateDir)
+	stateDir = dir
+
+	r := checkStateDir()
+	if r.status == checkFail || !strings.HasPrefix(r.detail, dir) {
+		t.Fatalf("expected the state directory to be usable, got %s: %s", r.status, r.detail)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/genuinetools/img/client"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerfile2llb"
+	"github.com/moby/buildkit/util/appcontext"
+)
+
+// plan converts the Dockerfile to LLB for every target the way the
+// frontend does, and prints the steps with whether they are predicted to be
+// in the build cache, without solving anything.
+func (cmd *buildCommand) plan(c *client.Client, frontendAttrs map[string]string, targets []string) error {
+	dt, err := ioutil.ReadFile(cmd.dockerfilePath)
+	if err != nil {
+		return fmt.Errorf("reading dockerfile failed: %v", err)
+	}
+	excludes, err := readDockerignore(cmd.contextDir)
+	if err != nil {
+		return err
+	}
+
+	// The stages without the cache, as the frontend reads them.
+	var ignoreCache []string
+	if v, ok := frontendAttrs["no-cache"]; ok {
+		ignoreCache = []string{}
+		if v != "" {
+			ignoreCache = strings.Split(v, ",")
+		}
+	}
+
+	ctx := namespaces.WithNamespace(appcontext.Context(), "buildkit")
+	for i, target := range targets {
+		def, err := dockerfileDefinition(ctx, dt, dockerfile2llb.ConvertOpt{
+			Target:       target,
+			MetaResolver: c,
+			BuildArgs:    filterFrontendAttrs(frontendAttrs, "build-arg:"),
+			Labels:       filterFrontendAttrs(frontendAttrs, "label:"),
+			Excludes:     excludes,
+			IgnoreCache:  ignoreCache,
+		})
+		if err != nil {
+			return err
+		}
+		steps, err := c.PlanDefinition(ctx, def)
+		if err != nil {
+			return fmt.Errorf("planning the build failed: %v", err)
+		}
+
+		if len(targets) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("Target %s:\n", target)
+		}
+		printPlan(steps)
+	}
+	return nil
+}
+
+// printPlan prints the base images and the steps of a build as a table, each
+// step with the steps it uses.
+func printPlan(steps []client.PlannedStep) {
+	tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, '\t', 0)
+	fmt.Fprintln(tw, "IMAGE\tDIGEST")
+	for _, step := range steps {
+		if step.Image != "" {
+			fmt.Fprintf(tw, "%s\t%s\n", step.Image, step.ImageDigest)
+		}
+	}
+	tw.Flush()
+	fmt.Println()
+
+	counts := map[string]int{}
+	tw = tabwriter.NewWriter(os.Stdout, 1, 8, 1, '\t', 0)
+	fmt.Fprintln(tw, "#\tSTEP\tCACHE\tINPUTS")
+	for i, step := range steps {
+		name := step.Name
+		if len(name) > 60 {
+			name = name[0:60] + "..."
+		}
+		inputs := make([]string, 0, len(step.Inputs))
+		for _, in := range step.Inputs {
+			inputs = append(inputs, fmt.Sprintf("#%d", in+1))
+		}
+		fmt.Fprintf(tw, "#%d\t%s\t%s\t%s\n", i+1, name, step.Cache, strings.Join(inputs, ","))
+		counts[step.Cache]++
+	}
+	tw.Flush()
+
+	fmt.Printf("\n%d steps: %d cached, %d to run, %d unknown until the build context is sent\n", len(steps), counts[client.StepCached], counts[client.StepRun], counts[client.StepUnknown])
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// errorHint is a remediation hint for errors matching a known failure.
+type errorHint struct {
+	re   *regexp.Regexp
+	hint string
+}
+
+// errorHints are the known failure signatures and how to fix them. The first
+// matching hint is shown.
+var errorHints = []errorHint{
+	{
+		regexp.MustCompile(`(?i)failed to use new[ug]idmap|no subuid ranges|no subgid ranges`),
+		"make sure your user has at least 65536 ids in /etc/subuid and /etc/subgid, e.g. `user:100000:65536`",
+	},
+	{
+		regexp.MustCompile(`(?i)mapping tool not present|new[ug]idmap.*(executable file not found|no such file)`),
+		"install newuidmap and newgidmap, they are provided by the uidmap (or shadow-utils) package",
+	},
+	{
+		regexp.MustCompile(`(?i)overlay.*(operation not permitted|permission denied)`),
+		"your kernel does not allow mounting overlayfs without privileges, use `-backend native`",
+	},
+	{
+		regexp.MustCompile(`(?i)401 unauthorized|authentication required|unauthorized: `),
+		"log in to the registry with `img login REGISTRY` and check you have access to the repository",
+	},
+	{
+		regexp.MustCompile(`(?i)no space left on device|message larger than max|file too large`),
+		"the build context may be too large, exclude files with a .dockerignore or free up space with `img rm`",
+	},
+}
+
+// withHint appends the remediation hint for a known failure to the error
+// message. Errors that do not match a known failure are returned as is.
+func withHint(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+	for _, h := range errorHints {
+		if h.re.MatchString(msg) {
+			return fmt.Errorf("%s\nhint: %s (run `img doctor` to check your environment)", msg, h.hint)
+		}
+	}
+	return err
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestWithHint(t *testing.T) {
+	tests := []struct {
+		name string
+		err  string
+		hint string
+	}{
+		{name: "no match", err: "image not found"},
+		{name: "subuid", err: "failed to use newuidmap: exit status 1: newuidmap: uid range [1-65537) -> [100000-165536) not allowed", hint: "at least 65536 ids in /etc/subuid"},
+		{name: "no subgid ranges", err: "No subgid ranges found for group \"jess\"", hint: "at least 65536 ids in /etc/subuid"},
+		{name: "newuidmap missing", err: `exec: "newuidmap": executable file not found in $PATH`, hint: "install newuidmap and newgidmap"},
+		{name: "overlay", err: "mounting overlay failed: operation not permitted", hint: "use `-backend native`"},
+		{name: "auth", err: "pulling failed: 401 Unauthorized", hint: "img login REGISTRY"},
+		{name: "disk full", err: "write /tmp/img/x: no space left on device", hint: "exclude files with a .dockerignore"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := withHint(errors.New(tt.err))
+			if tt.hint == "" {
+				if err.Error() != tt.err {
+					t.Fatalf("expected the error to be returned as is, got: %v", err)
+				}
+				return
+			}
+			if !strings.HasPrefix(err.Error(), tt.err+"\nhint: ") || !strings.Contains(err.Error(), tt.hint) || !strings.HasSuffix(err.Error(), "(run `img doctor` to check your environment)") {
+				t.Fatalf("expected the hint %q, got: %v", tt.hint, err)
+			}
+		})
+	}
+
+	if withHint(nil) != nil {
+		t.Fatal("expected no error for nil")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Exit codes for the classes of failure a command can have, so scripts can
+// act on the type of failure without parsing the error message. 2 is left to
+// the usage errors of the flag package.
+const (
+	// exitCodeFailure is used for any failure not covered by another code.
+	exitCodeFailure = 1
+	// exitCodeStep is used when a build step failed to run.
+	exitCodeStep = 3
+	// exitCodeAuth is used when the registry rejected the credentials.
+	exitCodeAuth = 4
+	// exitCodeNetwork is used when a remote could not be reached.
+	exitCodeNetwork = 5
+	// exitCodeParse is used when the Dockerfile could not be parsed.
+	exitCodeParse = 6
+	// exitCodeCancelled is used when the command was interrupted by SIGINT or
+	// SIGTERM, which cancel the context of the command, as shells do for
+	// SIGINT.
+	exitCodeCancelled = 130
+)
+
+// exitCodeRule maps errors with a message containing one of the patterns to
+// an exit code.
+type exitCodeRule struct {
+	code     int
+	patterns []string
+}
+
+// exitCodeRules are checked in order, so more specific failures must come
+// first. For example a step that failed because it could not reach the
+// network is a step failure.
+var exitCodeRules = []exitCodeRule{
+	{exitCodeCancelled, []string{context.Canceled.Error()}},
+	{exitCodeParse, []string{"dockerfile parse error", "unknown instruction", "failed to parse dockerfile", "dockerfile/parser"}},
+	{exitCodeStep, []string{"executor failed running"}},
+	{exitCodeAuth, []string{"unauthorized", "authentication required", "401 unauthorized", "denied: requested access"}},
+	{exitCodeNetwork, []string{"dial tcp", "no such host", "connection refused", "connection reset", "i/o timeout", "tls handshake", "network is unreachable"}},
+}
+
+// exitCode returns the exit code for err.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, rule := range exitCodeRules {
+		for _, p := range rule.patterns {
+			if strings.Contains(msg, p) {
+				return rule.code
+			}
+		}
+	}
+
+	if _, ok := errors.Cause(err).(net.Error); ok {
+		return exitCodeNetwork
+	}
+
+	return exitCodeFailure
+}
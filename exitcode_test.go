@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{name: "no error", err: nil, expected: 0},
+		{name: "other failure", err: errors.New("image not found"), expected: exitCodeFailure},
+		{name: "cancelled", err: pkgerrors.Wrap(context.Canceled, "solving failed"), expected: exitCodeCancelled},
+		{name: "parse error", err: errors.New("failed to solve: Dockerfile parse error line 2: unknown instruction: RUNN"), expected: exitCodeParse},
+		{name: "step failure", err: errors.New("executor failed running [/bin/sh -c make]: exit code: 2"), expected: exitCodeStep},
+		{name: "step failure reaching the network", err: errors.New("executor failed running [/bin/sh -c curl x]: dial tcp: lookup x: no such host"), expected: exitCodeStep},
+		{name: "auth", err: errors.New("failed to authorize: 401 Unauthorized"), expected: exitCodeAuth},
+		{name: "network message", err: errors.New("Get https://r.j3ss.co/v2/: dial tcp 1.2.3.4:443: i/o timeout"), expected: exitCodeNetwork},
+		{name: "network error", err: pkgerrors.Wrap(&net.DNSError{Err: "server misbehaving", Name: "r.j3ss.co"}, "pulling failed"), expected: exitCodeNetwork},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := exitCode(tt.err); code != tt.expected {
+				t.Fatalf("expected exit code %d, got %d", tt.expected, code)
+			}
+		})
+	}
+}
+
+// runExitCode runs the test command and returns its exit code and output.
+func runExitCode(t *testing.T, stdin io.Reader, args ...string) (int, string) {
+	cmd := testCommand(args...)
+	cmd.Stdin = stdin
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return 0, string(out)
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("running img %v failed: %v", args, err)
+	}
+	return exitErr.Sys().(syscall.WaitStatus).ExitStatus(), string(out)
+}
+
+func TestExitCodeCommands(t *testing.T) {
+	if code, out := runExitCode(t, nil, "build", "-nope"); code != 2 {
+		t.Fatalf("expected exit code 2 for an unknown flag, got %d: %s", code, out)
+	}
+
+	if code, out := runExitCode(t, withDockerfile("FROM busybox\nRUNN true\n"), "build", "-t", "exitcodetest", "-"); code != exitCodeParse {
+		t.Fatalf("expected exit code %d for a Dockerfile parse error, got %d: %s", exitCodeParse, code, out)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/docker/pkg/term"
+	"github.com/genuinetools/img/client"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/util/appcontext"
+)
+
+const exportShortHelp = `Export the filesystem of an image as a tar archive (streamed to STDOUT by default).`
+
+var exportLongHelp = exportShortHelp + `
+The layers are flattened into a single root filesystem, as for LXC or
+systemd-nspawn, without the image config.`
+
+func (cmd *exportCommand) Name() string       { return "export" }
+func (cmd *exportCommand) Args() string       { return "[OPTIONS] IMAGE" }
+func (cmd *exportCommand) ShortHelp() string  { return exportShortHelp }
+func (cmd *exportCommand) LongHelp() string   { return exportLongHelp }
+func (cmd *exportCommand) Hidden() bool       { return false }
+func (cmd *exportCommand) DoReexec() bool     { return true }
+func (cmd *exportCommand) RequiresRunc() bool { return false }
+
+func (cmd *exportCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.output, "o", "", "Write to a file, instead of STDOUT")
+	fs.StringVar(&cmd.platform, "platform", platforms.Default(), "Platform of the image to export from a manifest list")
+}
+
+type exportCommand struct {
+	output   string
+	platform string
+}
+
+func (cmd *exportCommand) Run(args []string) (err error) {
+	if len(args) < 1 {
+		return fmt.Errorf("must pass an image to export")
+	}
+	options := client.ExportOptions{Platform: cmd.platform}
+	if _, err := platforms.Parse(cmd.platform); err != nil {
+		return fmt.Errorf("invalid platform %q: %v", cmd.platform, err)
+	}
+
+	// Create the context.
+	ctx := appcontext.Context()
+	id := identity.NewID()
+	ctx = session.NewContext(ctx, id)
+	ctx = namespaces.WithNamespace(ctx, "buildkit")
+
+	// Create the client.
+	c, err := client.New(stateDir, backend, stateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Create the writer.
+	writer, err := cmd.writer()
+	if err != nil {
+		return err
+	}
+
+	return c.ExportImage(ctx, args[0], options, writer)
+}
+
+func (cmd *exportCommand) writer() (io.WriteCloser, error) {
+	if cmd.output != "" {
+		return os.Create(cmd.output)
+	}
+
+	if term.IsTerminal(os.Stdout.Fd()) {
+		return nil, fmt.Errorf("cowardly refusing to export to a terminal. Use the -o flag or redirect")
+	}
+
+	return os.Stdout, nil
+}
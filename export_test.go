@@ -0,0 +1,12 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExportErrors(t *testing.T) {
+	if err := (&exportCommand{}).Run(nil); err == nil || !strings.Contains(err.Error(), "must pass an image to export") {
+		t.Fatalf("expected a missing image error, got: %v", err)
+	}
+}
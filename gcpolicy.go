@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	units "github.com/docker/go-units"
+	"github.com/genuinetools/img/client"
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/sirupsen/logrus"
+)
+
+// gcPolicyFile is the name of the file, in the state directory, holding the
+// GC policy applied at the end of builds.
+const gcPolicyFile = "gcpolicy.json"
+
+// gcPolicy is the GC policy of a state directory, its rules are applied in
+// order like the gcpolicy of the OCI worker of buildkitd.
+type gcPolicy struct {
+	Rules []gcRule `json:"gcpolicy"`
+}
+
+// gcRule prunes the records matching its filters that were not used for
+// KeepDuration, until the build cache uses at most KeepBytes.
+type gcRule struct {
+	All          bool         `json:"all"`
+	Filters      []string     `json:"filters"`
+	KeepDuration jsonDuration `json:"keepDuration"`
+	KeepBytes    jsonBytes    `json:"keepBytes"`
+}
+
+// jsonDuration is a duration written as a string, such as "48h", or a number
+// of seconds as buildkitd does.
+type jsonDuration time.Duration
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*d = jsonDuration(time.Duration(v) * time.Second)
+	case string:
+		dur, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = jsonDuration(dur)
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	return nil
+}
+
+// jsonBytes is a size written as a string, such as "10GB", or a number of
+// bytes.
+type jsonBytes int64
+
+func (s *jsonBytes) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*s = jsonBytes(v)
+	case string:
+		n, err := units.RAMInBytes(v)
+		if err != nil {
+			return err
+		}
+		*s = jsonBytes(n)
+	default:
+		return fmt.Errorf("invalid size %s", b)
+	}
+	return nil
+}
+
+// loadGCPolicy reads the GC policy of the state directory, it returns no
+// rules if there is no policy.
+func loadGCPolicy(dir string) ([]client.PruneOptions, error) {
+	p := filepath.Join(dir, gcPolicyFile)
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var policy gcPolicy
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return nil, fmt.Errorf("parsing %s failed: %v", p, err)
+	}
+
+	rules := make([]client.PruneOptions, 0, len(policy.Rules))
+	for _, r := range policy.Rules {
+		rule := client.PruneOptions{
+			Filters:     r.Filters,
+			KeepStorage: int64(r.KeepBytes),
+			All:         r.All,
+		}
+		if r.KeepDuration > 0 {
+			rule.Filters = append(rule.Filters, "until="+time.Duration(r.KeepDuration).String())
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// applyGCPolicy prunes the build cache with the GC policy of the state
+// directory once a build is done. Failures are only logged since the GC
+// should never fail a build.
+func applyGCPolicy(c *client.Client) {
+	rules, err := loadGCPolicy(stateDir)
+	if err != nil {
+		logrus.Warnf("loading the GC policy failed: %v", err)
+		return
+	}
+	if len(rules) == 0 {
+		return
+	}
+
+	ctx := namespaces.WithNamespace(appcontext.Context(), "buildkit")
+	pruned, err := c.Prune(ctx, rules...)
+	if err != nil {
+		logrus.Warnf("applying the GC policy failed: %v", err)
+	}
+	var total int64
+	for _, di := range pruned {
+		if di.Size > 0 {
+			total += di.Size
+		}
+	}
+	if len(pruned) > 0 {
+		logrus.Infof("GC policy pruned %d build cache records, %s", len(pruned), units.BytesSize(float64(total)))
+	}
+}
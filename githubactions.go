@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/builder/dockerfile/parser"
+	units "github.com/docker/go-units"
+)
+
+// githubActions writes the outputs, step summary and annotations of a build
+// when img runs in a GitHub Actions workflow.
+type githubActions struct {
+	outputFile  string
+	summaryFile string
+}
+
+// newGitHubActions returns the GitHub Actions integration if img runs in a
+// workflow, which sets GITHUB_OUTPUT and GITHUB_STEP_SUMMARY.
+func newGitHubActions() (*githubActions, bool) {
+	g := &githubActions{
+		outputFile:  os.Getenv("GITHUB_OUTPUT"),
+		summaryFile: os.Getenv("GITHUB_STEP_SUMMARY"),
+	}
+	return g, g.outputFile != "" || g.summaryFile != ""
+}
+
+// WriteOutputs sets the image and digest step outputs.
+func (g *githubActions) WriteOutputs(image, digest string) error {
+	if g.outputFile == "" {
+		return nil
+	}
+	return appendFile(g.outputFile, fmt.Sprintf("image=%s\ndigest=%s\n", image, digest))
+}
+
+// WriteSummary adds a markdown table of the build steps to the job summary.
+func (g *githubActions) WriteSummary(image, digest string, steps []buildStep, buildErr error) error {
+	if g.summaryFile == "" {
+		return nil
+	}
+
+	var b strings.Builder
+	if buildErr != nil {
+		fmt.Fprintf(&b, "### Build of `%s` failed\n\n", image)
+	} else {
+		fmt.Fprintf(&b, "### Built `%s`\n\n", image)
+	}
+	b.WriteString("| Step | Status | Duration | Transferred |\n")
+	b.WriteString("|------|--------|----------|-------------|\n")
+	for _, step := range steps {
+		// Pipes would end the table cell.
+		name := strings.Replace(step.Name, "|", "\\|", -1)
+		fmt.Fprintf(&b, "| `%s` | %s | %s | %s |\n", name, step.Status(), step.Duration.Round(time.Millisecond), units.BytesSize(float64(step.Transferred)))
+	}
+	if digest != "" {
+		fmt.Fprintf(&b, "\n**Digest:** `%s`\n", digest)
+	}
+	if buildErr != nil {
+		fmt.Fprintf(&b, "\n```\n%v\n```\n", buildErr)
+	}
+	b.WriteString("\n")
+
+	return appendFile(g.summaryFile, b.String())
+}
+
+// AnnotateDockerfile prints the warnings for the Dockerfile as workflow
+// commands, so they show up as annotations on the file.
+func (g *githubActions) AnnotateDockerfile(w io.Writer, dockerfile string) {
+	f, err := os.Open(dockerfile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	result, err := parser.Parse(f)
+	if err != nil {
+		// The build reports parse errors.
+		return
+	}
+	for _, warning := range result.Warnings {
+		workflowCommand(w, "warning", dockerfile, 0, strings.TrimPrefix(warning, "[WARNING]: "))
+	}
+	for _, node := range result.AST.Children {
+		if strings.EqualFold(node.Value, "maintainer") {
+			workflowCommand(w, "warning", dockerfile, node.StartLine, "MAINTAINER is deprecated, use a LABEL instead")
+		}
+	}
+}
+
+// AnnotateError prints a failed build as an error workflow command for the
+// Dockerfile.
+func (g *githubActions) AnnotateError(w io.Writer, dockerfile string, err error) {
+	workflowCommand(w, "error", dockerfile, 0, err.Error())
+}
+
+// workflowCommand prints a GitHub Actions workflow command annotating file.
+func workflowCommand(w io.Writer, command, file string, line int, msg string) {
+	props := "file=" + escapeWorkflowProperty(file)
+	if line > 0 {
+		props += fmt.Sprintf(",line=%d", line)
+	}
+	fmt.Fprintf(w, "::%s %s::%s\n", command, props, escapeWorkflowData(msg))
+}
+
+func escapeWorkflowData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+func escapeWorkflowProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
+
+func appendFile(path, s string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening %s failed: %v", path, err)
+	}
+	if _, err := f.WriteString(s); err != nil {
+		f.Close()
+		return fmt.Errorf("writing to %s failed: %v", path, err)
+	}
+	return f.Close()
+}
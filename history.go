@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	units "github.com/docker/go-units"
+	"github.com/genuinetools/img/client"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/util/appcontext"
+)
+
+const historyHelp = `Show the history of an image.`
+
+func (cmd *historyCommand) Name() string       { return "history" }
+func (cmd *historyCommand) Args() string       { return "[OPTIONS] IMAGE" }
+func (cmd *historyCommand) ShortHelp() string  { return historyHelp }
+func (cmd *historyCommand) LongHelp() string   { return historyHelp }
+func (cmd *historyCommand) Hidden() bool       { return false }
+func (cmd *historyCommand) DoReexec() bool     { return true }
+func (cmd *historyCommand) RequiresRunc() bool { return false }
+
+func (cmd *historyCommand) Register(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.noTrunc, "no-trunc", false, "Don't truncate the output")
+	fs.BoolVar(&cmd.quiet, "q", false, "Only show the layer digests")
+}
+
+type historyCommand struct {
+	noTrunc bool
+	quiet   bool
+}
+
+func (cmd *historyCommand) Run(args []string) (err error) {
+	if len(args) < 1 {
+		return fmt.Errorf("must pass an image to show the history of")
+	}
+
+	// Create the context.
+	ctx := appcontext.Context()
+	id := identity.NewID()
+	ctx = session.NewContext(ctx, id)
+	ctx = namespaces.WithNamespace(ctx, "buildkit")
+
+	// Create the client.
+	c, err := client.New(stateDir, backend, stateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	entries, err := c.ImageHistory(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	if cmd.quiet {
+		for _, entry := range entries {
+			fmt.Println(cmd.layer(entry))
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, '\t', 0)
+
+	fmt.Fprintln(tw, "LAYER\tCREATED\tCREATED BY\tSIZE\tCOMMENT")
+
+	for _, entry := range entries {
+		created := "<missing>"
+		if !entry.Created.IsZero() {
+			created = units.HumanDuration(time.Now().UTC().Sub(entry.Created)) + " ago"
+		}
+		createdBy := strings.Replace(entry.CreatedBy, "\t", " ", -1)
+		if !cmd.noTrunc && len(createdBy) > 45 {
+			createdBy = createdBy[0:44] + "…"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			cmd.layer(entry),
+			created,
+			createdBy,
+			units.BytesSize(float64(entry.Size)),
+			entry.Comment,
+		)
+	}
+
+	tw.Flush()
+
+	return nil
+}
+
+// layer returns the layer of a history entry as it is printed, <missing> for
+// the entries without one.
+func (cmd *historyCommand) layer(entry client.HistoryEntry) string {
+	if entry.EmptyLayer || entry.Layer == "" {
+		return "<missing>"
+	}
+	if cmd.noTrunc {
+		return entry.Layer.String()
+	}
+	return entry.Layer.Encoded()[0:12]
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/genuinetools/img/client"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestHistoryLayer(t *testing.T) {
+	layer := digest.FromString("history")
+
+	tests := []struct {
+		cmd      *historyCommand
+		entry    client.HistoryEntry
+		expected string
+	}{
+		{&historyCommand{}, client.HistoryEntry{Layer: layer}, layer.Encoded()[0:12]},
+		{&historyCommand{noTrunc: true}, client.HistoryEntry{Layer: layer}, layer.String()},
+		{&historyCommand{}, client.HistoryEntry{EmptyLayer: true}, "<missing>"},
+		{&historyCommand{}, client.HistoryEntry{}, "<missing>"},
+	}
+	for _, tt := range tests {
+		if got := tt.cmd.layer(tt.entry); got != tt.expected {
+			t.Fatalf("expected %s, got %s", tt.expected, got)
+		}
+	}
+}
+
+func TestHistoryErrors(t *testing.T) {
+	if err := (&historyCommand{}).Run(nil); err == nil || !strings.Contains(err.Error(), "must pass an image to show the history of") {
+		t.Fatalf("expected a missing image error, got: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/template"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/genuinetools/img/client"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/util/appcontext"
+)
+
+const inspectHelp = `Show the config, manifest and layers of an image.`
+
+func (cmd *inspectCommand) Name() string       { return "inspect" }
+func (cmd *inspectCommand) Args() string       { return "[OPTIONS] IMAGE [IMAGE...]" }
+func (cmd *inspectCommand) ShortHelp() string  { return inspectHelp }
+func (cmd *inspectCommand) LongHelp() string   { return inspectHelp }
+func (cmd *inspectCommand) Hidden() bool       { return false }
+func (cmd *inspectCommand) DoReexec() bool     { return true }
+func (cmd *inspectCommand) RequiresRunc() bool { return false }
+
+func (cmd *inspectCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.format, "format", "", "Format the output using the given Go template, e.g. '{{.Config.Config.Env}}'")
+}
+
+type inspectCommand struct {
+	format string
+}
+
+func (cmd *inspectCommand) Run(args []string) (err error) {
+	if len(args) < 1 {
+		return fmt.Errorf("must pass an image to inspect")
+	}
+
+	var tmpl *template.Template
+	if cmd.format != "" {
+		tmpl, err = template.New("format").Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				dt, err := json.Marshal(v)
+				return string(dt), err
+			},
+		}).Parse(cmd.format)
+		if err != nil {
+			return fmt.Errorf("parsing format template failed: %v", err)
+		}
+	}
+
+	// Create the context.
+	ctx := appcontext.Context()
+	id := identity.NewID()
+	ctx = session.NewContext(ctx, id)
+	ctx = namespaces.WithNamespace(ctx, "buildkit")
+
+	// Create the client.
+	c, err := client.New(stateDir, backend, stateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	images := make([]*client.InspectedImage, 0, len(args))
+	for _, name := range args {
+		image, err := c.InspectImage(ctx, name)
+		if err != nil {
+			return err
+		}
+		images = append(images, image)
+	}
+
+	if tmpl == nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		return enc.Encode(images)
+	}
+	for _, image := range images {
+		if err := tmpl.Execute(os.Stdout, image); err != nil {
+			return fmt.Errorf("executing format template failed: %v", err)
+		}
+		fmt.Println()
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInspectErrors(t *testing.T) {
+	tests := []struct {
+		cmd  *inspectCommand
+		args []string
+		err  string
+	}{
+		{cmd: &inspectCommand{}, err: "must pass an image to inspect"},
+		{cmd: &inspectCommand{format: "{{.Name"}, args: []string{"busybox"}, err: "parsing format template failed"},
+	}
+	for _, tt := range tests {
+		if err := tt.cmd.Run(tt.args); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("expected %q, got: %v", tt.err, err)
+		}
+	}
+}
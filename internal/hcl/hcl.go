@@ -0,0 +1,345 @@
+// Package hcl implements a parser for the subset of HCL used by bake files.
+//
+// It supports blocks with at most one label, attributes, strings, numbers,
+// booleans, null, lists, objects and comments. Strings are returned with
+// their ${...} interpolations left in place, and a variable reference used as
+// a value is returned as the string "${NAME}", so the caller substitutes
+// variables the same way everywhere. Function calls, operators, template
+// directives and heredocs are not supported.
+package hcl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Parse parses an HCL file into the same values as the JSON syntax of the
+// file: a block TYPE "LABEL" { ... } is stored as body[TYPE][LABEL], a block
+// without a label as body[TYPE]. Blocks repeated with the same type and label
+// are merged. Attributes are map[string]interface{}, []interface{}, string,
+// bool or nil values, numbers are returned as strings.
+func Parse(data []byte) (map[string]interface{}, error) {
+	p := &parser{s: string(data), line: 1}
+	body, err := p.body(false)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+type parser struct {
+	s    string
+	i    int
+	line int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("hcl: line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+// skip skips whitespace and comments, and newlines too if newlines is set.
+// It reports whether a newline was skipped.
+func (p *parser) skip(newlines bool) bool {
+	sawNewline := false
+	for p.i < len(p.s) {
+		c := p.s[p.i]
+		switch {
+		case c == '\n':
+			if !newlines {
+				return sawNewline
+			}
+			sawNewline = true
+			p.line++
+			p.i++
+		case c == ' ' || c == '\t' || c == '\r':
+			p.i++
+		case c == '#' || strings.HasPrefix(p.s[p.i:], "//"):
+			for p.i < len(p.s) && p.s[p.i] != '\n' {
+				p.i++
+			}
+		case strings.HasPrefix(p.s[p.i:], "/*"):
+			end := strings.Index(p.s[p.i+2:], "*/")
+			if end < 0 {
+				p.i = len(p.s)
+				return sawNewline
+			}
+			p.line += strings.Count(p.s[p.i:p.i+2+end], "\n")
+			p.i += end + 4
+		default:
+			return sawNewline
+		}
+	}
+	return sawNewline
+}
+
+func (p *parser) peek() byte {
+	if p.i >= len(p.s) {
+		return 0
+	}
+	return p.s[p.i]
+}
+
+// body parses the attributes and blocks up to the closing brace of a block,
+// or to the end of the file.
+func (p *parser) body(block bool) (map[string]interface{}, error) {
+	body := map[string]interface{}{}
+	for {
+		p.skip(true)
+		switch c := p.peek(); {
+		case c == 0:
+			if block {
+				return nil, p.errorf("missing '}'")
+			}
+			return body, nil
+		case c == '}':
+			if !block {
+				return nil, p.errorf("unexpected '}'")
+			}
+			p.i++
+			return body, nil
+		}
+
+		name := p.ident()
+		if name == "" {
+			return nil, p.errorf("expected an attribute or block, found %q", p.peek())
+		}
+		p.skip(false)
+
+		if p.peek() == '=' {
+			p.i++
+			v, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := body[name]; ok {
+				return nil, p.errorf("duplicate attribute %q", name)
+			}
+			body[name] = v
+			if err := p.endOfLine(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var labels []string
+		for p.peek() != '{' {
+			var label string
+			if p.peek() == '"' {
+				s, err := p.str()
+				if err != nil {
+					return nil, err
+				}
+				label = s
+			} else if label = p.ident(); label == "" {
+				return nil, p.errorf("expected a label or '{' after %s", name)
+			}
+			labels = append(labels, label)
+			p.skip(false)
+		}
+		if len(labels) > 1 {
+			return nil, p.errorf("block %s has more than one label", name)
+		}
+		p.i++
+		b, err := p.body(true)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(labels) == 0 {
+			merge(body, name, b)
+			continue
+		}
+		blocks, ok := body[name].(map[string]interface{})
+		if !ok {
+			blocks = map[string]interface{}{}
+			body[name] = blocks
+		}
+		merge(blocks, labels[0], b)
+	}
+}
+
+// merge sets m[key] to the block body b, merging it with an earlier block.
+func merge(m map[string]interface{}, key string, b map[string]interface{}) {
+	if prev, ok := m[key].(map[string]interface{}); ok {
+		for k, v := range b {
+			prev[k] = v
+		}
+		return
+	}
+	m[key] = b
+}
+
+// endOfLine makes sure an attribute is followed by a newline, a closing
+// brace or the end of the file.
+func (p *parser) endOfLine() error {
+	if p.skip(false); p.peek() == '\n' || p.peek() == '}' || p.peek() == 0 {
+		return nil
+	}
+	return p.errorf("unexpected %q after attribute", p.peek())
+}
+
+func (p *parser) ident() string {
+	start := p.i
+	for p.i < len(p.s) {
+		r, size := utf8.DecodeRuneInString(p.s[p.i:])
+		if !(unicode.IsLetter(r) || r == '_' || p.i > start && (unicode.IsDigit(r) || r == '-')) {
+			break
+		}
+		p.i += size
+	}
+	return p.s[start:p.i]
+}
+
+func (p *parser) expr() (interface{}, error) {
+	p.skip(false)
+	c := p.peek()
+	switch {
+	case c == '"':
+		return p.str()
+	case c == '[':
+		return p.list()
+	case c == '{':
+		return p.object()
+	case c == '-' || c >= '0' && c <= '9':
+		start := p.i
+		for p.i++; p.i < len(p.s) && strings.IndexByte("0123456789.eE+-", p.s[p.i]) >= 0; p.i++ {
+		}
+		if _, err := strconv.ParseFloat(p.s[start:p.i], 64); err != nil {
+			return nil, p.errorf("invalid number %s", p.s[start:p.i])
+		}
+		return p.s[start:p.i], nil
+	case strings.HasPrefix(p.s[p.i:], "<<"):
+		return nil, p.errorf("heredocs are not supported")
+	}
+
+	name := p.ident()
+	switch name {
+	case "":
+		return nil, p.errorf("expected a value, found %q", c)
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	if p.skip(false); p.peek() == '(' {
+		return nil, p.errorf("function %s is not supported", name)
+	}
+	return "${" + name + "}", nil
+}
+
+// str parses a quoted string, leaving the interpolations in it in place.
+func (p *parser) str() (string, error) {
+	var b strings.Builder
+	depth := 0
+	for p.i++; p.i < len(p.s); p.i++ {
+		c := p.s[p.i]
+		switch {
+		case c == '\n':
+			return "", p.errorf("unterminated string")
+		case c == '"' && depth == 0:
+			p.i++
+			return b.String(), nil
+		case strings.HasPrefix(p.s[p.i:], "%{"):
+			return "", p.errorf("template directives are not supported")
+		case strings.HasPrefix(p.s[p.i:], "$${"):
+			b.WriteString("$${")
+			p.i += 2
+		case strings.HasPrefix(p.s[p.i:], "${"):
+			depth++
+			b.WriteString("${")
+			p.i++
+		case c == '}' && depth > 0:
+			depth--
+			b.WriteByte(c)
+		case c == '\\' && depth == 0:
+			end := p.i + 2
+			switch {
+			case strings.HasPrefix(p.s[p.i:], `\u`):
+				end = p.i + 6
+			case strings.HasPrefix(p.s[p.i:], `\U`):
+				end = p.i + 10
+			}
+			if end > len(p.s) {
+				return "", p.errorf("invalid escape in string")
+			}
+			r, _, _, err := strconv.UnquoteChar(p.s[p.i:end], '"')
+			if err != nil {
+				return "", p.errorf("invalid escape %s in string", p.s[p.i:end])
+			}
+			b.WriteRune(r)
+			p.i = end - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func (p *parser) list() (interface{}, error) {
+	l := []interface{}{}
+	for p.i++; ; {
+		if p.skip(true); p.peek() == ']' {
+			p.i++
+			return l, nil
+		}
+		v, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, v)
+		p.skip(true)
+		switch p.peek() {
+		case ',':
+			p.i++
+		case ']':
+		default:
+			return nil, p.errorf("expected ',' or ']' in list")
+		}
+	}
+}
+
+func (p *parser) object() (interface{}, error) {
+	m := map[string]interface{}{}
+	for p.i++; ; {
+		if p.skip(true); p.peek() == '}' {
+			p.i++
+			return m, nil
+		}
+		var key string
+		if p.peek() == '"' {
+			k, err := p.str()
+			if err != nil {
+				return nil, err
+			}
+			key = k
+		} else if key = p.ident(); key == "" {
+			return nil, p.errorf("expected a key in object, found %q", p.peek())
+		}
+		if p.skip(false); p.peek() != '=' && p.peek() != ':' {
+			return nil, p.errorf("expected '=' after %s", key)
+		}
+		p.i++
+		v, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := m[key]; ok {
+			return nil, p.errorf("duplicate key %q in object", key)
+		}
+		m[key] = v
+		// Items are separated by commas or newlines.
+		newline := p.skip(true)
+		switch {
+		case p.peek() == ',':
+			p.i++
+		case p.peek() == '}' || newline:
+		default:
+			return nil, p.errorf("expected ',' or '}' in object")
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package hcl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type m = map[string]interface{}
+type l = []interface{}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected map[string]interface{}
+	}{
+		{
+			name:     "empty",
+			input:    "",
+			expected: m{},
+		},
+		{
+			name: "bake file",
+			input: `# The default group.
+group "default" {
+  targets = ["app", "db"]
+}
+
+variable "TAG" {
+  default = "latest"
+}
+
+target "app" {
+  context    = "./app"
+  dockerfile = "Dockerfile"
+  tags       = ["jess/app:${TAG}"]
+  args = {
+    GO_VERSION = "1.10"
+    DEBUG      = true
+  }
+  no-cache = false
+}
+
+target db {
+  inherits = ["app"]
+  tags     = ["jess/db:${TAG}"] // inline comment
+}
+`,
+			expected: m{
+				"group": m{
+					"default": m{"targets": l{"app", "db"}},
+				},
+				"variable": m{
+					"TAG": m{"default": "latest"},
+				},
+				"target": m{
+					"app": m{
+						"context":    "./app",
+						"dockerfile": "Dockerfile",
+						"tags":       l{"jess/app:${TAG}"},
+						"args":       m{"GO_VERSION": "1.10", "DEBUG": true},
+						"no-cache":   false,
+					},
+					"db": m{
+						"inherits": l{"app"},
+						"tags":     l{"jess/db:${TAG}"},
+					},
+				},
+			},
+		},
+		{
+			name: "repeated blocks are merged",
+			input: `target "app" {
+  context = "."
+}
+target "app" {
+  tags = ["a"]
+}
+`,
+			expected: m{
+				"target": m{
+					"app": m{"context": ".", "tags": l{"a"}},
+				},
+			},
+		},
+		{
+			name:     "block without a label",
+			input:    "settings {\n  debug = null\n}\n",
+			expected: m{"settings": m{"debug": nil}},
+		},
+		{
+			name:     "numbers and variables",
+			input:    "a = 1\nb = -2.5e3\nc = TAG\n",
+			expected: m{"a": "1", "b": "-2.5e3", "c": "${TAG}"},
+		},
+		{
+			name:     "escapes and interpolations",
+			input:    `a = "tab\there é ${join("-", ["x"])} $${LITERAL}"` + "\n",
+			expected: m{"a": "tab\there é ${join(\"-\", [\"x\"])} $${LITERAL}"},
+		},
+		{
+			name: "lists and objects over several lines",
+			input: `a = [
+  "x",
+  "y",
+]
+b = {
+  c: "d",
+  "e" = 1
+}
+/* a block
+   comment */
+`,
+			expected: m{
+				"a": l{"x", "y"},
+				"b": m{"c": "d", "e": "1"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := Parse([]byte(tt.input))
+			if err != nil {
+				t.Fatalf("parsing failed: %v", err)
+			}
+			if !reflect.DeepEqual(v, tt.expected) {
+				t.Fatalf("expected %#v, got %#v", tt.expected, v)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{
+			name:  "missing closing brace",
+			input: "target \"app\" {\n  context = \".\"\n",
+			err:   "missing '}'",
+		},
+		{
+			name:  "unexpected closing brace",
+			input: "a = 1\n}\n",
+			err:   "unexpected '}'",
+		},
+		{
+			name:  "duplicate attribute",
+			input: "a = 1\na = 2\n",
+			err:   `duplicate attribute "a"`,
+		},
+		{
+			name:  "duplicate object key",
+			input: "a = {b = 1, b = 2}\n",
+			err:   `duplicate key "b"`,
+		},
+		{
+			name:  "two attributes on a line",
+			input: "a = 1 b = 2\n",
+			err:   "after attribute",
+		},
+		{
+			name:  "several labels",
+			input: "target \"a\" \"b\" {\n}\n",
+			err:   "more than one label",
+		},
+		{
+			name:  "unterminated string",
+			input: "a = \"b\n",
+			err:   "unterminated string",
+		},
+		{
+			name:  "invalid escape",
+			input: `a = "\q"` + "\n",
+			err:   "invalid escape",
+		},
+		{
+			name:  "invalid number",
+			input: "a = 1.2.3\n",
+			err:   "invalid number",
+		},
+		{
+			name:  "unclosed list",
+			input: "a = [\"b\" \"c\"]\n",
+			err:   "expected ',' or ']'",
+		},
+		{
+			name:  "missing value",
+			input: "a =\n",
+			err:   "expected a value",
+		},
+		{
+			name:  "function call",
+			input: "a = upper(\"b\")\n",
+			err:   "function upper is not supported",
+		},
+		{
+			name:  "heredoc",
+			input: "a = <<EOT\nb\nEOT\n",
+			err:   "heredocs are not supported",
+		},
+		{
+			name:  "template directive",
+			input: `a = "%{if true}b%{endif}"` + "\n",
+			err:   "template directives are not supported",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := Parse([]byte(tt.input))
+			if err == nil {
+				t.Fatalf("expected an error, got %#v", v)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected error to contain %q, got: %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+)
+
+const namespace = "img"
+
+var (
+	// BuildsTotal counts the finished builds by result.
+	BuildsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "builds_total",
+		Help:      "Total number of finished builds by result.",
+	}, []string{"result"})
+
+	// BuildDuration observes the duration of builds.
+	BuildDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "build_duration_seconds",
+		Help:      "Duration of builds in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	})
+
+	// BuildStepsTotal counts the completed build steps by whether they were
+	// cached, from which the cache hit ratio can be calculated.
+	BuildStepsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "build_steps_total",
+		Help:      "Total number of completed build steps by cache status.",
+	}, []string{"cached"})
+
+	// PulledBytesTotal counts the bytes of pulled images.
+	PulledBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pulled_bytes_total",
+		Help:      "Total size in bytes of pulled images.",
+	})
+
+	// PushedBytesTotal counts the bytes of pushed images.
+	PushedBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pushed_bytes_total",
+		Help:      "Total size in bytes of pushed images.",
+	})
+
+	// GCRunsTotal counts the garbage collection runs of the content store.
+	GCRunsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gc_runs_total",
+		Help:      "Total number of garbage collection runs by result.",
+	}, []string{"result"})
+
+	registry = prometheus.NewRegistry()
+)
+
+func init() {
+	registry.MustRegister(
+		BuildsTotal,
+		BuildDuration,
+		BuildStepsTotal,
+		PulledBytesTotal,
+		PushedBytesTotal,
+		GCRunsTotal,
+	)
+}
+
+// Result returns the result label value for an error.
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// Handler returns the http handler serving the metrics in the Prometheus
+// exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Push sends the current metrics to a Prometheus Pushgateway under the given
+// job name.
+func Push(ctx context.Context, gateway, job string) error {
+	families, err := registry.Gather()
+	if err != nil {
+		return fmt.Errorf("gathering metrics failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expfmt.FmtText)
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			return fmt.Errorf("encoding metric %s failed: %v", mf.GetName(), err)
+		}
+	}
+
+	u := strings.TrimSuffix(gateway, "/") + "/metrics/job/" + url.PathEscape(job)
+	req, err := http.NewRequest(http.MethodPost, u, &buf)
+	if err != nil {
+		return fmt.Errorf("creating request to %s failed: %v", u, err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", string(expfmt.FmtText))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("pushing metrics to %s failed: %v", u, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("pushing metrics to %s failed with status %s", u, resp.Status)
+	}
+
+	return nil
+}
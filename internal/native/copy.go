@@ -0,0 +1,223 @@
+package native
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/containerd/continuity/sysx"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ficlone is the FICLONE ioctl, which makes a file share the extents of
+// another on file systems such as btrfs and XFS.
+const ficlone = 0x40049409
+
+var (
+	// noReflink is set once the file system refused a reflink, so the
+	// following files are copied without trying.
+	noReflink int32
+	// noCopyFileRange is set once copy_file_range failed.
+	noCopyFileRange int32
+
+	// copyFileRangeChunk is the most copy_file_range is asked to copy at
+	// once, the kernel copies less than 2GiB a call anyway.
+	copyFileRangeChunk int64 = 1 << 30
+
+	// reflink and copyFileRange are variables so the tests can make them
+	// fail.
+	reflink       = ficloneFile
+	copyFileRange = unix.CopyFileRange
+)
+
+// ficloneFile makes dst share the extents of src.
+func ficloneFile(dst, src *os.File) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, dst.Fd(), ficlone, src.Fd()); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// copyDir copies the directory src to dst like continuity's fs.CopyDir, but
+// copies files with a reflink when it can, with copy_file_range otherwise,
+// and falls back to reading and writing them when neither works.
+func copyDir(dst, src string) error {
+	return copyDirectory(dst, src, map[uint64]string{})
+}
+
+func copyDirectory(dst, src string, inodes map[uint64]string) error {
+	stat, err := os.Stat(src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat %s", src)
+	}
+	if !stat.IsDir() {
+		return errors.Errorf("source is not directory")
+	}
+
+	if st, err := os.Stat(dst); err != nil {
+		if err := os.Mkdir(dst, stat.Mode()); err != nil {
+			return errors.Wrapf(err, "failed to mkdir %s", dst)
+		}
+	} else if !st.IsDir() {
+		return errors.Errorf("cannot copy to non-directory: %s", dst)
+	} else if err := os.Chmod(dst, stat.Mode()); err != nil {
+		return errors.Wrapf(err, "failed to chmod on %s", dst)
+	}
+
+	fis, err := ioutil.ReadDir(src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", src)
+	}
+	if err := copyFileInfo(stat, dst); err != nil {
+		return errors.Wrapf(err, "failed to copy file info for %s", dst)
+	}
+
+	for _, fi := range fis {
+		source := filepath.Join(src, fi.Name())
+		target := filepath.Join(dst, fi.Name())
+
+		switch {
+		case fi.IsDir():
+			if err := copyDirectory(target, source, inodes); err != nil {
+				return err
+			}
+			continue
+		case fi.Mode()&os.ModeType == 0:
+			st := fi.Sys().(*syscall.Stat_t)
+			if link, ok := inodes[st.Ino]; ok && st.Nlink > 1 {
+				if err := os.Link(link, target); err != nil {
+					return errors.Wrap(err, "failed to create hard link")
+				}
+				continue
+			}
+			if st.Nlink > 1 {
+				inodes[st.Ino] = target
+			}
+			if err := copyFile(target, source); err != nil {
+				return errors.Wrap(err, "failed to copy files")
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(source)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read link: %s", source)
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return errors.Wrapf(err, "failed to create symlink: %s", target)
+			}
+		case fi.Mode()&os.ModeDevice != 0:
+			st := fi.Sys().(*syscall.Stat_t)
+			if err := unix.Mknod(target, st.Mode, int(st.Rdev)); err != nil {
+				return errors.Wrapf(err, "failed to create device")
+			}
+		default:
+			return errors.Errorf("unsupported mode %s", fi.Mode())
+		}
+		if err := copyFileInfo(fi, target); err != nil {
+			return errors.Wrap(err, "failed to copy file info")
+		}
+		if err := copyXAttrs(target, source); err != nil {
+			return errors.Wrap(err, "failed to copy xattrs")
+		}
+	}
+	return nil
+}
+
+// copyFile copies the content of source to a new file target.
+func copyFile(target, source string) error {
+	src, err := os.Open(source)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open source %s", source)
+	}
+	defer src.Close()
+	dst, err := os.Create(target)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open target %s", target)
+	}
+	defer dst.Close()
+
+	if atomic.LoadInt32(&noReflink) == 0 {
+		if err := reflink(dst, src); err == nil {
+			return nil
+		}
+		atomic.StoreInt32(&noReflink, 1)
+	}
+
+	fi, err := src.Stat()
+	if err != nil {
+		return errors.Wrap(err, "unable to stat source")
+	}
+	if atomic.LoadInt32(&noCopyFileRange) == 0 {
+		size := fi.Size()
+		for size > 0 {
+			chunk := size
+			if chunk > copyFileRangeChunk {
+				chunk = copyFileRangeChunk
+			}
+			n, err := copyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, int(chunk), 0)
+			if err != nil || n == 0 {
+				break
+			}
+			size -= int64(n)
+		}
+		if size == 0 {
+			return nil
+		}
+		// copy_file_range can fail for reasons such as the file systems
+		// or a seccomp profile, copy what is left the slow way.
+		atomic.StoreInt32(&noCopyFileRange, 1)
+	}
+
+	offset, err := dst.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return errors.Wrap(err, "userspace copy failed")
+}
+
+func copyFileInfo(fi os.FileInfo, name string) error {
+	st := fi.Sys().(*syscall.Stat_t)
+	if err := os.Lchown(name, int(st.Uid), int(st.Gid)); err != nil {
+		// Some file systems such as NFS refuse chowns that change nothing.
+		dst, err2 := os.Lstat(name)
+		if !os.IsPermission(err) || err2 != nil || dst.Sys().(*syscall.Stat_t).Uid != st.Uid || dst.Sys().(*syscall.Stat_t).Gid != st.Gid {
+			return errors.Wrapf(err, "failed to chown %s", name)
+		}
+	}
+
+	if fi.Mode()&os.ModeSymlink == 0 {
+		if err := os.Chmod(name, fi.Mode()); err != nil {
+			return errors.Wrapf(err, "failed to chmod %s", name)
+		}
+	}
+
+	timespec := []unix.Timespec{unix.Timespec(st.Atim), unix.Timespec(st.Mtim)}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, name, timespec, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return errors.Wrapf(err, "failed to utime %s", name)
+	}
+	return nil
+}
+
+func copyXAttrs(dst, src string) error {
+	keys, err := sysx.LListxattr(src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list xattrs on %s", src)
+	}
+	for _, key := range keys {
+		data, err := sysx.LGetxattr(src, key)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get xattr %q on %s", key, src)
+		}
+		if err := sysx.LSetxattr(dst, key, data, 0); err != nil {
+			return errors.Wrapf(err, "failed to set xattr %q on %s", key, dst)
+		}
+	}
+	return nil
+}
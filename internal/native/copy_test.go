@@ -0,0 +1,249 @@
+package native
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// resetCopy restores what copyFile uses after a test replaced it.
+func resetCopy() {
+	reflink = ficloneFile
+	copyFileRange = unix.CopyFileRange
+	copyFileRangeChunk = 1 << 30
+	noReflink = 0
+	noCopyFileRange = 0
+}
+
+// testContent returns n bytes that do not repeat within a chunk, so content
+// copied to the wrong offset does not compare equal.
+func testContent(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7 + i/251)
+	}
+	return b
+}
+
+func TestCopyFile(t *testing.T) {
+	defer resetCopy()
+
+	reflinkErr := func(err error) func(dst, src *os.File) error {
+		return func(dst, src *os.File) error { return err }
+	}
+	// failAfter returns a copy_file_range that copies n times and then
+	// fails.
+	failAfter := func(n int) func(int, *int64, int, *int64, int, int) (int, error) {
+		return func(rfd int, roff *int64, wfd int, woff *int64, len int, flags int) (int, error) {
+			if n == 0 {
+				return 0, unix.EXDEV
+			}
+			n--
+			return unix.CopyFileRange(rfd, roff, wfd, woff, len, flags)
+		}
+	}
+
+	tests := map[string]struct {
+		reflink       func(dst, src *os.File) error
+		copyFileRange func(int, *int64, int, *int64, int, int) (int, error)
+		size          int
+		// calls is how many times copy_file_range is expected to be
+		// called.
+		calls int
+		// reflinkRefused is whether the following files are expected to
+		// be copied without trying a reflink.
+		reflinkRefused bool
+	}{
+		"reflink not supported": {
+			reflink:        reflinkErr(unix.EOPNOTSUPP),
+			copyFileRange:  unix.CopyFileRange,
+			size:           1000,
+			calls:          1,
+			reflinkRefused: true,
+		},
+		"reflink across file systems": {
+			reflink:        reflinkErr(unix.EXDEV),
+			copyFileRange:  unix.CopyFileRange,
+			size:           1000,
+			calls:          1,
+			reflinkRefused: true,
+		},
+		"larger than a copy_file_range chunk": {
+			reflink:        reflinkErr(unix.EOPNOTSUPP),
+			copyFileRange:  unix.CopyFileRange,
+			size:           3*4096 + 100,
+			calls:          4,
+			reflinkRefused: true,
+		},
+		"copy_file_range fails": {
+			reflink:        reflinkErr(unix.EOPNOTSUPP),
+			copyFileRange:  failAfter(0),
+			size:           3*4096 + 100,
+			calls:          1,
+			reflinkRefused: true,
+		},
+		"copy_file_range fails after a chunk": {
+			reflink:        reflinkErr(unix.EXDEV),
+			copyFileRange:  failAfter(1),
+			size:           3*4096 + 100,
+			calls:          2,
+			reflinkRefused: true,
+		},
+		"reflink": {
+			// Not every file system supports reflinks, this one copies.
+			reflink: func(dst, src *os.File) error {
+				_, err := io.Copy(dst, src)
+				return err
+			},
+			copyFileRange: unix.CopyFileRange,
+			size:          1000,
+			calls:         0,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			defer resetCopy()
+			dir, err := ioutil.TempDir("", "img-native-copy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			var calls int
+			reflink = tt.reflink
+			copyFileRange = func(rfd int, roff *int64, wfd int, woff *int64, len int, flags int) (int, error) {
+				calls++
+				if int64(len) > copyFileRangeChunk {
+					t.Fatalf("expected copy_file_range to copy %d bytes at most, got asked for %d", copyFileRangeChunk, len)
+				}
+				return tt.copyFileRange(rfd, roff, wfd, woff, len, flags)
+			}
+			copyFileRangeChunk = 4096
+
+			content := testContent(tt.size)
+			source, target := filepath.Join(dir, "source"), filepath.Join(dir, "target")
+			if err := ioutil.WriteFile(source, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := copyFile(target, source); err != nil {
+				t.Fatal(err)
+			}
+
+			dt, err := ioutil.ReadFile(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(dt, content) {
+				t.Fatalf("expected the %d bytes of the source, got %d different bytes", len(content), len(dt))
+			}
+			if calls != tt.calls {
+				t.Fatalf("expected %d calls to copy_file_range, got %d", tt.calls, calls)
+			}
+			if refused := noReflink != 0; refused != tt.reflinkRefused {
+				t.Fatalf("expected the reflink refused to be %t, got %t", tt.reflinkRefused, refused)
+			}
+		})
+	}
+}
+
+func TestCopyDir(t *testing.T) {
+	defer resetCopy()
+
+	dir, err := ioutil.TempDir("", "img-native-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+
+	if err := os.MkdirAll(filepath.Join(src, "private"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "run"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "private/key"), []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "run"), filepath.Join(src, "private/run")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("private/key", filepath.Join(src, "key")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A sparse file with data between holes and a hole at its end.
+	content := testContent(4096)
+	f, err := os.Create(filepath.Join(src, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int64{0, 1 << 20, 3 << 20} {
+		if _, err := f.WriteAt(content, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Truncate(4 << 20); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// Copy without reflinks so the content is copied either way.
+	reflink = func(dst, src *os.File) error { return unix.EOPNOTSUPP }
+	if err := copyDir(dst, src); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"run", "private", "private/key", "private/run", "key", "sparse"} {
+		sfi, err := os.Lstat(filepath.Join(src, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dfi, err := os.Lstat(filepath.Join(dst, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sfi.Mode() != dfi.Mode() {
+			t.Fatalf("expected %s to have the mode %s, got %s", p, sfi.Mode(), dfi.Mode())
+		}
+		if !sfi.IsDir() && !sfi.ModTime().Equal(dfi.ModTime()) {
+			t.Fatalf("expected %s to have the modification time %s, got %s", p, sfi.ModTime(), dfi.ModTime())
+		}
+		if !sfi.Mode().IsRegular() {
+			continue
+		}
+		sdt, err := ioutil.ReadFile(filepath.Join(src, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ddt, err := ioutil.ReadFile(filepath.Join(dst, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sdt, ddt) {
+			t.Fatalf("expected %s to have the content of the source", p)
+		}
+	}
+
+	if link, err := os.Readlink(filepath.Join(dst, "key")); err != nil || link != "private/key" {
+		t.Fatalf("expected key to link to private/key, got %q: %v", link, err)
+	}
+	run, err := os.Stat(filepath.Join(dst, "run"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	linked, err := os.Stat(filepath.Join(dst, "private/run"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Sys().(*syscall.Stat_t).Ino != linked.Sys().(*syscall.Stat_t).Ino {
+		t.Fatal("expected private/run to be a hard link of run")
+	}
+}
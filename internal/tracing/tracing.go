@@ -0,0 +1,335 @@
+// Package tracing implements a minimal OpenTelemetry tracer that exports spans
+// with the OTLP/HTTP JSON protocol.
+//
+// The tracer is configured through the standard OTEL_* environment variables
+// and is disabled unless an OTLP endpoint is set.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultServiceName = "img"
+	tracesPath         = "/v1/traces"
+
+	// Status codes as defined by the OTLP specification.
+	statusCodeUnset = 0
+	statusCodeError = 2
+
+	// spanKindInternal is the OTLP span kind for internal operations.
+	spanKindInternal = 1
+)
+
+// Tracer collects spans for a single trace and exports them to an OTLP
+// endpoint on Flush. A nil *Tracer is valid and records nothing.
+type Tracer struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+
+	traceID      string
+	parentSpanID string
+
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// Span is a single timed operation in a trace.
+type Span struct {
+	tracer *Tracer
+
+	ID       string
+	ParentID string
+	Name     string
+	Start    time.Time
+	End      time.Time
+	Attrs    map[string]string
+	Err      error
+}
+
+// New returns a tracer configured from the OTEL_* environment variables.
+// It returns nil if no OTLP endpoint is configured or the SDK is disabled.
+func New() *Tracer {
+	if disabled, _ := strconv.ParseBool(os.Getenv("OTEL_SDK_DISABLED")); disabled {
+		return nil
+	}
+
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + tracesPath
+	}
+
+	if protocol := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); protocol != "" && protocol != "http/json" {
+		logrus.Warnf("OTLP protocol %s is not supported, using http/json", protocol)
+	}
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+
+	t := &Tracer{
+		endpoint:    endpoint,
+		headers:     parseHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")),
+		serviceName: serviceName,
+		traceID:     randomID(16),
+	}
+
+	// Join the trace of the calling process if it was propagated to us.
+	if traceID, spanID, ok := parseTraceParent(os.Getenv("TRACEPARENT")); ok {
+		t.traceID = traceID
+		t.parentSpanID = spanID
+	}
+
+	return t
+}
+
+// Start begins a new span as a child of parent. If parent is nil the span is
+// a root span of the trace.
+func (t *Tracer) Start(name string, parent *Span) *Span {
+	if t == nil {
+		return nil
+	}
+
+	return &Span{
+		tracer:   t,
+		ID:       randomID(8),
+		ParentID: t.parentID(parent),
+		Name:     name,
+		Start:    time.Now(),
+		Attrs:    map[string]string{},
+	}
+}
+
+// Record adds an already completed span with explicit timestamps.
+func (t *Tracer) Record(name string, parent *Span, start, end time.Time, attrs map[string]string, err error) {
+	if t == nil {
+		return
+	}
+
+	t.add(&Span{
+		tracer:   t,
+		ID:       randomID(8),
+		ParentID: t.parentID(parent),
+		Name:     name,
+		Start:    start,
+		End:      end,
+		Attrs:    attrs,
+		Err:      err,
+	})
+}
+
+// SetAttr sets an attribute on the span.
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.Attrs[key] = value
+}
+
+// Finish ends the span, recording err as its status if it is not nil.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	s.Err = err
+	s.tracer.add(s)
+}
+
+// Flush exports all of the recorded spans to the OTLP endpoint.
+func (t *Tracer) Flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(t.export(spans))
+	if err != nil {
+		return fmt.Errorf("marshaling spans failed: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("creating request to %s failed: %v", t.endpoint, err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("exporting spans to %s failed: %v", t.endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("exporting spans to %s failed with status %s", t.endpoint, resp.Status)
+	}
+
+	return nil
+}
+
+func (t *Tracer) add(s *Span) {
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+}
+
+func (t *Tracer) parentID(parent *Span) string {
+	if parent != nil {
+		return parent.ID
+	}
+	return t.parentSpanID
+}
+
+// The following types mirror the OTLP JSON encoding of an export request.
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            status     `json:"status"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func (t *Tracer) export(spans []*Span) exportRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           t.traceID,
+			SpanID:            s.ID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        attributes(s.Attrs),
+			Status:            status{Code: statusCodeUnset},
+		}
+		if s.Err != nil {
+			span.Status = status{Code: statusCodeError, Message: s.Err.Error()}
+		}
+		out = append(out, span)
+	}
+
+	return exportRequest{
+		ResourceSpans: []resourceSpans{
+			{
+				Resource: resource{
+					Attributes: attributes(map[string]string{"service.name": t.serviceName}),
+				},
+				ScopeSpans: []scopeSpans{
+					{
+						Scope: scope{Name: defaultServiceName},
+						Spans: out,
+					},
+				},
+			},
+		},
+	}
+}
+
+func attributes(attrs map[string]string) []keyValue {
+	kvs := make([]keyValue, 0, len(attrs))
+	for k, v := range attrs {
+		kvs = append(kvs, keyValue{Key: k, Value: anyValue{StringValue: v}})
+	}
+	return kvs
+}
+
+// parseHeaders parses the comma separated key=value pairs of the
+// OTEL_EXPORTER_OTLP_HEADERS environment variable.
+func parseHeaders(s string) map[string]string {
+	headers := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return headers
+}
+
+// parseTraceParent parses a W3C traceparent header value.
+func parseTraceParent(s string) (traceID, spanID string, ok bool) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
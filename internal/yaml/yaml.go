@@ -0,0 +1,552 @@
+// Package yaml implements a parser for the subset of YAML used by compose and
+// similar configuration files.
+//
+// It supports block and flow mappings and sequences, plain, quoted and block
+// scalars, comments, anchors, aliases and merge keys. Tags and multiple
+// documents are not supported. Scalars are not resolved to types: they are
+// returned as strings, and null values as nil.
+package yaml
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parse parses a YAML document into map[string]interface{},
+// []interface{}, string and nil values.
+func Parse(data []byte) (interface{}, error) {
+	p := &parser{
+		lines:   strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n"),
+		anchors: map[string]interface{}{},
+	}
+	if len(p.lines) > 0 && strings.HasPrefix(p.lines[0], "\ufeff") {
+		p.lines[0] = strings.TrimPrefix(p.lines[0], "\ufeff")
+	}
+
+	if !p.next() {
+		return nil, nil
+	}
+	v, err := p.node(p.indent())
+	if err != nil {
+		return nil, err
+	}
+	if p.next() && p.text() != "..." {
+		return nil, p.errorf("unexpected content %q", p.text())
+	}
+	return v, nil
+}
+
+type parser struct {
+	lines   []string
+	pos     int
+	anchors map[string]interface{}
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("yaml: line %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// next skips blank lines, comments and document markers and reports whether
+// there is a line left.
+func (p *parser) next() bool {
+	for ; p.pos < len(p.lines); p.pos++ {
+		t := p.text()
+		if t != "" && t != "---" && !strings.HasPrefix(t, "%") {
+			return true
+		}
+	}
+	return false
+}
+
+// indent returns the indentation of the current line.
+func (p *parser) indent() int {
+	line := p.lines[p.pos]
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// text returns the current line without indentation and comment.
+func (p *parser) text() string {
+	return strings.TrimSpace(stripComment(p.lines[p.pos]))
+}
+
+// checkIndent returns an error if the current line is indented with tabs,
+// which YAML does not allow.
+func (p *parser) checkIndent() error {
+	line := p.lines[p.pos]
+	if strings.ContainsRune(line[:len(line)-len(strings.TrimLeft(line, " \t"))], '\t') {
+		return p.errorf("tabs are not allowed in indentation")
+	}
+	return nil
+}
+
+// node parses the block node starting on the current line at indent.
+func (p *parser) node(indent int) (interface{}, error) {
+	if err := p.checkIndent(); err != nil {
+		return nil, err
+	}
+	if p.indent() != indent {
+		return nil, p.errorf("bad indentation")
+	}
+	t := p.text()
+	if isSeqItem(t) {
+		return p.sequence(indent)
+	}
+	if _, _, ok := splitKey(t); ok {
+		return p.mapping(indent)
+	}
+	return p.value(t, indent-1)
+}
+
+func (p *parser) mapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+	var merges []map[string]interface{}
+	for p.next() && p.indent() >= indent {
+		if err := p.checkIndent(); err != nil {
+			return nil, err
+		}
+		if p.indent() > indent {
+			return nil, p.errorf("bad indentation")
+		}
+		t := p.text()
+		key, rest, ok := splitKey(t)
+		if !ok {
+			return nil, p.errorf("expected a key in %q", t)
+		}
+		if k, err := unquote(key); err == nil {
+			key = k
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+
+		v, err := p.value(rest, indent)
+		if err != nil {
+			return nil, err
+		}
+		if key == "<<" {
+			switch mv := v.(type) {
+			case map[string]interface{}:
+				merges = append(merges, mv)
+			case []interface{}:
+				for _, item := range mv {
+					im, ok := item.(map[string]interface{})
+					if !ok {
+						return nil, p.errorf("merge key must refer to mappings")
+					}
+					merges = append(merges, im)
+				}
+			default:
+				return nil, p.errorf("merge key must refer to a mapping")
+			}
+			continue
+		}
+		m[key] = v
+	}
+
+	// Keys of the mapping itself take precedence over merged ones.
+	for _, mm := range merges {
+		for k, v := range mm {
+			if _, ok := m[k]; !ok {
+				m[k] = v
+			}
+		}
+	}
+	return m, nil
+}
+
+func (p *parser) sequence(indent int) (interface{}, error) {
+	s := []interface{}{}
+	for p.next() && p.indent() == indent && isSeqItem(p.text()) {
+		if err := p.checkIndent(); err != nil {
+			return nil, err
+		}
+		line := p.lines[p.pos]
+		item := strings.TrimLeft(strings.TrimPrefix(strings.TrimLeft(line, " "), "-"), " ")
+		t := strings.TrimSpace(stripComment(item))
+		if _, _, ok := splitKey(t); !ok && !isSeqItem(t) {
+			v, err := p.value(t, indent)
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, v)
+			continue
+		}
+
+		// Parse the item as a node indented to where its content starts, so
+		// a mapping continued on the next lines lines up with it.
+		itemIndent := len(line) - len(item)
+		p.lines[p.pos] = strings.Repeat(" ", itemIndent) + item
+		v, err := p.node(itemIndent)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, v)
+	}
+	if p.pos < len(p.lines) && p.indent() > indent {
+		return nil, p.errorf("bad indentation")
+	}
+	return s, nil
+}
+
+// value parses the value following a key or sequence item on the current
+// line, the node is at parent indent.
+func (p *parser) value(rest string, parent int) (interface{}, error) {
+	var anchor string
+	if strings.HasPrefix(rest, "&") {
+		i := strings.IndexAny(rest, " \t")
+		if i < 0 {
+			i = len(rest)
+		}
+		anchor, rest = rest[1:i], strings.TrimSpace(rest[i:])
+	}
+
+	v, err := p.inlineValue(rest, parent)
+	if err != nil {
+		return nil, err
+	}
+	if anchor != "" {
+		p.anchors[anchor] = v
+	}
+	return v, nil
+}
+
+func (p *parser) inlineValue(rest string, parent int) (interface{}, error) {
+	switch {
+	case rest == "":
+		p.pos++
+		if !p.next() {
+			return nil, nil
+		}
+		if ind := p.indent(); ind > parent || ind == parent && isSeqItem(p.text()) {
+			return p.node(ind)
+		}
+		return nil, nil
+	case strings.HasPrefix(rest, "*"):
+		v, ok := p.anchors[rest[1:]]
+		if !ok {
+			return nil, p.errorf("unknown alias %q", rest)
+		}
+		p.pos++
+		return v, nil
+	case strings.HasPrefix(rest, "!"):
+		return nil, p.errorf("tags are not supported")
+	case strings.HasPrefix(rest, "|") || strings.HasPrefix(rest, ">"):
+		return p.blockScalar(rest, parent)
+	case strings.HasPrefix(rest, "[") || strings.HasPrefix(rest, "{"):
+		// Flow collections may span several lines.
+		for !balanced(rest) && p.pos+1 < len(p.lines) {
+			p.pos++
+			rest += " " + p.text()
+		}
+		f := &flow{s: rest}
+		v, err := f.value()
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if f.skipSpace(); f.i < len(f.s) {
+			return nil, p.errorf("unexpected %q after flow collection", f.s[f.i:])
+		}
+		p.pos++
+		return v, nil
+	case strings.HasPrefix(rest, `"`) || strings.HasPrefix(rest, "'"):
+		s, err := unquote(rest)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		p.pos++
+		return s, nil
+	}
+
+	// Plain scalars may continue on more indented lines.
+	s := rest
+	for p.pos++; p.next() && p.indent() > parent; p.pos++ {
+		t := p.text()
+		if _, _, ok := splitKey(t); ok || isSeqItem(t) {
+			return nil, p.errorf("bad indentation")
+		}
+		s += " " + t
+	}
+	// A plain scalar cannot hold a mapping entry, as in "a: b: c".
+	if strings.Contains(s, ": ") || strings.HasSuffix(s, ":") {
+		return nil, p.errorf("mapping values are not allowed in %q", s)
+	}
+	return plain(s), nil
+}
+
+// blockScalar parses a literal (|) or folded (>) block scalar.
+func (p *parser) blockScalar(header string, parent int) (interface{}, error) {
+	folded := header[0] == '>'
+	chomp := byte(0)
+	if strings.ContainsAny(header[1:], "-+") {
+		chomp = header[1+strings.IndexAny(header[1:], "-+")]
+	}
+
+	var lines []string
+	indent := -1
+	for p.pos++; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		if strings.TrimSpace(line) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		ind := len(line) - len(strings.TrimLeft(line, " "))
+		if ind <= parent {
+			break
+		}
+		if indent < 0 {
+			indent = ind
+		}
+		if ind < indent {
+			return nil, p.errorf("bad indentation in block scalar")
+		}
+		lines = append(lines, line[indent:])
+	}
+
+	// Trailing blank lines only count for keep chomping.
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+
+	var s string
+	if folded {
+		for i, l := range lines {
+			switch {
+			case i == 0, lines[i-1] == "":
+			case l == "" || strings.HasPrefix(l, " ") || strings.HasPrefix(lines[i-1], " "):
+				s += "\n"
+			default:
+				s += " "
+			}
+			s += l
+		}
+	} else {
+		s = strings.Join(lines, "\n")
+	}
+
+	switch {
+	case len(lines) == 0:
+	case chomp == '-':
+	case chomp == '+':
+		s += strings.Repeat("\n", trailing+1)
+	default:
+		s += "\n"
+	}
+	return s, nil
+}
+
+// flow parses flow collections and scalars.
+type flow struct {
+	s string
+	i int
+}
+
+func (f *flow) skipSpace() {
+	for f.i < len(f.s) && (f.s[f.i] == ' ' || f.s[f.i] == '\t') {
+		f.i++
+	}
+}
+
+func (f *flow) value() (interface{}, error) {
+	f.skipSpace()
+	if f.i >= len(f.s) {
+		return nil, fmt.Errorf("unexpected end of flow collection")
+	}
+	switch f.s[f.i] {
+	case '[':
+		f.i++
+		s := []interface{}{}
+		for {
+			if f.skipSpace(); f.i < len(f.s) && f.s[f.i] == ']' {
+				f.i++
+				return s, nil
+			}
+			v, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, v)
+			if err := f.separator(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		f.i++
+		m := map[string]interface{}{}
+		for {
+			if f.skipSpace(); f.i < len(f.s) && f.s[f.i] == '}' {
+				f.i++
+				return m, nil
+			}
+			k, err := f.scalar(true)
+			if err != nil {
+				return nil, err
+			}
+			var v interface{}
+			if f.skipSpace(); f.i < len(f.s) && f.s[f.i] == ':' {
+				f.i++
+				if v, err = f.value(); err != nil {
+					return nil, err
+				}
+			}
+			key, _ := k.(string)
+			if _, dup := m[key]; dup {
+				return nil, fmt.Errorf("duplicate key %q", key)
+			}
+			m[key] = v
+			if err := f.separator('}'); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return f.scalar(false)
+}
+
+// separator consumes the comma between items, leaving the closing bracket.
+func (f *flow) separator(end byte) error {
+	f.skipSpace()
+	switch {
+	case f.i >= len(f.s):
+		return fmt.Errorf("missing %q in flow collection", end)
+	case f.s[f.i] == ',':
+		f.i++
+	case f.s[f.i] != end:
+		return fmt.Errorf("expected ',' or %q in flow collection", end)
+	}
+	return nil
+}
+
+func (f *flow) scalar(key bool) (interface{}, error) {
+	f.skipSpace()
+	start := f.i
+	if f.i < len(f.s) && (f.s[f.i] == '"' || f.s[f.i] == '\'') {
+		q := f.s[f.i]
+		for f.i++; f.i < len(f.s); f.i++ {
+			if q == '"' && f.s[f.i] == '\\' {
+				f.i++
+				continue
+			}
+			if f.s[f.i] == q {
+				if q == '\'' && f.i+1 < len(f.s) && f.s[f.i+1] == '\'' {
+					f.i++
+					continue
+				}
+				f.i++
+				return unquote(f.s[start:f.i])
+			}
+		}
+		return nil, fmt.Errorf("unterminated quoted scalar")
+	}
+
+	for f.i < len(f.s) {
+		c := f.s[f.i]
+		if c == ',' || c == ']' || c == '}' || key && c == ':' && (f.i+1 == len(f.s) || f.s[f.i+1] == ' ') {
+			break
+		}
+		if !key && c == ':' && f.i+1 < len(f.s) && f.s[f.i+1] == ' ' {
+			break
+		}
+		f.i++
+	}
+	return plain(strings.TrimSpace(f.s[start:f.i])), nil
+}
+
+// plain returns the value of a plain scalar.
+func plain(s string) interface{} {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	}
+	return s
+}
+
+// unquote returns the value of a single or double quoted scalar.
+func unquote(s string) (string, error) {
+	if len(s) < 2 || s[0] != s[len(s)-1] || s[0] != '"' && s[0] != '\'' {
+		return "", fmt.Errorf("invalid quoted scalar %s", s)
+	}
+	if s[0] == '\'' {
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	}
+	v, err := strconv.Unquote(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid quoted scalar %s", s)
+	}
+	return v, nil
+}
+
+// isSeqItem reports whether the line is an item of a block sequence.
+func isSeqItem(t string) bool {
+	return t == "-" || strings.HasPrefix(t, "- ")
+}
+
+// splitKey splits a mapping entry into its key and value.
+func splitKey(t string) (key, rest string, ok bool) {
+	if strings.HasPrefix(t, "[") || strings.HasPrefix(t, "{") {
+		return "", "", false
+	}
+	var quote byte
+	for i := 0; i < len(t); i++ {
+		c := t[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && i == 0:
+			quote = c
+		case c == ':' && (i+1 == len(t) || t[i+1] == ' ' || t[i+1] == '\t'):
+			return strings.TrimSpace(t[:i]), strings.TrimSpace(t[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// stripComment removes a comment from a line, outside of quoted scalars.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.ContainsRune(" \t[{,:-", rune(line[i-1])) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// balanced reports whether the brackets of a flow collection are closed.
+func balanced(s string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		}
+	}
+	return depth <= 0
+}
@@ -0,0 +1,269 @@
+package yaml
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type m = map[string]interface{}
+type s = []interface{}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected interface{}
+	}{
+		{
+			name:     "empty",
+			input:    "",
+			expected: nil,
+		},
+		{
+			name:     "comments only",
+			input:    "# nothing\n---\n",
+			expected: nil,
+		},
+		{
+			name:     "scalar",
+			input:    "hello world",
+			expected: "hello world",
+		},
+		{
+			name: "compose services",
+			input: `version: "3.7"
+services:
+  web:
+    build:
+      context: ./web
+      dockerfile: Dockerfile.prod
+      args:
+        - GO_VERSION=1.10
+    image: jess/web:latest
+    ports:
+      - "8080:80"
+    depends_on: [db]
+  db:
+    image: postgres:10 # the database
+`,
+			expected: m{
+				"version": "3.7",
+				"services": m{
+					"web": m{
+						"build": m{
+							"context":    "./web",
+							"dockerfile": "Dockerfile.prod",
+							"args":       s{"GO_VERSION=1.10"},
+						},
+						"image":      "jess/web:latest",
+						"ports":      s{"8080:80"},
+						"depends_on": s{"db"},
+					},
+					"db": m{
+						"image": "postgres:10",
+					},
+				},
+			},
+		},
+		{
+			name: "environment mapping and nulls",
+			input: `environment:
+  DEBUG: "true"
+  EMPTY:
+  TILDE: ~
+  QUOTED: 'it''s'
+`,
+			expected: m{
+				"environment": m{
+					"DEBUG":  "true",
+					"EMPTY":  nil,
+					"TILDE":  nil,
+					"QUOTED": "it's",
+				},
+			},
+		},
+		{
+			name: "sequence of mappings",
+			input: `volumes:
+  - type: bind
+    source: ./src
+  - type: volume
+    source: data
+`,
+			expected: m{
+				"volumes": s{
+					m{"type": "bind", "source": "./src"},
+					m{"type": "volume", "source": "data"},
+				},
+			},
+		},
+		{
+			name: "sequence at the indentation of its key",
+			input: `command:
+- sh
+- -c
+`,
+			expected: m{"command": s{"sh", "-c"}},
+		},
+		{
+			name: "anchors, aliases and merge keys",
+			input: `x-common: &common
+  restart: always
+  image: base
+services:
+  a:
+    <<: *common
+    image: a
+  b: *common
+`,
+			expected: m{
+				"x-common": m{"restart": "always", "image": "base"},
+				"services": m{
+					"a": m{"restart": "always", "image": "a"},
+					"b": m{"restart": "always", "image": "base"},
+				},
+			},
+		},
+		{
+			name: "flow collections over several lines",
+			input: `labels: {a: "1", b: 2}
+cmd: [
+  "echo",
+  hi,
+]
+`,
+			expected: m{
+				"labels": m{"a": "1", "b": "2"},
+				"cmd":    s{"echo", "hi"},
+			},
+		},
+		{
+			name: "block scalars",
+			input: `literal: |
+  line one
+  line two
+folded: >-
+  one
+  two
+
+  three
+keep: |+
+  x
+
+end: y
+`,
+			expected: m{
+				"literal": "line one\nline two\n",
+				"folded":  "one two\nthree",
+				"keep":    "x\n\n",
+				"end":     "y",
+			},
+		},
+		{
+			name: "multi-line plain scalar",
+			input: `description: a long
+  description
+`,
+			expected: m{"description": "a long description"},
+		},
+		{
+			name:     "colons and hashes in scalars",
+			input:    "url: http://example.com/#top\ntime: 12:30\n",
+			expected: m{"url": "http://example.com/#top", "time": "12:30"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := Parse([]byte(tt.input))
+			if err != nil {
+				t.Fatalf("parsing failed: %v", err)
+			}
+			if !reflect.DeepEqual(v, tt.expected) {
+				t.Fatalf("expected %#v, got %#v", tt.expected, v)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{
+			name:  "mapping in a plain scalar",
+			input: "a: b: c\n",
+			err:   "mapping values are not allowed",
+		},
+		{
+			name:  "duplicate key",
+			input: "a: 1\na: 2\n",
+			err:   `duplicate key "a"`,
+		},
+		{
+			name:  "duplicate flow key",
+			input: "a: {b: 1, b: 2}\n",
+			err:   `duplicate key "b"`,
+		},
+		{
+			name:  "bad indentation",
+			input: "a:\n  b: 1\n   c: 2\n",
+			err:   "bad indentation",
+		},
+		{
+			name:  "sequence item in a mapping",
+			input: "a: 1\n- b\n",
+			err:   "expected a key",
+		},
+		{
+			name:  "tab indentation",
+			input: "a:\n\tb: 1\n",
+			err:   "tabs are not allowed",
+		},
+		{
+			name:  "unknown alias",
+			input: "a: *nope\n",
+			err:   "unknown alias",
+		},
+		{
+			name:  "unterminated quoted scalar",
+			input: "a: \"b\n",
+			err:   "invalid quoted scalar",
+		},
+		{
+			name:  "unclosed flow sequence",
+			input: "a: [b, c\n",
+			err:   "missing ']'",
+		},
+		{
+			name:  "content after a flow collection",
+			input: "a: [b] c\n",
+			err:   "after flow collection",
+		},
+		{
+			name:  "merge of a scalar",
+			input: "x: &x 1\na:\n  <<: *x\n",
+			err:   "merge key must refer to a mapping",
+		},
+		{
+			name:  "tag",
+			input: "a: !!str 1\n",
+			err:   "tags are not supported",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := Parse([]byte(tt.input))
+			if err == nil {
+				t.Fatalf("expected an error, got %#v", v)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected error to contain %q, got: %v", tt.err, err)
+			}
+		})
+	}
+}
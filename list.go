@@ -41,7 +41,7 @@ func (cmd *listCommand) Run(args []string) (err error) {
 	ctx = namespaces.WithNamespace(ctx, "buildkit")
 
 	// Create the client.
-	c, err := client.New(stateDir, backend, nil)
+	c, err := client.New(stateDir, backend, stateLock, nil)
 	if err != nil {
 		return err
 	}
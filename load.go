@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/genuinetools/img/client"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/util/appcontext"
+)
+
+const loadShortHelp = `Load images from a tar archive (read from STDIN by default).`
+
+var loadLongHelp = loadShortHelp + `
+Both docker archives, as created by docker save, and OCI archives are loaded.`
+
+func (cmd *loadCommand) Name() string       { return "load" }
+func (cmd *loadCommand) Args() string       { return "[OPTIONS]" }
+func (cmd *loadCommand) ShortHelp() string  { return loadShortHelp }
+func (cmd *loadCommand) LongHelp() string   { return loadLongHelp }
+func (cmd *loadCommand) Hidden() bool       { return false }
+func (cmd *loadCommand) DoReexec() bool     { return true }
+func (cmd *loadCommand) RequiresRunc() bool { return false }
+
+func (cmd *loadCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.input, "i", "", "Read from a tar archive file, instead of STDIN")
+	fs.StringVar(&cmd.name, "t", "", "Name for the images of the archive without one, like those of most OCI archives")
+	fs.BoolVar(&cmd.quiet, "q", false, "Only print the names of the loaded images")
+}
+
+type loadCommand struct {
+	input string
+	name  string
+	quiet bool
+}
+
+func (cmd *loadCommand) Run(args []string) (err error) {
+	var r io.Reader = os.Stdin
+	if cmd.input != "" {
+		f, err := os.Open(cmd.input)
+		if err != nil {
+			return fmt.Errorf("opening archive failed: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	// Create the context.
+	ctx := appcontext.Context()
+	id := identity.NewID()
+	ctx = session.NewContext(ctx, id)
+	ctx = namespaces.WithNamespace(ctx, "buildkit")
+
+	// Create the client.
+	c, err := client.New(stateDir, backend, stateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	loaded, err := c.LoadImage(ctx, r, cmd.name)
+	if err != nil {
+		return err
+	}
+
+	for _, img := range loaded {
+		if cmd.quiet {
+			fmt.Println(img.Name)
+			continue
+		}
+		fmt.Printf("Loaded image %s: %s\n", img.Name, img.Target.Digest)
+	}
+
+	return nil
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadErrors(t *testing.T) {
+	cmd := &loadCommand{input: filepath.Join("testdata", "nope.tar")}
+	if err := cmd.Run(nil); err == nil || !strings.Contains(err.Error(), "opening archive failed") {
+		t.Fatalf("expected a missing archive to fail, got: %v", err)
+	}
+}
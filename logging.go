@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	textLogFormat = "text"
+	jsonLogFormat = "json"
+)
+
+var validLogFormats = []string{textLogFormat, jsonLogFormat}
+
+// configureLogging sets up the logger from the global logging flags.
+func configureLogging() error {
+	// The debug flag is a shortcut for the debug log level.
+	if debug {
+		logLevel = logrus.DebugLevel.String()
+	}
+
+	level, err := logrus.ParseLevel(logLevel)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid log level", logLevel)
+	}
+	logrus.SetLevel(level)
+
+	switch logFormat {
+	case textLogFormat:
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case jsonLogFormat:
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("%s is not a valid log format (%v)", logFormat, validLogFormats)
+	}
+
+	if logFile != "" {
+		// Open the log file for appending since the re-exec'd child will write to
+		// the same file as its parent.
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("opening log file %s failed: %v", logFile, err)
+		}
+		logrus.SetOutput(f)
+	}
+
+	return nil
+}
@@ -178,8 +178,7 @@ func readInput(in io.Reader) string {
 	reader := bufio.NewReader(in)
 	line, _, err := reader.ReadLine()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "reading input failed: %v", err)
-		os.Exit(1)
+		logrus.Fatalf("reading input failed: %v", err)
 	}
 
 	return string(line)
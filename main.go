@@ -2,13 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"runtime"
 	"strings"
 	"text/tabwriter"
+	"time"
 
+	"github.com/genuinetools/img/client"
 	"github.com/genuinetools/img/internal/binutils"
+	"github.com/genuinetools/img/internal/metrics"
+	"github.com/genuinetools/img/internal/tracing"
 	_ "github.com/genuinetools/img/internal/unshare"
 	"github.com/genuinetools/img/types"
 	"github.com/sirupsen/logrus"
@@ -21,13 +27,38 @@ const (
 )
 
 var (
-	backend  string
-	stateDir string
-	debug    bool
+	backend   string
+	stateDir  string
+	stateLock string
+	debug     bool
+	logLevel  string
+	logFormat string
+	logFile   string
+
+	pushgateway string
+
+	offline       bool
+	offlineLayout string
+	unpackJobs    int
+
+	memoryBudgetFlag string
+	// memoryBudget is the memory img tries to stay under in bytes, 0 if
+	// there is no budget.
+	memoryBudget int64
 
 	defaultStateDirectory = "/tmp/img"
 
 	validBackends = []string{types.AutoBackend, types.NativeBackend, types.OverlayFSBackend}
+
+	validStateLocks = []string{types.AutoStateLock, types.FlockStateLock, types.LeaseStateLock}
+
+	// commands holds the list of available commands.
+	commands []command
+
+	// tracer records spans for the running command when OpenTelemetry
+	// tracing is configured, commandSpan is the root span for the command.
+	tracer      *tracing.Tracer
+	commandSpan *tracing.Span
 )
 
 type command interface {
@@ -56,16 +87,39 @@ func (s *stringSlice) Set(value string) error {
 
 func main() {
 	// Build the list of available commands.
-	commands := []command{
+	commands = []command{
+		&assembleCommand{},
+		&bakeCommand{},
+		&benchCommand{},
 		&buildCommand{},
+		&cloneCommand{},
+		&completionCommand{},
+		&composeCommand{},
+		&cpCommand{},
+		&daemonCommand{},
+		&diffCommand{},
+		&doctorCommand{},
 		&diskUsageCommand{},
+		&exportCommand{},
+		&historyCommand{},
+		&inspectCommand{},
 		&listCommand{},
+		&loadCommand{},
 		&loginCommand{},
+		&manifestCommand{},
+		&optimizeCommand{},
+		&pruneCommand{},
 		&pullCommand{},
 		&pushCommand{},
+		&queueCommand{},
 		&removeCommand{},
 		&saveCommand{},
+		&serveCommand{},
+		&solveCommand{},
 		&tagCommand{},
+		&tagsCommand{},
+		&targetsCommand{},
+		&unpackCommand{},
 		&versionCommand{},
 	}
 
@@ -91,14 +145,8 @@ func main() {
 
 	for _, command := range commands {
 		if name := command.Name(); os.Args[1] == name {
-			// Build flag set with global flags in there.
-			fs := flag.NewFlagSet(name, flag.ExitOnError)
-			fs.BoolVar(&debug, "d", false, "enable debug logging")
-			fs.StringVar(&backend, "backend", defaultBackend, fmt.Sprintf("backend for snapshots (%v)", validBackends))
-			fs.StringVar(&stateDir, "state", defaultStateDirectory, fmt.Sprintf("directory to hold the global state"))
-
-			// Register the subcommand flags in there, too.
-			command.Register(fs)
+			// Build flag set with global and subcommand flags in there.
+			fs := newFlagSet(command)
 
 			// Override the usage text to something nicer.
 			resetUsage(fs, command.Name(), command.Args(), command.LongHelp())
@@ -109,9 +157,9 @@ func main() {
 				os.Exit(1)
 			}
 
-			// set log level
-			if debug {
-				logrus.SetLevel(logrus.DebugLevel)
+			// Set up the logger.
+			if err := configureLogging(); err != nil {
+				logrus.Fatal(err)
 			}
 
 			// Make sure we have a valid backend.
@@ -126,6 +174,29 @@ func main() {
 				logrus.Fatalf("%s is not a valid snapshots backend", backend)
 			}
 
+			// Make sure we have a valid state lock.
+			found = false
+			for _, vl := range validStateLocks {
+				if vl == stateLock {
+					found = true
+					break
+				}
+			}
+			if !found {
+				logrus.Fatalf("%s is not a valid state lock", stateLock)
+			}
+
+			if offlineLayout != "" && !offline {
+				logrus.Fatal("-offline-layout can only be used with -offline")
+			}
+			if offline {
+				client.DisableNetwork()
+			}
+			client.SetUnpackJobs(unpackJobs)
+			if err := setMemoryBudget(memoryBudgetFlag); err != nil {
+				logrus.Fatalf("parsing -memory-budget failed: %v", err)
+			}
+
 			// Perform the re-exec if necessary.
 			if command.DoReexec() {
 				reexec()
@@ -142,10 +213,26 @@ func main() {
 				defer os.RemoveAll(runcDir)
 			}
 
+			// Record the profiles asked for with -profile.
+			stopProfiles, err := startProfiles(name)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+
+			// Set up tracing if it was configured in the environment.
+			tracer = tracing.New()
+			commandSpan = tracer.Start("img "+name, nil)
+
 			// Run the command with the post-flag-processing args.
-			if err := command.Run(fs.Args()); err != nil {
-				fmt.Fprintf(os.Stderr, "%v\n", err)
-				os.Exit(1)
+			err = command.Run(fs.Args())
+			stopProfiles()
+			commandSpan.Finish(err)
+			flushTracer()
+			pushMetrics()
+			if err != nil {
+				logrus.WithField("command", name).Debugf("command failed: %v", err)
+				fmt.Fprintf(os.Stderr, "%v\n", withHint(err))
+				os.Exit(exitCode(err))
 			}
 
 			// Easy peasy livin' breezy.
@@ -158,6 +245,57 @@ func main() {
 	os.Exit(1)
 }
 
+// flushTracer exports the recorded spans, failures are only logged since
+// tracing should never fail a command.
+func flushTracer() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracer.Flush(ctx); err != nil {
+		logrus.Warnf("flushing traces failed: %v", err)
+	}
+}
+
+// pushMetrics sends the metrics to the Pushgateway if one was configured,
+// failures are only logged since metrics should never fail a command.
+func pushMetrics() {
+	if pushgateway == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := metrics.Push(ctx, pushgateway, "img"); err != nil {
+		logrus.Warnf("pushing metrics failed: %v", err)
+	}
+}
+
+// newFlagSet returns a flag set for the command with the global flags and the
+// command specific flags registered.
+func newFlagSet(cmd command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.Name(), flag.ExitOnError)
+	fs.BoolVar(&debug, "d", false, "enable debug logging")
+	fs.StringVar(&logLevel, "log-level", logrus.InfoLevel.String(), "log level (debug, info, warn, error, fatal, panic)")
+	fs.StringVar(&logFormat, "log-format", textLogFormat, fmt.Sprintf("log format (%v)", validLogFormats))
+	fs.StringVar(&logFile, "log-file", "", "write logs to a file instead of STDERR")
+	fs.StringVar(&pushgateway, "metrics-pushgateway", "", "push metrics to a Prometheus Pushgateway when the command finishes")
+	fs.StringVar(&backend, "backend", defaultBackend, fmt.Sprintf("backend for snapshots (%v)", validBackends))
+	fs.StringVar(&stateDir, "state", defaultStateDirectory, fmt.Sprintf("directory to hold the global state"))
+	fs.BoolVar(&offline, "offline", false, "disable all network access, images must already be in the state directory")
+	fs.StringVar(&offlineLayout, "offline-layout", "", "OCI image layout directory to load the missing images of a build from when offline")
+	fs.StringVar(&memoryBudgetFlag, "memory-budget", "", "memory to stay under, e.g. 512m, build logs and large layer diffs go through temporary files and the disk instead of memory")
+	fs.IntVar(&unpackJobs, "unpack-jobs", runtime.NumCPU(), "number of layers to decompress concurrently when pulling an image")
+	fs.StringVar(&stateLock, "state-lock", types.AutoStateLock, fmt.Sprintf("locking for the state directory, lease is safe on network filesystems (%v)", validStateLocks))
+
+	// Register the subcommand flags in there, too.
+	cmd.Register(fs)
+	// compose has its own -profile, for the services of compose profiles.
+	if fs.Lookup("profile") == nil {
+		fs.Var(&profiles, "profile", fmt.Sprintf("record a profile of the command in the current directory or DIR, as KIND or KIND=DIR, can be repeated (%v)", validProfiles))
+	}
+
+	return fs
+}
+
 func resetUsage(fs *flag.FlagSet, name, args, longHelp string) {
 	var (
 		hasFlags   bool
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
@@ -54,22 +56,28 @@ func TestMain(m *testing.M) {
 	os.Exit(r)
 }
 
-// doRun runs the test command, recording stdout and stderr and
-// returning exit status.
-func doRun(args []string, stdin io.Reader) (string, error) {
+// testCommand returns the test command with the state directory of the
+// tests.
+func testCommand(args ...string) *exec.Cmd {
 	prog := "./testimg" + exeSuffix
 
 	newargs := []string{args[0], "--state", testStateDir}
 	newargs = append(newargs, args[1:]...)
 
+	return exec.Command(prog, newargs...)
+}
+
+// doRun runs the test command, recording stdout and stderr and
+// returning exit status.
+func doRun(args []string, stdin io.Reader) (string, error) {
 	// TODO(genuinetools): the sudo here is horrible, I know.
-	cmd := exec.Command(prog, newargs...)
+	cmd := testCommand(args...)
 	if stdin != nil {
 		cmd.Stdin = stdin
 	}
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return string(out), fmt.Errorf("Error running %s: %s\n%v", strings.Join(newargs, " "), string(out), err)
+		return string(out), fmt.Errorf("Error running %s: %s\n%v", strings.Join(cmd.Args[1:], " "), string(out), err)
 	}
 
 	return string(out), nil
@@ -91,6 +99,26 @@ func run(t *testing.T, args ...string) string {
 	return out
 }
 
+// runStdout runs the test command, and expects it to succeed. It returns
+// stdout alone.
+func runStdout(t *testing.T, args ...string) string {
+	if runtime.GOOS == "windows" {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+
+	var stderr bytes.Buffer
+	cmd := testCommand(args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Logf("img %v failed unexpectedly: %v\n%s%s", args, err, out, stderr.String())
+		t.FailNow()
+	}
+
+	return string(out)
+}
+
 func runBuild(t *testing.T, name string, stdin io.Reader) {
 	if runtime.GOOS == "windows" {
 		mu.Lock()
@@ -111,3 +139,22 @@ func runBuild(t *testing.T, name string, stdin io.Reader) {
 func withDockerfile(dockerfile string) io.Reader {
 	return strings.NewReader(dockerfile)
 }
+
+// withFiles creates a temporary directory with the files, by their path
+// relative to it. The caller removes the directory.
+func withFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "img-test-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
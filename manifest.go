@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/genuinetools/img/client"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/util/appcontext"
+)
+
+const manifestShortHelp = `Create, annotate or push a manifest list.`
+
+var manifestLongHelp = manifestShortHelp + `
+Assembles a multi-platform manifest list from images built for each platform.
+
+  $ img manifest create LIST IMAGE [IMAGE...]
+  $ img manifest -arch arm -variant v7 annotate LIST IMAGE
+  $ img manifest push LIST`
+
+func (cmd *manifestCommand) Name() string       { return "manifest" }
+func (cmd *manifestCommand) Args() string       { return "[OPTIONS] create|annotate|push LIST [IMAGE...]" }
+func (cmd *manifestCommand) ShortHelp() string  { return manifestShortHelp }
+func (cmd *manifestCommand) LongHelp() string   { return manifestLongHelp }
+func (cmd *manifestCommand) Hidden() bool       { return false }
+func (cmd *manifestCommand) DoReexec() bool     { return true }
+func (cmd *manifestCommand) RequiresRunc() bool { return false }
+
+func (cmd *manifestCommand) Register(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.amend, "amend", false, "Add the images to the existing manifest list (create)")
+	fs.StringVar(&cmd.annotation.OS, "os", "", "Set the operating system of the image (annotate)")
+	fs.StringVar(&cmd.annotation.OSVersion, "os-version", "", "Set the operating system version of the image (annotate)")
+	fs.Var(&cmd.osFeatures, "os-features", "Set the operating system features of the image (annotate)")
+	fs.StringVar(&cmd.annotation.Arch, "arch", "", "Set the architecture of the image (annotate)")
+	fs.StringVar(&cmd.annotation.Variant, "variant", "", "Set the architecture variant of the image (annotate)")
+	fs.BoolVar(&cmd.insecure, "insecure-registry", false, "Push to insecure registry (push)")
+}
+
+type manifestCommand struct {
+	amend      bool
+	annotation client.ManifestAnnotation
+	osFeatures stringSlice
+	insecure   bool
+}
+
+func (cmd *manifestCommand) Run(args []string) (err error) {
+	if len(args) < 1 {
+		return fmt.Errorf("must pass create, annotate or push")
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("must pass the name of a manifest list")
+	}
+	list := args[1]
+
+	// Create the context.
+	ctx := appcontext.Context()
+	id := identity.NewID()
+	ctx = session.NewContext(ctx, id)
+	ctx = namespaces.WithNamespace(ctx, "buildkit")
+
+	// Create the client.
+	c, err := client.New(stateDir, backend, stateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	switch args[0] {
+	case "create":
+		if len(args) < 3 && !cmd.amend {
+			return fmt.Errorf("must pass the images of the manifest list")
+		}
+		img, err := c.CreateManifestList(ctx, list, args[2:], cmd.amend)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created manifest list %s: %s\n", img.Name, img.Target.Digest)
+		return nil
+	case "annotate":
+		if len(args) != 3 {
+			return fmt.Errorf("must pass the image to annotate in the manifest list")
+		}
+		cmd.annotation.OSFeatures = cmd.osFeatures
+		img, err := c.AnnotateManifestList(ctx, list, args[2], cmd.annotation)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Annotated %s in manifest list %s: %s\n", args[2], img.Name, img.Target.Digest)
+		return nil
+	case "push":
+		push := &pushCommand{insecure: cmd.insecure, progress: progressAuto, client: c}
+		return push.Run([]string{list})
+	}
+	return fmt.Errorf("unknown manifest command %q, must be create, annotate or push", args[0])
+}
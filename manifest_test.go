@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestManifestErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "img-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(s string) { stateDir = s }(stateDir)
+	stateDir = dir
+
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{args: []string{}, err: "must pass create, annotate or push"},
+		{args: []string{"create"}, err: "must pass the name of a manifest list"},
+		{args: []string{"create", "manifestlist"}, err: "must pass the images of the manifest list"},
+		{args: []string{"annotate", "manifestlist"}, err: "must pass the image to annotate in the manifest list"},
+		{args: []string{"inspect", "manifestlist"}, err: `unknown manifest command "inspect"`},
+	}
+	for _, tt := range tests {
+		if err := (&manifestCommand{}).Run(tt.args); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("expected manifest %v to fail with %q, got: %v", tt.args, tt.err, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/genuinetools/img/internal/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// notifyOptions holds the flags for sending a notification when a command
+// finishes. They default to the IMG_NOTIFY_URL and IMG_NOTIFY_LOGS_URL
+// environment variables so they can be set once for every invocation.
+type notifyOptions struct {
+	url     string
+	logsURL string
+}
+
+func (o *notifyOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.url, "notify-url", os.Getenv("IMG_NOTIFY_URL"), "POST a JSON notification with the result to the URL when finished")
+	fs.StringVar(&o.logsURL, "notify-logs-url", os.Getenv("IMG_NOTIFY_LOGS_URL"), "URL of the logs to include in the notification, e.g. the CI job")
+}
+
+// notification is the JSON payload sent to the notify URL.
+type notification struct {
+	Command  string    `json:"command"`
+	Image    string    `json:"image"`
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+	Digest   string    `json:"digest,omitempty"`
+	Duration float64   `json:"duration"`
+	LogsURL  string    `json:"logsUrl,omitempty"`
+	Finished time.Time `json:"finished"`
+}
+
+// notify sends the result of a command to the notify URL if one is set.
+// Failures are only logged since they should not fail the command.
+func (o *notifyOptions) notify(command, image, digest string, start time.Time, err error) {
+	if o.url == "" {
+		return
+	}
+
+	n := notification{
+		Command:  command,
+		Image:    image,
+		Result:   metrics.Result(err),
+		Digest:   digest,
+		Duration: time.Since(start).Seconds(),
+		LogsURL:  o.logsURL,
+		Finished: time.Now().UTC(),
+	}
+	if err != nil {
+		n.Error = err.Error()
+	}
+
+	if err := sendNotification(o.url, n); err != nil {
+		logrus.Warnf("sending notification failed: %v", err)
+	}
+}
+
+func sendNotification(url string, n notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("marshaling notification failed: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("creating request to %s failed: %v", url, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("posting notification to %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("posting notification to %s failed with status %s", url, resp.Status)
+	}
+
+	return nil
+}
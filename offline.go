@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/genuinetools/img/client"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerfile2llb"
+	"github.com/opencontainers/go-digest"
+)
+
+// checkOfflineImages makes sure the images a Dockerfile builds from are in the
+// image store, loading them from the -offline-layout if one was given. The
+// error lists every missing image so they can be pulled beforehand.
+func checkOfflineImages(ctx context.Context, c *client.Client, dockerfile, target string, buildArgs map[string]string) error {
+	dt, err := ioutil.ReadFile(dockerfile)
+	if err != nil {
+		return fmt.Errorf("reading dockerfile failed: %v", err)
+	}
+
+	missing, err := missingImages(ctx, c, dt, target, buildArgs)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 && offlineLayout != "" {
+		if err := loadOCILayout(ctx, c, offlineLayout); err != nil {
+			return err
+		}
+		if missing, err = missingImages(ctx, c, dt, target, buildArgs); err != nil {
+			return err
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("building offline needs images that are not in the image store, pull or load them first:\n  %s", strings.Join(missing, "\n  "))
+	}
+	return nil
+}
+
+// missingImages returns the images the stages needed for the target are
+// built from, or copy from, that are not in the image store.
+func missingImages(ctx context.Context, c *client.Client, dt []byte, target string, buildArgs map[string]string) ([]string, error) {
+	r := &recordingResolver{c: c}
+	if _, _, err := dockerfile2llb.Dockerfile2LLB(ctx, dt, dockerfile2llb.ConvertOpt{
+		Target:       target,
+		MetaResolver: r,
+		BuildArgs:    buildArgs,
+	}); err != nil {
+		return nil, fmt.Errorf("converting dockerfile to llb failed: %v", err)
+	}
+	sort.Strings(r.missing)
+	return r.missing, nil
+}
+
+// recordingResolver resolves image configs with the client, recording the
+// images that cannot be resolved. With the network disabled only the image
+// store is looked at.
+type recordingResolver struct {
+	c *client.Client
+
+	mu      sync.Mutex
+	missing []string
+}
+
+func (r *recordingResolver) ResolveImageConfig(ctx context.Context, ref string) (digest.Digest, []byte, error) {
+	dgst, dt, err := r.c.ResolveImageConfig(ctx, ref)
+	if err != nil {
+		r.mu.Lock()
+		r.missing = append(r.missing, ref)
+		r.mu.Unlock()
+	}
+	return dgst, dt, err
+}
+
+// loadOCILayout loads the named images of an OCI image layout directory into
+// the image store.
+func loadOCILayout(ctx context.Context, c *client.Client, dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); err != nil {
+		return fmt.Errorf("%s is not an OCI image layout: %v", dir, err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tarDirectory(pw, dir))
+	}()
+	defer pr.Close()
+
+	if _, err := c.LoadImage(ctx, pr, ""); err != nil {
+		return fmt.Errorf("loading images from %s failed: %v", dir, err)
+	}
+	return nil
+}
+
+// tarDirectory writes the regular files in dir to w as a tarball.
+func tarDirectory(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
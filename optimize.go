@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/namespaces"
+	units "github.com/docker/go-units"
+	"github.com/genuinetools/img/client"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/util/appcontext"
+)
+
+const optimizeShortHelp = `Rewrite the layers of an image to share more of them with reference images.`
+
+const optimizeLongHelp = `Rewrite the layers of an image to share more of them with reference images.
+
+Layers with the same content as a layer of the reference images are replaced
+by it, and layers containing all the files of a layer of the reference images
+are split into that layer and one with the rest of their files. The
+filesystem of the image does not change. The expected pull size is what a host
+that already has the reference images has to pull.`
+
+func (cmd *optimizeCommand) Name() string       { return "optimize" }
+func (cmd *optimizeCommand) Args() string       { return "[OPTIONS] IMAGE" }
+func (cmd *optimizeCommand) ShortHelp() string  { return optimizeShortHelp }
+func (cmd *optimizeCommand) LongHelp() string   { return optimizeLongHelp }
+func (cmd *optimizeCommand) Hidden() bool       { return false }
+func (cmd *optimizeCommand) DoReexec() bool     { return true }
+func (cmd *optimizeCommand) RequiresRunc() bool { return false }
+
+func (cmd *optimizeCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.tag, "t", "", "Name and optionally a tag in the 'name:tag' format for the optimized image")
+	fs.Var(&cmd.refs, "ref", "Reference image to share layers with, can be repeated")
+}
+
+type optimizeCommand struct {
+	tag  string
+	refs stringSlice
+}
+
+func (cmd *optimizeCommand) Run(args []string) (err error) {
+	if len(args) < 1 {
+		return errors.New("must pass an image to optimize")
+	}
+	if cmd.tag == "" {
+		return errors.New("please specify a name for the optimized image with -t")
+	}
+	if len(cmd.refs) == 0 {
+		return errors.New("please specify at least one reference image with -ref")
+	}
+
+	// Create the context.
+	ctx := appcontext.Context()
+	id := identity.NewID()
+	ctx = session.NewContext(ctx, id)
+	ctx = namespaces.WithNamespace(ctx, "buildkit")
+
+	// Create the client.
+	c, err := client.New(stateDir, backend, stateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	res, err := c.OptimizeImage(ctx, args[0], cmd.tag, cmd.refs)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, '\t', 0)
+	fmt.Fprintln(tw, "LAYER\tSIZE\tACTION\tLAYERS")
+	for _, l := range res.Layers {
+		for i, nl := range l.Layers {
+			layer, size, action := "", "", ""
+			if i == 0 {
+				layer, size, action = l.Original.Digest.String(), units.BytesSize(float64(l.Original.Size)), l.Action
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s (%s)\n", layer, size, action, nl.Digest, units.BytesSize(float64(nl.Size)))
+		}
+	}
+	tw.Flush()
+
+	fmt.Printf("\nExpected pull size with the reference images: %s -> %s\n", units.BytesSize(float64(res.PullSize)), units.BytesSize(float64(res.OptimizedPullSize)))
+	fmt.Printf("Successfully optimized %s as %s\n", args[0], res.Image.Name)
+	return nil
+}
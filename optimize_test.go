@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOptimizeErrors(t *testing.T) {
+	tests := []struct {
+		cmd  *optimizeCommand
+		args []string
+		err  string
+	}{
+		{cmd: &optimizeCommand{tag: "optimizetest:optimized", refs: stringSlice{"busybox"}}, err: "must pass an image to optimize"},
+		{cmd: &optimizeCommand{refs: stringSlice{"busybox"}}, args: []string{"busybox"}, err: "please specify a name for the optimized image with -t"},
+		{cmd: &optimizeCommand{tag: "optimizetest:optimized"}, args: []string{"busybox"}, err: "please specify at least one reference image with -ref"},
+	}
+	for _, tt := range tests {
+		if err := tt.cmd.Run(tt.args); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("expected %q, got: %v", tt.err, err)
+		}
+	}
+}
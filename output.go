@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/filesync"
+)
+
+// buildOutput is an output of a build set with -o. Outputs are exported from
+// the image store once the image is built.
+type buildOutput struct {
+	Type  string
+	Attrs map[string]string
+}
+
+// solveExporters are the types of the outputs the build exports itself with
+// an exporter of buildkit. They are exported instead of the image, so the
+// build does not store one.
+var solveExporters = map[string]bool{
+	"local":  true,
+	"oci":    true,
+	"docker": true,
+}
+
+// attachable returns the session attachable receiving the files of an
+// output exported by the build, a directory for local outputs and a tarball
+// for the others.
+func (out buildOutput) attachable() (session.Attachable, error) {
+	dest := out.Attrs["dest"]
+	if out.Type != "local" {
+		f, err := os.Create(dest)
+		if err != nil {
+			return nil, fmt.Errorf("creating output file %s failed: %v", dest, err)
+		}
+		return filesync.NewFSSyncTarget(f), nil
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return nil, fmt.Errorf("creating output directory %s failed: %v", dest, err)
+	}
+	return filesync.NewFSSyncTargetDir(dest), nil
+}
+
+// parseOutput parses an output in the type=NAME[,KEY=VALUE...] format.
+func parseOutput(s string) (buildOutput, error) {
+	fields, err := csv.NewReader(strings.NewReader(s)).Read()
+	if err != nil {
+		return buildOutput{}, fmt.Errorf("parsing output %q failed: %v", s, err)
+	}
+
+	out := buildOutput{Attrs: map[string]string{}}
+	for _, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return buildOutput{}, fmt.Errorf("invalid output %q, must be type=NAME[,KEY=VALUE...]", s)
+		}
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		if key == "type" {
+			out.Type = kv[1]
+			continue
+		}
+		out.Attrs[key] = kv[1]
+	}
+	if out.Type == "" {
+		return buildOutput{}, fmt.Errorf("output %q has no type", s)
+	}
+	return out, nil
+}
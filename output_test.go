@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOutput(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected buildOutput
+		err      string
+	}{
+		{
+			input:    "type=local,dest=out",
+			expected: buildOutput{Type: "local", Attrs: map[string]string{"dest": "out"}},
+		},
+		{
+			input:    "type=sbom",
+			expected: buildOutput{Type: "sbom", Attrs: map[string]string{}},
+		},
+		{
+			input:    "dest=image.tar, TYPE=docker,name=jess/thing",
+			expected: buildOutput{Type: "docker", Attrs: map[string]string{"dest": "image.tar", "name": "jess/thing"}},
+		},
+		{
+			input:    `type=exec,"args=a,b"`,
+			expected: buildOutput{Type: "exec", Attrs: map[string]string{"args": "a,b"}},
+		},
+		{input: "local", err: `invalid output "local", must be type=NAME[,KEY=VALUE...]`},
+		{input: "dest=out", err: `output "dest=out" has no type`},
+		{input: "type=", err: `output "type=" has no type`},
+		{input: `type=local,"dest=out`, err: "parsing output"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			out, err := parseOutput(tt.input)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error to contain %q, got: %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsing output failed: %v", err)
+			}
+			if !reflect.DeepEqual(out, tt.expected) {
+				t.Fatalf("expected %#v, got %#v", tt.expected, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// validProfiles are the kinds of profiles -profile can record.
+var validProfiles = []string{"cpu", "mem", "trace"}
+
+// profiles holds the -profile flags, each KIND or KIND=DIR.
+var profiles stringSlice
+
+// profile is a profile recorded while a command runs.
+type profile struct {
+	kind string
+	path string
+	file *os.File
+}
+
+// startProfiles starts recording the profiles of the -profile flags for the
+// command. The returned function stops them and writes them out.
+func startProfiles(name string) (func(), error) {
+	var started []*profile
+	stop := func() {
+		for _, p := range started {
+			if err := p.stop(); err != nil {
+				logrus.Warnf("writing %s profile failed: %v", p.kind, err)
+				continue
+			}
+			logrus.Infof("Wrote %s profile to %s", p.kind, p.path)
+		}
+	}
+
+	for _, v := range profiles {
+		kind, dir := v, "."
+		if i := strings.Index(v, "="); i >= 0 {
+			kind, dir = v[:i], v[i+1:]
+		}
+		ext := map[string]string{"cpu": "cpu.pprof", "mem": "mem.pprof", "trace": "trace.out"}[kind]
+		if ext == "" {
+			stop()
+			return nil, fmt.Errorf("%s is not a valid profile (%v)", kind, validProfiles)
+		}
+
+		p := &profile{kind: kind, path: filepath.Join(dir, fmt.Sprintf("img-%s-%d.%s", name, os.Getpid(), ext))}
+		if err := p.start(); err != nil {
+			stop()
+			return nil, fmt.Errorf("starting %s profile failed: %v", kind, err)
+		}
+		started = append(started, p)
+	}
+	return stop, nil
+}
+
+func (p *profile) start() error {
+	f, err := os.Create(p.path)
+	if err != nil {
+		return err
+	}
+	p.file = f
+
+	switch p.kind {
+	case "cpu":
+		err = pprof.StartCPUProfile(f)
+	case "trace":
+		err = trace.Start(f)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(p.path)
+	}
+	return err
+}
+
+func (p *profile) stop() error {
+	switch p.kind {
+	case "cpu":
+		pprof.StopCPUProfile()
+	case "mem":
+		// Get up-to-date statistics of the memory in use.
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(p.file); err != nil {
+			p.file.Close()
+			return err
+		}
+	case "trace":
+		trace.Stop()
+	}
+	return p.file.Close()
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	units "github.com/docker/go-units"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/util/progress"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// progressEvent is a single solve status event in the JSON progress stream.
+type progressEvent struct {
+	Type      string          `json:"type"`
+	Time      time.Time       `json:"time"`
+	Vertex    digest.Digest   `json:"vertex,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Inputs    []digest.Digest `json:"inputs,omitempty"`
+	Started   *time.Time      `json:"started,omitempty"`
+	Completed *time.Time      `json:"completed,omitempty"`
+	Cached    bool            `json:"cached,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Current   int64           `json:"current,omitempty"`
+	Total     int64           `json:"total,omitempty"`
+	Stream    int64           `json:"stream,omitempty"`
+	Data      string          `json:"data,omitempty"`
+	Image     string          `json:"image,omitempty"`
+	Digest    string          `json:"digest,omitempty"`
+}
+
+const (
+	progressEventVertex = "vertex"
+	progressEventStatus = "status"
+	progressEventLog    = "log"
+	// progressEventResult is the last event of -progress json, with the
+	// image and its digest.
+	progressEventResult = "result"
+)
+
+// progressEventWriter writes the solve status events as JSON lines.
+type progressEventWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newProgressEventWriter(w io.Writer) *progressEventWriter {
+	return &progressEventWriter{enc: json.NewEncoder(w)}
+}
+
+// watch writes an event for each vertex, status and log of a status update.
+// It is meant to be used as a watcher with watchStatus.
+func (p *progressEventWriter) watch(resp *controlapi.StatusResponse) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for _, v := range resp.Vertexes {
+		p.write(progressEvent{
+			Type:      progressEventVertex,
+			Time:      now,
+			Vertex:    v.Digest,
+			Name:      v.Name,
+			Inputs:    v.Inputs,
+			Started:   v.Started,
+			Completed: v.Completed,
+			Cached:    v.Cached,
+			Error:     v.Error,
+		})
+	}
+	for _, s := range resp.Statuses {
+		p.write(progressEvent{
+			Type:      progressEventStatus,
+			Time:      s.Timestamp,
+			Vertex:    s.Vertex,
+			ID:        s.ID,
+			Name:      s.Name,
+			Current:   s.Current,
+			Total:     s.Total,
+			Started:   s.Started,
+			Completed: s.Completed,
+		})
+	}
+	for _, l := range resp.Logs {
+		p.write(progressEvent{
+			Type:   progressEventLog,
+			Time:   l.Timestamp,
+			Vertex: l.Vertex,
+			Stream: l.Stream,
+			Data:   string(l.Msg),
+		})
+	}
+}
+
+// result writes the result event of a successful build, pull or push.
+func (p *progressEventWriter) result(image, digest string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.write(progressEvent{
+		Type:   progressEventResult,
+		Time:   time.Now(),
+		Image:  image,
+		Digest: digest,
+	})
+}
+
+func (p *progressEventWriter) write(e progressEvent) {
+	if err := p.enc.Encode(e); err != nil {
+		logrus.Warnf("writing progress event failed: %v", err)
+	}
+}
+
+const (
+	progressAuto  = "auto"
+	progressPlain = "plain"
+	progressTTY   = "tty"
+	progressJSON  = "json"
+)
+
+// progressModes are the values of the -progress flag.
+var progressModes = []string{progressAuto, progressPlain, progressTTY, progressJSON}
+
+// validateProgressMode returns an error if mode is not one of progressModes.
+func validateProgressMode(mode string) error {
+	for _, m := range progressModes {
+		if mode == m {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid progress mode %s, must be one of %s", mode, strings.Join(progressModes, ", "))
+}
+
+// jsonProgress writes an event for each vertex, status and log of the
+// status updates as JSON lines.
+func jsonProgress(w io.Writer, ch chan *controlapi.StatusResponse) error {
+	p := newProgressEventWriter(w)
+	for resp := range ch {
+		p.watch(resp)
+	}
+	return nil
+}
+
+// plainProgress prints the status updates as lines, for logs that are not a
+// terminal. The steps are numbered in the order they start and every line
+// about a step starts with its number.
+func plainProgress(w io.Writer, ch chan *controlapi.StatusResponse) error {
+	p := &plainPrinter{
+		w:       w,
+		ids:     map[digest.Digest]int{},
+		started: map[digest.Digest]*controlapi.Vertex{},
+		done:    map[digest.Digest]bool{},
+		status:  map[string]bool{},
+		partial: map[digest.Digest][]byte{},
+	}
+	for resp := range ch {
+		p.print(resp)
+	}
+	return nil
+}
+
+type plainPrinter struct {
+	w       io.Writer
+	ids     map[digest.Digest]int
+	started map[digest.Digest]*controlapi.Vertex
+	done    map[digest.Digest]bool
+	status  map[string]bool
+	// partial holds the last line of the output of a step until it is
+	// complete.
+	partial map[digest.Digest][]byte
+}
+
+func (p *plainPrinter) id(dgst digest.Digest) int {
+	id, ok := p.ids[dgst]
+	if !ok {
+		id = len(p.ids) + 1
+		p.ids[dgst] = id
+	}
+	return id
+}
+
+func (p *plainPrinter) print(resp *controlapi.StatusResponse) {
+	for _, v := range resp.Vertexes {
+		if v.Started == nil && !v.Cached {
+			continue
+		}
+		if _, ok := p.started[v.Digest]; !ok {
+			p.started[v.Digest] = v
+			fmt.Fprintf(p.w, "#%d %s\n", p.id(v.Digest), v.Name)
+		}
+	}
+	for _, s := range resp.Statuses {
+		if s.Completed == nil || p.status[s.ID] {
+			continue
+		}
+		p.status[s.ID] = true
+		line := fmt.Sprintf("#%d %s", p.id(s.Vertex), s.ID)
+		if s.Total > 0 {
+			line += fmt.Sprintf(" %s / %s", units.BytesSize(float64(s.Current)), units.BytesSize(float64(s.Total)))
+		}
+		fmt.Fprintln(p.w, line+" done")
+	}
+	for _, l := range resp.Logs {
+		dt := append(p.partial[l.Vertex], l.Msg...)
+		lines := bytes.Split(dt, []byte("\n"))
+		for _, line := range lines[:len(lines)-1] {
+			fmt.Fprintf(p.w, "#%d %s\n", p.id(l.Vertex), line)
+		}
+		p.partial[l.Vertex] = lines[len(lines)-1]
+	}
+	for _, v := range resp.Vertexes {
+		if p.done[v.Digest] || (v.Completed == nil && !v.Cached) {
+			continue
+		}
+		p.done[v.Digest] = true
+		id := p.id(v.Digest)
+		if line := p.partial[v.Digest]; len(line) > 0 {
+			fmt.Fprintf(p.w, "#%d %s\n", id, line)
+			delete(p.partial, v.Digest)
+		}
+		switch {
+		case v.Error != "":
+			fmt.Fprintf(p.w, "#%d ERROR: %s\n", id, v.Error)
+		case v.Cached:
+			fmt.Fprintf(p.w, "#%d CACHED\n", id)
+		default:
+			started := p.started[v.Digest].Started
+			if v.Started != nil {
+				started = v.Started
+			}
+			var d time.Duration
+			if started != nil {
+				d = v.Completed.Sub(*started)
+			}
+			fmt.Fprintf(p.w, "#%d DONE %.1fs\n", id, d.Seconds())
+		}
+	}
+}
+
+// registryProgress displays the progress the pull and push packages of
+// buildkit write to the context as the statuses of a single step named name.
+// The returned function must be called with the result of the pull or push
+// once it is done, it returns the result or the error of the display.
+func registryProgress(ctx context.Context, name, mode string) (context.Context, func(error) error) {
+	pr, ctx, cancel := progress.NewContext(ctx)
+
+	now := time.Now()
+	vtx := controlapi.Vertex{Digest: digest.FromString(name), Name: name, Started: &now}
+
+	ch := make(chan *controlapi.StatusResponse)
+	displayed := make(chan error, 1)
+	go func() {
+		displayed <- showProgress(ch, mode)
+	}()
+
+	readCtx, readCancel := context.WithCancel(context.Background())
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		v := vtx
+		ch <- &controlapi.StatusResponse{Vertexes: []*controlapi.Vertex{&v}}
+		for {
+			items, err := pr.Read(readCtx)
+			if err != nil {
+				return
+			}
+			resp := &controlapi.StatusResponse{}
+			for _, item := range items {
+				st, ok := item.Sys.(progress.Status)
+				if !ok {
+					continue
+				}
+				resp.Statuses = append(resp.Statuses, &controlapi.VertexStatus{
+					ID:        item.ID,
+					Vertex:    vtx.Digest,
+					Name:      st.Action,
+					Current:   int64(st.Current),
+					Total:     int64(st.Total),
+					Timestamp: item.Timestamp,
+					Started:   st.Started,
+					Completed: st.Completed,
+				})
+			}
+			ch <- resp
+		}
+	}()
+
+	return ctx, func(err error) error {
+		// The reader is done once every writer is closed, give up on the
+		// ones that are not after a pull or push that failed.
+		cancel()
+		select {
+		case <-read:
+		case <-time.After(time.Second):
+			readCancel()
+			<-read
+		}
+		readCancel()
+
+		now := time.Now()
+		vtx.Completed = &now
+		if err != nil {
+			vtx.Error = err.Error()
+		}
+		ch <- &controlapi.StatusResponse{Vertexes: []*controlapi.Vertex{&vtx}}
+		close(ch)
+		if derr := <-displayed; err == nil {
+			err = derr
+		}
+		return err
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// Modes of the -provenance flag, as in buildx: min only records the builder
+// and the materials of the build, max also records its parameters.
+const (
+	provenanceMin = "min"
+	provenanceMax = "max"
+)
+
+// The types of the SLSA provenance statements attached to images.
+const (
+	inTotoStatementType    = "https://in-toto.io/Statement/v0.1"
+	slsaProvenancePredType = "https://slsa.dev/provenance/v0.2"
+	buildKitBuildType      = "https://mobyproject.org/buildkit@v1"
+)
+
+// parseProvenanceMode returns the mode of a -provenance value, or "" when
+// no provenance should be recorded.
+func parseProvenanceMode(v string) (string, error) {
+	switch strings.TrimPrefix(v, "mode=") {
+	case "", "false":
+		return "", nil
+	case "true", provenanceMin:
+		return provenanceMin, nil
+	case provenanceMax:
+		return provenanceMax, nil
+	}
+	return "", fmt.Errorf("invalid provenance value %q, must be mode=min or mode=max", v)
+}
+
+// inTotoStatement is an in-toto statement about the images in its subject.
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	PredicateType string          `json:"predicateType"`
+	Subject       []inTotoSubject `json:"subject"`
+	Predicate     interface{}     `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// slsaProvenance is the predicate of SLSA provenance v0.2.
+type slsaProvenance struct {
+	Builder     slsaBuilder    `json:"builder"`
+	BuildType   string         `json:"buildType"`
+	Invocation  slsaInvocation `json:"invocation"`
+	BuildConfig interface{}    `json:"buildConfig,omitempty"`
+	Metadata    slsaMetadata   `json:"metadata"`
+	Materials   []slsaMaterial `json:"materials"`
+}
+
+type slsaBuilder struct {
+	ID string `json:"id"`
+}
+
+type slsaInvocation struct {
+	ConfigSource slsaConfigSource       `json:"configSource"`
+	Parameters   map[string]interface{} `json:"parameters"`
+	Environment  map[string]string      `json:"environment"`
+}
+
+type slsaConfigSource struct {
+	URI        string            `json:"uri,omitempty"`
+	Digest     map[string]string `json:"digest,omitempty"`
+	EntryPoint string            `json:"entryPoint"`
+}
+
+type slsaMetadata struct {
+	BuildStartedOn  *time.Time       `json:"buildStartedOn,omitempty"`
+	BuildFinishedOn *time.Time       `json:"buildFinishedOn,omitempty"`
+	Completeness    slsaCompleteness `json:"completeness"`
+	Reproducible    bool             `json:"reproducible"`
+}
+
+type slsaCompleteness struct {
+	Parameters  bool `json:"parameters"`
+	Environment bool `json:"environment"`
+	Materials   bool `json:"materials"`
+}
+
+type slsaMaterial struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// provenanceStatement returns the SLSA provenance statement of a build. In
+// max mode it records the build arguments, the target and the Dockerfile,
+// which may contain secrets passed as build arguments.
+func provenanceStatement(p buildProvenance, mode string, dockerfile []byte) ([]byte, error) {
+	dgst, err := digest.Parse(p.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("parsing image digest %q failed: %v", p.Digest, err)
+	}
+
+	pred := slsaProvenance{
+		Builder:   slsaBuilder{ID: p.Builder.ID},
+		BuildType: buildKitBuildType,
+		Invocation: slsaInvocation{
+			ConfigSource: slsaConfigSource{EntryPoint: p.Dockerfile},
+			Parameters:   map[string]interface{}{"frontend": "dockerfile.v0"},
+			Environment:  map[string]string{"platform": platforms.Default()},
+		},
+		Metadata: slsaMetadata{
+			BuildStartedOn:  &p.Started,
+			BuildFinishedOn: &p.Finished,
+			Completeness:    slsaCompleteness{Materials: true},
+		},
+		Materials: []slsaMaterial{},
+	}
+	for _, m := range p.Materials {
+		pred.Materials = append(pred.Materials, provenanceMaterial(m))
+	}
+	if mode == provenanceMax {
+		pred.Invocation.ConfigSource.URI = p.Source
+		if len(p.BuildArgs) > 0 {
+			pred.Invocation.Parameters["args"] = p.BuildArgs
+		}
+		if p.Target != "" {
+			pred.Invocation.Parameters["target"] = p.Target
+		}
+		if dockerfile != nil {
+			d := digest.FromBytes(dockerfile)
+			pred.Invocation.ConfigSource.Digest = map[string]string{d.Algorithm().String(): d.Hex()}
+			pred.BuildConfig = map[string]string{"dockerfile": string(dockerfile)}
+		}
+		pred.Metadata.Completeness.Parameters = true
+	}
+
+	return json.MarshalIndent(inTotoStatement{
+		Type:          inTotoStatementType,
+		PredicateType: slsaProvenancePredType,
+		Subject: []inTotoSubject{{
+			Name:   packageURL(p.Image),
+			Digest: map[string]string{dgst.Algorithm().String(): dgst.Hex()},
+		}},
+		Predicate: pred,
+	}, "", "  ")
+}
+
+// provenanceMaterial returns the material of an image pulled by the build,
+// with its digest when the frontend pinned it.
+func provenanceMaterial(image string) slsaMaterial {
+	m := slsaMaterial{URI: packageURL(image)}
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return m
+	}
+	if c, ok := named.(reference.Canonical); ok {
+		m.Digest = map[string]string{c.Digest().Algorithm().String(): c.Digest().Hex()}
+	}
+	return m
+}
+
+// packageURL returns the pkg:docker package URL of an image reference.
+func packageURL(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "pkg:docker/" + image
+	}
+	purl := "pkg:docker/" + named.Name()
+	if t, ok := named.(reference.Tagged); ok {
+		purl += "@" + t.Tag()
+	} else if c, ok := named.(reference.Canonical); ok {
+		purl += "@" + c.Digest().String()
+	}
+	return purl
+}
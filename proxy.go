@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// proxyArgs are the build args buildkit passes to the RUN steps as proxy
+// variables without them being part of the cache key or the image, unless
+// the Dockerfile declares them with ARG.
+var proxyArgs = []string{"HTTP_PROXY", "HTTPS_PROXY", "FTP_PROXY", "NO_PROXY"}
+
+// isProxyArg returns whether the build arg is a proxy variable, in any case.
+func isProxyArg(name string) bool {
+	for _, p := range proxyArgs {
+		if strings.EqualFold(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyBuildArgs returns the proxy variables of the environment that are not
+// set by the build args, to pass them to the build like docker build does.
+// The upper case variables win over the lower case ones.
+func proxyBuildArgs(args map[string]string) map[string]string {
+	proxies := map[string]string{}
+	for _, name := range proxyArgs {
+		set := false
+		for k := range args {
+			if strings.EqualFold(k, name) {
+				set = true
+				break
+			}
+		}
+		if set {
+			continue
+		}
+		for _, env := range []string{name, strings.ToLower(name)} {
+			if v := os.Getenv(env); v != "" {
+				proxies[name] = v
+				break
+			}
+		}
+	}
+	return proxies
+}
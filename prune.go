@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/namespaces"
+	units "github.com/docker/go-units"
+	"github.com/genuinetools/img/client"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/util/appcontext"
+)
+
+const pruneShortHelp = `Remove build cache records that are not in use.`
+
+var pruneLongHelp = pruneShortHelp + `
+Without options every record is removed, except the local, git and http
+sources kept to transfer them incrementally, which -all removes too.
+
+Filters, which can be repeated and must all match:
+  until=DURATION      last used longer ago than DURATION (e.g. 24h)
+  id=PREFIX           the record ID starts with PREFIX
+  description=TEXT    the record description contains TEXT
+  type=TYPE           the record is of TYPE (regular, internal, source.local,
+                      source.git.checkout or exec.cachemount)
+  reference=IMAGE     the record holds a layer of IMAGE`
+
+func (cmd *pruneCommand) Name() string       { return "prune" }
+func (cmd *pruneCommand) Args() string       { return "[OPTIONS]" }
+func (cmd *pruneCommand) ShortHelp() string  { return pruneShortHelp }
+func (cmd *pruneCommand) LongHelp() string   { return pruneLongHelp }
+func (cmd *pruneCommand) Hidden() bool       { return false }
+func (cmd *pruneCommand) DoReexec() bool     { return true }
+func (cmd *pruneCommand) RequiresRunc() bool { return false }
+
+func (cmd *pruneCommand) Register(fs *flag.FlagSet) {
+	fs.Var(&cmd.filters, "filter", "Only remove the records matching the filter, as KEY=VALUE (can be repeated)")
+	fs.StringVar(&cmd.keepStorage, "keep-storage", "", "Remove the least recently used records until the cache uses at most this much space (e.g. 10GB)")
+	fs.BoolVar(&cmd.all, "all", false, "Also remove the sources kept between builds")
+}
+
+type pruneCommand struct {
+	filters     stringSlice
+	keepStorage string
+	all         bool
+}
+
+func (cmd *pruneCommand) Run(args []string) (err error) {
+	opts := client.PruneOptions{
+		Filters: cmd.filters,
+		All:     cmd.all,
+	}
+	if cmd.keepStorage != "" {
+		opts.KeepStorage, err = units.RAMInBytes(cmd.keepStorage)
+		if err != nil {
+			return fmt.Errorf("invalid -keep-storage %q: %v", cmd.keepStorage, err)
+		}
+	}
+
+	// Create the context.
+	ctx := appcontext.Context()
+	id := identity.NewID()
+	ctx = session.NewContext(ctx, id)
+	ctx = namespaces.WithNamespace(ctx, "buildkit")
+
+	// Create the client.
+	c, err := client.New(stateDir, backend, stateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	pruned, err := c.Prune(ctx, opts)
+
+	tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, '\t', 0)
+	if len(pruned) > 0 {
+		fmt.Fprintln(tw, "ID\tSIZE\tDESCRIPTION")
+	}
+	total := int64(0)
+	for _, di := range pruned {
+		id := di.ID
+		if di.Mutable {
+			id += "*"
+		}
+		desc := di.Description
+		if len(desc) > 50 {
+			desc = desc[0:50] + "..."
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", id, units.BytesSize(float64(di.Size)), desc)
+		if di.Size > 0 {
+			total += di.Size
+		}
+	}
+	tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	tw = tabwriter.NewWriter(os.Stdout, 1, 8, 1, '\t', 0)
+	fmt.Fprintf(tw, "Reclaimed:\t%s\n", units.BytesSize(float64(total)))
+	tw.Flush()
+
+	return nil
+}
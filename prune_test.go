@@ -0,0 +1,13 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPruneErrors(t *testing.T) {
+	cmd := &pruneCommand{keepStorage: "lots"}
+	if err := cmd.Run(nil); err == nil || !strings.Contains(err.Error(), `invalid -keep-storage "lots"`) {
+		t.Fatalf("expected an invalid storage to fail, got: %v", err)
+	}
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/containerd/containerd/namespaces"
 	units "github.com/docker/go-units"
 	"github.com/genuinetools/img/client"
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/util/appcontext"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -22,28 +25,39 @@ func (cmd *pullCommand) Hidden() bool       { return false }
 func (cmd *pullCommand) DoReexec() bool     { return true }
 func (cmd *pullCommand) RequiresRunc() bool { return false }
 
-func (cmd *pullCommand) Register(fs *flag.FlagSet) {}
+func (cmd *pullCommand) Register(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.quiet, "q", false, "Suppress verbose output and print image digest on success")
+	fs.BoolVar(&cmd.quiet, "quiet", false, "Suppress verbose output and print image digest on success")
+	fs.StringVar(&cmd.progress, "progress", progressAuto, fmt.Sprintf("Set the type of progress output (%s)", strings.Join(progressModes, ", ")))
+}
 
 type pullCommand struct {
-	image string
+	image    string
+	quiet    bool
+	progress string
 }
 
 func (cmd *pullCommand) Run(args []string) (err error) {
 	if len(args) < 1 {
 		return fmt.Errorf("must pass an image or repository to pull")
 	}
+	if err := validateProgressMode(cmd.progress); err != nil {
+		return err
+	}
 
 	// Get the specified image.
 	cmd.image = args[0]
 
 	// Create the client.
-	c, err := client.New(stateDir, backend, nil)
+	c, err := client.New(stateDir, backend, stateLock, nil)
 	if err != nil {
 		return err
 	}
 	defer c.Close()
 
-	fmt.Printf("Pulling %s...\n", cmd.image)
+	if !cmd.quiet && cmd.progress != progressJSON {
+		logrus.Infof("Pulling %s...", cmd.image)
+	}
 
 	var listedImage *client.ListedImage
 	// Create the context.
@@ -61,14 +75,35 @@ func (cmd *pullCommand) Run(args []string) (err error) {
 	})
 	eg.Go(func() error {
 		defer sess.Close()
-		var err error
-		listedImage, err = c.Pull(ctx, cmd.image)
+		span := tracer.Start("registry pull", commandSpan)
+		span.SetAttr("img.image", cmd.image)
+		var (
+			err          error
+			progressDone func(error) error
+		)
+		pullCtx := ctx
+		if !cmd.quiet {
+			pullCtx, progressDone = registryProgress(ctx, "pulling "+cmd.image, cmd.progress)
+		}
+		listedImage, err = c.Pull(pullCtx, cmd.image)
+		if progressDone != nil {
+			err = progressDone(err)
+		}
+		span.Finish(err)
 		return err
 	})
 	if err := eg.Wait(); err != nil {
 		return err
 	}
 
+	if cmd.quiet {
+		fmt.Println(listedImage.Target.Digest)
+		return nil
+	}
+	if cmd.progress == progressJSON {
+		newProgressEventWriter(os.Stdout).result(listedImage.Name, listedImage.Target.Digest.String())
+		return nil
+	}
 	fmt.Printf("Pulled: %s\n", listedImage.Target.Digest)
 	fmt.Printf("Size: %s\n", units.BytesSize(float64(listedImage.ContentSize)))
 
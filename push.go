@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/containerd/containerd/namespaces"
 	"github.com/genuinetools/img/client"
-	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/util/appcontext"
-	"golang.org/x/sync/errgroup"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
 )
 
 const pushHelp = `Push an image or a repository to a registry.`
@@ -23,52 +27,96 @@ func (cmd *pushCommand) RequiresRunc() bool { return false }
 
 func (cmd *pushCommand) Register(fs *flag.FlagSet) {
 	fs.BoolVar(&cmd.insecure, "insecure-registry", false, "Push to insecure registry")
+	fs.BoolVar(&cmd.quiet, "q", false, "Suppress verbose output and print the digest of the pushed manifest on success")
+	fs.BoolVar(&cmd.quiet, "quiet", false, "Suppress verbose output and print the digest of the pushed manifest on success")
+	fs.StringVar(&cmd.progress, "progress", progressAuto, fmt.Sprintf("Set the type of progress output (%s)", strings.Join(progressModes, ", ")))
+	cmd.compression.register(fs)
+	cmd.notify.register(fs)
 }
 
 type pushCommand struct {
-	image    string
-	insecure bool
+	image       string
+	insecure    bool
+	quiet       bool
+	progress    string
+	compression compressionOptions
+	notify      notifyOptions
+	// client is used instead of creating one when set.
+	client *client.Client
 }
 
 func (cmd *pushCommand) Run(args []string) (err error) {
 	if len(args) < 1 {
 		return fmt.Errorf("must pass an image or repository to push")
 	}
+	if err := validateProgressMode(cmd.progress); err != nil {
+		return err
+	}
+	if err := cmd.compression.Validate(); err != nil {
+		return err
+	}
 
 	// Get the specified image.
 	cmd.image = args[0]
 
-	// Create the client.
-	c, err := client.New(stateDir, backend, nil)
-	if err != nil {
-		return err
+	// Create the client, unless the push shares one with other commands.
+	c := cmd.client
+	if c == nil {
+		if c, err = client.New(stateDir, backend, stateLock, nil); err != nil {
+			return err
+		}
+		defer c.Close()
 	}
-	defer c.Close()
 
-	fmt.Printf("Pushing %s...\n", cmd.image)
+	if !cmd.quiet && cmd.progress != progressJSON {
+		logrus.Infof("Pushing %s...", cmd.image)
+	}
+
+	start := time.Now()
+	var dgst digest.Digest
+	defer func() {
+		cmd.notify.notify("push", cmd.image, dgst.String(), start, err)
+	}()
 
 	// Create the context.
 	ctx := appcontext.Context()
-	sess, sessDialer, err := c.Session(ctx)
-	if err != nil {
-		return err
-	}
-	ctx = session.NewContext(ctx, sess.ID())
 	ctx = namespaces.WithNamespace(ctx, "buildkit")
-	eg, ctx := errgroup.WithContext(ctx)
 
-	eg.Go(func() error {
-		return sess.Run(ctx, sessDialer)
-	})
-	eg.Go(func() error {
-		defer sess.Close()
-		return c.Push(ctx, cmd.image, cmd.insecure)
+	span := tracer.Start("registry push", commandSpan)
+	span.SetAttr("img.image", cmd.image)
+	var progressDone func(error) error
+	if !cmd.quiet {
+		ctx, progressDone = registryProgress(ctx, "pushing "+cmd.image, cmd.progress)
+	}
+	err = c.WithSession(ctx, nil, func(ctx context.Context, _ string) (err error) {
+		dgst, err = c.PushCompressed(ctx, cmd.image, cmd.insecure, cmd.compression.Compression)
+		return err
 	})
-	if err := eg.Wait(); err != nil {
+	if progressDone != nil {
+		err = progressDone(err)
+	}
+	span.Finish(err)
+	if err != nil {
 		return err
 	}
 
+	if cmd.quiet {
+		fmt.Println(dgst)
+		return nil
+	}
+	if cmd.progress == progressJSON {
+		newProgressEventWriter(os.Stdout).result(cmd.image, dgst.String())
+		return nil
+	}
 	fmt.Printf("Successfully pushed %s\n", cmd.image)
 
 	return nil
 }
+
+// pushWithSession pushes the image with a session providing the registry
+// credentials.
+func pushWithSession(ctx context.Context, c *client.Client, image string, insecure bool) error {
+	return c.WithSession(ctx, nil, func(ctx context.Context, _ string) error {
+		return c.Push(ctx, image, insecure)
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/genuinetools/img/client"
+	"github.com/genuinetools/img/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// testDockerArchive returns a docker archive of an image tagged name with a
+// single layer holding the files.
+func testDockerArchive(t *testing.T, name string, files map[string]string) []byte {
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	for p, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: p, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":["` + digest.FromBytes(layer.Bytes()).String() + `"]}}`)
+	// The config is named after its digest, as docker save does.
+	configName := digest.FromBytes(config).Hex() + ".json"
+	manifest, err := json.Marshal([]map[string]interface{}{{
+		"Config":   configName,
+		"RepoTags": []string{name},
+		"Layers":   []string{"layer.tar"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	tw = tar.NewWriter(&archive)
+	for _, f := range []struct {
+		name string
+		dt   []byte
+	}{
+		{"layer.tar", layer.Bytes()},
+		{configName, config},
+		{"manifest.json", manifest},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.dt)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.dt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+// testClient returns a client with a state directory of its own, and a
+// function closing it and removing the directory. The worker of the client
+// needs a runc binary even if nothing is run, so a fake one is put in the
+// PATH when there is none.
+func testClient(t *testing.T) (*client.Client, func()) {
+	dir, err := ioutil.TempDir("", "img-test-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restorePath := func() {}
+	if _, err := exec.LookPath("runc"); err != nil {
+		bin := filepath.Join(dir, "bin")
+		if err := os.MkdirAll(bin, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(bin, "runc"), []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		path := os.Getenv("PATH")
+		os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+		restorePath = func() { os.Setenv("PATH", path) }
+	}
+
+	c, err := client.New(filepath.Join(dir, "state"), types.NativeBackend, types.FlockStateLock, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, func() {
+		c.Close()
+		restorePath()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPushNotifyDigest(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+
+	// Serve a registry from a state directory of its own.
+	regClient, cleanup := testClient(t)
+	defer cleanup()
+	handler, err := regClient.RegistryHandler(client.RegistryOptions{ReadWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := httptest.NewServer(handler)
+	defer reg.Close()
+
+	notifications := make(chan notification, 1)
+	notifyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("decoding the notification failed: %v", err)
+		}
+		notifications <- n
+	}))
+	defer notifyServer.Close()
+
+	c, cleanup := testClient(t)
+	defer cleanup()
+	image := strings.TrimPrefix(reg.URL, "http://") + "/jess/pushtest:latest"
+	if _, err := c.LoadImage(ctx, bytes.NewReader(testDockerArchive(t, image, map[string]string{"hello": "world"})), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &pushCommand{
+		client:   c,
+		insecure: true,
+		quiet:    true,
+		progress: progressAuto,
+		notify:   notifyOptions{url: notifyServer.URL},
+	}
+	if err := cmd.Run([]string{image}); err != nil {
+		t.Fatal(err)
+	}
+
+	n := <-notifications
+	if n.Command != "push" || n.Result != "success" || n.Image != image {
+		t.Fatalf("expected a successful push of %s, got %+v", image, n)
+	}
+	// The digest is the one of the manifest the registry has.
+	resp, err := http.Head(reg.URL + "/v2/jess/pushtest/manifests/latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if dgst := resp.Header.Get("Docker-Content-Digest"); n.Digest == "" || n.Digest != dgst {
+		t.Fatalf("expected the digest %s of the pushed manifest in the notification, got %q", dgst, n.Digest)
+	}
+}
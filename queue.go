@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	units "github.com/docker/go-units"
+)
+
+const queueShortHelp = `List or cancel the builds of an img daemon.`
+
+var queueLongHelp = queueShortHelp + `
+Talks to the HTTP build API of an img daemon started with -http-addr.
+
+  $ img queue ls
+  $ img queue cancel BUILD_ID`
+
+func (cmd *queueCommand) Name() string       { return "queue" }
+func (cmd *queueCommand) Args() string       { return "[OPTIONS] ls|cancel [BUILD_ID...]" }
+func (cmd *queueCommand) ShortHelp() string  { return queueShortHelp }
+func (cmd *queueCommand) LongHelp() string   { return queueLongHelp }
+func (cmd *queueCommand) Hidden() bool       { return false }
+func (cmd *queueCommand) DoReexec() bool     { return false }
+func (cmd *queueCommand) RequiresRunc() bool { return false }
+
+func (cmd *queueCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.api, "api", envOr("IMG_API_URL", "http://localhost:8080"), "URL of the HTTP build API of the daemon (default is $IMG_API_URL)")
+	fs.StringVar(&cmd.token, "token", os.Getenv("IMG_API_TOKEN"), "Token for the HTTP build API (default is $IMG_API_TOKEN)")
+	fs.BoolVar(&cmd.all, "a", false, "List finished builds too")
+}
+
+type queueCommand struct {
+	api   string
+	token string
+	all   bool
+}
+
+func (cmd *queueCommand) Run(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("must pass ls or cancel")
+	}
+
+	switch args[0] {
+	case "ls":
+		return cmd.list()
+	case "cancel":
+		if len(args) < 2 {
+			return fmt.Errorf("must pass the ID of a build to cancel")
+		}
+		for _, id := range args[1:] {
+			var b apiBuildStatus
+			if err := cmd.do(http.MethodDelete, "/v1/builds/"+id, &b); err != nil {
+				return err
+			}
+			fmt.Printf("%s\t%s\n", b.ID, b.Status)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown queue command %q, must be ls or cancel", args[0])
+}
+
+// list prints the queued and running builds, or all of them with -a.
+func (cmd *queueCommand) list() error {
+	var builds []apiBuildStatus
+	if err := cmd.do(http.MethodGet, "/v1/builds", &builds); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "ID\tTAG\tUSER\tPRIORITY\tSTATUS\tCREATED")
+	for _, b := range builds {
+		if !cmd.all && b.Status != apiBuildQueued && b.Status != apiBuildRunning {
+			continue
+		}
+		status := b.Status
+		if b.Position != nil {
+			status = fmt.Sprintf("%s (%d ahead)", status, *b.Position)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s ago\n", b.ID, b.Tag, b.User, b.Priority, status, units.HumanDuration(time.Since(b.Created)))
+	}
+	return w.Flush()
+}
+
+// do sends a request to the HTTP build API and decodes the response into v.
+func (cmd *queueCommand) do(method, path string, v interface{}) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(cmd.api, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cmd.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("requesting %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("requesting %s failed: %s: %s", path, resp.Status, apiErr.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// envOr returns the value of the environment variable or def if it is not
+// set.
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
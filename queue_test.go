@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBuildQueue(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		started []string
+		release = make(chan struct{})
+	)
+	q := newBuildQueue(1, 0, func(b *apiBuild) {
+		mu.Lock()
+		started = append(started, b.id)
+		mu.Unlock()
+		<-release
+	})
+
+	// The first build starts right away and keeps the only slot busy.
+	q.push(&apiBuild{id: "first", user: "jess"})
+	q.push(&apiBuild{id: "jess2", user: "jess"})
+	q.push(&apiBuild{id: "gt1", user: "genuinetools"})
+	q.push(&apiBuild{id: "urgent", user: "jess", priority: 10})
+
+	if pos := q.position("urgent"); pos != 0 {
+		t.Fatalf("expected the build with the highest priority to be first, got position %d", pos)
+	}
+	if pos := q.position("gt1"); pos != 2 {
+		t.Fatalf("expected position 2, got %d", pos)
+	}
+	if pos := q.position("first"); pos != -1 {
+		t.Fatalf("expected the running build not to be queued, got position %d", pos)
+	}
+
+	// Cancelled builds are taken out of the queue.
+	if !q.remove("jess2") || q.remove("jess2") {
+		t.Fatal("expected a queued build to be removed once")
+	}
+
+	for i := 0; i < 3; i++ {
+		release <- struct{}{}
+	}
+
+	// The builds run one after the other, by priority and then by fairness.
+	expected := []string{"first", "urgent", "gt1"}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(started, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected the builds to start in the order %v, got %v", expected, started)
+	}
+}
+
+func TestBuildQueueFairness(t *testing.T) {
+	q := newBuildQueue(2, 1, func(*apiBuild) {})
+	q.running["jess"] = 1
+	q.total = 1
+	q.queued = []*apiBuild{
+		{id: "jess2", user: "jess"},
+		{id: "gt1", user: "genuinetools"},
+	}
+
+	// jess is at her limit of one build, so genuinetools goes first.
+	if i := q.next(); i < 0 || q.queued[i].id != "gt1" {
+		t.Fatalf("expected the build of the other user to start next, got index %d", i)
+	}
+
+	q.running["genuinetools"] = 1
+	if i := q.next(); i != -1 {
+		t.Fatalf("expected no build to start while both users are at their limit, got index %d", i)
+	}
+}
+
+func TestQueueCommand(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer jesstoken" {
+			apiError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+		switch {
+		case r.Method == http.MethodDelete && r.URL.Path == "/v1/builds/nope":
+			apiError(w, http.StatusNotFound, "no such build nope")
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/builds":
+			json.NewEncoder(w).Encode([]apiBuildStatus{{ID: "b1", Status: apiBuildSuccess}})
+		default:
+			apiError(w, http.StatusNotFound, "not found")
+		}
+	}))
+	defer srv.Close()
+
+	cmd := &queueCommand{api: srv.URL + "/", token: "jesstoken"}
+
+	var builds []apiBuildStatus
+	if err := cmd.do(http.MethodGet, "/v1/builds", &builds); err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].ID != "b1" {
+		t.Fatalf("expected the builds of the API, got: %#v", builds)
+	}
+
+	tests := []struct {
+		cmd      *queueCommand
+		args     []string
+		expected string
+	}{
+		{cmd, []string{"cancel", "nope"}, "404 Not Found: no such build nope"},
+		{cmd, []string{"cancel"}, "must pass the ID of a build to cancel"},
+		{cmd, []string{"pause"}, `unknown queue command "pause"`},
+		{cmd, nil, "must pass ls or cancel"},
+		{&queueCommand{api: srv.URL, token: "wrong"}, []string{"ls"}, "invalid or missing token"},
+	}
+	for _, tt := range tests {
+		err := tt.cmd.Run(tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Fatalf("expected %q for %v, got: %v", tt.expected, tt.args, err)
+		}
+	}
+}
+
+func TestAPIUsers(t *testing.T) {
+	f, err := ioutil.TempFile("", "img-api-users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# USER TOKEN\njess jesstoken\n\ngenuinetools gttoken\n")
+	f.Close()
+
+	cmd := &daemonCommand{httpToken: "token", httpUsers: f.Name()}
+	users, err := cmd.apiUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"token": "default", "jesstoken": "jess", "gttoken": "genuinetools"}
+	if len(users) != len(expected) {
+		t.Fatalf("expected users %v, got %v", expected, users)
+	}
+	for token, user := range expected {
+		if users[token] != user {
+			t.Fatalf("expected users %v, got %v", expected, users)
+		}
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte("jess\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cmd.apiUsers(); err == nil || !strings.Contains(err.Error(), ":1: expected a USER TOKEN line") {
+		t.Fatalf("expected a malformed line error, got: %v", err)
+	}
+}
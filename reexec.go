@@ -14,24 +14,11 @@ func reexec() {
 	// TODO(jessfraz): This is a hack to re-exec our selves and wait for the
 	// process since it was not exiting correctly with the constructor.
 	if len(os.Getenv("IMG_RUNNING_TESTS")) <= 0 && len(os.Getenv("IMG_DO_UNSHARE")) <= 0 && system.GetParentNSeuid() != 0 {
-		var (
-			pgid int
-			err  error
-		)
-
-		// On ^C, or SIGTERM handle exit.
-		c := make(chan os.Signal)
+		// On ^C, or SIGTERM, pass the signal on to the child to cancel the
+		// command, since it is in its own process group the terminal does not
+		// signal. Like the child, give up on a clean exit at the third signal.
+		c := make(chan os.Signal, 3)
 		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-		go func() {
-			for sig := range c {
-				logrus.Infof("Received %s, exiting.", sig.String())
-				if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil {
-					logrus.Fatalf("syscall.Kill %d error: %v", pgid, err)
-					continue
-				}
-				os.Exit(0)
-			}
-		}()
 
 		// Initialize and re-exec with our unshare.
 		cmd := exec.Command("/proc/self/exe", os.Args[1:]...)
@@ -46,28 +33,42 @@ func reexec() {
 			logrus.Fatalf("cmd.Start error: %v", err)
 		}
 
-		pgid, err = syscall.Getpgid(cmd.Process.Pid)
+		pgid, err := syscall.Getpgid(cmd.Process.Pid)
 		if err != nil {
 			logrus.Fatalf("getpgid error: %v", err)
 		}
 
-		var (
-			ws       syscall.WaitStatus
-			exitCode int
-		)
-		for {
-			// Store the exitCode before calling wait so we get the real one.
-			exitCode = ws.ExitStatus()
-			_, err := syscall.Wait4(-pgid, &ws, syscall.WNOHANG, nil)
-			if err != nil {
-				if err.Error() == "no child processes" {
-					// We exited. We need to pass the correct error code from
-					// the child.
-					os.Exit(exitCode)
+		go func() {
+			signals := 0
+			for sig := range c {
+				signals++
+				if signals < 3 {
+					logrus.Infof("Received %s, cancelling.", sig.String())
+					cmd.Process.Signal(sig)
+					continue
 				}
-
-				logrus.Fatalf("wait4 error: %v", err)
+				logrus.Infof("Received %s, exiting.", sig.String())
+				if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil {
+					logrus.Fatalf("syscall.Kill %d error: %v", pgid, err)
+				}
+				os.Exit(exitCodeCancelled)
 			}
+		}()
+
+		// Pass the exit code of the child on, or the one shells give to a
+		// process killed by a signal.
+		err = cmd.Wait()
+		if err == nil {
+			os.Exit(0)
+		}
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			logrus.Fatalf("wait error: %v", err)
+		}
+		ws := exitErr.Sys().(syscall.WaitStatus)
+		if ws.Signaled() {
+			os.Exit(128 + int(ws.Signal()))
 		}
+		os.Exit(ws.ExitStatus())
 	}
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/moby/buildkit/identity"
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/util/appcontext"
+	"github.com/sirupsen/logrus"
 )
 
 const removeHelp = `Remove one or more images.`
@@ -37,7 +38,7 @@ func (cmd *removeCommand) Run(args []string) (err error) {
 	ctx = namespaces.WithNamespace(ctx, "buildkit")
 
 	// Create the client.
-	c, err := client.New(stateDir, backend, nil)
+	c, err := client.New(stateDir, backend, stateLock, nil)
 	if err != nil {
 		return err
 	}
@@ -45,7 +46,7 @@ func (cmd *removeCommand) Run(args []string) (err error) {
 
 	// Loop over the arguments as images and run remove.
 	for _, image := range args {
-		fmt.Printf("Removing %s...\n", image)
+		logrus.Infof("Removing %s...", image)
 
 		err = c.RemoveImage(ctx, image)
 		if err != nil {
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/genuinetools/img/version"
+)
+
+// Names of the result files written to the results directory. IMAGE_URL and
+// IMAGE_DIGEST are the type hinted results Tekton Chains looks for.
+const (
+	resultImageURL    = "IMAGE_URL"
+	resultImageDigest = "IMAGE_DIGEST"
+	resultProvenance  = "PROVENANCE"
+)
+
+// buildProvenance describes how an image was built.
+type buildProvenance struct {
+	Builder    provenanceBuilder `json:"builder"`
+	Image      string            `json:"image"`
+	Digest     string            `json:"digest"`
+	Dockerfile string            `json:"dockerfile"`
+	Source     string            `json:"source,omitempty"`
+	Target     string            `json:"target,omitempty"`
+	BuildArgs  map[string]string `json:"buildArgs,omitempty"`
+	// Materials are the images the build used, pinned by digest when the
+	// frontend resolved them.
+	Materials []string  `json:"materials"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+}
+
+type provenanceBuilder struct {
+	ID        string `json:"id"`
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit"`
+	BuildKit  string `json:"buildkit"`
+}
+
+func newBuildProvenance(image, digest string) buildProvenance {
+	return buildProvenance{
+		Builder: provenanceBuilder{
+			ID:        "https://github.com/genuinetools/img",
+			Version:   version.VERSION,
+			GitCommit: version.GITCOMMIT,
+			BuildKit:  version.BUILDKITREVISION,
+		},
+		Image:  image,
+		Digest: digest,
+	}
+}
+
+// buildMaterials returns the images pulled by the steps of a build.
+func buildMaterials(steps []buildStep) []string {
+	materials := []string{}
+	for _, step := range steps {
+		if strings.HasPrefix(step.Name, "docker-image://") {
+			materials = append(materials, strings.TrimPrefix(step.Name, "docker-image://"))
+		}
+	}
+	sort.Strings(materials)
+	return materials
+}
+
+// writeResults writes the result files of a build to dir, one value per file
+// so they can be used as Tekton task results and Argo output parameters.
+func writeResults(dir string, p buildProvenance) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating results directory %s failed: %v", dir, err)
+	}
+
+	provenance, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling provenance failed: %v", err)
+	}
+
+	for name, value := range map[string][]byte{
+		resultImageURL:    []byte(p.Image),
+		resultImageDigest: []byte(p.Digest),
+		resultProvenance:  provenance,
+	} {
+		// Results are read verbatim, so they must not end with a newline.
+		if err := ioutil.WriteFile(filepath.Join(dir, name), value, 0644); err != nil {
+			return fmt.Errorf("writing result %s failed: %v", name, err)
+		}
+	}
+
+	return nil
+}
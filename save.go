@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/containerd/containerd/namespaces"
 	"github.com/docker/docker/pkg/term"
@@ -14,9 +15,7 @@ import (
 	"github.com/moby/buildkit/util/appcontext"
 )
 
-// TODO(AkihiroSuda): support saving multiple images
-// TODO(AkihiroSuda): support OCI archive
-const saveHelp = `Save an image to a tar archive (streamed to STDOUT by default).`
+const saveHelp = `Save images to a tar archive (streamed to STDOUT by default).`
 
 func (cmd *saveCommand) Name() string       { return "save" }
 func (cmd *saveCommand) Args() string       { return "[OPTIONS] IMAGE [IMAGE...]" }
@@ -28,16 +27,34 @@ func (cmd *saveCommand) RequiresRunc() bool { return false }
 
 func (cmd *saveCommand) Register(fs *flag.FlagSet) {
 	fs.StringVar(&cmd.output, "o", "", "Write to a file, instead of STDOUT")
+	fs.StringVar(&cmd.format, "format", client.SaveFormatDocker, fmt.Sprintf("Format of the archive (%s)", strings.Join(client.SaveFormats, ", ")))
+	fs.StringVar(&cmd.dir, "dir", "", "Write to a directory with an OCI image layout, instead of an archive")
+	cmd.compression.register(fs)
 }
 
 type saveCommand struct {
 	output string
+	format string
+	dir    string
+
+	compression compressionOptions
 }
 
 func (cmd *saveCommand) Run(args []string) (err error) {
 	if len(args) < 1 {
 		return fmt.Errorf("must pass an image to save")
 	}
+	if cmd.dir != "" && cmd.output != "" {
+		return fmt.Errorf("-dir and -o are mutually exclusive")
+	}
+	switch cmd.format {
+	case client.SaveFormatDocker, client.SaveFormatOCI:
+	default:
+		return fmt.Errorf("invalid format %s, must be one of %s", cmd.format, strings.Join(client.SaveFormats, ", "))
+	}
+	if err := cmd.compression.Validate(); err != nil {
+		return err
+	}
 
 	// Create the context.
 	ctx := appcontext.Context()
@@ -46,26 +63,24 @@ func (cmd *saveCommand) Run(args []string) (err error) {
 	ctx = namespaces.WithNamespace(ctx, "buildkit")
 
 	// Create the client.
-	c, err := client.New(stateDir, backend, nil)
+	c, err := client.New(stateDir, backend, stateLock, nil)
 	if err != nil {
 		return err
 	}
 	defer c.Close()
 
+	if cmd.dir != "" {
+		return c.SaveImagesToDir(ctx, args, cmd.dir, cmd.compression.Compression)
+	}
+
 	// Create the writer.
 	writer, err := cmd.writer()
 	if err != nil {
 		return err
 	}
 
-	// Loop over the arguments as images and run save.
-	for _, image := range args {
-		if err := c.SaveImage(ctx, image, writer); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	// Save the images into a single archive.
+	return c.SaveImages(ctx, args, cmd.format, cmd.compression.Compression, writer)
 }
 
 func (cmd *saveCommand) writer() (io.WriteCloser, error) {
@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -22,3 +23,44 @@ func TestSaveImage(t *testing.T) {
 		t.Fatalf("%s should exist after saving the image but it didn't", tmpf)
 	}
 }
+
+func TestSaveImageOCI(t *testing.T) {
+	runBuild(t, "saveocithing", withDockerfile(`
+    FROM busybox
+	RUN echo saveocitest
+    `))
+
+	tmpf := filepath.Join(os.TempDir(), "save-image-oci-test.tar")
+	defer os.RemoveAll(tmpf)
+
+	run(t, "save", "-format", "oci", "-o", tmpf, "saveocithing")
+
+	// The image must be loadable again.
+	out := run(t, "load", "-q", "-i", tmpf)
+	if !strings.Contains(out, "docker.io/library/saveocithing:latest") {
+		t.Fatalf("expected the saved image to be loaded, got: %s", out)
+	}
+}
+
+func TestSaveImages(t *testing.T) {
+	runBuild(t, "savemultione", withDockerfile(`
+    FROM busybox
+	RUN echo savemultione
+    `))
+	runBuild(t, "savemultitwo", withDockerfile(`
+    FROM busybox
+	RUN echo savemultitwo
+    `))
+
+	tmpf := filepath.Join(os.TempDir(), "save-images-test.tar")
+	defer os.RemoveAll(tmpf)
+
+	run(t, "save", "-o", tmpf, "savemultione", "savemultitwo")
+
+	out := run(t, "load", "-q", "-i", tmpf)
+	for _, name := range []string{"docker.io/library/savemultione:latest", "docker.io/library/savemultitwo:latest"} {
+		if !strings.Contains(out, name) {
+			t.Fatalf("expected %s to be loaded, got: %s", name, out)
+		}
+	}
+}
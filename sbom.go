@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/genuinetools/img/client"
+	"github.com/genuinetools/img/version"
+	"github.com/opencontainers/go-digest"
+)
+
+// Formats of the -sbom flag.
+const (
+	sbomSPDX      = "spdx"
+	sbomCycloneDX = "cyclonedx"
+)
+
+// The predicate types of the SBOM statements attached to images.
+var sbomPredicateTypes = map[string]string{
+	sbomSPDX:      "https://spdx.dev/Document",
+	sbomCycloneDX: "https://cyclonedx.org/bom",
+}
+
+// parseSBOMFormat returns the format of a -sbom value, or "" when no SBOM
+// should be attached.
+func parseSBOMFormat(v string) (string, error) {
+	switch strings.TrimPrefix(v, "format=") {
+	case "", "false":
+		return "", nil
+	case "true", sbomSPDX:
+		return sbomSPDX, nil
+	case sbomCycloneDX:
+		return sbomCycloneDX, nil
+	}
+	return "", fmt.Errorf("invalid sbom value %q, must be format=spdx or format=cyclonedx", v)
+}
+
+// spdxDocument is an SPDX 2.3 document.
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  time.Time `json:"created"`
+	Creators []string  `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// cycloneDXBOM is a CycloneDX 1.4 BOM.
+type cycloneDXBOM struct {
+	BOMFormat   string               `json:"bomFormat"`
+	SpecVersion string               `json:"specVersion"`
+	Version     int                  `json:"version"`
+	Metadata    cycloneDXMetadata    `json:"metadata"`
+	Components  []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp time.Time          `json:"timestamp"`
+	Tools     []cycloneDXTool    `json:"tools"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXTool struct {
+	Vendor  string `json:"vendor"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type cycloneDXComponent struct {
+	Type     string             `json:"type"`
+	Name     string             `json:"name"`
+	Version  string             `json:"version,omitempty"`
+	PURL     string             `json:"purl,omitempty"`
+	Licenses []cycloneDXLicense `json:"licenses,omitempty"`
+}
+
+type cycloneDXLicense struct {
+	License struct {
+		Name string `json:"name"`
+	} `json:"license"`
+}
+
+// sbomStatement returns the in-toto statement with the SBOM of the packages
+// of an image in the format. created is when the SBOM is created, the
+// timestamp of reproducible builds.
+func sbomStatement(image string, dgst digest.Digest, format string, release client.OSRelease, pkgs []client.Package, created time.Time) ([]byte, error) {
+	var predicate interface{}
+	switch format {
+	case sbomSPDX:
+		doc := spdxDocument{
+			SPDXVersion:       "SPDX-2.3",
+			DataLicense:       "CC0-1.0",
+			SPDXID:            "SPDXRef-DOCUMENT",
+			Name:              image,
+			DocumentNamespace: "https://github.com/genuinetools/img/sbom/" + url.PathEscape(image) + "-" + dgst.Hex(),
+			CreationInfo: spdxCreationInfo{
+				Created:  created,
+				Creators: []string{"Tool: img-" + version.VERSION},
+			},
+			Packages:      []spdxPackage{},
+			Relationships: []spdxRelationship{},
+		}
+		for i, p := range pkgs {
+			id := fmt.Sprintf("SPDXRef-Package-%s-%d", p.Type, i)
+			license := p.License
+			if license == "" {
+				license = "NOASSERTION"
+			}
+			sp := spdxPackage{
+				Name:             p.Name,
+				SPDXID:           id,
+				VersionInfo:      p.Version,
+				DownloadLocation: "NOASSERTION",
+				LicenseDeclared:  license,
+				ExternalRefs: []spdxExternalRef{{
+					ReferenceCategory: "PACKAGE-MANAGER",
+					ReferenceType:     "purl",
+					ReferenceLocator:  packagePURL(release, p),
+				}},
+			}
+			if p.Source != "" {
+				sp.SourceInfo = "built from the " + p.Source + " source package"
+			}
+			doc.Packages = append(doc.Packages, sp)
+			doc.Relationships = append(doc.Relationships, spdxRelationship{
+				SPDXElementID:      "SPDXRef-DOCUMENT",
+				RelationshipType:   "DESCRIBES",
+				RelatedSPDXElement: id,
+			})
+		}
+		predicate = doc
+	case sbomCycloneDX:
+		bom := cycloneDXBOM{
+			BOMFormat:   "CycloneDX",
+			SpecVersion: "1.4",
+			Version:     1,
+			Metadata: cycloneDXMetadata{
+				Timestamp: created,
+				Tools:     []cycloneDXTool{{Vendor: "genuinetools", Name: "img", Version: version.VERSION}},
+				Component: cycloneDXComponent{Type: "container", Name: image, Version: dgst.String()},
+			},
+			Components: []cycloneDXComponent{},
+		}
+		for _, p := range pkgs {
+			c := cycloneDXComponent{
+				Type:    "library",
+				Name:    p.Name,
+				Version: p.Version,
+				PURL:    packagePURL(release, p),
+			}
+			if p.License != "" {
+				var l cycloneDXLicense
+				l.License.Name = p.License
+				c.Licenses = []cycloneDXLicense{l}
+			}
+			bom.Components = append(bom.Components, c)
+		}
+		predicate = bom
+	default:
+		return nil, fmt.Errorf("unknown sbom format %s", format)
+	}
+
+	return json.MarshalIndent(inTotoStatement{
+		Type:          inTotoStatementType,
+		PredicateType: sbomPredicateTypes[format],
+		Subject: []inTotoSubject{{
+			Name:   packageURL(image),
+			Digest: map[string]string{dgst.Algorithm().String(): dgst.Hex()},
+		}},
+		Predicate: predicate,
+	}, "", "  ")
+}
+
+// packagePURL returns the package URL of a package of a distribution, e.g.
+// pkg:apk/alpine/musl@1.2.3-r0?arch=x86_64&distro=alpine-3.16.
+func packagePURL(release client.OSRelease, p client.Package) string {
+	namespace := release.ID
+	if namespace == "" {
+		namespace = map[string]string{"apk": "alpine", "deb": "debian"}[p.Type]
+	}
+	q := url.Values{}
+	if p.Arch != "" {
+		q.Set("arch", p.Arch)
+	}
+	if release.ID != "" && release.VersionID != "" {
+		q.Set("distro", release.ID+"-"+release.VersionID)
+	}
+	if p.Source != "" {
+		q.Set("upstream", p.Source)
+	}
+	purl := fmt.Sprintf("pkg:%s/%s/%s", p.Type, namespace, url.PathEscape(p.Name))
+	if p.Version != "" {
+		purl += "@" + url.PathEscape(p.Version)
+	}
+	if len(q) > 0 {
+		purl += "?" + q.Encode()
+	}
+	return purl
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/genuinetools/img/client"
+	"github.com/sirupsen/logrus"
+)
+
+const serveShortHelp = `Serve the local image store.`
+
+var serveLongHelp = serveShortHelp + `
+The registry subcommand serves the images in the state directory with the
+OCI distribution API, so local clusters (kind, k3s) and other hosts can pull
+them without pushing to a remote registry:
+
+  $ img serve registry -addr localhost:5000
+  $ docker pull localhost:5000/r.j3ss.co/img:latest
+
+The registry is read-only unless -read-write is passed, then images pushed
+to it are added to the image store. With -token clients must pass the token,
+as the password of docker login or as a bearer token. A read-write registry
+needs a token unless it is served on a loopback address.`
+
+func (cmd *serveCommand) Name() string       { return "serve" }
+func (cmd *serveCommand) Args() string       { return "[OPTIONS] registry" }
+func (cmd *serveCommand) ShortHelp() string  { return serveShortHelp }
+func (cmd *serveCommand) LongHelp() string   { return serveLongHelp }
+func (cmd *serveCommand) Hidden() bool       { return false }
+func (cmd *serveCommand) DoReexec() bool     { return true }
+func (cmd *serveCommand) RequiresRunc() bool { return true }
+
+func (cmd *serveCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.addr, "addr", "localhost:5000", "Address to serve on")
+	fs.BoolVar(&cmd.readWrite, "read-write", false, "Accept pushes to the registry")
+	fs.StringVar(&cmd.token, "token", os.Getenv("IMG_REGISTRY_TOKEN"), "Token clients must pass, as the password of docker login or as a bearer token (default is $IMG_REGISTRY_TOKEN)")
+}
+
+type serveCommand struct {
+	addr      string
+	readWrite bool
+	token     string
+}
+
+func (cmd *serveCommand) Run(args []string) error {
+	if len(args) < 1 || args[0] != "registry" {
+		return fmt.Errorf("must pass what to serve, only registry is supported")
+	}
+	// Pushes overwrite the tags of the image store, so anyone who can reach
+	// the registry must not be able to push.
+	if cmd.readWrite && cmd.token == "" && !isLoopbackAddr(cmd.addr) {
+		return fmt.Errorf("serving a read-write registry on %s requires a token, pass one with -token or serve on a loopback address", cmd.addr)
+	}
+
+	// Create the client.
+	c, err := client.New(stateDir, backend, stateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	handler, err := c.RegistryHandler(client.RegistryOptions{ReadWrite: cmd.readWrite, Token: cmd.token})
+	if err != nil {
+		return err
+	}
+
+	mode := "read-only"
+	if cmd.readWrite {
+		mode = "read-write"
+	}
+	logrus.Infof("Serving %s registry on %s", mode, cmd.addr)
+	return http.ListenAndServe(cmd.addr, handler)
+}
+
+// isLoopbackAddr returns whether a HOST:PORT address only listens on a
+// loopback interface. An empty host listens on all interfaces.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
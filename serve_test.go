@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestServeUnknown(t *testing.T) {
+	for _, args := range [][]string{nil, {"images"}} {
+		err := (&serveCommand{}).Run(args)
+		if err == nil || !strings.Contains(err.Error(), "only registry is supported") {
+			t.Fatalf("expected an unsupported error for %v, got: %v", args, err)
+		}
+	}
+}
+
+func TestServeReadWriteToken(t *testing.T) {
+	err := (&serveCommand{addr: "0.0.0.0:5000", readWrite: true}).Run([]string{"registry"})
+	if err == nil || !strings.Contains(err.Error(), "serving a read-write registry on 0.0.0.0:5000 requires a token") {
+		t.Fatalf("expected a read-write registry on all interfaces to require a token, got: %v", err)
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	tests := map[string]bool{
+		"localhost:5000": true,
+		"127.0.0.1:5000": true,
+		"[::1]:5000":     true,
+		"0.0.0.0:5000":   false,
+		":5000":          false,
+		"myhost:5000":    false,
+		"10.0.0.1:5000":  false,
+		"localhost":      false,
+	}
+	for addr, expected := range tests {
+		if got := isLoopbackAddr(addr); got != expected {
+			t.Fatalf("expected %v for %s, got %v", expected, addr, got)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/docker/distribution/reference"
+	"github.com/genuinetools/img/client"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/util/appcontext"
+	"golang.org/x/sync/errgroup"
+)
+
+const solveHelp = `Solve a marshalled LLB definition read from a file or stdin.`
+
+func (cmd *solveCommand) Name() string       { return "solve" }
+func (cmd *solveCommand) Args() string       { return "[OPTIONS] [FILE]" }
+func (cmd *solveCommand) ShortHelp() string  { return solveHelp }
+func (cmd *solveCommand) LongHelp() string   { return solveHelp }
+func (cmd *solveCommand) Hidden() bool       { return false }
+func (cmd *solveCommand) DoReexec() bool     { return true }
+func (cmd *solveCommand) RequiresRunc() bool { return true }
+
+func (cmd *solveCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.tag, "t", "", "Export the result as an image with the name and optionally a tag in the 'name:tag' format")
+	fs.StringVar(&cmd.output, "o", "", "Export the result instead of an image with type=local,dest=DIR or type=oci|docker,dest=FILE")
+	fs.Var(&cmd.locals, "local", "Make a directory available to the llb.Local sources of the definition, as NAME=DIR, can be repeated")
+	fs.BoolVar(&cmd.push, "push", false, "Push the image to its registry once it is exported")
+	fs.BoolVar(&cmd.quiet, "q", false, "Suppress the output and print the image digest on success")
+	fs.StringVar(&cmd.progress, "progress", progressAuto, fmt.Sprintf("Set the type of progress output (%s)", strings.Join(progressModes, ", ")))
+}
+
+type solveCommand struct {
+	tag      string
+	output   string
+	locals   stringSlice
+	push     bool
+	quiet    bool
+	progress string
+}
+
+func (cmd *solveCommand) Run(args []string) error {
+	if err := validateProgressMode(cmd.progress); err != nil {
+		return err
+	}
+
+	var out *buildOutput
+	if cmd.output != "" {
+		o, err := parseOutput(cmd.output)
+		if err != nil {
+			return err
+		}
+		if !solveExporters[o.Type] || o.Attrs["dest"] == "" {
+			return fmt.Errorf("invalid output %q, must be type=local,dest=DIR or type=oci|docker,dest=FILE", cmd.output)
+		}
+		out = &o
+	}
+	if cmd.push && (cmd.tag == "" || out != nil) {
+		return errors.New("-push needs an image exported with -t and cannot be used with -o")
+	}
+	if cmd.tag != "" {
+		named, err := reference.ParseNormalizedNamed(cmd.tag)
+		if err != nil {
+			return fmt.Errorf("parsing image name %q failed: %v", cmd.tag, err)
+		}
+		cmd.tag = reference.TagNameOnly(named).String()
+	}
+
+	localDirs := map[string]string{}
+	for _, l := range cmd.locals {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("invalid local value %s, must be NAME=DIR", l)
+		}
+		localDirs[kv[0]] = kv[1]
+	}
+
+	// Read the definition, as written by llb.WriteTo.
+	var r io.Reader = os.Stdin
+	if len(args) > 0 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	def, err := llb.ReadFrom(r)
+	if err != nil {
+		return fmt.Errorf("reading llb definition failed: %v", err)
+	}
+	if len(def.Def) == 0 {
+		return errors.New("the llb definition is empty")
+	}
+
+	c, err := client.New(stateDir, backend, stateLock, localDirs)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx := appcontext.Context()
+	sess, sessDialer, err := c.SessionWithLocalDirs(ctx, localDirs)
+	if err != nil {
+		return err
+	}
+
+	// Without -t or -o the definition is only solved, to run its steps.
+	var (
+		exporter      string
+		exporterAttrs map[string]string
+	)
+	if cmd.tag != "" {
+		exporter, exporterAttrs = "image", map[string]string{"name": cmd.tag}
+		if cmd.push {
+			exporterAttrs["push"] = "true"
+		}
+	}
+	if out != nil {
+		a, err := out.attachable()
+		if err != nil {
+			return err
+		}
+		sess.Allow(a)
+		// The tarballs name the image with the tag, if there is one.
+		exporter = out.Type
+		if out.Type == "local" {
+			exporterAttrs = nil
+		}
+	}
+
+	ctx = session.NewContext(ctx, sess.ID())
+	ctx = namespaces.WithNamespace(ctx, "buildkit")
+	eg, ctx := errgroup.WithContext(ctx)
+
+	ch := make(chan *controlapi.StatusResponse)
+	var resp *controlapi.SolveResponse
+	eg.Go(func() error {
+		return sess.Run(ctx, sessDialer)
+	})
+	eg.Go(func() error {
+		defer sess.Close()
+		var err error
+		resp, err = c.Solve(ctx, &controlapi.SolveRequest{
+			Ref:           identity.NewID(),
+			Session:       sess.ID(),
+			Definition:    def.ToPB(),
+			Exporter:      exporter,
+			ExporterAttrs: exporterAttrs,
+		}, ch)
+		return err
+	})
+	eg.Go(func() error {
+		if cmd.quiet {
+			return discardProgress(ch)
+		}
+		return showProgress(ch, cmd.progress)
+	})
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	digest := resp.ExporterResponse["containerimage.digest"]
+	switch {
+	case cmd.quiet:
+		if digest != "" {
+			fmt.Println(digest)
+		}
+	case cmd.progress == progressJSON:
+		newProgressEventWriter(os.Stdout).result(cmd.tag, digest)
+	case out != nil:
+		fmt.Printf("Successfully exported to %s\n", out.Attrs["dest"])
+	case cmd.tag != "":
+		fmt.Printf("Successfully built %s\n", cmd.tag)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/moby/buildkit/client/llb"
+)
+
+func TestSolveErrors(t *testing.T) {
+	dir := withFiles(t, map[string]string{
+		"empty.pb": "",
+	})
+	defer os.RemoveAll(dir)
+
+	def, err := llb.Local("context").Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := llb.WriteTo(def, &buf); err != nil {
+		t.Fatal(err)
+	}
+	f := filepath.Join(dir, "llb.pb")
+	if err := ioutil.WriteFile(f, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cmd  *solveCommand
+		args []string
+		err  string
+	}{
+		{cmd: &solveCommand{progress: "fancy"}, args: []string{f}, err: "invalid progress mode fancy"},
+		{cmd: &solveCommand{}, args: []string{filepath.Join(dir, "empty.pb")}, err: "the llb definition is empty"},
+		{cmd: &solveCommand{push: true}, args: []string{f}, err: "-push needs an image exported with -t"},
+		{cmd: &solveCommand{tag: "solvetest", push: true, output: "type=local,dest=out"}, args: []string{f}, err: "-push needs an image exported with -t"},
+		{cmd: &solveCommand{output: "type=tar"}, args: []string{f}, err: `invalid output "type=tar"`},
+		{cmd: &solveCommand{output: "type=local"}, args: []string{f}, err: `invalid output "type=local"`},
+		{cmd: &solveCommand{tag: "Invalid:Tag"}, args: []string{f}, err: "parsing image name"},
+		{cmd: &solveCommand{locals: stringSlice{"context"}}, args: []string{f}, err: "invalid local value context, must be NAME=DIR"},
+		{cmd: &solveCommand{}, args: []string{filepath.Join(dir, "nope.pb")}, err: "no such file or directory"},
+	}
+	for _, tt := range tests {
+		if tt.cmd.progress == "" {
+			tt.cmd.progress = progressAuto
+		}
+		if err := tt.cmd.Run(tt.args); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("expected %q, got: %v", tt.err, err)
+		}
+	}
+}
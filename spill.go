@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+
+	units "github.com/docker/go-units"
+	"github.com/genuinetools/img/client"
+)
+
+// bufferedBytes is the size of the spill buffers held in memory.
+var bufferedBytes int64
+
+// setMemoryBudget parses the -memory-budget flag and bounds the build logs
+// and the snapshot trees kept in memory by it.
+func setMemoryBudget(s string) error {
+	if s == "" {
+		return nil
+	}
+	n, err := units.RAMInBytes(s)
+	if err != nil {
+		return err
+	}
+	memoryBudget = n
+	client.SetMemoryBudget(n)
+	return nil
+}
+
+// spillBuffer is a buffer for the logs of builds. It is kept in memory,
+// unless the buffers would take more than a quarter of the -memory-budget,
+// then it is moved to a temporary file. It is not safe for concurrent use.
+type spillBuffer struct {
+	mem  []byte
+	file *os.File
+	size int64
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && memoryBudget > 0 && atomic.LoadInt64(&bufferedBytes)+int64(len(p)) > memoryBudget/4 {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	if b.file != nil {
+		n, err := b.file.WriteAt(p, b.size)
+		b.size += int64(n)
+		return n, err
+	}
+	b.mem = append(b.mem, p...)
+	b.size += int64(len(p))
+	atomic.AddInt64(&bufferedBytes, int64(len(p)))
+	return len(p), nil
+}
+
+// spill moves the buffer to a temporary file. The file is removed right
+// away, it is only kept open.
+func (b *spillBuffer) spill() error {
+	f, err := ioutil.TempFile("", "img-buffer-")
+	if err != nil {
+		return err
+	}
+	os.Remove(f.Name())
+	if _, err := f.Write(b.mem); err != nil {
+		f.Close()
+		return err
+	}
+	atomic.AddInt64(&bufferedBytes, -int64(len(b.mem)))
+	b.file, b.mem = f, nil
+	return nil
+}
+
+// Len returns the number of bytes written to the buffer.
+func (b *spillBuffer) Len() int64 {
+	return b.size
+}
+
+func (b *spillBuffer) ReadAt(p []byte, off int64) (int, error) {
+	if b.file != nil {
+		return b.file.ReadAt(p, off)
+	}
+	if off >= int64(len(b.mem)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.mem[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteTo writes the content of the buffer to w.
+func (b *spillBuffer) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, io.NewSectionReader(b, 0, b.size))
+}
+
+// Close releases the memory or the temporary file of the buffer.
+func (b *spillBuffer) Close() error {
+	atomic.AddInt64(&bufferedBytes, -int64(len(b.mem)))
+	b.mem = nil
+	if b.file != nil {
+		return b.file.Close()
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/opencontainers/go-digest"
+)
+
+// filterStatus returns a channel with only the vertexes whose name matches re,
+// along with their statuses and logs.
+func filterStatus(ch chan *controlapi.StatusResponse, re *regexp.Regexp) chan *controlapi.StatusResponse {
+	out := make(chan *controlapi.StatusResponse)
+	go func() {
+		defer close(out)
+		matched := map[digest.Digest]bool{}
+		for resp := range ch {
+			filtered := &controlapi.StatusResponse{}
+			for _, v := range resp.Vertexes {
+				if re.MatchString(v.Name) {
+					matched[v.Digest] = true
+					// The inputs may have been filtered out, drop them so
+					// the progress UI does not wait on them.
+					vtx := *v
+					vtx.Inputs = nil
+					filtered.Vertexes = append(filtered.Vertexes, &vtx)
+				}
+			}
+			for _, s := range resp.Statuses {
+				if matched[s.Vertex] {
+					filtered.Statuses = append(filtered.Statuses, s)
+				}
+			}
+			for _, l := range resp.Logs {
+				if matched[l.Vertex] {
+					filtered.Logs = append(filtered.Logs, l)
+				}
+			}
+			out <- filtered
+		}
+	}()
+	return out
+}
+
+// followStep writes the complete output of the steps matching re to stdout
+// and stderr instead of showing the progress of the whole build.
+func followStep(ch chan *controlapi.StatusResponse, re *regexp.Regexp) error {
+	for resp := range filterStatus(ch, re) {
+		for _, v := range resp.Vertexes {
+			if v.Started != nil && v.Completed == nil {
+				fmt.Fprintf(os.Stderr, "==> %s\n", v.Name)
+			}
+		}
+		for _, l := range resp.Logs {
+			if l.Stream == 1 {
+				os.Stdout.Write(l.Msg)
+			} else {
+				os.Stderr.Write(l.Msg)
+			}
+		}
+	}
+	return nil
+}
+
+// stepLogs collects the output of every step of a build.
+type stepLogs struct {
+	mu    sync.Mutex
+	order []digest.Digest
+	names map[digest.Digest]string
+	logs  map[digest.Digest]*spillBuffer
+}
+
+func newStepLogs() *stepLogs {
+	return &stepLogs{
+		names: map[digest.Digest]string{},
+		logs:  map[digest.Digest]*spillBuffer{},
+	}
+}
+
+// watch records the logs of a status update. It is meant to be used as a
+// watcher with watchStatus.
+func (s *stepLogs) watch(resp *controlapi.StatusResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range resp.Vertexes {
+		if _, ok := s.names[v.Digest]; !ok {
+			s.order = append(s.order, v.Digest)
+		}
+		s.names[v.Digest] = v.Name
+	}
+	for _, l := range resp.Logs {
+		b, ok := s.logs[l.Vertex]
+		if !ok {
+			b = &spillBuffer{}
+			s.logs[l.Vertex] = b
+		}
+		b.Write(l.Msg)
+	}
+}
+
+// Dump writes the complete output of the steps whose name matches re to w.
+// It returns the number of steps that matched.
+func (s *stepLogs) Dump(w io.Writer, re *regexp.Regexp) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, dgst := range s.order {
+		name := s.names[dgst]
+		if !re.MatchString(name) {
+			continue
+		}
+		n++
+		fmt.Fprintf(w, "==> %s\n", name)
+		b, ok := s.logs[dgst]
+		if !ok || b.Len() == 0 {
+			continue
+		}
+		b.WriteTo(w)
+		last := make([]byte, 1)
+		if _, err := b.ReadAt(last, b.Len()-1); err == nil && last[0] != '\n' {
+			io.WriteString(w, "\n")
+		}
+	}
+	return n
+}
+
+// Close releases the logs.
+func (s *stepLogs) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.logs {
+		b.Close()
+	}
+	return nil
+}
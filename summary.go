@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	units "github.com/docker/go-units"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/opencontainers/go-digest"
+)
+
+// buildStep holds the summary information for a single build step.
+type buildStep struct {
+	Name      string        `json:"name"`
+	Digest    digest.Digest `json:"digest"`
+	Started   *time.Time    `json:"started,omitempty"`
+	Completed *time.Time    `json:"completed,omitempty"`
+	Duration  time.Duration `json:"duration"`
+	Cached    bool          `json:"cached"`
+	Error     string        `json:"error,omitempty"`
+	// Transferred is the amount of data the step reported progress for, for
+	// example the bytes pulled or the build context sent. It is not the size
+	// of the snapshot the step produced.
+	Transferred int64 `json:"transferred"`
+	// Transfer is the time the step spent transferring that data, such as
+	// pulling layers or the build context.
+	Transfer time.Duration `json:"transfer"`
+}
+
+// Status returns the state of the step as shown in the summary.
+func (step buildStep) Status() string {
+	switch {
+	case step.Error != "":
+		return "error"
+	case step.Cached:
+		return "cached"
+	case step.Completed == nil:
+		return "incomplete"
+	}
+	return "done"
+}
+
+// buildSummary collects the steps of a build from the solve status stream.
+type buildSummary struct {
+	mu    sync.Mutex
+	order []digest.Digest
+	steps map[digest.Digest]*buildStep
+	sizes map[digest.Digest]map[string]int64
+	// transfers are when each status of a step started and last reported
+	// progress.
+	transfers map[digest.Digest]map[string][2]time.Time
+}
+
+func newBuildSummary() *buildSummary {
+	return &buildSummary{
+		steps:     map[digest.Digest]*buildStep{},
+		sizes:     map[digest.Digest]map[string]int64{},
+		transfers: map[digest.Digest]map[string][2]time.Time{},
+	}
+}
+
+// watch records the vertexes and statuses of a status update. It is meant to
+// be used as a watcher with watchStatus.
+func (s *buildSummary) watch(resp *controlapi.StatusResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range resp.Vertexes {
+		step, ok := s.steps[v.Digest]
+		if !ok {
+			step = &buildStep{Digest: v.Digest}
+			s.steps[v.Digest] = step
+			s.order = append(s.order, v.Digest)
+		}
+		step.Name = v.Name
+		step.Cached = v.Cached
+		step.Error = v.Error
+		if v.Started != nil {
+			step.Started = v.Started
+		}
+		if v.Completed != nil {
+			step.Completed = v.Completed
+		}
+		if step.Started != nil && step.Completed != nil {
+			step.Duration = step.Completed.Sub(*step.Started)
+		}
+	}
+
+	// Keep the last reported total of each status so the sizes of
+	// concurrent transfers in a step can be added up.
+	for _, vs := range resp.Statuses {
+		if _, ok := s.sizes[vs.Vertex]; !ok {
+			s.sizes[vs.Vertex] = map[string]int64{}
+		}
+		size := vs.Total
+		if size == 0 {
+			size = vs.Current
+		}
+		s.sizes[vs.Vertex][vs.ID] = size
+
+		if vs.Started == nil {
+			continue
+		}
+		end := vs.Timestamp
+		if vs.Completed != nil {
+			end = *vs.Completed
+		}
+		if _, ok := s.transfers[vs.Vertex]; !ok {
+			s.transfers[vs.Vertex] = map[string][2]time.Time{}
+		}
+		s.transfers[vs.Vertex][vs.ID] = [2]time.Time{*vs.Started, end}
+	}
+}
+
+// Steps returns the steps of the build in the order they were first seen.
+func (s *buildSummary) Steps() []buildStep {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	steps := make([]buildStep, 0, len(s.order))
+	for _, dgst := range s.order {
+		step := *s.steps[dgst]
+		for _, size := range s.sizes[dgst] {
+			step.Transferred += size
+		}
+		var transfers [][2]time.Time
+		for _, t := range s.transfers[dgst] {
+			transfers = append(transfers, t)
+		}
+		step.Transfer = unionDuration(transfers)
+		steps = append(steps, step)
+	}
+
+	// Order the steps by when they started so the table reads like the build.
+	sort.SliceStable(steps, func(i, j int) bool {
+		if steps[i].Started == nil || steps[j].Started == nil {
+			return steps[j].Started == nil && steps[i].Started != nil
+		}
+		return steps[i].Started.Before(*steps[j].Started)
+	})
+
+	return steps
+}
+
+// FailedStep returns the step that caused the build to fail. Steps that were
+// only cancelled because of another failure are skipped.
+func (s *buildSummary) FailedStep() (buildStep, bool) {
+	for _, step := range s.Steps() {
+		if step.Error != "" && !strings.Contains(step.Error, context.Canceled.Error()) {
+			return step, true
+		}
+	}
+	return buildStep{}, false
+}
+
+// Print writes the summary as a table to w.
+func (s *buildSummary) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 1, 8, 1, '\t', 0)
+	fmt.Fprintln(tw, "STEP\tSTATUS\tDURATION\tTRANSFER\tTRANSFERRED")
+
+	for _, step := range s.Steps() {
+		name := step.Name
+		if len(name) > 60 {
+			name = name[0:60] + "..."
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", name, step.Status(), step.Duration.Round(time.Millisecond), step.Transfer.Round(time.Millisecond), units.BytesSize(float64(step.Transferred)))
+	}
+
+	tw.Flush()
+}
+
+// WriteJSON writes the summary steps as JSON to the file at path.
+func (s *buildSummary) WriteJSON(path string) error {
+	b, err := json.MarshalIndent(s.Steps(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling build summary failed: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("writing build summary to %s failed: %v", path, err)
+	}
+
+	return nil
+}
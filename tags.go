@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/reference"
+	registryapi "github.com/genuinetools/reg/registry"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const tagsHelp = `List the tags of a repository in a registry.`
+
+func (cmd *tagsCommand) Name() string       { return "tags" }
+func (cmd *tagsCommand) Args() string       { return "[OPTIONS] REPOSITORY" }
+func (cmd *tagsCommand) ShortHelp() string  { return tagsHelp }
+func (cmd *tagsCommand) LongHelp() string   { return tagsHelp }
+func (cmd *tagsCommand) Hidden() bool       { return false }
+func (cmd *tagsCommand) DoReexec() bool     { return false }
+func (cmd *tagsCommand) RequiresRunc() bool { return false }
+
+func (cmd *tagsCommand) Register(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.digests, "digests", false, "Show the digest of each tag")
+	fs.BoolVar(&cmd.insecure, "insecure-registry", false, "Use plain HTTP to talk to the registry")
+}
+
+type tagsCommand struct {
+	digests  bool
+	insecure bool
+}
+
+func (cmd *tagsCommand) Run(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("must pass a repository to list the tags of")
+	}
+
+	named, err := reference.ParseNormalizedNamed(args[0])
+	if err != nil {
+		return fmt.Errorf("parsing repository name %q failed: %v", args[0], err)
+	}
+	if !reference.IsNameOnly(named) {
+		return fmt.Errorf("repository %s must not have a tag or digest", args[0])
+	}
+	repo := reference.Path(named)
+
+	r, err := cmd.registry(reference.Domain(named))
+	if err != nil {
+		return err
+	}
+
+	tags, err := listTags(r, repo)
+	if err != nil {
+		return fmt.Errorf("listing tags of %s failed: %v", named, err)
+	}
+
+	if !cmd.digests {
+		for _, tag := range tags {
+			fmt.Println(tag)
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, '\t', 0)
+
+	fmt.Fprintln(tw, "TAG\tDIGEST")
+
+	for _, tag := range tags {
+		dgst, err := tagDigest(r, repo, tag)
+		if err != nil {
+			return fmt.Errorf("getting digest of %s:%s failed: %v", named, tag, err)
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", tag, dgst)
+	}
+
+	tw.Flush()
+
+	return nil
+}
+
+// registry returns a client for a registry with the credentials img login
+// saved for it.
+func (cmd *tagsCommand) registry(domain string) (*registryapi.Registry, error) {
+	// The credentials of Docker Hub are saved for its index, the API is
+	// served by registry-1.
+	server := domain
+	if domain == "docker.io" {
+		server = defaultDockerRegistry
+		domain = "registry-1.docker.io"
+	}
+
+	dcfg, err := config.Load(config.Dir())
+	if err != nil {
+		return nil, fmt.Errorf("loading config file failed: %v", err)
+	}
+	authConfig, err := dcfg.GetAuthConfig(server)
+	if err != nil {
+		return nil, fmt.Errorf("getting auth config for %s failed: %v", server, err)
+	}
+	authConfig.ServerAddress = "https://" + domain
+	if cmd.insecure {
+		authConfig.ServerAddress = "http://" + domain
+	}
+
+	r, err := registryapi.New(authConfig, debug)
+	if err != nil {
+		return nil, fmt.Errorf("creating registry client failed: %v", err)
+	}
+	return r, nil
+}
+
+// listTags returns the tags of a repository, following the pages of the tag
+// list the registry returns.
+func listTags(r *registryapi.Registry, repo string) ([]string, error) {
+	u, err := url.Parse(fmt.Sprintf("%s/v2/%s/tags/list", r.URL, repo))
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for {
+		resp, err := r.Client.Get(u.String())
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("registry returned %s", resp.Status)
+		}
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing tag list failed: %v", err)
+		}
+		tags = append(tags, list.Tags...)
+
+		// The next page is in the Link header, as <URL>; rel="next".
+		link := resp.Header.Get("Link")
+		if link == "" {
+			return tags, nil
+		}
+		next, err := url.Parse(strings.Trim(strings.Split(link, ";")[0], " <>"))
+		if err != nil {
+			return nil, fmt.Errorf("parsing link %q failed: %v", link, err)
+		}
+		u = u.ResolveReference(next)
+	}
+}
+
+// tagDigest returns the digest of the manifest a tag points at, with a HEAD
+// request accepting manifest lists and indexes so their digest is returned
+// rather than the one of a manifest of the list.
+func tagDigest(r *registryapi.Registry, repo, tag string) (string, error) {
+	req, err := http.NewRequest(http.MethodHead, fmt.Sprintf("%s/v2/%s/manifests/%s", r.URL, repo, tag), nil)
+	if err != nil {
+		return "", err
+	}
+	for _, mt := range distribution.ManifestMediaTypes() {
+		req.Header.Add("Accept", mt)
+	}
+	req.Header.Add("Accept", ocispec.MediaTypeImageManifest)
+	req.Header.Add("Accept", ocispec.MediaTypeImageIndex)
+
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry returned %s", resp.Status)
+	}
+
+	dgst := resp.Header.Get("Docker-Content-Digest")
+	if dgst == "" {
+		return "", fmt.Errorf("registry returned no digest")
+	}
+	return dgst, nil
+}
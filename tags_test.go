@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// tagsRegistry returns a registry serving the tags of the tagstest
+// repository over two pages.
+func tagsRegistry() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/" || r.URL.Path == "/v2":
+		case r.URL.Path == "/v2/tagstest/tags/list" && r.URL.Query().Get("last") == "":
+			w.Header().Set("Link", `</v2/tagstest/tags/list?last=v2&n=2>; rel="next"`)
+			json.NewEncoder(w).Encode(map[string]interface{}{"name": "tagstest", "tags": []string{"v1", "v2"}})
+		case r.URL.Path == "/v2/tagstest/tags/list":
+			json.NewEncoder(w).Encode(map[string]interface{}{"name": "tagstest", "tags": []string{"v3"}})
+		case r.Method == http.MethodHead && strings.HasPrefix(r.URL.Path, "/v2/tagstest/manifests/"):
+			w.Header().Set("Docker-Content-Digest", digest.FromString(strings.TrimPrefix(r.URL.Path, "/v2/tagstest/manifests/")).String())
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"code":"NAME_UNKNOWN"}]}`))
+		}
+	}))
+}
+
+func TestListTags(t *testing.T) {
+	reg := tagsRegistry()
+	defer reg.Close()
+
+	r, err := (&tagsCommand{insecure: true}).registry(strings.TrimPrefix(reg.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := listTags(r, "tagstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tags, ",") != "v1,v2,v3" {
+		t.Fatalf("expected the tags of both pages, got %v", tags)
+	}
+
+	dgst, err := tagDigest(r, "tagstest", "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dgst != digest.FromString("v2").String() {
+		t.Fatalf("expected the digest of v2, got %s", dgst)
+	}
+
+	if _, err := listTags(r, "nope"); err == nil || !strings.Contains(err.Error(), "registry returned 404 Not Found") {
+		t.Fatalf("expected a missing repository to fail, got: %v", err)
+	}
+}
+
+func TestTagsErrors(t *testing.T) {
+	reg := tagsRegistry()
+	defer reg.Close()
+	host := strings.TrimPrefix(reg.URL, "http://")
+
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{args: []string{}, err: "must pass a repository to list the tags of"},
+		{args: []string{"Invalid"}, err: "parsing repository name"},
+		{args: []string{host + "/tagstest:v1"}, err: "must not have a tag or digest"},
+		{args: []string{host + "/nope"}, err: "registry returned 404 Not Found"},
+	}
+	for _, tt := range tests {
+		if err := (&tagsCommand{insecure: true}).Run(tt.args); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("expected tags %v to fail with %q, got: %v", tt.args, tt.err, err)
+		}
+	}
+}
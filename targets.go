@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/docker/builder/dockerfile/instructions"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/builder/dockerfile/shell"
+)
+
+const targetsHelp = `List the stages of a Dockerfile that can be built with -target.`
+
+func (cmd *targetsCommand) Name() string       { return "targets" }
+func (cmd *targetsCommand) Args() string       { return "[OPTIONS] PATH" }
+func (cmd *targetsCommand) ShortHelp() string  { return targetsHelp }
+func (cmd *targetsCommand) LongHelp() string   { return targetsHelp }
+func (cmd *targetsCommand) Hidden() bool       { return false }
+func (cmd *targetsCommand) DoReexec() bool     { return false }
+func (cmd *targetsCommand) RequiresRunc() bool { return false }
+
+func (cmd *targetsCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.dockerfilePath, "f", "", "Name of the Dockerfile (Default is 'PATH/Dockerfile')")
+	fs.Var(&cmd.buildArgs, "build-arg", "Set build-time variables, used in the names of the base images")
+}
+
+type targetsCommand struct {
+	dockerfilePath string
+	buildArgs      stringSlice
+}
+
+func (cmd *targetsCommand) Run(args []string) error {
+	if len(args) < 1 && cmd.dockerfilePath == "" {
+		return errors.New("must pass a path or a Dockerfile with -f")
+	}
+	dockerfile := cmd.dockerfilePath
+	if dockerfile == "" {
+		dockerfile = filepath.Join(args[0], defaultDockerfileName)
+	}
+	dt, err := ioutil.ReadFile(dockerfile)
+	if err != nil {
+		return fmt.Errorf("reading dockerfile failed: %v", err)
+	}
+
+	buildArgs := map[string]string{}
+	for _, buildArg := range cmd.buildArgs {
+		kv := strings.SplitN(buildArg, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid build-arg value %s", buildArg)
+		}
+		buildArgs[kv[0]] = kv[1]
+	}
+
+	stages, err := dockerfileStages(dt, buildArgs)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, '\t', 0)
+	fmt.Fprintln(tw, "TARGET\tBASE")
+	for i, st := range stages {
+		// Stages without a name cannot be targets.
+		if st.Name == "" {
+			continue
+		}
+		name := st.Name
+		if i == len(stages)-1 {
+			name += " (default)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", name, st.BaseName)
+	}
+	return tw.Flush()
+}
+
+// dockerfileStages parses the stages of a Dockerfile, with the build args
+// and the defaults of the ARG instructions before the first FROM expanded in
+// the names of their base images.
+func dockerfileStages(dt []byte, buildArgs map[string]string) ([]instructions.Stage, error) {
+	result, err := parser.Parse(bytes.NewReader(dt))
+	if err != nil {
+		return nil, fmt.Errorf("parsing dockerfile failed: %v", err)
+	}
+	stages, metaArgs, err := instructions.Parse(result.AST)
+	if err != nil {
+		return nil, fmt.Errorf("parsing dockerfile failed: %v", err)
+	}
+
+	var env []string
+	for _, a := range metaArgs {
+		if v, ok := buildArgs[a.Key]; ok {
+			env = append(env, a.Key+"="+v)
+		} else if a.Value != nil {
+			env = append(env, a.Key+"="+*a.Value)
+		}
+	}
+	lex := shell.NewLex(result.EscapeToken)
+	for i := range stages {
+		if stages[i].BaseName, err = lex.ProcessWord(stages[i].BaseName, env); err != nil {
+			return nil, fmt.Errorf("expanding the base image of stage %d failed: %v", i, err)
+		}
+	}
+	return stages, nil
+}
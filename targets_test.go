@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDockerfileStages(t *testing.T) {
+	dockerfile := []byte(`ARG GO_VERSION=1.10
+FROM golang:${GO_VERSION} AS build
+FROM busybox
+FROM alpine AS release
+`)
+
+	tests := []struct {
+		buildArgs map[string]string
+		expected  string
+	}{
+		{nil, "build=golang:1.10 =busybox release=alpine"},
+		{map[string]string{"GO_VERSION": "1.11"}, "build=golang:1.11 =busybox release=alpine"},
+	}
+	for _, tt := range tests {
+		stages, err := dockerfileStages(dockerfile, tt.buildArgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, st := range stages {
+			got = append(got, st.Name+"="+st.BaseName)
+		}
+		if strings.Join(got, " ") != tt.expected {
+			t.Fatalf("expected the stages %s with the build args %v, got %v", tt.expected, tt.buildArgs, got)
+		}
+	}
+
+	if _, err := dockerfileStages([]byte("FROM busybox AS\n"), nil); err == nil || !strings.Contains(err.Error(), "parsing dockerfile failed") {
+		t.Fatalf("expected an invalid stage name to fail, got: %v", err)
+	}
+}
+
+func TestTargetsErrors(t *testing.T) {
+	dir := withFiles(t, map[string]string{
+		"Dockerfile": "FROM busybox\n",
+	})
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		cmd  *targetsCommand
+		args []string
+		err  string
+	}{
+		{cmd: &targetsCommand{}, err: "must pass a path or a Dockerfile with -f"},
+		{cmd: &targetsCommand{}, args: []string{filepath.Join(dir, "nope")}, err: "reading dockerfile failed"},
+		{cmd: &targetsCommand{buildArgs: stringSlice{"GO_VERSION"}}, args: []string{dir}, err: "invalid build-arg value GO_VERSION"},
+	}
+	for _, tt := range tests {
+		if err := tt.cmd.Run(tt.args); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("expected %q, got: %v", tt.err, err)
+		}
+	}
+}
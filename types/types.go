@@ -8,3 +8,15 @@ const (
 	// OverlayFSBackend defines the overlayfs backend.
 	OverlayFSBackend = "overlayfs"
 )
+
+const (
+	// AutoStateLock is automatically resolved into lease for state directories
+	// on network filesystems and flock otherwise.
+	AutoStateLock = "auto"
+	// FlockStateLock locks the state directory with the flock(2) locks of its
+	// databases.
+	FlockStateLock = "flock"
+	// LeaseStateLock locks the state directory with a lease file, which is
+	// safe on network filesystems.
+	LeaseStateLock = "lease"
+)
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/genuinetools/img/client"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/util/appcontext"
+)
+
+const unpackShortHelp = `Unpack the filesystem of an image to a rootfs directory.`
+
+var unpackLongHelp = unpackShortHelp + `
+The layers are flattened like img export does, into a directory runtimes
+such as runc can run the image from.`
+
+func (cmd *unpackCommand) Name() string       { return "unpack" }
+func (cmd *unpackCommand) Args() string       { return "[OPTIONS] IMAGE" }
+func (cmd *unpackCommand) ShortHelp() string  { return unpackShortHelp }
+func (cmd *unpackCommand) LongHelp() string   { return unpackLongHelp }
+func (cmd *unpackCommand) Hidden() bool       { return false }
+func (cmd *unpackCommand) DoReexec() bool     { return true }
+func (cmd *unpackCommand) RequiresRunc() bool { return false }
+
+func (cmd *unpackCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.output, "o", "rootfs", "Directory to unpack the image to, it must not exist")
+	fs.StringVar(&cmd.platform, "platform", platforms.Default(), "Platform of the image to unpack from a manifest list")
+	fs.Var(&cmd.uidMaps, "uid-map", "Shift the owners of the files into a user namespace range, as CONTAINER_ID:HOST_ID:SIZE (can be repeated)")
+	fs.Var(&cmd.gidMaps, "gid-map", "Shift the groups of the files into a user namespace range, as CONTAINER_ID:HOST_ID:SIZE (can be repeated)")
+	fs.StringVar(&cmd.chown, "chown", "", "Set the owner of every file, as UID:GID")
+}
+
+type unpackCommand struct {
+	output   string
+	platform string
+	uidMaps  stringSlice
+	gidMaps  stringSlice
+	chown    string
+}
+
+func (cmd *unpackCommand) Run(args []string) (err error) {
+	if len(args) < 1 {
+		return fmt.Errorf("must pass an image to unpack")
+	}
+	options := client.ExportOptions{Platform: cmd.platform}
+	if _, err := platforms.Parse(cmd.platform); err != nil {
+		return fmt.Errorf("invalid platform %q: %v", cmd.platform, err)
+	}
+	if options.UIDMap, err = parseIDMaps(cmd.uidMaps); err != nil {
+		return err
+	}
+	if options.GIDMap, err = parseIDMaps(cmd.gidMaps); err != nil {
+		return err
+	}
+	if cmd.chown != "" {
+		if len(cmd.uidMaps) > 0 || len(cmd.gidMaps) > 0 {
+			return fmt.Errorf("-chown cannot be used with -uid-map or -gid-map")
+		}
+		ids, err := parseIDs(cmd.chown, 2)
+		if err != nil {
+			return fmt.Errorf("invalid owner %q, must be UID:GID", cmd.chown)
+		}
+		options.Chown = &idtools.IDPair{UID: ids[0], GID: ids[1]}
+	}
+
+	output, err := filepath.Abs(cmd.output)
+	if err != nil {
+		return err
+	}
+	// Do not mix the files of the image with those of another directory.
+	if _, err := os.Stat(output); err == nil {
+		return fmt.Errorf("%s already exists", output)
+	}
+
+	// Create the context.
+	ctx := appcontext.Context()
+	id := identity.NewID()
+	ctx = session.NewContext(ctx, id)
+	ctx = namespaces.WithNamespace(ctx, "buildkit")
+
+	// Create the client.
+	c, err := client.New(stateDir, backend, stateLock, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.UnpackImage(ctx, args[0], output, options); err != nil {
+		// Leave nothing half unpacked behind.
+		os.RemoveAll(output)
+		return err
+	}
+
+	fmt.Printf("Successfully unpacked %s to %s\n", args[0], output)
+	return nil
+}
+
+// parseIDMaps parses ID maps given as CONTAINER_ID:HOST_ID:SIZE.
+func parseIDMaps(maps []string) ([]idtools.IDMap, error) {
+	var idMaps []idtools.IDMap
+	for _, s := range maps {
+		ids, err := parseIDs(s, 3)
+		if err != nil || ids[2] < 1 {
+			return nil, fmt.Errorf("invalid ID map %q, must be CONTAINER_ID:HOST_ID:SIZE", s)
+		}
+		idMaps = append(idMaps, idtools.IDMap{ContainerID: ids[0], HostID: ids[1], Size: ids[2]})
+	}
+	return idMaps, nil
+}
+
+// parseIDs parses n IDs separated by colons.
+func parseIDs(s string, n int) ([]int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != n {
+		return nil, fmt.Errorf("expected %d IDs", n)
+	}
+	ids := make([]int, n)
+	for i, p := range parts {
+		id, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, err
+		}
+		if id < 0 {
+			return nil, fmt.Errorf("negative ID %d", id)
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
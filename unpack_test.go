@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/pkg/idtools"
+)
+
+func TestUnpackErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "img-unpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		cmd      *unpackCommand
+		args     []string
+		expected string
+	}{
+		{&unpackCommand{platform: "linux/amd64"}, nil, "must pass an image to unpack"},
+		{&unpackCommand{output: "rootfs", platform: "linux/amd64/v1/x"}, []string{"busybox"}, "invalid platform"},
+		{&unpackCommand{output: dir, platform: "linux/amd64"}, []string{"busybox"}, dir + " already exists"},
+		{&unpackCommand{platform: "linux/amd64", uidMaps: stringSlice{"0:100000"}}, []string{"busybox"}, `invalid ID map "0:100000"`},
+		{&unpackCommand{platform: "linux/amd64", gidMaps: stringSlice{"0:100000:0"}}, []string{"busybox"}, `invalid ID map "0:100000:0"`},
+		{&unpackCommand{platform: "linux/amd64", chown: "1000:1000", uidMaps: stringSlice{"0:100000:65536"}}, []string{"busybox"}, "-chown cannot be used with -uid-map or -gid-map"},
+		{&unpackCommand{platform: "linux/amd64", chown: "1000"}, []string{"busybox"}, `invalid owner "1000", must be UID:GID`},
+	}
+	for _, tt := range tests {
+		if err := tt.cmd.Run(tt.args); err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Fatalf("expected %q unpacking %v, got: %v", tt.expected, tt.args, err)
+		}
+	}
+}
+
+func TestParseIDMaps(t *testing.T) {
+	maps, err := parseIDMaps([]string{"0:100000:1", "1:200000:65535"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []idtools.IDMap{
+		{ContainerID: 0, HostID: 100000, Size: 1},
+		{ContainerID: 1, HostID: 200000, Size: 65535},
+	}
+	if !reflect.DeepEqual(maps, expected) {
+		t.Fatalf("expected %v, got %v", expected, maps)
+	}
+
+	for _, s := range []string{"0:100000", "0:100000:0", "0:-1:10", "a:b:c", "0:1:2:3"} {
+		if _, err := parseIDMaps([]string{s}); err == nil {
+			t.Fatalf("expected parsing %q to fail", s)
+		}
+	}
+}
@@ -1,35 +1,114 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
 	"runtime"
 
+	librunc "github.com/containerd/go-runc"
+	"github.com/genuinetools/img/client"
+	"github.com/genuinetools/img/internal/binutils"
 	"github.com/genuinetools/img/version"
 )
 
 const versionHelp = `Show the version information.`
 
 func (cmd *versionCommand) Name() string       { return "version" }
-func (cmd *versionCommand) Args() string       { return "" }
+func (cmd *versionCommand) Args() string       { return "[OPTIONS]" }
 func (cmd *versionCommand) ShortHelp() string  { return versionHelp }
 func (cmd *versionCommand) LongHelp() string   { return versionHelp }
 func (cmd *versionCommand) Hidden() bool       { return false }
 func (cmd *versionCommand) DoReexec() bool     { return false }
 func (cmd *versionCommand) RequiresRunc() bool { return false }
 
-func (cmd *versionCommand) Register(fs *flag.FlagSet) {}
+func (cmd *versionCommand) Register(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.json, "json", false, "Print the versions of img and its components as JSON")
+}
+
+type versionCommand struct {
+	json bool
+}
 
-type versionCommand struct{}
+// versionInfo holds the versions of img and the components it is built with.
+type versionInfo struct {
+	Version    string          `json:"version"`
+	GitCommit  string          `json:"gitCommit"`
+	GoVersion  string          `json:"goVersion"`
+	GoCompiler string          `json:"goCompiler"`
+	Platform   string          `json:"platform"`
+	BuildKit   string          `json:"buildkit"`
+	Containerd string          `json:"containerd"`
+	Runc       runcVersionInfo `json:"runc"`
+	Backend    string          `json:"backend"`
+	StateLock  string          `json:"stateLock"`
+	Features   featuresInfo    `json:"features"`
+}
+
+// runcVersionInfo describes the runc binary used to run build steps.
+type runcVersionInfo struct {
+	// Embedded is the revision of the runc binary embedded in img.
+	Embedded string `json:"embedded"`
+	// Installed is the version of the runc binary found in the PATH, which
+	// is used instead of the embedded binary.
+	Installed string `json:"installed,omitempty"`
+	Spec      string `json:"spec,omitempty"`
+}
+
+// featuresInfo lists what the build engine supports.
+type featuresInfo struct {
+	Backends  []string `json:"backends"`
+	Frontends []string `json:"frontends"`
+	Exporters []string `json:"exporters"`
+	// ExporterPlugins are the exporter plugins found in the PATH.
+	ExporterPlugins []string `json:"exporterPlugins"`
+}
 
 func (cmd *versionCommand) Run(args []string) error {
-	fmt.Printf(`%s:
+	if !cmd.json {
+		fmt.Printf(`%s:
  version     : %s
  git hash    : %s
  go version  : %s
  go compiler : %s
  platform    : %s/%s
 `, "img", version.VERSION, version.GITCOMMIT,
-		runtime.Version(), runtime.Compiler, runtime.GOOS, runtime.GOARCH)
-	return nil
+			runtime.Version(), runtime.Compiler, runtime.GOOS, runtime.GOARCH)
+		return nil
+	}
+
+	info := versionInfo{
+		Version:    version.VERSION,
+		GitCommit:  version.GITCOMMIT,
+		GoVersion:  runtime.Version(),
+		GoCompiler: runtime.Compiler,
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+		BuildKit:   version.BUILDKITREVISION,
+		Containerd: version.CONTAINERDREVISION,
+		Runc: runcVersionInfo{
+			Embedded: version.RUNCREVISION,
+		},
+		Backend:   client.ResolveBackend(stateDir, backend),
+		StateLock: client.ResolveStateLock(stateDir, stateLock),
+		Features: featuresInfo{
+			Backends:        validBackends,
+			Frontends:       []string{"dockerfile.v0"},
+			Exporters:       []string{"image", "local", "oci", "docker"},
+			ExporterPlugins: client.ExporterPlugins(),
+		},
+	}
+
+	if binutils.RuncBinaryExists() {
+		v, err := (&librunc.Runc{}).Version(context.Background())
+		if err == nil {
+			info.Runc.Installed = v.Runc
+			info.Runc.Spec = v.Spec
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
 }
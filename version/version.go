@@ -5,3 +5,12 @@ var VERSION string
 
 // GITCOMMIT indicates which git hash the binary was built off of
 var GITCOMMIT string
+
+// BUILDKITREVISION is the revision of the vendored BuildKit library.
+var BUILDKITREVISION string
+
+// CONTAINERDREVISION is the revision of the vendored containerd library.
+var CONTAINERDREVISION string
+
+// RUNCREVISION is the revision of the runc binary embedded in img.
+var RUNCREVISION string
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/genuinetools/img/client"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/identity"
+	"github.com/sirupsen/logrus"
+)
+
+// Types of the lifecycle events sent by the daemon.
+const (
+	eventBuildStarted   = "dev.img.build.started"
+	eventBuildSucceeded = "dev.img.build.succeeded"
+	eventBuildFailed    = "dev.img.build.failed"
+	eventPushSucceeded  = "dev.img.push.succeeded"
+	eventPushFailed     = "dev.img.push.failed"
+	eventGCStarted      = "dev.img.gc.started"
+	eventGCFinished     = "dev.img.gc.finished"
+)
+
+// webhookSignatureHeader holds the hex encoded HMAC-SHA256 of the body of a
+// webhook, keyed with the webhook secret.
+const webhookSignatureHeader = "X-Img-Signature-256"
+
+// cloudEvent is a CloudEvents 1.0 event in the structured JSON format.
+type cloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Time            time.Time   `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+// eventData is the data of the lifecycle events.
+type eventData struct {
+	// Build is the ID of the build for build events.
+	Build  string `json:"build,omitempty"`
+	Image  string `json:"image,omitempty"`
+	Digest string `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Source is the API the request came from: grpc, http or docker.
+	Source   string  `json:"source"`
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// webhooks posts the lifecycle events of the daemon to the webhook URLs.
+// A nil *webhooks sends nothing.
+type webhooks struct {
+	urls   []string
+	secret []byte
+	source string
+}
+
+func newWebhooks(urls []string, secret, source string) *webhooks {
+	if len(urls) == 0 {
+		return nil
+	}
+	return &webhooks{urls: urls, secret: []byte(secret), source: source}
+}
+
+// send posts an event to every webhook in the background, failures are
+// retried a few times and then logged.
+func (w *webhooks) send(eventType string, data eventData) {
+	if w == nil {
+		return
+	}
+
+	b, err := json.Marshal(cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              identity.NewID(),
+		Source:          w.source,
+		Type:            eventType,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	})
+	if err != nil {
+		logrus.Warnf("marshaling %s event failed: %v", eventType, err)
+		return
+	}
+
+	for _, url := range w.urls {
+		go func(url string) {
+			var err error
+			for attempt, backoff := 0, time.Second; attempt < 3; attempt, backoff = attempt+1, backoff*2 {
+				if err = w.post(url, b); err == nil {
+					return
+				}
+				time.Sleep(backoff)
+			}
+			logrus.Warnf("sending %s event failed: %v", eventType, err)
+		}(url)
+	}
+}
+
+func (w *webhooks) post(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request to %s failed: %v", url, err)
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("posting event to %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("posting event to %s failed with status %s", url, resp.Status)
+	}
+	return nil
+}
+
+// build sends the started event of a build and returns the function to send
+// its result with.
+func (w *webhooks) build(source, id, image string, push bool) func(digest string, err error) {
+	start := time.Now()
+	w.send(eventBuildStarted, eventData{Build: id, Image: image, Source: source})
+	return func(digest string, err error) {
+		data := eventData{Build: id, Image: image, Digest: digest, Source: source, Duration: time.Since(start).Seconds()}
+		if err != nil {
+			data.Error = err.Error()
+			w.send(eventBuildFailed, data)
+			return
+		}
+		w.send(eventBuildSucceeded, data)
+		if push {
+			w.send(eventPushSucceeded, data)
+		}
+	}
+}
+
+// push sends the result of a push.
+func (w *webhooks) push(source, image string, start time.Time, err error) {
+	data := eventData{Image: image, Source: source, Duration: time.Since(start).Seconds()}
+	if err != nil {
+		data.Error = err.Error()
+		w.send(eventPushFailed, data)
+		return
+	}
+	w.send(eventPushSucceeded, data)
+}
+
+// serveHooks returns the hooks sending the events of the BuildKit API.
+func (w *webhooks) serveHooks() *client.ServeHooks {
+	if w == nil {
+		return nil
+	}
+	return &client.ServeHooks{
+		Solve: func(req *controlapi.SolveRequest) func(*controlapi.SolveResponse, error) {
+			done := w.build("grpc", req.Ref, req.ExporterAttrs["name"], req.ExporterAttrs["push"] == "true")
+			return func(resp *controlapi.SolveResponse, err error) {
+				var digest string
+				if resp != nil {
+					digest = resp.ExporterResponse["containerimage.digest"]
+				}
+				done(digest, err)
+			}
+		},
+		Prune: func(req *controlapi.PruneRequest) func(error) {
+			start := time.Now()
+			w.send(eventGCStarted, eventData{Source: "grpc"})
+			return func(err error) {
+				data := eventData{Source: "grpc", Duration: time.Since(start).Seconds()}
+				if err != nil {
+					data.Error = err.Error()
+				}
+				w.send(eventGCFinished, data)
+			}
+		},
+	}
+}